@@ -0,0 +1,145 @@
+// Adaptive compression related models and functions.
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// bandwidthSampleSize is the number of uploaded bytes after which the upload bandwidth is reported.
+	bandwidthSampleSize = 4 << 20
+	// adaptiveLevelInterval is the minimum number of uncompressed bytes between compression level adjustments.
+	adaptiveLevelInterval = 16 << 20
+	// adaptiveLevelTolerance is the relative difference between the compression and the upload rate
+	// tolerated without adjusting the compression level.
+	adaptiveLevelTolerance = 0.25
+)
+
+// bandwidthReader measures the bandwidth the underlying reader is consumed with
+// and reports it (in bytes per second) on the bandwidth channel after every bandwidthSampleSize bytes.
+// The time spent waiting in Read is excluded, so that the measured bandwidth is the upload's,
+// not the archive's which is read.
+type bandwidthReader struct {
+	reader    io.Reader
+	bandwidth chan<- float64
+	lastRead  time.Time
+	sending   time.Duration
+	n         int64
+	reported  int64
+}
+
+func (r *bandwidthReader) Read(b []byte) (int, error) {
+	if !r.lastRead.IsZero() {
+		r.sending += time.Since(r.lastRead)
+	}
+
+	n, err := r.reader.Read(b)
+	r.lastRead = time.Now()
+	r.n += int64(n)
+
+	if r.n-r.reported >= bandwidthSampleSize && r.sending > 0 {
+		r.reported = r.n
+		// Never block the upload, the archive reads the latest bandwidth only.
+		select {
+		case r.bandwidth <- float64(r.n) / r.sending.Seconds():
+		default:
+		}
+	}
+	return n, err
+}
+
+// adaptiveLevel adjusts the compression level of an archive to the upload bandwidth,
+// so that neither the compression nor the upload has to wait for the other:
+// the level is lowered if the compression is slower than the upload, and raised if the upload is slower.
+//
+// adaptiveLevel is written between the compressor and the archive's writer
+// to measure the time the compression waits for the upload.
+type adaptiveLevel struct {
+	writer    io.Writer
+	bandwidth <-chan float64
+	upload    float64
+	min       int
+	max       int
+	level     int
+	// blocked is the total time spent writing to the underlying writer.
+	blocked time.Duration
+
+	// start, startBlocked, startUncompressed and startCompressed describe the beginning of the current interval.
+	start             time.Time
+	startBlocked      time.Duration
+	startUncompressed int64
+	startCompressed   int64
+}
+
+// newAdaptiveLevel returns an adaptiveLevel for the given compression,
+// or nil if the compression method's level can not be adjusted.
+func newAdaptiveLevel(writer io.Writer, compression Compression) *adaptiveLevel {
+	level := &adaptiveLevel{
+		writer:    writer,
+		bandwidth: compression.Bandwidth,
+		start:     time.Now(),
+	}
+
+	switch compression.Method {
+	case GZIP:
+		level.min, level.max, level.level = 1, 9, compression.Level
+		if level.level == 0 {
+			level.level = level.max
+		}
+	case ZSTD:
+		level.min, level.max, level.level = int(zstd.SpeedFastest), int(zstd.SpeedBestCompression), int(zstd.SpeedDefault)
+	default:
+		return nil
+	}
+	return level
+}
+
+func (l *adaptiveLevel) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := l.writer.Write(b)
+	l.blocked += time.Since(start)
+	return n, err
+}
+
+// next returns the compression level of the subsequent entries given the current sizes of the archive,
+// ok is false if the level does not change.
+func (l *adaptiveLevel) next(uncompressed, compressed int64) (level int, ok bool) {
+	for received := true; received; {
+		select {
+		case l.upload = <-l.bandwidth:
+		default:
+			received = false
+		}
+	}
+
+	input := uncompressed - l.startUncompressed
+	output := compressed - l.startCompressed
+	if l.upload == 0 || input < adaptiveLevelInterval || output == 0 {
+		return 0, false
+	}
+
+	now := time.Now()
+	busy := now.Sub(l.start) - (l.blocked - l.startBlocked)
+	l.start, l.startBlocked, l.startUncompressed, l.startCompressed = now, l.blocked, uncompressed, compressed
+	if busy <= 0 {
+		return 0, false
+	}
+
+	// Both rates are in uncompressed bytes per second: the rate the archive is compressed with,
+	// and the rate the upload consumes the archive with at the current compression ratio.
+	compressing := float64(input) / busy.Seconds()
+	uploading := l.upload * float64(input) / float64(output)
+
+	switch {
+	case compressing < uploading*(1-adaptiveLevelTolerance) && l.level > l.min:
+		l.level--
+	case compressing > uploading*(1+adaptiveLevelTolerance) && l.level < l.max:
+		l.level++
+	default:
+		return 0, false
+	}
+	return l.level, true
+}
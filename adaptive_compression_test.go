@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func Test_adaptiveLevel_next(t *testing.T) {
+	tests := []struct {
+		name      string
+		bandwidth float64
+		elapsed   time.Duration
+		input     int64
+		wantLevel int
+		wantOk    bool
+	}{
+		{name: "no bandwidth measured", input: adaptiveLevelInterval, elapsed: time.Second, wantLevel: 0, wantOk: false},
+		{name: "interval not reached", bandwidth: 1, input: adaptiveLevelInterval - 1, elapsed: time.Second, wantLevel: 0, wantOk: false},
+		{name: "upload is slower", bandwidth: 1, input: adaptiveLevelInterval, elapsed: time.Second, wantLevel: 7, wantOk: true},
+		{name: "compression is slower", bandwidth: 1 << 40, input: adaptiveLevelInterval, elapsed: time.Hour, wantLevel: 5, wantOk: true},
+		{name: "balanced", bandwidth: adaptiveLevelInterval / 2, input: adaptiveLevelInterval, elapsed: time.Second, wantLevel: 0, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bandwidth := make(chan float64, 1)
+			level := newAdaptiveLevel(&bytes.Buffer{}, Compression{Method: GZIP, Level: 6, Bandwidth: bandwidth})
+			level.start = time.Now().Add(-tt.elapsed)
+			if tt.bandwidth != 0 {
+				bandwidth <- tt.bandwidth
+			}
+
+			// The archive is compressed to the half of its size.
+			gotLevel, gotOk := level.next(tt.input, tt.input/2)
+			if gotLevel != tt.wantLevel || gotOk != tt.wantOk {
+				t.Errorf("adaptiveLevel.next() = %d, %v, want %d, %v", gotLevel, gotOk, tt.wantLevel, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_newAdaptiveLevel(t *testing.T) {
+	if level := newAdaptiveLevel(&bytes.Buffer{}, Compression{Method: LZ4}); level != nil {
+		t.Errorf("newAdaptiveLevel() = %v, want nil", level)
+	}
+	if level := newAdaptiveLevel(&bytes.Buffer{}, Compression{Method: ZSTD}); level == nil || level.min >= level.level || level.level >= level.max {
+		t.Errorf("newAdaptiveLevel() = %v, want the default zstd level between the fastest and the best", level)
+	}
+}
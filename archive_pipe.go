@@ -0,0 +1,206 @@
+// Pipe cache related models and functions.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// pipeBlockSize is the size of the blocks the archive is passed to the upload in.
+	pipeBlockSize = 1024 * 1024
+	// pipeBlocks is the number of the blocks buffered between the archive and the upload,
+	// the archive waits for the upload if the buffer is full.
+	pipeBlocks = 16
+)
+
+// errUploadStopped is returned to the archive's writes once the upload stopped reading the archive.
+var errUploadStopped = errors.New("upload stopped reading the archive")
+
+// bufferedPipe connects the archive written in a goroutine to the upload reading it with a bounded buffer of blocks,
+// unlike io.Pipe the archive is not blocked by each read, only by a full buffer.
+type bufferedPipe struct {
+	blocks chan []byte
+	// block is the block being written, sent once it is full or the writer is closed.
+	block []byte
+	// pending is the rest of the block being read.
+	pending []byte
+	// done is closed when the reader is closed, the writes fail with rerr afterwards.
+	done       chan struct{}
+	rerr       error
+	closeRead  sync.Once
+	closeWrite sync.Once
+	// werr is the error the reads fail with after the buffered blocks, io.EOF if the archive was written.
+	werr error
+	// stopped reports whether a write failed because the reader was closed.
+	stopped bool
+}
+
+// pipeReader is the read half of a bufferedPipe.
+type pipeReader struct {
+	p *bufferedPipe
+}
+
+// pipeWriter is the write half of a bufferedPipe.
+type pipeWriter struct {
+	p *bufferedPipe
+}
+
+// newBufferedPipe creates a bufferedPipe buffering at most blocks blocks of pipeBlockSize.
+func newBufferedPipe(blocks int) (*pipeReader, *pipeWriter) {
+	p := &bufferedPipe{
+		blocks: make(chan []byte, blocks),
+		done:   make(chan struct{}),
+	}
+	return &pipeReader{p: p}, &pipeWriter{p: p}
+}
+
+// Read reads from the buffered blocks, waiting for the next block if none is buffered.
+func (r *pipeReader) Read(b []byte) (int, error) {
+	p := r.p
+	if len(p.pending) == 0 {
+		select {
+		case block, ok := <-p.blocks:
+			if !ok {
+				return 0, p.werr
+			}
+			p.pending = block
+		case <-p.done:
+			return 0, io.ErrClosedPipe
+		}
+	}
+
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// CloseWithError closes the reader, the subsequent and the waiting writes fail with err.
+func (r *pipeReader) CloseWithError(err error) {
+	r.p.closeRead.Do(func() {
+		r.p.rerr = err
+		close(r.p.done)
+	})
+}
+
+// Write buffers b, sending the full blocks to the reader.
+func (w *pipeWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if w.p.block == nil {
+			w.p.block = make([]byte, 0, pipeBlockSize)
+		}
+		m := copy(w.p.block[len(w.p.block):cap(w.p.block)], b)
+		w.p.block = w.p.block[:len(w.p.block)+m]
+		b = b[m:]
+
+		if len(w.p.block) == cap(w.p.block) {
+			if err := w.send(); err != nil {
+				return n, err
+			}
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// send sends the block being written to the reader, waiting if the buffer is full.
+func (w *pipeWriter) send() error {
+	select {
+	case <-w.p.done:
+		w.p.stopped = true
+		return w.p.rerr
+	default:
+	}
+
+	select {
+	case w.p.blocks <- w.p.block:
+		w.p.block = nil
+		return nil
+	case <-w.p.done:
+		w.p.stopped = true
+		return w.p.rerr
+	}
+}
+
+// Close sends the rest of the archive, the reads fail with io.EOF after the buffered blocks.
+func (w *pipeWriter) Close() error {
+	if len(w.p.block) > 0 {
+		if err := w.send(); err != nil {
+			return err
+		}
+	}
+	w.CloseWithError(nil)
+	return nil
+}
+
+// CloseWithError closes the writer without sending the rest of the archive,
+// the reads fail with err after the buffered blocks, or with io.EOF if err is nil.
+func (w *pipeWriter) CloseWithError(err error) {
+	w.p.closeWrite.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+		w.p.werr = err
+		close(w.p.blocks)
+	})
+}
+
+// archiveResult is the outcome of writing the archive in the pipeline.
+type archiveResult struct {
+	report archiveReport
+	err    error
+}
+
+// archivePipeline writes and compresses the archive in a goroutine while the upload reads it through a bufferedPipe,
+// the errors of either side are returned to the main goroutine instead of exiting from the goroutine.
+type archivePipeline struct {
+	reader *pipeReader
+	result chan archiveResult
+}
+
+// startArchivePipeline starts writing the archive with write, the archive is read from the pipeline's reader.
+func startArchivePipeline(write func(io.WriteCloser) (archiveReport, error)) *archivePipeline {
+	reader, writer := newBufferedPipe(pipeBlocks)
+	pipeline := &archivePipeline{reader: reader, result: make(chan archiveResult, 1)}
+
+	go func() {
+		report, err := write(writer)
+		// The upload reads the error after the written blocks, or io.EOF if the archive is complete.
+		writer.CloseWithError(err)
+		pipeline.result <- archiveResult{report: report, err: err}
+	}()
+	return pipeline
+}
+
+// finish stops the archive if the upload failed with uploadErr, waits for the archive and returns its report.
+// The returned error is the cause of the failure: the archive's error if it failed on its own, or uploadErr.
+func (p *archivePipeline) finish(uploadErr error) (archiveReport, error) {
+	// The upload reads the archive until the end if it succeeded, so this only stops a failed upload's archive.
+	p.reader.CloseWithError(errUploadStopped)
+	result := <-p.result
+
+	if result.err != nil && !p.reader.p.stopped {
+		return result.report, fmt.Errorf("failed to generate cache archive: %s", result.err)
+	}
+	if uploadErr != nil {
+		return result.report, uploadErr
+	}
+	return result.report, result.err
+}
+
+// pipeArchiveSize returns the size of the archive the pipe cache uploads, writing the archive once more into a counter:
+// the Bitrise cache API requires the size to request the upload url, before the archive is streamed.
+// The archive is compressed as it is uploaded, so that the size is the number of the uploaded bytes, not the uncompressed size.
+func pipeArchiveSize(descriptor map[string]string, stackData []byte, compression Compression, options archiveOptions, pths []string) (int64, error) {
+	// The uploaded archive writes the entry index.
+	options.entryIndexPth = ""
+
+	var size sizeWriteCloser
+	if _, err := writeArchive(descriptor, stackData, compression, options, false, &size, pths); err != nil {
+		return 0, fmt.Errorf("failed to generate cache archive to get its size: %s", err)
+	}
+	return int64(size), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_bufferedPipe(t *testing.T) {
+	data := make([]byte, 3*pipeBlockSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	reader, writer := newBufferedPipe(2)
+	go func() {
+		// Written in small writes, as the archive is.
+		for b := data; len(b) > 0; {
+			n := 1000
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := writer.Write(b[:n]); err != nil {
+				t.Errorf("Write() error = %v", err)
+				return
+			}
+			b = b[n:]
+		}
+		if err := writer.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	}()
+
+	got, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("ReadAll() read %d bytes, want the %d written bytes", len(got), len(data))
+	}
+}
+
+func Test_archivePipeline_finish(t *testing.T) {
+	archiveErr := errors.New("file vanished")
+	uploadErr := errors.New("connection reset")
+
+	tests := []struct {
+		name      string
+		write     func(io.WriteCloser) error
+		upload    func(io.Reader) error
+		wantErr   string
+		wantEntry int
+	}{
+		{
+			name: "success",
+			write: func(w io.WriteCloser) error {
+				if _, err := w.Write([]byte("archive")); err != nil {
+					return err
+				}
+				return w.Close()
+			},
+			upload: func(r io.Reader) error {
+				_, err := ioutil.ReadAll(r)
+				return err
+			},
+			wantEntry: 1,
+		},
+		{
+			name: "archive fails",
+			write: func(w io.WriteCloser) error {
+				if _, err := w.Write([]byte("archive")); err != nil {
+					return err
+				}
+				return archiveErr
+			},
+			upload: func(r io.Reader) error {
+				_, err := ioutil.ReadAll(r)
+				return err
+			},
+			wantErr: "failed to generate cache archive: file vanished",
+		},
+		{
+			name: "upload fails while the archive is written",
+			write: func(w io.WriteCloser) error {
+				block := make([]byte, pipeBlockSize)
+				for {
+					if _, err := w.Write(block); err != nil {
+						return err
+					}
+				}
+			},
+			upload: func(r io.Reader) error {
+				return uploadErr
+			},
+			wantErr: "connection reset",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline := startArchivePipeline(func(w io.WriteCloser) (archiveReport, error) {
+				if err := tt.write(w); err != nil {
+					return archiveReport{}, err
+				}
+				return archiveReport{entries: 1}, nil
+			})
+
+			report, err := pipeline.finish(tt.upload(pipeline.reader))
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("finish() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("finish() error = %v, want %s", err, tt.wantErr)
+			}
+			if report.entries != tt.wantEntry {
+				t.Errorf("finish() report entries = %d, want %d", report.entries, tt.wantEntry)
+			}
+		})
+	}
+}
+
+func Test_pipeArchiveSize(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "file")
+	createDirStruct(t, map[string]string{pth: strings.Repeat("compressible content\n", 10000)})
+	descriptor := map[string]string{pth: "1-1000000000"}
+	stackData := []byte(`{"stack_id":"osx-xcode-15.0.x"}`)
+	options := archiveOptions{format: TAR, dataModTime: time.Unix(1000000000, 0)}
+
+	uncompressed, err := pipeArchiveSize(descriptor, stackData, Compression{Method: NONE}, options, []string{pth})
+	if err != nil {
+		t.Fatalf("pipeArchiveSize() error = %v", err)
+	}
+
+	for _, method := range []CompressionMethod{NONE, GZIP, ZSTD} {
+		t.Run(string(method), func(t *testing.T) {
+			compression := Compression{Method: method}
+			size, err := pipeArchiveSize(descriptor, stackData, compression, options, []string{pth})
+			if err != nil {
+				t.Fatalf("pipeArchiveSize() error = %v", err)
+			}
+
+			pipeline := startArchivePipeline(func(writer io.WriteCloser) (archiveReport, error) {
+				return writeArchive(descriptor, stackData, compression, options, false, writer, []string{pth})
+			})
+			uploaded, err := ioutil.ReadAll(pipeline.reader)
+			if _, err := pipeline.finish(err); err != nil {
+				t.Fatalf("failed to stream archive: %s", err)
+			}
+
+			if size != int64(len(uploaded)) {
+				t.Errorf("pipeArchiveSize() = %d, want the uploaded size %d", size, len(uploaded))
+			}
+			if method != NONE && size >= uncompressed {
+				t.Errorf("pipeArchiveSize() = %d, want less than the uncompressed size %d", size, uncompressed)
+			}
+		})
+	}
+}
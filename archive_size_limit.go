@@ -0,0 +1,85 @@
+// Archive size limit related models and functions.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// sizeLimitError is returned by Archive.Write if writing a path would exceed the archive's size limit.
+type sizeLimitError struct {
+	pth   string
+	size  int64
+	limit int64
+}
+
+func (e *sizeLimitError) Error() string {
+	return fmt.Sprintf("archive size limit of %d bytes would be exceeded by %s, %d bytes already written", e.limit, e.pth, e.size)
+}
+
+// checkSizeLimit returns a sizeLimitError if the archive may exceed its size limit by writing pth:
+// the written size and the upper bound of the entry's size, its header and uncompressed content, exceed the limit.
+// The data buffered by the compressor is not counted, the limit is approximate.
+func (a *Archive) checkSizeLimit(pth string) error {
+	stat := os.Lstat
+	if a.dereferenced[pth] {
+		stat = os.Stat
+	}
+	info, err := stat(pth)
+	if err != nil {
+		return fmt.Errorf("failed to stat(%s), error: %s", pth, err)
+	}
+
+	size := int64(tarBlockSize)
+	if info.Mode().IsRegular() {
+		size += info.Size()
+	}
+	if _, compressed := a.Size(); compressed+size > a.maxSize {
+		return &sizeLimitError{pth: pth, size: compressed, limit: a.maxSize}
+	}
+	return nil
+}
+
+// sortByPriority sorts the paths by the priority of their include items, the highest first,
+// so that the paths of the lowest priority are dropped if the archive is trimmed to its size limit.
+func sortByPriority(pths []string, optionsByPth map[string]includeOptions) {
+	priorities := map[string]int{}
+	for _, pth := range pths {
+		priorities[pth] = optionsForPath(pth, optionsByPth).priority
+	}
+	sort.Slice(pths, func(i, j int) bool {
+		if priorities[pths[i]] != priorities[pths[j]] {
+			return priorities[pths[i]] > priorities[pths[j]]
+		}
+		return pths[i] < pths[j]
+	})
+}
+
+// logSizeBreakdown logs the size of the paths of each include item, the largest first.
+func logSizeBreakdown(pths []string, itemPths []string) {
+	type itemSize struct {
+		pth   string
+		files int
+		size  int64
+	}
+
+	var sizes []itemSize
+	for itemPth, groupPths := range groupByIncludeItem(pths, itemPths) {
+		size, err := cacheSize(groupPths)
+		if err != nil {
+			log.Warnf("Failed to calculate the size of %s: %s", itemPth, err)
+			continue
+		}
+		sizes = append(sizes, itemSize{pth: itemPth, files: len(groupPths), size: size})
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		return sizes[i].size > sizes[j].size
+	})
+
+	for _, size := range sizes {
+		log.Printf("- %s: %d files, %d bytes", size.pth, size.files, size.size)
+	}
+}
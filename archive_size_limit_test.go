@@ -0,0 +1,72 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func TestArchive_sizeLimit(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pths := []string{filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b"), filepath.Join(tmpDir, "c")}
+	createDirStruct(t, map[string]string{
+		pths[0]: strings.Repeat("a", 100000),
+		pths[1]: strings.Repeat("b", 100000),
+		pths[2]: strings.Repeat("c", 100000),
+	})
+
+	tests := []struct {
+		name        string
+		maxSize     int64
+		trim        bool
+		wantDropped []string
+		wantErr     bool
+	}{
+		{name: "within limit", maxSize: 1000000},
+		{name: "fail", maxSize: 250000, wantErr: true},
+		{name: "trim", maxSize: 250000, trim: true, wantDropped: pths[2:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var writer bufferWriteCloser
+			archive, err := NewArchive(&writer, TAR, Compression{Method: NONE})
+			if err != nil {
+				t.Fatalf("failed to create archive: %s", err)
+			}
+			archive.maxSize = tt.maxSize
+			archive.trim = tt.trim
+
+			err = archive.Write(pths, false)
+			if _, ok := err.(*sizeLimitError); ok != tt.wantErr || (err != nil && !ok) {
+				t.Fatalf("Write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(archive.dropped, tt.wantDropped) {
+				t.Errorf("dropped = %v, want %v", archive.dropped, tt.wantDropped)
+			}
+			if size, _ := archive.Size(); size > tt.maxSize {
+				t.Errorf("archive size = %d, want at most %d", size, tt.maxSize)
+			}
+		})
+	}
+}
+
+func Test_sortByPriority(t *testing.T) {
+	optionsByPth := map[string]includeOptions{
+		"/project/Pods":     {priority: 10},
+		"/project/Carthage": {priority: -1},
+	}
+	pths := []string{"/project/Carthage/a", "/project/build/b", "/project/Pods/c", "/project/build/a", "/project/Pods/b"}
+
+	sortByPriority(pths, optionsByPth)
+	want := []string{"/project/Pods/b", "/project/Pods/c", "/project/build/a", "/project/build/b", "/project/Carthage/a"}
+	if !reflect.DeepEqual(pths, want) {
+		t.Errorf("sortByPriority() = %v, want %v", pths, want)
+	}
+}
@@ -0,0 +1,225 @@
+// Cache archive verification related models and functions.
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/andybalholm/brotli"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+)
+
+// newDecompressor wraps the given reader with a decompressing reader of the given compression.
+// Returns the reader itself if the method is NONE.
+func newDecompressor(reader io.Reader, compression Compression) (io.ReadCloser, error) {
+	switch compression.Method {
+	case NONE:
+		return ioutil.NopCloser(reader), nil
+	case GZIP:
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return gzipReader, nil
+	case ZSTD:
+		var options []zstd.DOption
+		if len(compression.Dictionary) > 0 {
+			options = append(options, zstd.WithDecoderDicts(compression.Dictionary))
+		}
+		decoder, err := zstd.NewReader(reader, options...)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case LZ4:
+		return ioutil.NopCloser(lz4.NewReader(reader)), nil
+	case XZ:
+		xzReader, err := xz.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xzReader), nil
+	case BROTLI:
+		return ioutil.NopCloser(brotli.NewReader(reader)), nil
+	default:
+		return nil, fmt.Errorf("unknown compression method: %s", compression.Method)
+	}
+}
+
+// concatFile reads the concatenation of files (the volumes of a split archive) as a single file.
+type concatFile struct {
+	files []*os.File
+	sizes []int64
+	size  int64
+}
+
+// openConcatFile opens the files at pths in order.
+func openConcatFile(pths []string) (*concatFile, error) {
+	concat := &concatFile{}
+	for _, pth := range pths {
+		file, err := os.Open(pth)
+		if err != nil {
+			concat.Close()
+			return nil, fmt.Errorf("failed to open file (%s): %s", pth, err)
+		}
+		concat.files = append(concat.files, file)
+
+		info, err := file.Stat()
+		if err != nil {
+			concat.Close()
+			return nil, fmt.Errorf("failed to get file info (%s): %s", pth, err)
+		}
+		concat.sizes = append(concat.sizes, info.Size())
+		concat.size += info.Size()
+	}
+	return concat, nil
+}
+
+// ReadAt reads len(b) bytes starting at off of the concatenated files.
+func (f *concatFile) ReadAt(b []byte, off int64) (int, error) {
+	read := 0
+	for i, file := range f.files {
+		if len(b) == 0 {
+			break
+		}
+		if off >= f.sizes[i] {
+			off -= f.sizes[i]
+			continue
+		}
+
+		chunk := b
+		if free := f.sizes[i] - off; int64(len(chunk)) > free {
+			chunk = chunk[:free]
+		}
+		n, err := file.ReadAt(chunk, off)
+		read += n
+		if err != nil {
+			return read, err
+		}
+		b = b[n:]
+		off = 0
+	}
+
+	if len(b) > 0 {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Close closes the files.
+func (f *concatFile) Close() {
+	for _, file := range f.files {
+		if err := file.Close(); err != nil {
+			log.Warnf("Failed to close file (%s): %s", file.Name(), err)
+		}
+	}
+}
+
+// verifyArchive reads the archive end-to-end and returns an error if it is corrupt,
+// or if it does not contain the given number of entries.
+func verifyArchive(reader io.ReaderAt, size int64, format ArchiveFormat, compression Compression, entries int) error {
+	var count int
+	var err error
+	switch format {
+	case TAR:
+		count, err = verifyTar(io.NewSectionReader(reader, 0, size), compression)
+	case ZIP:
+		count, err = verifyZip(reader, size)
+	default:
+		return fmt.Errorf("unknown archive format: %s", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if count != entries {
+		return fmt.Errorf("archive contains %d entries, %d entries were written", count, entries)
+	}
+	return nil
+}
+
+// verifyTar decompresses and reads the tar archive, returns the number of its entries.
+func verifyTar(reader io.Reader, compression Compression) (int, error) {
+	decompressor, err := newDecompressor(reader, compression)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decompress archive: %s", err)
+	}
+	defer func() {
+		if err := decompressor.Close(); err != nil {
+			log.Warnf("Failed to close decompressor: %s", err)
+		}
+	}()
+
+	tarReader := tar.NewReader(decompressor)
+	count := 0
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to read header of entry %d: %s", count+1, err)
+		}
+
+		if _, err := io.Copy(ioutil.Discard, tarReader); err != nil {
+			return count, fmt.Errorf("failed to read entry (%s): %s", header.Name, err)
+		}
+		count++
+	}
+
+	// The compressed stream continues after the end of the tar archive, for example with the seek table.
+	if _, err := io.Copy(ioutil.Discard, decompressor); err != nil {
+		return count, fmt.Errorf("failed to decompress archive: %s", err)
+	}
+	return count, nil
+}
+
+// verifyZip reads the zip archive and verifies the checksums of its entries, returns the number of its entries.
+func verifyZip(reader io.ReaderAt, size int64) (int, error) {
+	zipReader, err := zip.NewReader(reader, size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read archive: %s", err)
+	}
+
+	for _, file := range zipReader.File {
+		if err := verifyZipEntry(file); err != nil {
+			return 0, fmt.Errorf("failed to read entry (%s): %s", file.Name, err)
+		}
+	}
+	return len(zipReader.File), nil
+}
+
+// verifyZipEntry reads the content of the zip entry, the reader returns an error if its checksum does not match.
+func verifyZipEntry(file *zip.File) error {
+	entry, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := entry.Close(); err != nil {
+			log.Warnf("Failed to close entry (%s): %s", file.Name, err)
+		}
+	}()
+
+	_, err = io.Copy(ioutil.Discard, entry)
+	return err
+}
+
+// verifyArchiveFiles verifies the archive stored in the files at pths, the volumes of the archive in order.
+func verifyArchiveFiles(pths []string, format ArchiveFormat, compression Compression, entries int) error {
+	file, err := openConcatFile(pths)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return verifyArchive(file, file.size, format, compression, entries)
+}
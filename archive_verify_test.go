@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_verifyArchive(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	var pths []string
+	contentByPth := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		pth := filepath.Join(tmpDir, name)
+		var content string
+		for i := 0; i < 8*1024; i++ {
+			content += fmt.Sprintf("%s %d\n", name, i)
+		}
+		contentByPth[pth] = content
+		pths = append(pths, pth)
+	}
+	createDirStruct(t, contentByPth)
+
+	tests := []struct {
+		name        string
+		format      ArchiveFormat
+		compression Compression
+	}{
+		{name: "tar", format: TAR, compression: Compression{Method: NONE}},
+		{name: "gzip", format: TAR, compression: Compression{Method: GZIP}},
+		{name: "zstd", format: TAR, compression: Compression{Method: ZSTD}},
+		{name: "seekable zstd", format: TAR, compression: Compression{Method: ZSTD, Seekable: true}},
+		{name: "lz4", format: TAR, compression: Compression{Method: LZ4}},
+		{name: "xz", format: TAR, compression: Compression{Method: XZ}},
+		{name: "brotli", format: TAR, compression: Compression{Method: BROTLI}},
+		{name: "zip", format: ZIP, compression: Compression{Method: GZIP}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var writer bufferWriteCloser
+			archive, err := NewArchive(&writer, tt.format, tt.compression)
+			if err != nil {
+				t.Fatalf("failed to create archive: %s", err)
+			}
+			if err := archive.Write(pths, false); err != nil {
+				t.Fatalf("failed to write archive: %s", err)
+			}
+			if err := archive.WriteHeader(map[string]string{}, cacheInfoFilePath); err != nil {
+				t.Fatalf("failed to write header: %s", err)
+			}
+			if err := archive.Close(); err != nil {
+				t.Fatalf("failed to close archive: %s", err)
+			}
+			b := writer.Bytes()
+
+			if err := verifyArchive(bytes.NewReader(b), int64(len(b)), tt.format, tt.compression, archive.Entries()); err != nil {
+				t.Errorf("verifyArchive() error = %v", err)
+			}
+
+			if err := verifyArchive(bytes.NewReader(b), int64(len(b)), tt.format, tt.compression, archive.Entries()+1); err == nil {
+				t.Errorf("verifyArchive() with missing entry error = nil, want error")
+			}
+
+			truncated := b[:len(b)/2]
+			if err := verifyArchive(bytes.NewReader(truncated), int64(len(truncated)), tt.format, tt.compression, archive.Entries()); err == nil {
+				t.Errorf("verifyArchive() of truncated archive error = nil, want error")
+			}
+		})
+	}
+}
+
+func Test_verifyArchiveFiles(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "file")
+	createDirStruct(t, map[string]string{pth: strings.Repeat("content", 1024)})
+
+	volumes := newVolumeWriter(filepath.Join(tmpDir, "cache-archive.tar"), 1000)
+	archive, err := NewArchive(volumes, TAR, Compression{Method: NONE})
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	if err := archive.Write([]string{pth}, false); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+
+	var volumePths []string
+	for _, volume := range volumes.volumes {
+		volumePths = append(volumePths, volume.Path)
+	}
+	if len(volumePths) < 2 {
+		t.Fatalf("archive is written into %d volumes, want multiple", len(volumePths))
+	}
+
+	if err := verifyArchiveFiles(volumePths, TAR, Compression{Method: NONE}, 1); err != nil {
+		t.Errorf("verifyArchiveFiles() error = %v", err)
+	}
+
+	if err := ioutil.WriteFile(volumePths[1], []byte("corrupt"), 0600); err != nil {
+		t.Fatalf("failed to corrupt volume: %s", err)
+	}
+	if err := verifyArchiveFiles(volumePths, TAR, Compression{Method: NONE}, 1); err == nil {
+		t.Errorf("verifyArchiveFiles() of corrupt volumes error = nil, want error")
+	}
+}
@@ -0,0 +1,96 @@
+// Automatic lockfile change indicator related models and functions.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// lockfileRule describes the cache paths a well-known lockfile decides the content of.
+type lockfileRule struct {
+	lockfile string
+	// siblings are the base names of the cache paths keyed on the lockfile next to them, such as node_modules.
+	siblings []string
+	// caches are the global caches keyed on the lockfile in the working directory, such as ~/.npm.
+	caches []string
+}
+
+// lockfileRules are the lockfiles detected for the automatic change indicators.
+var lockfileRules = []lockfileRule{
+	{lockfile: "Podfile.lock", siblings: []string{"Pods"}, caches: []string{"~/Library/Caches/CocoaPods"}},
+	{lockfile: "package-lock.json", siblings: []string{"node_modules"}, caches: []string{"~/.npm"}},
+	{lockfile: "yarn.lock", siblings: []string{"node_modules"}, caches: []string{"~/.cache/yarn", "~/Library/Caches/Yarn"}},
+	{lockfile: "go.sum", caches: []string{"~/go/pkg/mod"}},
+	{lockfile: "gradle.lockfile", caches: []string{"~/.gradle/caches"}},
+}
+
+// lockfileIndicators returns the lockfiles the cache path pth is keyed on, sorted:
+// the lockfiles next to pth for which pth is a sibling, and the lockfiles in workDir for which pth is in a cache.
+func lockfileIndicators(pth, workDir string) ([]string, error) {
+	pth, err := absPath(pth)
+	if err != nil {
+		return nil, err
+	}
+	pth = strings.TrimSuffix(pth, string(filepath.Separator))
+
+	found := map[string]bool{}
+	for _, rule := range lockfileRules {
+		var candidates []string
+		for _, sibling := range rule.siblings {
+			if filepath.Base(pth) == sibling {
+				candidates = append(candidates, filepath.Join(filepath.Dir(pth), rule.lockfile))
+			}
+		}
+		for _, cache := range rule.caches {
+			cache, err := absPath(cache)
+			if err != nil {
+				return nil, err
+			}
+			if pth == cache || strings.HasPrefix(pth, cache+string(filepath.Separator)) {
+				candidates = append(candidates, filepath.Join(workDir, rule.lockfile))
+			}
+		}
+
+		for _, candidate := range candidates {
+			lockfile, err := absPath(candidate)
+			if err != nil {
+				return nil, err
+			}
+			if info, err := os.Stat(lockfile); err == nil && !info.IsDir() {
+				found[lockfile] = true
+			}
+		}
+	}
+
+	lockfiles := make([]string, 0, len(found))
+	for lockfile := range found {
+		lockfiles = append(lockfiles, lockfile)
+	}
+	sort.Strings(lockfiles)
+	return lockfiles, nil
+}
+
+// autoIndicators sets the detected lockfiles as the indicator of the include items without an indicator,
+// as a comma-separated multi-file indicator if more than one lockfile is detected.
+// The lockfiles of the global caches are detected in workDir.
+func autoIndicators(indicatorByPath map[string]string, workDir string) (map[string]string, error) {
+	indicators := map[string]string{}
+	for pth, indicator := range indicatorByPath {
+		if indicator == "" {
+			lockfiles, err := lockfileIndicators(pth, workDir)
+			if err != nil {
+				return nil, err
+			}
+			if len(lockfiles) > 0 {
+				indicator = strings.Join(lockfiles, ", ")
+				log.Printf("Keying %s on: %s", pth, indicator)
+			}
+		}
+		indicators[pth] = indicator
+	}
+	return indicators, nil
+}
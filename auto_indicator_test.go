@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_autoIndicators(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	home := filepath.Join(tmpDir, "home")
+	workDir := filepath.Join(tmpDir, "project")
+	createDirStruct(t, map[string]string{
+		filepath.Join(workDir, "Podfile.lock"):                  "",
+		filepath.Join(workDir, "package-lock.json"):             "",
+		filepath.Join(workDir, "yarn.lock"):                     "",
+		filepath.Join(workDir, "web", "package-lock.json"):      "",
+		filepath.Join(home, ".npm", "file"):                     "",
+		filepath.Join(home, ".gradle", "caches", "file"):        "",
+		filepath.Join(workDir, "Pods", "file"):                  "",
+		filepath.Join(workDir, "web", "node_modules", "file"):   "",
+		filepath.Join(workDir, "other", "node_modules", "file"): "",
+	})
+
+	originalHome := os.Getenv("HOME")
+	if err := os.Setenv("HOME", home); err != nil {
+		t.Fatalf("failed to set HOME: %s", err)
+	}
+	defer func() {
+		if err := os.Setenv("HOME", originalHome); err != nil {
+			t.Errorf("failed to restore HOME: %s", err)
+		}
+	}()
+
+	indicatorByPath := map[string]string{
+		filepath.Join(workDir, "Pods"):                  "",
+		filepath.Join(workDir, "web", "node_modules"):   "",
+		filepath.Join(workDir, "other", "node_modules"): "",
+		"~/.npm":                        "",
+		"~/.gradle/caches":              "",
+		filepath.Join(workDir, "build"): "custom/indicator",
+	}
+	got, err := autoIndicators(indicatorByPath, workDir)
+	if err != nil {
+		t.Fatalf("autoIndicators() error = %v", err)
+	}
+
+	want := map[string]string{
+		filepath.Join(workDir, "Pods"):                  filepath.Join(workDir, "Podfile.lock"),
+		filepath.Join(workDir, "web", "node_modules"):   filepath.Join(workDir, "web", "package-lock.json"),
+		filepath.Join(workDir, "other", "node_modules"): "",
+		"~/.npm":                        filepath.Join(workDir, "package-lock.json"),
+		"~/.gradle/caches":              "",
+		filepath.Join(workDir, "build"): "custom/indicator",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("autoIndicators() = %v, want %v", got, want)
+	}
+
+	// Both lockfiles key node_modules next to them.
+	createDirStruct(t, map[string]string{filepath.Join(workDir, "web", "yarn.lock"): ""})
+	lockfiles, err := lockfileIndicators(filepath.Join(workDir, "web", "node_modules"), workDir)
+	if err != nil {
+		t.Fatalf("lockfileIndicators() error = %v", err)
+	}
+	if want := []string{filepath.Join(workDir, "web", "package-lock.json"), filepath.Join(workDir, "web", "yarn.lock")}; !reflect.DeepEqual(lockfiles, want) {
+		t.Errorf("lockfileIndicators() = %v, want %v", lockfiles, want)
+	}
+}
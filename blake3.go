@@ -0,0 +1,313 @@
+// BLAKE3 related models and functions.
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+	"runtime"
+	"sync"
+)
+
+const (
+	// blake3ChunkLen is the size of the chunks, the leaves of the BLAKE3 tree.
+	blake3ChunkLen = 1024
+	// blake3BlockLen is the size of the blocks the chunks and the parents are compressed in.
+	blake3BlockLen = 64
+	// blake3BatchSize is the amount of the written data buffered before its chunks are hashed in parallel.
+	blake3BatchSize = 1024 * 1024
+	// blake3MinParallelChunks is the number of chunks worth to spread across the goroutines.
+	blake3MinParallelChunks = 64
+)
+
+// The domain separation flags of BLAKE3.
+const (
+	blake3ChunkStart uint32 = 1 << iota
+	blake3ChunkEnd
+	blake3Parent
+	blake3Root
+)
+
+// blake3IV is the initial chaining value, the same as SHA-256's.
+var blake3IV = [8]uint32{0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19}
+
+// blake3MsgPermutation permutes the message words between the rounds.
+var blake3MsgPermutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+// blake3G mixes the message words mx and my into the state.
+func blake3G(state *[16]uint32, a, b, c, d int, mx, my uint32) {
+	state[a] += state[b] + mx
+	state[d] = bits.RotateLeft32(state[d]^state[a], -16)
+	state[c] += state[d]
+	state[b] = bits.RotateLeft32(state[b]^state[c], -12)
+	state[a] += state[b] + my
+	state[d] = bits.RotateLeft32(state[d]^state[a], -8)
+	state[c] += state[d]
+	state[b] = bits.RotateLeft32(state[b]^state[c], -7)
+}
+
+// blake3Compress compresses a block into the chaining value, returning the whole state.
+func blake3Compress(cv [8]uint32, block [16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	state := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := block
+	for round := 0; round < 7; round++ {
+		blake3G(&state, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&state, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&state, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&state, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&state, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&state, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&state, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&state, 3, 4, 9, 14, m[14], m[15])
+
+		var permuted [16]uint32
+		for i, j := range blake3MsgPermutation {
+			permuted[i] = m[j]
+		}
+		m = permuted
+	}
+
+	for i := 0; i < 8; i++ {
+		state[i] ^= state[i+8]
+		state[i+8] ^= cv[i]
+	}
+	return state
+}
+
+// blake3Words returns the little-endian words of a block, zero-padded.
+func blake3Words(b []byte) [16]uint32 {
+	var block [blake3BlockLen]byte
+	copy(block[:], b)
+
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(block[i*4:])
+	}
+	return words
+}
+
+// blake3Output is a node of the tree before it is compressed, as a chaining value or as the root.
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+// chainingValue returns the chaining value of a non-root node.
+func (o blake3Output) chainingValue() [8]uint32 {
+	state := blake3Compress(o.cv, o.block, o.counter, o.blockLen, o.flags)
+	var cv [8]uint32
+	copy(cv[:], state[:8])
+	return cv
+}
+
+// rootHash returns the 32 bytes hash of the root node.
+func (o blake3Output) rootHash() []byte {
+	state := blake3Compress(o.cv, o.block, 0, o.blockLen, o.flags|blake3Root)
+	sum := make([]byte, 32)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(sum[i*4:], state[i])
+	}
+	return sum
+}
+
+// blake3ParentOutput returns the parent node of two chaining values.
+func blake3ParentOutput(left, right [8]uint32) blake3Output {
+	var block [16]uint32
+	copy(block[:8], left[:])
+	copy(block[8:], right[:])
+	return blake3Output{cv: blake3IV, block: block, blockLen: blake3BlockLen, flags: blake3Parent}
+}
+
+// blake3ChunkState hashes the blocks of a chunk.
+type blake3ChunkState struct {
+	cv               [8]uint32
+	counter          uint64
+	block            [blake3BlockLen]byte
+	blockLen         int
+	blocksCompressed int
+}
+
+// newBlake3ChunkState returns the state of the chunk of the given index.
+func newBlake3ChunkState(counter uint64) blake3ChunkState {
+	return blake3ChunkState{cv: blake3IV, counter: counter}
+}
+
+// len returns the number of the bytes written into the chunk.
+func (s *blake3ChunkState) len() int {
+	return s.blocksCompressed*blake3BlockLen + s.blockLen
+}
+
+// startFlag returns the flag of the chunk's first block.
+func (s *blake3ChunkState) startFlag() uint32 {
+	if s.blocksCompressed == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+// update writes b into the chunk, b must fit into the chunk.
+// A full block is only compressed once more data follows it, since the last block of the chunk is flagged.
+func (s *blake3ChunkState) update(b []byte) {
+	for len(b) > 0 {
+		if s.blockLen == blake3BlockLen {
+			state := blake3Compress(s.cv, blake3Words(s.block[:]), s.counter, blake3BlockLen, s.startFlag())
+			copy(s.cv[:], state[:8])
+			s.blocksCompressed++
+			s.blockLen = 0
+		}
+		n := copy(s.block[s.blockLen:], b)
+		s.blockLen += n
+		b = b[n:]
+	}
+}
+
+// output returns the node of the chunk.
+func (s *blake3ChunkState) output() blake3Output {
+	return blake3Output{
+		cv:       s.cv,
+		block:    blake3Words(s.block[:s.blockLen]),
+		counter:  s.counter,
+		blockLen: uint32(s.blockLen),
+		flags:    s.startFlag() | blake3ChunkEnd,
+	}
+}
+
+// blake3ChunkCVs returns the chaining values of the whole chunks of data, the first of them has the given index,
+// hashing them with at most workers goroutines.
+func blake3ChunkCVs(data []byte, counter uint64, workers int) [][8]uint32 {
+	cvs := make([][8]uint32, len(data)/blake3ChunkLen)
+	hashRange := func(from, to int) {
+		for i := from; i < to; i++ {
+			state := newBlake3ChunkState(counter + uint64(i))
+			state.update(data[i*blake3ChunkLen : (i+1)*blake3ChunkLen])
+			cvs[i] = state.output().chainingValue()
+		}
+	}
+
+	if workers < 2 || len(cvs) < blake3MinParallelChunks {
+		hashRange(0, len(cvs))
+		return cvs
+	}
+
+	var wg sync.WaitGroup
+	per := (len(cvs) + workers - 1) / workers
+	for from := 0; from < len(cvs); from += per {
+		to := from + per
+		if to > len(cvs) {
+			to = len(cvs)
+		}
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			hashRange(from, to)
+		}(from, to)
+	}
+	wg.Wait()
+	return cvs
+}
+
+// blake3Hasher computes the BLAKE3 hash of the written data, hashing the chunks of large files on all of the CPUs:
+// the chunks of each batch are hashed in parallel, and merged into the tree in order.
+type blake3Hasher struct {
+	chunk blake3ChunkState
+	// stack holds the chaining values of the complete subtrees of the chunks hashed so far.
+	stack  [][8]uint32
+	chunks uint64
+	// pending is the written data not hashed yet.
+	pending []byte
+}
+
+// newBlake3 returns a hash.Hash computing the 32 bytes BLAKE3 hash of the written data.
+func newBlake3() hash.Hash {
+	h := &blake3Hasher{}
+	h.Reset()
+	return h
+}
+
+// Reset resets the hash to its initial state.
+func (h *blake3Hasher) Reset() {
+	h.chunk = newBlake3ChunkState(0)
+	h.stack = h.stack[:0]
+	h.chunks = 0
+	h.pending = h.pending[:0]
+}
+
+// Size returns the number of bytes of the sum.
+func (h *blake3Hasher) Size() int {
+	return 32
+}
+
+// BlockSize returns the size of the blocks the input is compressed in.
+func (h *blake3Hasher) BlockSize() int {
+	return blake3BlockLen
+}
+
+// Write buffers b, hashing the buffered data once a batch is buffered.
+func (h *blake3Hasher) Write(b []byte) (int, error) {
+	h.pending = append(h.pending, b...)
+	if len(h.pending) > blake3BatchSize {
+		h.flush()
+	}
+	return len(b), nil
+}
+
+// pushChunk merges the chaining value of the next chunk into the stack of the subtrees,
+// each complete subtree is merged with its sibling as in the binary representation of the number of chunks.
+func (h *blake3Hasher) pushChunk(cv [8]uint32) {
+	h.chunks++
+	for total := h.chunks; total&1 == 0; total >>= 1 {
+		cv = blake3ParentOutput(h.stack[len(h.stack)-1], cv).chainingValue()
+		h.stack = h.stack[:len(h.stack)-1]
+	}
+	h.stack = append(h.stack, cv)
+	h.chunk = newBlake3ChunkState(h.chunks)
+}
+
+// flush hashes the pending data, the last chunk is kept in the chunk state since it may be the root.
+func (h *blake3Hasher) flush() {
+	data := h.pending
+	if len(data) == 0 {
+		return
+	}
+	h.pending = h.pending[:0]
+
+	if h.chunk.len() > 0 {
+		n := blake3ChunkLen - h.chunk.len()
+		if n > len(data) {
+			n = len(data)
+		}
+		h.chunk.update(data[:n])
+		data = data[n:]
+		if len(data) == 0 {
+			return
+		}
+		h.pushChunk(h.chunk.output().chainingValue())
+	}
+
+	whole := (len(data) - 1) / blake3ChunkLen * blake3ChunkLen
+	for _, cv := range blake3ChunkCVs(data[:whole], h.chunks, runtime.GOMAXPROCS(0)) {
+		h.pushChunk(cv)
+	}
+	h.chunk.update(data[whole:])
+}
+
+// Sum appends the hash of the written data to b, without changing the hash state.
+func (h *blake3Hasher) Sum(b []byte) []byte {
+	c := *h
+	c.stack = append([][8]uint32(nil), h.stack...)
+	c.pending = append([]byte(nil), h.pending...)
+	c.flush()
+
+	output := c.chunk.output()
+	for i := len(c.stack) - 1; i >= 0; i-- {
+		output = blake3ParentOutput(c.stack[i], output.chainingValue())
+	}
+	return append(b, output.rootHash()...)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// blake3TestInput returns the input of the official test vectors: the bytes repeating 0 to 250.
+func blake3TestInput(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func Test_blake3(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{name: "empty", input: nil, want: "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{name: "one byte", input: blake3TestInput(1), want: "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{name: "one chunk", input: blake3TestInput(1024), want: "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{name: "two chunks", input: blake3TestInput(1025), want: "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{name: "three chunks", input: blake3TestInput(3072), want: "b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2"},
+		{name: "hundred chunks", input: blake3TestInput(102400), want: "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newBlake3()
+			if _, err := h.Write(tt.input); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+				t.Errorf("Sum() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_blake3_batches(t *testing.T) {
+	data := bytes.Repeat(blake3TestInput(251*17), 1000)
+
+	whole := newBlake3()
+	if _, err := whole.Write(data); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	pieces := newBlake3()
+	for b := data; len(b) > 0; {
+		n := 32 * 1024
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := pieces.Write(b[:n]); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		b = b[n:]
+	}
+
+	if !bytes.Equal(whole.Sum(nil), pieces.Sum(nil)) {
+		t.Errorf("Sum() of the pieces = %x, want %x", pieces.Sum(nil), whole.Sum(nil))
+	}
+}
+
+func Test_blake3ChunkCVs(t *testing.T) {
+	data := blake3TestInput(blake3MinParallelChunks * 3 * blake3ChunkLen)
+	serial := blake3ChunkCVs(data, 5, 1)
+	parallel := blake3ChunkCVs(data, 5, 4)
+	if !reflect.DeepEqual(serial, parallel) {
+		t.Errorf("blake3ChunkCVs() with 4 workers differs from 1 worker")
+	}
+}
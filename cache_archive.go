@@ -3,27 +3,90 @@ package main
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bytes"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/bitrise-io/go-utils/command"
 	"github.com/bitrise-io/go-utils/log"
+	"github.com/klauspost/compress/flate"
 )
 
+// ArchiveFormat ...
+type ArchiveFormat string
+
+const (
+	// TAR ...
+	TAR = ArchiveFormat("tar")
+	// ZIP ...
+	ZIP = ArchiveFormat("zip")
+	// SQUASHFS ...
+	SQUASHFS = ArchiveFormat("squashfs")
+)
+
+// reproducibleModTime is the modification time of the entries of reproducible archives.
+var reproducibleModTime = time.Unix(0, 0)
+
+// reproducibleZipModTime is the modification time of the entries of reproducible zip archives,
+// the earliest time the MS-DOS date of zip headers can represent.
+var reproducibleZipModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// paxXattrPrefix prefixes the PAX records of extended attributes, the GNU and BSD tar implementations both read them.
+const paxXattrPrefix = "SCHILY.xattr."
+
 // Archive represents a cache archive.
 type Archive struct {
-	io   io.WriteCloser
-	tar  *tar.Writer
-	gzip *gzip.Writer
+	io  io.WriteCloser
+	tar *tar.Writer
+	// zip writes the archive instead of tar in the zip format, the entries are compressed by the zip writer.
+	zip        *zip.Writer
+	compressor io.WriteCloser
+	// uncompressed counts the tar stream's bytes (the entries' content in zip archives),
+	// also used to build the entry index of seekable archives,
+	// compressed counts the bytes written to the archive's writer.
+	uncompressed *countingWriter
+	compressed   *countingWriter
+	index        map[string]int64
+	// offsets maps the entry names to their offset for the entry index uploaded next to the archive, nil if not written.
+	offsets map[string]entryOffset
+	// stored lists the paths to archive without compression, storing reports whether the current frame is stored.
+	stored  map[string]bool
+	storing bool
+	// adaptive adjusts the compression level to the upload bandwidth, nil if the level is fixed.
+	adaptive *adaptiveLevel
+	// deflate reports whether the entries of zip archives are compressed.
+	deflate bool
+	// xattrs reports whether the extended attributes of the files are stored in PAX records of tar archives.
+	xattrs bool
+	// dereferenced lists the symlinks to archive as their target.
+	dereferenced map[string]bool
+	// links maps the inodes with multiple links to the first written path, the others are written as hardlinks.
+	links map[inode]string
+	// checksums maps the paths of the written files to their checksum manifest entry.
+	checksums map[string]fileChecksum
+	// entries counts the entries written into the archive.
+	entries int
+	// reproducible removes the metadata from the entries which differs between identical inputs,
+	// like modification times and owners, so that identical inputs produce identical archives.
+	reproducible bool
+	// owner replaces the owner of the tar entries, nil preserves the owners of the files.
+	owner *entryOwner
+	// stripSetuid clears the setuid and setgid bits of the entries.
+	stripSetuid bool
+	// maxSize limits the size of the archive, 0 if not limited.
+	// If trim is set, the paths exceeding the limit are dropped instead of failing Write, dropped lists them.
+	maxSize int64
+	trim    bool
+	dropped []string
+	// dataModTime is the modification time of the data entries like the archive info, zero writes the current time.
+	dataModTime time.Time
 }
 
 type nopReader struct{}
@@ -33,30 +96,150 @@ func (reader nopReader) Read(b []byte) (n int, err error) {
 }
 
 // NewArchive creates a instance of Archive.
-func NewArchive(io io.WriteCloser, compress bool) (*Archive, error) {
-	var tarWriter *tar.Writer
-	var gzipWriter *gzip.Writer
-	var err error
-	if compress {
-		gzipWriter, err = gzip.NewWriterLevel(io, gzip.BestCompression)
-		if err != nil {
-			return nil, err
+func NewArchive(io io.WriteCloser, format ArchiveFormat, compression Compression) (*Archive, error) {
+	compressed := &countingWriter{writer: io}
+
+	switch format {
+	case TAR:
+	case ZIP:
+		return newZipArchive(io, compressed, compression)
+	case SQUASHFS:
+		return newSquashfsArchive(io, compressed, compression)
+	default:
+		return nil, fmt.Errorf("unknown archive format: %s", format)
+	}
+	compressor, err := newCompressor(compressed, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	var adaptive *adaptiveLevel
+	if _, ok := compressor.(frameWriter); ok && compression.Bandwidth != nil {
+		adaptive = newAdaptiveLevel(io, compression)
+		if adaptive != nil {
+			compressed.writer = adaptive
 		}
+	}
 
-		tarWriter = tar.NewWriter(gzipWriter)
-	} else {
-		tarWriter = tar.NewWriter(io)
+	uncompressed := &countingWriter{writer: compressed}
+	if compressor != nil {
+		uncompressed.writer = compressor
 	}
+
+	var index map[string]int64
+	if compression.Seekable {
+		index = map[string]int64{}
+	}
+
+	return &Archive{
+		io:           io,
+		tar:          tar.NewWriter(uncompressed),
+		compressor:   compressor,
+		uncompressed: uncompressed,
+		compressed:   compressed,
+		index:        index,
+		adaptive:     adaptive,
+	}, nil
+}
+
+// newZipArchive creates an Archive writing the zip format, the entries are compressed with deflate
+// unless the compression method is NONE.
+func newZipArchive(archiveWriter io.WriteCloser, compressed *countingWriter, compression Compression) (*Archive, error) {
+	if compression.Seekable {
+		return nil, fmt.Errorf("seekable archive is not supported with archive format: %s", ZIP)
+	}
+
+	writer := zip.NewWriter(compressed)
+	switch compression.Method {
+	case NONE:
+	case GZIP:
+		level := compression.Level
+		if level == 0 {
+			level = flate.BestCompression
+		}
+		writer.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	default:
+		return nil, fmt.Errorf("compression method is not supported with archive format %s: %s", ZIP, compression.Method)
+	}
+
 	return &Archive{
-		io:   io,
-		tar:  tarWriter,
-		gzip: gzipWriter,
+		io:           archiveWriter,
+		zip:          writer,
+		uncompressed: &countingWriter{},
+		compressed:   compressed,
+		deflate:      compression.Method != NONE,
 	}, nil
 }
 
+// Size returns the number of bytes of the archive before and after compression.
+// The sizes are final after the archive is closed.
+func (a *Archive) Size() (uncompressed int64, compressed int64) {
+	return a.uncompressed.n, a.compressed.n
+}
+
+// Entries returns the number of entries written into the archive.
+func (a *Archive) Entries() int {
+	return a.entries
+}
+
+// startEntry prepares the archive for writing the entry with the given name:
+// in seekable archives every entry starts in a new frame, the offsets of the entries are recorded in the entry indexes,
+// stored entries are written into frames without compression,
+// and adapting archives start a new frame when the compression level changes.
+func (a *Archive) startEntry(name string, store bool) error {
+	a.entries++
+
+	frames, ok := a.compressor.(frameWriter)
+	nextFrame := ok && (a.index != nil || store != a.storing)
+
+	if a.adaptive != nil {
+		if level, changed := a.adaptive.next(a.Size()); changed {
+			log.Debugf("Compression level changed to: %d", level)
+			frames.setLevel(level)
+			nextFrame = true
+		}
+	}
+	if a.index == nil && a.offsets == nil && !nextFrame {
+		return nil
+	}
+
+	// Flush writes the padding of the previous entry.
+	if err := a.tar.Flush(); err != nil {
+		return err
+	}
+
+	if nextFrame {
+		if err := frames.nextFrame(store); err != nil {
+			return err
+		}
+		a.storing = store
+	}
+
+	if a.index != nil {
+		a.index[name] = a.uncompressed.n
+	}
+	if a.offsets != nil {
+		a.offsets[name] = entryOffset{Offset: a.compressed.n, UncompressedOffset: a.uncompressed.n}
+	}
+	return nil
+}
+
 // Write writes the given files in the cache archive.
+// If the archive's size limit is reached, the rest of the paths are dropped if trim is set, otherwise a sizeLimitError is returned.
 func (a *Archive) Write(pths []string, dry bool) error {
-	for _, pth := range pths {
+	for i, pth := range pths {
+		if a.maxSize > 0 {
+			if err := a.checkSizeLimit(pth); err != nil {
+				if _, ok := err.(*sizeLimitError); !ok || !a.trim {
+					return err
+				}
+				a.dropped = pths[i:]
+				return nil
+			}
+		}
+
 		if err := a.writeOne(pth, dry); err != nil {
 			return err
 		}
@@ -71,6 +254,13 @@ func (a *Archive) writeOne(pth string, dry bool) error {
 		return fmt.Errorf("failed to lstat(%s), error: %s", pth, err)
 	}
 
+	if a.dereferenced[pth] {
+		info, err = os.Stat(pth)
+		if err != nil {
+			return fmt.Errorf("failed to stat(%s), error: %s", pth, err)
+		}
+	}
+
 	var link string
 	if info.Mode()&os.ModeSymlink != 0 {
 		link, err = os.Readlink(pth)
@@ -79,26 +269,49 @@ func (a *Archive) writeOne(pth string, dry bool) error {
 		}
 	}
 
-	header, err := tar.FileInfoHeader(info, link)
-	if err != nil {
-		return fmt.Errorf("failed to get tar file header(%s), error: %s", link, err)
+	if err := a.startEntry(pth, a.stored[pth]); err != nil {
+		return fmt.Errorf("failed to start entry(%s), error: %s", pth, err)
 	}
 
-	header.Name = pth
-	header.ModTime = info.ModTime()
+	var xattrs map[string]string
+	if a.tar != nil && a.xattrs {
+		xattrs, err = readXattrs(pth)
+		if err != nil {
+			log.Warnf("Failed to read extended attributes (%s), archiving without them: %s", pth, err)
+		}
+	}
 
-	if err := a.tar.WriteHeader(header); err != nil {
-		return fmt.Errorf("failed to write header(%v), error: %s", header, err)
+	if a.tar != nil && info.Mode().IsRegular() {
+		if target, ok := a.hardlinkTarget(pth, info); ok {
+			a.checksums[pth] = a.checksums[target]
+			return a.writeHardlink(pth, info, target)
+		}
+
+		regions, sparse, err := sparseRegions(pth, info)
+		if err != nil {
+			return fmt.Errorf("failed to find data regions(%s), error: %s", pth, err)
+		}
+		if sparse {
+			return a.writeSparse(pth, info, regions, xattrs, dry)
+		}
+	}
+
+	entry, err := a.createEntry(pth, info, link, a.stored[pth], xattrs)
+	if err != nil {
+		return err
 	}
 
 	// Calling Write on special types like TypeLink, TypeSymlink, TypeChar, TypeBlock, TypeDir, and TypeFifo returns (0, ErrWriteTooLong) regardless of what the Header.Size claims.
 	if !info.Mode().IsRegular() {
+		a.addChecksum(pth, info, nil)
 		return nil
 	}
 
+	sum := newChecksum(dry)
+	entry = hashWriter(entry, sum)
 	if dry {
 		var reader nopReader
-		_, err = io.CopyN(a.tar, reader, info.Size())
+		_, err = io.CopyN(entry, reader, info.Size())
 	} else {
 		file, err := os.Open(pth)
 		if err != nil {
@@ -112,18 +325,126 @@ func (a *Archive) writeOne(pth string, dry bool) error {
 		}()
 
 		// Write writes to the current file in the tar archive. Write returns the error ErrWriteTooLong if more than Header.Size bytes are written after WriteHeader.
-		_, err = io.CopyN(a.tar, file, info.Size())
+		_, err = io.CopyN(entry, file, info.Size())
 	}
 	if err != nil && err != io.EOF {
-		return fmt.Errorf("failed to copy, error: %s, file: %s, size: %d for header: %v", err, info.Name(), info.Size(), header)
+		return fmt.Errorf("failed to copy, error: %s, file: %s, size: %d for entry: %s", err, info.Name(), info.Size(), pth)
 	}
 
+	a.addChecksum(pth, info, sum)
 	return nil
 }
 
+// createEntry writes the header of the entry with the given name into the archive,
+// and returns the writer of the entry's content.
+// The extended attributes are stored in tar archives only.
+func (a *Archive) createEntry(name string, info os.FileInfo, link string, store bool, xattrs map[string]string) (io.Writer, error) {
+	if a.zip != nil {
+		return a.createZipEntry(name, info, link, store)
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tar file header(%s), error: %s", link, err)
+	}
+
+	header.Name = name
+	header.ModTime = info.ModTime()
+	a.normalizeHeader(header)
+	// PAX records have no limits on the path lengths and the file sizes,
+	// unlike USTAR (100 characters long names, 8GB large files) which FormatUnknown prefers if possible.
+	header.Format = tar.FormatPAX
+	if len(xattrs) > 0 {
+		header.PAXRecords = map[string]string{}
+		for key, value := range xattrs {
+			header.PAXRecords[paxXattrPrefix+key] = value
+		}
+	}
+
+	if err := a.tar.WriteHeader(header); err != nil {
+		return nil, fmt.Errorf("failed to write header(%v), error: %s", header, err)
+	}
+	return a.tar, nil
+}
+
+// normalizeHeader applies the metadata policies of the archive to the tar header:
+// removes the metadata of reproducible archives which differs between identical inputs,
+// replaces the owner and strips the setuid and setgid bits if set.
+func (a *Archive) normalizeHeader(header *tar.Header) {
+	if a.reproducible {
+		header.ModTime = reproducibleModTime
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid = 0
+		header.Gid = 0
+		header.Uname = ""
+		header.Gname = ""
+	}
+
+	if a.owner != nil {
+		header.Uid = a.owner.uid
+		header.Gid = a.owner.gid
+		header.Uname = a.owner.uname
+		header.Gname = a.owner.gname
+	}
+
+	if a.stripSetuid {
+		header.Mode &^= setuidModeBits
+	}
+}
+
+// createZipEntry writes the header of the zip entry with the given name into the archive,
+// and returns the writer of the entry's content.
+// Zip entry names are relative, the leading slash of the absolute name is removed,
+// symlinks are stored with their target as content like Info-ZIP does.
+func (a *Archive) createZipEntry(name string, info os.FileInfo, link string, store bool) (io.Writer, error) {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get zip file header(%s), error: %s", name, err)
+	}
+
+	header.Name = strings.TrimPrefix(name, "/")
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if a.reproducible {
+		header.Modified = reproducibleZipModTime
+	}
+	if a.stripSetuid {
+		header.SetMode(header.Mode() &^ (os.ModeSetuid | os.ModeSetgid))
+	}
+	header.Method = zip.Store
+	if a.deflate && !store && info.Mode().IsRegular() {
+		header.Method = zip.Deflate
+	}
+
+	writer, err := a.zip.CreateHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write header(%s), error: %s", header.Name, err)
+	}
+	a.uncompressed.writer = writer
+
+	if link != "" {
+		if _, err := io.WriteString(a.uncompressed, link); err != nil {
+			return nil, fmt.Errorf("failed to write link(%s), error: %s", name, err)
+		}
+	}
+	return a.uncompressed, nil
+}
+
 // WriteHeader writes the cache descriptor file into the archive as a tar header.
 func (a *Archive) WriteHeader(descriptor map[string]string, descriptorPth string) error {
-	b, err := json.MarshalIndent(descriptor, "", " ")
+	b, err := descriptorData(descriptor)
+	if err != nil {
+		return err
+	}
+
+	return a.writeData(b, descriptorPth)
+}
+
+// WriteCompressedHeader writes the cache descriptor file compressed with gzip into the archive, as WriteHeader.
+func (a *Archive) WriteCompressedHeader(descriptor map[string]string, descriptorPth string) error {
+	b, err := compressedDescriptorData(descriptor)
 	if err != nil {
 		return err
 	}
@@ -138,27 +459,67 @@ func (a *Archive) writeData(data []byte, descriptorPth string) error {
 		Size:     int64(len(data)),
 		Typeflag: tar.TypeReg,
 		Mode:     0600,
-		ModTime:  time.Now(),
+		ModTime:  a.dataModTime,
+	}
+	if header.ModTime.IsZero() {
+		header.ModTime = time.Now()
 	}
 
-	if err := a.tar.WriteHeader(header); err != nil {
+	if err := a.startEntry(header.Name, false); err != nil {
+		return err
+	}
+
+	entry, err := a.createEntry(header.Name, header.FileInfo(), "", false, nil)
+	if err != nil {
 		return err
 	}
 
-	if _, err := io.Copy(a.tar, bytes.NewReader(data)); err != nil && err != io.EOF {
+	if _, err := io.Copy(entry, bytes.NewReader(data)); err != nil && err != io.EOF {
 		return err
 	}
 	return nil
 }
 
+// writeIndex writes the entry index of a seekable archive into the archive,
+// mapping entry names to the offset of their header in the uncompressed tar stream.
+func (a *Archive) writeIndex(indexPth string) error {
+	b, err := json.Marshal(a.index)
+	if err != nil {
+		return err
+	}
+
+	return a.writeData(b, indexPth)
+}
+
+// writeTombstones writes the tombstone list into the archive:
+// the paths of the previous cache which were removed since, the pull step deletes them instead of leaving them behind.
+func (a *Archive) writeTombstones(pths []string, tombstonesPth string) error {
+	b, err := json.Marshal(pths)
+	if err != nil {
+		return err
+	}
+
+	return a.writeData(b, tombstonesPth)
+}
+
 // Close closes the archive.
 func (a *Archive) Close() error {
-	if err := a.tar.Close(); err != nil {
+	if a.index != nil {
+		if err := a.writeIndex(cacheIndexFilePath); err != nil {
+			return err
+		}
+	}
+
+	if a.zip != nil {
+		if err := a.zip.Close(); err != nil {
+			return err
+		}
+	} else if err := a.tar.Close(); err != nil {
 		return err
 	}
 
-	if a.gzip != nil {
-		if err := a.gzip.Close(); err != nil {
+	if a.compressor != nil {
+		if err := a.compressor.Close(); err != nil {
 			return err
 		}
 	}
@@ -167,16 +528,25 @@ func (a *Archive) Close() error {
 }
 
 // uploadArchive uploads the archive file to a given destination.
-// If the destination is a local file path (url has a file:// scheme) this function copies the cache archive file to the destination.
-// Otherwise destination should point to the Bitrise cache API server, in this case the function has builtin retry logic with 3s sleep.
+// If the destination is a local file path (url has a file:// scheme) this function copies the cache archive file to the destination,
+// or into the destination directory if the path ends with a separator.
+// If the destination is an S3 bucket (url has a s3:// scheme) the file is uploaded to the bucket.
+// If the destination is an SFTP server (url has a sftp:// scheme) the file is uploaded with sftp.
+// If the destination is a generic HTTP repository (url has a http+ prefix) the file is uploaded with the configured method and headers.
+// Otherwise destination should point to the Bitrise cache API server, in this case the failed requests are retried with uploadRetryPolicy,
+// requesting a fresh upload url if the upload url was rejected.
 func uploadArchiveFile(pth, url string) error {
-	if strings.HasPrefix(url, "file://") {
-		dst := strings.TrimPrefix(url, "file://")
-		dir := filepath.Dir(dst)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return err
-		}
-		return command.CopyFile(pth, dst)
+	if strings.HasPrefix(url, fileScheme) {
+		return copyLocalFile(pth, url)
+	}
+	if strings.HasPrefix(url, s3Scheme) {
+		return uploadS3File(pth, url)
+	}
+	if strings.HasPrefix(url, sftpScheme) {
+		return uploadSFTPFile(pth, url)
+	}
+	if strings.HasPrefix(url, httpScheme) {
+		return uploadHTTPFile(pth, url)
 	}
 
 	fi, err := os.Stat(pth)
@@ -186,40 +556,151 @@ func uploadArchiveFile(pth, url string) error {
 	sizeInBytes := fi.Size()
 	log.Printf("Archive file size: %d bytes / %f MB", sizeInBytes, (float64(sizeInBytes) / 1024.0 / 1024.0))
 
-	uploadURL, err := getCacheUploadURL(url, sizeInBytes)
+	checksums, err := loadContentChecksums(pth)
 	if err != nil {
-		return fmt.Errorf("failed to generate upload url: %s", err)
+		return fmt.Errorf("failed to compute checksums: %s", err)
 	}
 
-	if err := tryToUploadArchiveFile(uploadURL, pth); err != nil {
-		fmt.Println()
-		log.Warnf("First upload attempt failed, retrying...")
-		fmt.Println()
-		time.Sleep(3000 * time.Millisecond)
-		return tryToUploadArchiveFile(uploadURL, pth)
-	}
-	return nil
+	var uploadURL string
+	return uploadRetryPolicy.do(func() error {
+		// The retries may wait long enough for the upload url to expire.
+		if uploadURL != "" && presignedURLExpiresSoon(uploadURL, time.Now()) {
+			log.Printf("Upload url expires soon, requesting a fresh upload url")
+			uploadURL = ""
+		}
+		if uploadURL == "" {
+			var err error
+			uploadURL, err = getCacheUploadURL(url, sizeInBytes)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tryToUploadArchiveFile(uploadURL, pth, checksums)
+		if uploadErr, ok := err.(*uploadError); ok && uploadErr.expired {
+			uploadURL = ""
+		}
+		return err
+	})
+}
+
+// uploadReaderRequiresSize reports whether uploadArchiveReader requires the size of the archive:
+// the Bitrise cache API requires it to request the upload url, the other destinations are uploaded as the archive is written.
+func uploadReaderRequiresSize(url string) bool {
+	return !strings.HasPrefix(url, fileScheme) && !strings.HasPrefix(url, s3Scheme) && !strings.HasPrefix(url, httpScheme)
 }
 
+// uploadArchiveReader uploads the archive read from reader, only requesting the upload url is retried,
+// since the reader can not be read again.
+// sizeInBytes is the size of the archive if uploadReaderRequiresSize reports it is required, it is ignored otherwise.
 func uploadArchiveReader(reader io.Reader, sizeInBytes int64, url string) error {
-	uploadURL, err := getCacheUploadURL(url, sizeInBytes)
-	if err != nil {
-		return fmt.Errorf("failed to generate upload url: %s", err)
+	if strings.HasPrefix(url, fileScheme) {
+		return copyFileAtomically(reader, cacheArchivePath, url)
+	}
+	if strings.HasPrefix(url, s3Scheme) {
+		return uploadS3Reader(reader, url)
+	}
+	if strings.HasPrefix(url, sftpScheme) {
+		return fmt.Errorf("sftp storage backend can not upload from a stream")
+	}
+	if strings.HasPrefix(url, httpScheme) {
+		return uploadHTTPReader(reader, url)
+	}
+
+	var uploadURL string
+	if err := uploadRetryPolicy.do(func() error {
+		var err error
+		uploadURL, err = getCacheUploadURL(url, sizeInBytes)
+		return err
+	}); err != nil {
+		return err
 	}
 
 	return tryToUploadArchiveReader(uploadURL, reader)
 }
 
+// downloadArchiveFile returns the content of the file uploaded from pth to the destination url, or nil if it does not exist.
+// The Bitrise cache API only provides the download url of the cache archive to the Cache Pull step,
+// the files can be downloaded from the other destinations.
+func downloadArchiveFile(pth, url string) ([]byte, error) {
+	if strings.HasPrefix(url, fileScheme) {
+		return readLocalFile(pth, url)
+	}
+	if strings.HasPrefix(url, s3Scheme) {
+		return downloadS3File(pth, url)
+	}
+	if strings.HasPrefix(url, sftpScheme) {
+		return downloadSFTPFile(pth, url)
+	}
+	if strings.HasPrefix(url, httpScheme) {
+		return downloadHTTPFile(pth, url)
+	}
+	return nil, fmt.Errorf("bitrise storage backend can not download the uploaded files")
+}
+
+// refreshStoredArchive reports whether the destination url already stores a file identical to the file at pth uploaded to it,
+// comparing their SHA256 checksums; if it does, the stored file is refreshed as the latest cache instead of uploading pth.
+// The Bitrise cache API and the SFTP backend do not provide the checksums of the stored files.
+func refreshStoredArchive(pth, url string) (bool, error) {
+	checksums, err := computeContentChecksums(pth)
+	if err != nil {
+		return false, fmt.Errorf("failed to compute checksums: %s", err)
+	}
+
+	if strings.HasPrefix(url, fileScheme) {
+		return refreshStoredFile(pth, url, checksums.sha256)
+	}
+	if strings.HasPrefix(url, s3Scheme) {
+		return refreshS3Object(pth, url, checksums.sha256)
+	}
+	if strings.HasPrefix(url, httpScheme) {
+		return refreshStoredHTTPFile(pth, url, checksums.sha256)
+	}
+	return false, fmt.Errorf("storage backend does not provide the checksums of the stored files")
+}
+
+// cacheAPIErrorMessage returns the error message of a rejected request to the Bitrise cache API from the response body.
+func cacheAPIErrorMessage(body []byte) string {
+	var respModel map[string]interface{}
+	if err := json.Unmarshal(body, &respModel); err == nil {
+		for _, key := range []string{"error_msg", "message", "error"} {
+			if msg, ok := respModel[key].(string); ok && msg != "" {
+				return msg
+			}
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// uploadTTLDays is the TTL of the uploaded cache in days, sent to the storage as a retention hint, 0 sends no TTL.
+// It is configured by the step inputs.
+var uploadTTLDays int
+
+// uploadURLRequest is the body of the upload url request of the Bitrise cache API.
+type uploadURLRequest struct {
+	FileSizeInBytes int64  `json:"file_size_in_bytes"`
+	TTLInDays       int    `json:"ttl_in_days,omitempty"`
+	CacheKey        string `json:"cache_key,omitempty"`
+}
+
 // getCacheUploadURL requests an upload url from the Bitrise cache API server.
+// The request sends the size of the archive before it is uploaded, so that the archives the cache API does not accept
+// (for example exceeding the limit of the plan) fail without uploading them.
 func getCacheUploadURL(cacheAPIURL string, fileSizeInBytes int64) (string, error) {
-	req, err := http.NewRequest(http.MethodPost, cacheAPIURL, bytes.NewReader([]byte(fmt.Sprintf(`{"file_size_in_bytes": %d}`, fileSizeInBytes))))
+	body, err := json.Marshal(uploadURLRequest{FileSizeInBytes: fileSizeInBytes, TTLInDays: uploadTTLDays, CacheKey: cacheKey})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, cacheAPIURL, bytes.NewReader(body))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %s", err)
 	}
 
-	resp, err := (&http.Client{Timeout: 20 * time.Second}).Do(req)
+	client := uploadHTTPClient()
+	client.Timeout = 20 * time.Second
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %s", err)
+		return "", newRequestError("failed to send upload url request: %s", err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -228,12 +709,19 @@ func getCacheUploadURL(cacheAPIURL string, fileSizeInBytes int64) (string, error
 	}()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 202 {
-		return "", fmt.Errorf("upload url was rejected with status code: %d", resp.StatusCode)
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if resp.StatusCode == http.StatusRequestEntityTooLarge || resp.StatusCode == http.StatusUnprocessableEntity {
+			return "", fmt.Errorf("cache API does not accept the archive of %d bytes / %.2f MB (status code: %d): %s", fileSizeInBytes, float64(fileSizeInBytes)/1024.0/1024.0, resp.StatusCode, cacheAPIErrorMessage(body))
+		}
+		if msg := cacheAPIErrorMessage(body); msg != "" {
+			log.Warnf("Upload url request was rejected: %s", msg)
+		}
+		return "", newStatusError("upload url was rejected with status code: %d", resp.StatusCode)
 	}
 
 	var respModel map[string]string
 	if err := json.NewDecoder(resp.Body).Decode(&respModel); err != nil {
-		return "", fmt.Errorf("failed to decode response body: %s", err)
+		return "", newRequestError("failed to decode response body: %s", err)
 	}
 
 	uploadURL, ok := respModel["upload_url"]
@@ -247,7 +735,8 @@ func getCacheUploadURL(cacheAPIURL string, fileSizeInBytes int64) (string, error
 // tryToUploadArchive performs the cache upload.
 // If the destination is a local file path (url has a file:// scheme) this function copies the cache archive file to the destination.
 // Otherwise destination should be a remote url.
-func tryToUploadArchiveFile(uploadURL string, archiveFilePath string) error {
+// The Content-MD5 header is sent if checksums is not nil, the other checksum headers are not signed by the presigned upload urls.
+func tryToUploadArchiveFile(uploadURL string, archiveFilePath string, checksums *contentChecksums) error {
 	archFile, err := os.Open(archiveFilePath)
 	if err != nil {
 		return fmt.Errorf("failed to open archive file for upload (%s): %s", archiveFilePath, err)
@@ -269,21 +758,31 @@ func tryToUploadArchiveFile(uploadURL string, archiveFilePath string) error {
 	}
 	fileSize := fileInfo.Size()
 
-	req, err := http.NewRequest(http.MethodPut, uploadURL, archFile)
+	req, err := http.NewRequest(http.MethodPut, uploadURL, newProgressReader(archFile, archiveFilePath, fileSize))
 	if err != nil {
 		return fmt.Errorf("failed to create upload request: %s", err)
 	}
 
 	req.Header.Add("Content-Length", strconv.FormatInt(fileSize, 10))
 	req.ContentLength = fileSize
+	checksums.setContentMD5(req.Header)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := uploadHTTPClient().Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to upload: %s", err)
+		return newRequestError("failed to upload: %s", err)
 	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("upload failed with status code: %d", resp.StatusCode)
+		// Some of the storages respond to the expired upload urls with 400 instead of 403.
+		if body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096)); err == nil && isExpiredResponse(string(body)) {
+			return &uploadError{err: fmt.Errorf("upload url expired, upload failed with status code: %d", resp.StatusCode), retryable: true, expired: true}
+		}
+		return newStatusError("upload failed with status code: %d", resp.StatusCode)
 	}
 
 	fileClosed = true
@@ -292,12 +791,12 @@ func tryToUploadArchiveFile(uploadURL string, archiveFilePath string) error {
 }
 
 func tryToUploadArchiveReader(uploadURL string, archiveReader io.Reader) error {
-	req, err := http.NewRequest(http.MethodPut, uploadURL, archiveReader)
+	req, err := http.NewRequest(http.MethodPut, uploadURL, newProgressReader(archiveReader, cacheArchivePath, 0))
 	if err != nil {
 		return fmt.Errorf("failed to create upload request: %s", err)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := uploadHTTPClient().Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to upload: %s", err)
 	}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bitrise-io/go-utils/pathutil"
 )
@@ -19,35 +27,72 @@ func (writer nopWriteCloser) Close() error {
 
 func TestNewArchive(t *testing.T) {
 	tests := []struct {
-		name     string
-		compress bool
-		wantGzip bool
-		wantErr  bool
+		name           string
+		format         ArchiveFormat
+		compression    CompressionMethod
+		wantCompressor bool
+		wantErr        bool
 	}{
 		{
-			name:     "no compress",
-			compress: false,
-			wantGzip: false,
-			wantErr:  false,
+			name:           "no compress",
+			compression:    NONE,
+			wantCompressor: false,
+			wantErr:        false,
 		},
 		{
-			name:     "compress",
-			compress: true,
-			wantGzip: true,
-			wantErr:  false,
+			name:           "gzip",
+			compression:    GZIP,
+			wantCompressor: true,
+			wantErr:        false,
+		},
+		{
+			name:           "zstd",
+			compression:    ZSTD,
+			wantCompressor: true,
+			wantErr:        false,
+		},
+		{
+			name:           "lz4",
+			compression:    LZ4,
+			wantCompressor: true,
+			wantErr:        false,
+		},
+		{
+			name:           "zip with unsupported method",
+			format:         ZIP,
+			compression:    ZSTD,
+			wantCompressor: false,
+			wantErr:        true,
+		},
+		{
+			name:           "squashfs into stream",
+			format:         SQUASHFS,
+			compression:    GZIP,
+			wantCompressor: false,
+			wantErr:        true,
+		},
+		{
+			name:           "unknown method",
+			compression:    CompressionMethod("unknown"),
+			wantCompressor: false,
+			wantErr:        true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			var writer nopWriteCloser
-			got, err := NewArchive(writer, tt.compress)
+			format := tt.format
+			if format == "" {
+				format = TAR
+			}
+			got, err := NewArchive(writer, format, Compression{Method: tt.compression})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("NewArchive() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			hasGzip := got != nil && got.gzip != nil
-			if tt.wantGzip != hasGzip {
-				t.Errorf("NewArchive() has gzip = %v, want %v", hasGzip, tt.wantGzip)
+			hasCompressor := got != nil && got.compressor != nil
+			if tt.wantCompressor != hasCompressor {
+				t.Errorf("NewArchive() has compressor = %v, want %v", hasCompressor, tt.wantCompressor)
 			}
 		})
 	}
@@ -65,7 +110,7 @@ func TestArchive_Write(t *testing.T) {
 	t.Log("no compress")
 	{
 		var writer nopWriteCloser
-		archive, err := NewArchive(writer, false)
+		archive, err := NewArchive(writer, TAR, Compression{Method: NONE})
 		if err != nil {
 			t.Fatalf("failed to create archive: %s", err)
 		}
@@ -78,7 +123,7 @@ func TestArchive_Write(t *testing.T) {
 	t.Log("compress")
 	{
 		var writer nopWriteCloser
-		archive, err := NewArchive(writer, true)
+		archive, err := NewArchive(writer, TAR, Compression{Method: GZIP})
 		if err != nil {
 			t.Fatalf("failed to create archive: %s", err)
 		}
@@ -99,7 +144,7 @@ func TestArchive_WriteHeader(t *testing.T) {
 	createDirStruct(t, map[string]string{fileToArchive: ""})
 
 	var writer nopWriteCloser
-	archive, err := NewArchive(writer, false)
+	archive, err := NewArchive(writer, TAR, Compression{Method: NONE})
 	if err != nil {
 		t.Fatalf("failed to create archive: %s", err)
 	}
@@ -121,7 +166,7 @@ func TestArchive_Close(t *testing.T) {
 	t.Log("no compress")
 	{
 		var writer nopWriteCloser
-		archive, err := NewArchive(writer, false)
+		archive, err := NewArchive(writer, TAR, Compression{Method: NONE})
 		if err != nil {
 			t.Fatalf("failed to create archive: %s", err)
 		}
@@ -138,7 +183,23 @@ func TestArchive_Close(t *testing.T) {
 	t.Log("compress")
 	{
 		var writer nopWriteCloser
-		archive, err := NewArchive(writer, true)
+		archive, err := NewArchive(writer, TAR, Compression{Method: GZIP})
+		if err != nil {
+			t.Fatalf("failed to create archive: %s", err)
+		}
+
+		if err := archive.Write([]string{fileToArchive}, false); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+
+		if err := archive.Close(); err != nil {
+			t.Fatalf("failed to close archive: %s", err)
+		}
+	}
+	t.Log("zstd")
+	{
+		var writer nopWriteCloser
+		archive, err := NewArchive(writer, TAR, Compression{Method: ZSTD})
 		if err != nil {
 			t.Fatalf("failed to create archive: %s", err)
 		}
@@ -152,3 +213,332 @@ func TestArchive_Close(t *testing.T) {
 		}
 	}
 }
+
+func TestArchive_Size(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	fileToArchive := filepath.Join(tmpDir, "file")
+	createDirStruct(t, map[string]string{fileToArchive: strings.Repeat("content", 1024)})
+
+	for _, method := range []CompressionMethod{NONE, GZIP, ZSTD} {
+		t.Run(string(method), func(t *testing.T) {
+			var writer bufferWriteCloser
+			archive, err := NewArchive(&writer, TAR, Compression{Method: method})
+			if err != nil {
+				t.Fatalf("failed to create archive: %s", err)
+			}
+
+			if err := archive.Write([]string{fileToArchive}, false); err != nil {
+				t.Fatalf("failed to write archive: %s", err)
+			}
+
+			if err := archive.Close(); err != nil {
+				t.Fatalf("failed to close archive: %s", err)
+			}
+
+			uncompressed, compressed := archive.Size()
+			if compressed != int64(writer.Len()) {
+				t.Errorf("compressed size = %d, want %d", compressed, writer.Len())
+			}
+			if method == NONE && uncompressed != compressed {
+				t.Errorf("uncompressed size = %d, want %d", uncompressed, compressed)
+			}
+			if method != NONE && uncompressed <= compressed {
+				t.Errorf("uncompressed size = %d, want greater than compressed size %d", uncompressed, compressed)
+			}
+		})
+	}
+}
+
+func TestArchive_zip(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	compressedFile := filepath.Join(tmpDir, "compressed")
+	storedFile := filepath.Join(tmpDir, "stored")
+	content := strings.Repeat("content", 1024)
+	createDirStruct(t, map[string]string{compressedFile: content, storedFile: content})
+
+	var writer bufferWriteCloser
+	archive, err := NewArchive(&writer, ZIP, Compression{Method: GZIP})
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	archive.stored = map[string]bool{storedFile: true}
+
+	if err := archive.Write([]string{compressedFile, storedFile}, false); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	if err := archive.WriteHeader(map[string]string{compressedFile: "-"}, cacheInfoFilePath); err != nil {
+		t.Fatalf("failed to write header: %s", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(writer.Bytes()), int64(writer.Len()))
+	if err != nil {
+		t.Fatalf("failed to read zip archive: %s", err)
+	}
+
+	wantMethods := map[string]uint16{
+		strings.TrimPrefix(compressedFile, "/"):    zip.Deflate,
+		strings.TrimPrefix(storedFile, "/"):        zip.Store,
+		strings.TrimPrefix(cacheInfoFilePath, "/"): zip.Deflate,
+	}
+	if len(reader.File) != len(wantMethods) {
+		t.Fatalf("number of entries = %d, want %d", len(reader.File), len(wantMethods))
+	}
+	for _, file := range reader.File {
+		if want, ok := wantMethods[file.Name]; !ok || file.Method != want {
+			t.Errorf("entry %s method = %d, want %d", file.Name, file.Method, want)
+		}
+		if file.Name == strings.TrimPrefix(cacheInfoFilePath, "/") {
+			continue
+		}
+
+		entry, err := file.Open()
+		if err != nil {
+			t.Fatalf("failed to open entry %s: %s", file.Name, err)
+		}
+		got, err := ioutil.ReadAll(entry)
+		if err != nil {
+			t.Fatalf("failed to read entry %s: %s", file.Name, err)
+		}
+		if string(got) != content {
+			t.Errorf("entry %s content does not match the written content", file.Name)
+		}
+	}
+}
+
+func TestArchive_longPaths(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	// Path components are limited by the file system (usually to 255 characters), the paths are not.
+	component := strings.Repeat("node_modules", 20)
+	contentByPth := map[string]string{}
+	var pths []string
+	for _, depth := range []int{1, 2, 5} {
+		pth := filepath.Join(tmpDir, strings.TrimSuffix(strings.Repeat(component+"/", depth), "/"), "file")
+		contentByPth[pth] = pth
+		pths = append(pths, pth)
+	}
+	createDirStruct(t, contentByPth)
+
+	link := filepath.Join(tmpDir, "link")
+	if err := os.Symlink(pths[len(pths)-1], link); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+	pths = append(pths, link)
+
+	var writer bufferWriteCloser
+	archive, err := NewArchive(&writer, TAR, Compression{Method: NONE})
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	if err := archive.Write(pths, false); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+
+	reader := tar.NewReader(&writer)
+	for _, pth := range pths {
+		header, err := reader.Next()
+		if err != nil {
+			t.Fatalf("failed to read header: %s", err)
+		}
+		if header.Name != pth {
+			t.Errorf("header name = %s (%d characters), want %s (%d characters)", header.Name, len(header.Name), pth, len(pth))
+		}
+		if pth == link {
+			if header.Linkname != pths[len(pths)-2] {
+				t.Errorf("header link name = %s, want %s", header.Linkname, pths[len(pths)-2])
+			}
+			continue
+		}
+
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("failed to read content: %s", err)
+		}
+		if string(content) != contentByPth[pth] {
+			t.Errorf("content of %s does not match the written content", pth)
+		}
+	}
+}
+
+// fileInfo is an os.FileInfo of a file which does not exist.
+type fileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (info fileInfo) Name() string       { return info.name }
+func (info fileInfo) Size() int64        { return info.size }
+func (info fileInfo) Mode() os.FileMode  { return 0644 }
+func (info fileInfo) ModTime() time.Time { return time.Unix(0, 0) }
+func (info fileInfo) IsDir() bool        { return false }
+func (info fileInfo) Sys() interface{}   { return nil }
+
+func TestArchive_hugeFile(t *testing.T) {
+	var writer bufferWriteCloser
+	archive, err := NewArchive(&writer, TAR, Compression{Method: NONE})
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+
+	// USTAR headers can not store sizes of 8GB or more.
+	size := int64(9) << 30
+	if _, err := archive.createEntry("/huge", fileInfo{name: "huge", size: size}, "", false, nil); err != nil {
+		t.Fatalf("failed to create entry: %s", err)
+	}
+
+	header, err := tar.NewReader(&writer).Next()
+	if err != nil {
+		t.Fatalf("failed to read header: %s", err)
+	}
+	if header.Size != size {
+		t.Errorf("header size = %d, want %d", header.Size, size)
+	}
+	if header.Format != tar.FormatPAX {
+		t.Errorf("header format = %s, want %s", header.Format, tar.FormatPAX)
+	}
+}
+
+func TestArchive_reproducible(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pths := []string{filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b")}
+	createDirStruct(t, map[string]string{
+		pths[0]: "a",
+		pths[1]: "b",
+	})
+
+	for _, format := range []ArchiveFormat{TAR, ZIP} {
+		t.Run(string(format), func(t *testing.T) {
+			var archives [][]byte
+			for _, modTime := range []time.Time{time.Unix(1000, 0), time.Unix(2000, 500)} {
+				for _, pth := range pths {
+					if err := os.Chtimes(pth, modTime, modTime); err != nil {
+						t.Fatalf("failed to change times: %s", err)
+					}
+				}
+
+				var writer bufferWriteCloser
+				archive, err := NewArchive(&writer, format, Compression{Method: GZIP})
+				if err != nil {
+					t.Fatalf("failed to create archive: %s", err)
+				}
+				archive.reproducible = true
+				if err := archive.Write(pths, false); err != nil {
+					t.Fatalf("failed to write archive: %s", err)
+				}
+				if err := archive.writeData([]byte("data"), cacheInfoFilePath); err != nil {
+					t.Fatalf("failed to write data: %s", err)
+				}
+				if err := archive.Close(); err != nil {
+					t.Fatalf("failed to close archive: %s", err)
+				}
+				archives = append(archives, writer.Bytes())
+			}
+
+			if !bytes.Equal(archives[0], archives[1]) {
+				t.Errorf("archives of identical files with different modification times are different")
+			}
+		})
+	}
+}
+
+func TestArchive_normalizeHeader(t *testing.T) {
+	owner := &entryOwner{uid: 501, gid: 20, uname: "builder", gname: "staff"}
+	header := tar.Header{
+		Mode:       04755,
+		Uid:        0,
+		Gid:        0,
+		Uname:      "root",
+		Gname:      "wheel",
+		ModTime:    time.Unix(1000, 0),
+		AccessTime: time.Unix(2000, 0),
+	}
+
+	tests := []struct {
+		name    string
+		archive Archive
+		want    tar.Header
+	}{
+		{
+			name:    "preserve",
+			archive: Archive{},
+			want:    header,
+		},
+		{
+			name:    "owner",
+			archive: Archive{owner: owner},
+			want:    tar.Header{Mode: 04755, Uid: 501, Gid: 20, Uname: "builder", Gname: "staff", ModTime: header.ModTime, AccessTime: header.AccessTime},
+		},
+		{
+			name:    "strip setuid",
+			archive: Archive{stripSetuid: true},
+			want:    tar.Header{Mode: 0755, Uname: "root", Gname: "wheel", ModTime: header.ModTime, AccessTime: header.AccessTime},
+		},
+		{
+			name:    "reproducible with owner",
+			archive: Archive{reproducible: true, owner: owner},
+			want:    tar.Header{Mode: 04755, Uid: 501, Gid: 20, Uname: "builder", Gname: "staff", ModTime: reproducibleModTime},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := header
+			tt.archive.normalizeHeader(&got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeHeader() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchive_writeTombstones(t *testing.T) {
+	var writer bufferWriteCloser
+	archive, err := NewArchive(&writer, TAR, Compression{Method: NONE})
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	if err := archive.writeTombstones([]string{"/path/to/removed/a", "/path/to/removed/b"}, cacheTombstonesPath); err != nil {
+		t.Fatalf("failed to write tombstones: %s", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+
+	reader := tar.NewReader(&writer)
+	header, err := reader.Next()
+	if err != nil {
+		t.Fatalf("failed to read header: %s", err)
+	}
+	if header.Name != cacheTombstonesPath {
+		t.Errorf("entry name = %s, want %s", header.Name, cacheTombstonesPath)
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read content: %s", err)
+	}
+	if want := `["/path/to/removed/a","/path/to/removed/b"]`; string(content) != want {
+		t.Errorf("tombstones = %s, want %s", content, want)
+	}
+}
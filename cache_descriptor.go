@@ -2,36 +2,107 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/bitrise-io/go-utils/fileutil"
 	"github.com/bitrise-io/go-utils/log"
 	"github.com/bitrise-io/go-utils/pathutil"
 )
 
+// SymlinkFingerprint ...
+type SymlinkFingerprint string
+
+const (
+	// SYMLINKTARGET fingerprints a symlink by the path of its target.
+	SYMLINKTARGET = SymlinkFingerprint("target")
+	// SYMLINKCONTENT fingerprints a symlink by its target's content, as the target file.
+	SYMLINKCONTENT = SymlinkFingerprint("content")
+)
+
+// InvalidationPolicy ...
+type InvalidationPolicy string
+
+const (
+	// INVALIDATEANY pushes a new cache on any change.
+	INVALIDATEANY = InvalidationPolicy("any")
+	// INDICATORONLY pushes a new cache on the changes of the indicators only, ignoring the files without an indicator.
+	INDICATORONLY = InvalidationPolicy("indicator-only")
+	// NEVERSHRINK pushes a new cache on the changed and added files only, ignoring the removed files.
+	NEVERSHRINK = InvalidationPolicy("never-shrink")
+)
+
 // ChangeIndicator ...
 type ChangeIndicator string
 
 const (
 	// MD5 ...
 	MD5 = ChangeIndicator("file-content-hash")
+	// XXH64 ...
+	XXH64 = ChangeIndicator("file-content-hash-xxh64")
+	// BLAKE3 ...
+	BLAKE3 = ChangeIndicator("file-content-hash-blake3")
+	// SHA256 ...
+	SHA256 = ChangeIndicator("file-content-hash-sha256")
 	// MODTIME ...
 	MODTIME = ChangeIndicator("file-mod-time")
+	// SIZEMODTIME fingerprints the size and the modification time (in seconds) of the files, without reading them.
+	SIZEMODTIME = ChangeIndicator("file-size-mod-time")
+	// MODTIMECONTENT fingerprints the size and the content of the files, only hashing the files whose modification time changed.
+	MODTIMECONTENT = ChangeIndicator("file-mod-time-content")
 )
 
+// isChangeIndicator reports whether method is the name of a fingerprint method.
+func isChangeIndicator(method string) bool {
+	switch ChangeIndicator(method) {
+	case MD5, XXH64, BLAKE3, SHA256, MODTIME, SIZEMODTIME, MODTIMECONTENT:
+		return true
+	}
+	return false
+}
+
+// contentHashes maps the fingerprint methods hashing the content of the files to their hash functions.
+var contentHashes = map[ChangeIndicator]func() hash.Hash{
+	MD5:    md5.New,
+	XXH64:  newXXH64,
+	BLAKE3: newBlake3,
+	SHA256: sha256.New,
+}
+
 // result stores how the keys are different in two cache descriptor.
 type result struct {
 	removedIgnored []string
 	removed        []string
 	changed        []string
-	matching       []string
-	addedIgnored   []string
-	added          []string
+	// matching counts the files which did not change, the unchanged directories are not walked to list them.
+	matching     int
+	addedIgnored []string
+	added        []string
+	// moved lists the removed files added to another path with the same fingerprint, they are in removed and added too.
+	moved []fileMove
+	// changedBytes is the total size of the removed, changed and added files, except the moved ones.
+	changedBytes int64
+}
+
+// fileMove is a file moved (or renamed) from one path to another.
+type fileMove struct {
+	from string
+	to   string
 }
 
 // hasChanges reports whether a new cache needs to be generated or not.
@@ -39,72 +110,345 @@ func (r result) hasChanges() bool {
 	return len(r.removed) > 0 || len(r.changed) > 0 || len(r.added) > 0
 }
 
+// changedFiles returns the number of the removed, changed and added files, a moved file counts once.
+func (r result) changedFiles() int {
+	return len(r.removed) + len(r.changed) + len(r.added) - len(r.moved)
+}
+
+// belowThresholds reports whether the changes are too few to push a new cache:
+// neither more than minFiles files nor more than minBytes bytes changed, a zero threshold is disabled.
+// Any change is enough if both of the thresholds are disabled.
+func (r result) belowThresholds(minFiles int, minBytes int64) bool {
+	if minFiles == 0 && minBytes == 0 {
+		return false
+	}
+	if minFiles > 0 && r.changedFiles() > minFiles {
+		return false
+	}
+	if minBytes > 0 && r.changedBytes > minBytes {
+		return false
+	}
+	return true
+}
+
 // compare compares two cache descriptor file and return the differences.
-func compare(old map[string]string, new map[string]string) (r result) {
-	newCopy := make(map[string]string, len(new))
-	for k, v := range new {
-		newCopy[k] = v
+// The descriptors are compared as trees of directory digests, the directories with the same digest are not compared file by file.
+// The removed files are sized by oldSizes, the changed and added files by newSizes,
+// the files missing from the sizes, such as of a cache written before the sizes were recorded, count as empty.
+func compare(old map[string]string, new map[string]string, oldSizes map[string]int64, newSizes map[string]int64) (r result) {
+	r.compareTrees(newDescriptorTree(old), newDescriptorTree(new), "", oldSizes, newSizes)
+	r.detectMoves(old, new, oldSizes, newSizes)
+	return
+}
+
+// ignoreRemovals moves the removed files to the ignored removed files, for the never-shrink invalidation policy,
+// the moved files count as added.
+func (r *result) ignoreRemovals(oldSizes, newSizes map[string]int64) {
+	moved := map[string]bool{}
+	for _, move := range r.moved {
+		moved[move.from] = true
+		r.changedBytes += newSizes[move.to]
+	}
+	for _, pth := range r.removed {
+		if !moved[pth] {
+			r.changedBytes -= oldSizes[pth]
+		}
+	}
+	r.removedIgnored = append(r.removedIgnored, r.removed...)
+	r.removed = nil
+	r.moved = nil
+}
+
+// detectMoves pairs the removed and the added files of the same fingerprint as moves, such as the files of a renamed directory.
+// Only the fingerprints of exactly one removed and one added file are paired,
+// the fingerprints shared by many files, such as of a lock file or a modification time, are ambiguous.
+func (r *result) detectMoves(old, new map[string]string, oldSizes, newSizes map[string]int64) {
+	removedByFingerprint := map[string][]string{}
+	for _, pth := range r.removed {
+		removedByFingerprint[old[pth]] = append(removedByFingerprint[old[pth]], pth)
+	}
+	addedByFingerprint := map[string][]string{}
+	for _, pth := range r.added {
+		addedByFingerprint[new[pth]] = append(addedByFingerprint[new[pth]], pth)
+	}
+
+	for fingerprint, removed := range removedByFingerprint {
+		added := addedByFingerprint[fingerprint]
+		if len(removed) != 1 || len(added) != 1 {
+			continue
+		}
+		r.moved = append(r.moved, fileMove{from: removed[0], to: added[0]})
+		r.changedBytes -= oldSizes[removed[0]] + newSizes[added[0]]
+	}
+	sort.Slice(r.moved, func(i, j int) bool { return r.moved[i].to < r.moved[j].to })
+}
+
+// newDescriptorTree creates the tree of the fingerprints of descriptor, split by the path separator.
+func newDescriptorTree(descriptor map[string]string) *compositeTree {
+	tree := newCompositeTree()
+	for pth, fingerprint := range descriptor {
+		tree.add(pth, fingerprint)
+	}
+	return tree
+}
+
+// compareTrees adds the differences of the old and the new tree of the directory at prefix to r,
+// either of them is nil if the directory does not exist in the descriptor.
+func (r *result) compareTrees(old, new *compositeTree, prefix string, oldSizes, newSizes map[string]int64) {
+	if old != nil && new != nil && old.digest() == new.digest() {
+		r.matching += old.fileCount()
+		return
+	}
+	if old == nil {
+		old = newCompositeTree()
+	}
+	if new == nil {
+		new = newCompositeTree()
 	}
 
-	for oldPth, oldIndicator := range old {
-		newIndicator, ok := newCopy[oldPth]
+	for name, oldIndicator := range old.files {
+		pth := filepath.FromSlash(prefix + name)
+		newIndicator, ok := new.files[name]
 		switch {
 		case !ok && oldIndicator == "-":
-			r.removedIgnored = append(r.removedIgnored, oldPth)
+			r.removedIgnored = append(r.removedIgnored, pth)
 		case !ok:
-			r.removed = append(r.removed, oldPth)
+			r.removed = append(r.removed, pth)
+			r.changedBytes += oldSizes[pth]
 		case oldIndicator != newIndicator:
-			r.changed = append(r.changed, oldPth)
+			r.changed = append(r.changed, pth)
+			r.changedBytes += newSizes[pth]
 		default:
-			r.matching = append(r.matching, oldPth)
+			r.matching++
 		}
-
-		delete(newCopy, oldPth)
 	}
-
-	for newPth, newIndicator := range newCopy {
+	for name, newIndicator := range new.files {
+		if _, ok := old.files[name]; ok {
+			continue
+		}
+		pth := filepath.FromSlash(prefix + name)
 		if newIndicator == "-" {
-			r.addedIgnored = append(r.addedIgnored, newPth)
+			r.addedIgnored = append(r.addedIgnored, pth)
 		} else {
-			r.added = append(r.added, newPth)
+			r.added = append(r.added, pth)
+			r.changedBytes += newSizes[pth]
 		}
 	}
 
-	return
+	for name, oldDir := range old.dirs {
+		r.compareTrees(oldDir, new.dirs[name], prefix+name+"/", oldSizes, newSizes)
+	}
+	for name, newDir := range new.dirs {
+		if _, ok := old.dirs[name]; !ok {
+			r.compareTrees(nil, newDir, prefix+name+"/", oldSizes, newSizes)
+		}
+	}
 }
 
 // cacheDescriptor creates a cache descriptor for a given cache_path - change_indicator_path mapping.
-func cacheDescriptor(indicatorByCachePth map[string]string, method ChangeIndicator) (map[string]string, error) {
-	descriptor := map[string]string{}
-	for pth, indicatorPth := range indicatorByCachePth {
-		if len(indicatorPth) == 0 {
-			// this file's changes does not fluctuates existing cache invalidation
-			descriptor[pth] = "-"
-			continue
-		}
+// The fingerprints are computed by at most workers goroutines; if any of them fails,
+// the error of the first failed path in lexical order is returned, so that the result does not depend on the scheduling.
+// The paths in methodByCachePth are fingerprinted with their own method instead of method,
+// and the symlinks are fingerprinted as specified by symlinks.
+// The permission bits of the indicator files are fingerprinted as well if modes is true.
+// The content fingerprints are reused from fingerprints if it is not nil.
+func cacheDescriptor(indicatorByCachePth map[string]string, method ChangeIndicator, methodByCachePth map[string]ChangeIndicator, symlinks SymlinkFingerprint, modes bool, workers int, fingerprints *fingerprintCache) (map[string]string, error) {
+	pths := make([]string, 0, len(indicatorByCachePth))
+	for pth := range indicatorByCachePth {
+		pths = append(pths, pth)
+	}
+	sort.Strings(pths)
 
-		indicator, err := readlinkOrEmptyIfInval(indicatorPth)
-		if err != nil {
-			return nil, err
+	// The indicator shared by many paths, such as a lock file or a git indicator, is fingerprinted once per method.
+	type indicatorJob struct {
+		indicatorPth string
+		method       ChangeIndicator
+	}
+	var jobList []indicatorJob
+	indexByJob := map[indicatorJob]int{}
+	jobOf := func(pth string) indicatorJob {
+		job := indicatorJob{indicatorPth: indicatorByCachePth[pth], method: method}
+		if pthMethod, ok := methodByCachePth[pth]; ok {
+			job.method = pthMethod
 		}
+		return job
+	}
+	for _, pth := range pths {
+		job := jobOf(pth)
+		if _, ok := indexByJob[job]; !ok {
+			indexByJob[job] = len(jobList)
+			jobList = append(jobList, job)
+		}
+	}
 
-		if indicator == "" {
-			if method == MD5 {
-				indicator, err = fileContentHash(indicatorPth)
-			} else {
-				indicator, err = fileModtime(indicatorPth)
-			}
-			if err != nil {
-				return nil, err
+	if workers < 1 {
+		workers = 1
+	}
+	indicators := make([]string, len(jobList))
+	errs := make([]error, len(jobList))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(jobList); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				indicators[i], errs[i] = fileIndicator(jobList[i].indicatorPth, jobList[i].method, symlinks, fingerprints)
+				if modes && errs[i] == nil {
+					indicators[i], errs[i] = withFileMode(jobList[i].indicatorPth, indicators[i], symlinks)
+				}
 			}
-		} else {
-			indicator = "symlink: " + indicator
+		}()
+	}
+	for i := range jobList {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	descriptor := make(map[string]string, len(pths))
+	for _, pth := range pths {
+		i := indexByJob[jobOf(pth)]
+		if errs[i] != nil {
+			return nil, errs[i]
 		}
-		descriptor[pth] = indicator
+		descriptor[pth] = indicators[i]
 	}
 	return descriptor, nil
 }
 
+// fileIndicator returns the fingerprint of the change indicator file at indicatorPth.
+func fileIndicator(indicatorPth string, method ChangeIndicator, symlinks SymlinkFingerprint, fingerprints *fingerprintCache) (string, error) {
+	if len(indicatorPth) == 0 {
+		// this file's changes does not fluctuates existing cache invalidation
+		return "-", nil
+	}
+
+	if name, ok, err := parseEnvIndicator(indicatorPth); ok {
+		if err != nil {
+			return "", err
+		}
+		return envIndicator(name), nil
+	}
+	if cmd, ok, err := parseCmdIndicator(indicatorPth); ok {
+		if err != nil {
+			return "", err
+		}
+		return cmdIndicator(cmd)
+	}
+	if target, ok := parseGitIndicator(indicatorPth); ok {
+		return gitIndicator(target)
+	}
+	if strings.HasPrefix(indicatorPth, multiFileIndicatorPrefix) {
+		return multiFileIndicator(indicatorPth, method, symlinks, fingerprints)
+	}
+
+	indicator, err := readlinkOrEmptyIfInval(indicatorPth)
+	if err != nil {
+		return "", err
+	}
+	if indicator != "" {
+		// A broken symlink or a symlink to a directory has no content to fingerprint
+		if info, err := os.Stat(indicatorPth); symlinks != SYMLINKCONTENT || err != nil || info.IsDir() {
+			return "symlink: " + indicator, nil
+		}
+	}
+
+	if newHash, ok := contentHashes[method]; ok {
+		return fingerprints.fingerprint(indicatorPth, method, func() (string, error) {
+			return fileContentHash(indicatorPth, newHash)
+		})
+	}
+	if method == MODTIMECONTENT {
+		// The fingerprint cache reuses the hash until the modification time moves,
+		// a file touched without changing its content keeps the same fingerprint.
+		return fingerprints.fingerprint(indicatorPth, method, func() (string, error) {
+			return fileSizeAndContentHash(indicatorPth)
+		})
+	}
+	if method == SIZEMODTIME {
+		return fileSizeModtime(indicatorPth)
+	}
+	return fileModtime(indicatorPth)
+}
+
+// isFileIndicator reports whether indicator is the path of an indicator file, rather than an env, a command, a git or a multi-file indicator.
+func isFileIndicator(indicator string) bool {
+	if _, ok, _ := parseEnvIndicator(indicator); ok {
+		return false
+	}
+	if _, ok, _ := parseCmdIndicator(indicator); ok {
+		return false
+	}
+	if _, ok := parseGitIndicator(indicator); ok {
+		return false
+	}
+	return indicator != "" && !strings.HasPrefix(indicator, multiFileIndicatorPrefix)
+}
+
+// withFileMode appends the permission bits of the indicator file to its fingerprint,
+// so that a file made executable without changing its content changes.
+// The symlinks fingerprinted by their target have no permission bits of their own.
+func withFileMode(indicatorPth, fingerprint string, symlinks SymlinkFingerprint) (string, error) {
+	if !isFileIndicator(indicatorPth) {
+		return fingerprint, nil
+	}
+
+	info, err := os.Lstat(indicatorPth)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if symlinks != SYMLINKCONTENT {
+			return fingerprint, nil
+		}
+		// A broken symlink or a symlink to a directory is fingerprinted by its target
+		if info, err = os.Stat(indicatorPth); err != nil || info.IsDir() {
+			return fingerprint, nil
+		}
+	}
+	return fmt.Sprintf("%s-%04o", fingerprint, info.Mode().Perm()), nil
+}
+
+// cacheSize returns the total size of the regular files in pths, used to estimate the cache archive's size.
+func cacheSize(pths []string) (int64, error) {
+	var size int64
+	for _, pth := range pths {
+		info, err := os.Lstat(pth)
+		if err != nil {
+			return 0, err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
+
+// fileSizes returns the sizes of the regular files in pths, recorded next to the cache descriptor.
+func fileSizes(pths []string) (map[string]int64, error) {
+	sizes := make(map[string]int64, len(pths))
+	for _, pth := range pths {
+		info, err := os.Lstat(pth)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().IsRegular() {
+			sizes[pth] = info.Size()
+		}
+	}
+	return sizes, nil
+}
+
+// totalSize returns the total of sizes, the size of the cache paths the sizes are recorded for.
+func totalSize(sizes map[string]int64) int64 {
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
+
 func readlinkOrEmptyIfInval(pth string) (string, error) {
 	link, err := os.Readlink(pth)
 	if err != nil {
@@ -124,8 +468,8 @@ func readlinkOrEmptyIfInval(pth string) (string, error) {
 	return link, err
 }
 
-// fileContentHash returns file's md5 content hash.
-func fileContentHash(pth string) (string, error) {
+// fileContentHash returns file's content hash computed with the given hash function.
+func fileContentHash(pth string, newHash func() hash.Hash) (string, error) {
 	f, err := os.Open(pth)
 	if err != nil {
 		return "", err
@@ -137,7 +481,7 @@ func fileContentHash(pth string) (string, error) {
 		}
 	}()
 
-	h := md5.New()
+	h := newHash()
 	if _, err := io.Copy(h, f); err != nil {
 		return "", err
 	}
@@ -145,33 +489,233 @@ func fileContentHash(pth string) (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
+// modTimeSeconds returns the file's modification time truncated to seconds, the precision of the fingerprints:
+// ext4 and APFS store nanoseconds, but HFS+ and the squashfs and zip archives only store seconds,
+// so the same file restored by the Cache Pull step on another stack gets the same fingerprint.
+func modTimeSeconds(fi os.FileInfo) int64 {
+	return fi.ModTime().Unix()
+}
+
+// fileSizeModtime returns file's size and modification time in seconds.
+func fileSizeModtime(pth string) (string, error) {
+	fi, err := os.Stat(pth)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", fi.Size(), modTimeSeconds(fi)), nil
+}
+
+// fileSizeAndContentHash returns file's size and xxHash64 content hash.
+func fileSizeAndContentHash(pth string) (string, error) {
+	fi, err := os.Stat(pth)
+	if err != nil {
+		return "", err
+	}
+	hash, err := fileContentHash(pth, newXXH64)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", fi.Size(), hash), nil
+}
+
 // fileModtime returns a file's modtime as a Unix timestamp representation.
 func fileModtime(pth string) (string, error) {
 	fi, err := os.Stat(pth)
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%d", fi.ModTime().Unix()), nil
+	return fmt.Sprintf("%d", modTimeSeconds(fi)), nil
 }
 
-// readCacheDescriptor reads cache descriptor from pth is exists.
-func readCacheDescriptor(pth string) (map[string]string, error) {
-	if exists, err := pathutil.IsPathExists(pth); err != nil {
+const (
+	// descriptorSchemaKey is the key of the schema version in the cache descriptor file,
+	// the cache paths are absolute, so it never collides with a path.
+	// The version is stored as an entry of the map, the pull steps reading the descriptor as a map of strings still read it.
+	descriptorSchemaKey = "#schema_version"
+	// descriptorSchemaVersion is the schema version of the cache descriptor files written by the step,
+	// the files without a version are of the version 1, the entries of both versions are the same.
+	descriptorSchemaVersion = 2
+)
+
+// versionedDescriptor returns a copy of descriptor with the schema version, the cache key, the push time and the signature,
+// as written into the cache descriptor file.
+func versionedDescriptor(descriptor map[string]string) map[string]string {
+	versioned := make(map[string]string, len(descriptor)+4)
+	for pth, fingerprint := range descriptor {
+		versioned[pth] = fingerprint
+	}
+	versioned[descriptorSchemaKey] = strconv.Itoa(descriptorSchemaVersion)
+	if cacheKey != "" {
+		versioned[descriptorCacheKeyKey] = cacheKey
+	}
+	if !pushTime.IsZero() {
+		versioned[descriptorPushTimeKey] = strconv.FormatInt(pushTime.Unix(), 10)
+	}
+	if descriptorSigningKey != nil {
+		versioned[descriptorSignatureKey] = descriptorSignature(versioned, descriptorSigningKey)
+	}
+	return versioned
+}
+
+// stripDescriptorMetadata deletes the schema version, the cache key, the push time and the signature from a descriptor read from a file.
+func stripDescriptorMetadata(descriptor map[string]string) {
+	for _, key := range []string{descriptorSchemaKey, descriptorCacheKeyKey, descriptorPushTimeKey, descriptorSignatureKey} {
+		delete(descriptor, key)
+	}
+}
+
+// descriptorData returns the cache descriptor file content of descriptor.
+// The keys are sorted by encoding/json, the same descriptor is always written as the same bytes,
+// regardless of the order the paths were fingerprinted in, so that the descriptor files can be diffed and hashed.
+func descriptorData(descriptor map[string]string) ([]byte, error) {
+	return json.MarshalIndent(versionedDescriptor(descriptor), "", " ")
+}
+
+// compressedDescriptorData returns the cache descriptor file content of descriptor compressed with gzip.
+// The gzip header has no modification time, the same descriptor is still always written as the same bytes.
+func compressedDescriptorData(descriptor map[string]string) ([]byte, error) {
+	data, err := descriptorData(descriptor)
+	if err != nil {
 		return nil, err
+	}
+
+	var b bytes.Buffer
+	writer := gzip.NewWriter(&b)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decompressDescriptorData returns the cache descriptor file content fileBytes decompressed if it is compressed with gzip,
+// or fileBytes itself, a JSON document never starts with the gzip magic.
+func decompressDescriptorData(fileBytes []byte) ([]byte, error) {
+	if !bytes.HasPrefix(fileBytes, []byte{0x1f, 0x8b}) {
+		return fileBytes, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(fileBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress cache descriptor: %s", err)
+	}
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress cache descriptor: %s", err)
+	}
+	return b, nil
+}
+
+// descriptorDigest returns the hex encoded SHA256 hash of the cache descriptor file content of descriptor,
+// identical caches have the same digest, the push time and the signature are not hashed.
+func descriptorDigest(descriptor map[string]string) (string, error) {
+	versioned := versionedDescriptor(descriptor)
+	delete(versioned, descriptorPushTimeKey)
+	delete(versioned, descriptorSignatureKey)
+	b, err := json.MarshalIndent(versioned, "", " ")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// readCacheDescriptor reads cache descriptor from pth is exists, without the schema version, the cache key, the push time and the signature.
+// The descriptor compressed with gzip is decompressed.
+// A descriptor of a newer schema version, written by a newer version of the step, is not read (nil is returned),
+// the cache is pushed again as if there was no previous cache.
+// So is a descriptor of another cache key, such as the cache of the main branch restored by a feature branch,
+// the cache of the current key is pushed even if nothing changed.
+// So is a descriptor without a valid signature if the descriptors are signed.
+// The time the cache was pushed at is returned from the descriptor read, zero if it records no time or is not read.
+func readCacheDescriptor(pth string) (map[string]string, time.Time, error) {
+	if exists, err := pathutil.IsPathExists(pth); err != nil {
+		return nil, time.Time{}, err
 	} else if !exists {
-		return nil, nil
+		return nil, time.Time{}, nil
 	}
 
 	fileBytes, err := fileutil.ReadBytesFromFile(pth)
 	if err != nil {
+		return nil, time.Time{}, err
+	}
+	descriptor, err := parseTrustedDescriptor(fileBytes)
+	if err != nil || descriptor == nil {
+		return nil, time.Time{}, err
+	}
+
+	pushedAt, err := descriptorPushTime(descriptor)
+	if err != nil {
+		log.Warnf("Invalid push time of the previous cache descriptor, ignoring it: %s", err)
+	}
+	stripDescriptorMetadata(descriptor)
+	return descriptor, pushedAt, nil
+}
+
+// parseCacheDescriptor parses the cache descriptor file content fileBytes, as readCacheDescriptor.
+func parseCacheDescriptor(fileBytes []byte) (map[string]string, error) {
+	descriptor, err := parseTrustedDescriptor(fileBytes)
+	if err != nil || descriptor == nil {
 		return nil, err
 	}
+	stripDescriptorMetadata(descriptor)
+	return descriptor, nil
+}
 
-	var previousFilePathMap map[string]string
-	err = json.Unmarshal(fileBytes, &previousFilePathMap)
+// parseTrustedDescriptor parses the cache descriptor file content fileBytes with its metadata,
+// nil if it is of a newer schema version, of another cache key or not validly signed, as readCacheDescriptor.
+func parseTrustedDescriptor(fileBytes []byte) (map[string]string, error) {
+	fileBytes, err := decompressDescriptorData(fileBytes)
 	if err != nil {
 		return nil, err
 	}
 
+	// The version is checked first, the entries of a newer version may not be strings
+	var versioned struct {
+		Version  string `json:"#schema_version"`
+		CacheKey string `json:"#cache_key"`
+	}
+	if err := json.Unmarshal(fileBytes, &versioned); err != nil {
+		return nil, err
+	}
+	if versioned.Version != "" {
+		if v, err := strconv.Atoi(versioned.Version); err != nil || v > descriptorSchemaVersion {
+			log.Warnf("Unsupported cache descriptor schema version (%s), ignoring the previous cache descriptor", versioned.Version)
+			return nil, nil
+		}
+	}
+	if versioned.CacheKey != cacheKey {
+		log.Printf("The previous cache descriptor is of another cache key (%s), ignoring it", versioned.CacheKey)
+		return nil, nil
+	}
+
+	var previousFilePathMap map[string]string
+	if err := json.Unmarshal(fileBytes, &previousFilePathMap); err != nil {
+		return nil, err
+	}
+	if descriptorSigningKey != nil && !hasValidSignature(previousFilePathMap, descriptorSigningKey) {
+		log.Warnf("The previous cache descriptor is unsigned or was modified, not trusting it")
+		return nil, nil
+	}
 	return previousFilePathMap, nil
 }
+
+// readCacheSizes reads the file sizes of the previous cache from pth if exists.
+func readCacheSizes(pth string) (map[string]int64, error) {
+	if exists, err := pathutil.IsPathExists(pth); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, nil
+	}
+
+	fileBytes, err := fileutil.ReadBytesFromFile(pth)
+	if err != nil {
+		return nil, err
+	}
+
+	var sizes map[string]int64
+	if err := json.Unmarshal(fileBytes, &sizes); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
 	"encoding/json"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -33,7 +37,7 @@ func Test_Test_cacheDescriptorModTime(t *testing.T) {
 
 	t.Log("mod time method")
 	{
-		descriptor, err := cacheDescriptor(map[string]string{filepath.Join(tmpDir, "subdir", "file1"): filepath.Join(tmpDir, "subdir", "file1")}, MODTIME)
+		descriptor, err := cacheDescriptor(map[string]string{filepath.Join(tmpDir, "subdir", "file1"): filepath.Join(tmpDir, "subdir", "file1")}, MODTIME, nil, SYMLINKTARGET, false, 1, nil)
 		if err != nil {
 			t.Errorf("cacheDescriptor() error = %v, wantErr %v", err, false)
 			return
@@ -71,17 +75,24 @@ func Test_cacheDescriptor(t *testing.T) {
 	}
 
 	createDirStruct(t, pths)
+	if err := os.Chtimes(filepath.Join(tmpDir, "subdir", "file1"), time.Unix(1000000000, 0), time.Unix(1000000000, 0)); err != nil {
+		t.Fatalf("failed to set mod time: %s", err)
+	}
 
 	err = os.Symlink("meow", filepath.Join(tmpDir, "subdir", "symlink"))
 	if err != nil {
 		t.Fatalf("failed to create symlink: %s", err)
 		return
 	}
+	if err := os.Symlink("file2", filepath.Join(tmpDir, "subdir", "file-symlink")); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
 
 	tests := []struct {
 		name                string
 		indicatorByCachePth map[string]string
 		method              ChangeIndicator
+		symlinks            SymlinkFingerprint
 		descriptor          map[string]string
 		wantErr             bool
 	}{
@@ -99,6 +110,34 @@ func Test_cacheDescriptor(t *testing.T) {
 			descriptor:          map[string]string{filepath.Join(tmpDir, "subdir", "file1"): "d41d8cd98f00b204e9800998ecf8427e"}, // empty string MD5 hash
 			wantErr:             false,
 		},
+		{
+			name:                "xxh64 content hash method",
+			indicatorByCachePth: map[string]string{filepath.Join(tmpDir, "subdir", "file1"): filepath.Join(tmpDir, "subdir", "file2")},
+			method:              XXH64,
+			descriptor:          map[string]string{filepath.Join(tmpDir, "subdir", "file1"): "ef46db3751d8e999"}, // empty string xxHash64 hash
+			wantErr:             false,
+		},
+		{
+			name:                "blake3 content hash method",
+			indicatorByCachePth: map[string]string{filepath.Join(tmpDir, "subdir", "file1"): filepath.Join(tmpDir, "subdir", "file2")},
+			method:              BLAKE3,
+			descriptor:          map[string]string{filepath.Join(tmpDir, "subdir", "file1"): "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"}, // empty string BLAKE3 hash
+			wantErr:             false,
+		},
+		{
+			name:                "sha256 content hash method",
+			indicatorByCachePth: map[string]string{filepath.Join(tmpDir, "subdir", "file1"): filepath.Join(tmpDir, "subdir", "file2")},
+			method:              SHA256,
+			descriptor:          map[string]string{filepath.Join(tmpDir, "subdir", "file1"): "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}, // empty string SHA-256 hash
+			wantErr:             false,
+		},
+		{
+			name:                "size mod time method",
+			indicatorByCachePth: map[string]string{filepath.Join(tmpDir, "subdir", "file2"): filepath.Join(tmpDir, "subdir", "file1")},
+			method:              SIZEMODTIME,
+			descriptor:          map[string]string{filepath.Join(tmpDir, "subdir", "file2"): "12-1000000000"},
+			wantErr:             false,
+		},
 		{
 			name:                "symlink",
 			indicatorByCachePth: map[string]string{filepath.Join(tmpDir, "subdir", "symlink"): filepath.Join(tmpDir, "subdir", "symlink")},
@@ -106,10 +145,26 @@ func Test_cacheDescriptor(t *testing.T) {
 			descriptor:          map[string]string{filepath.Join(tmpDir, "subdir", "symlink"): "symlink: meow"},
 			wantErr:             false,
 		},
+		{
+			name:                "symlink content",
+			indicatorByCachePth: map[string]string{filepath.Join(tmpDir, "subdir", "file-symlink"): filepath.Join(tmpDir, "subdir", "file-symlink")},
+			method:              MD5,
+			symlinks:            SYMLINKCONTENT,
+			descriptor:          map[string]string{filepath.Join(tmpDir, "subdir", "file-symlink"): "d41d8cd98f00b204e9800998ecf8427e"}, // file2's empty content
+			wantErr:             false,
+		},
+		{
+			name:                "broken symlink content",
+			indicatorByCachePth: map[string]string{filepath.Join(tmpDir, "subdir", "symlink"): filepath.Join(tmpDir, "subdir", "symlink")},
+			method:              MD5,
+			symlinks:            SYMLINKCONTENT,
+			descriptor:          map[string]string{filepath.Join(tmpDir, "subdir", "symlink"): "symlink: meow"},
+			wantErr:             false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			descriptor, err := cacheDescriptor(tt.indicatorByCachePth, tt.method)
+			descriptor, err := cacheDescriptor(tt.indicatorByCachePth, tt.method, nil, tt.symlinks, false, 2, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("cacheDescriptor() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -121,12 +176,132 @@ func Test_cacheDescriptor(t *testing.T) {
 	}
 }
 
+func Test_cacheDescriptor_workers(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	files := map[string]string{}
+	indicatorByCachePth := map[string]string{}
+	for i := 0; i < 50; i++ {
+		pth := filepath.Join(tmpDir, "file"+strconv.Itoa(i))
+		files[pth] = strconv.Itoa(i)
+		indicatorByCachePth[pth] = pth
+	}
+	createDirStruct(t, files)
+
+	serial, err := cacheDescriptor(indicatorByCachePth, XXH64, nil, SYMLINKTARGET, false, 1, nil)
+	if err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	}
+	parallel, err := cacheDescriptor(indicatorByCachePth, XXH64, nil, SYMLINKTARGET, false, 8, nil)
+	if err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	}
+	if !reflect.DeepEqual(serial, parallel) {
+		t.Errorf("cacheDescriptor() with 8 workers = %v, want %v", parallel, serial)
+	}
+
+	// The descriptor file is byte-stable across runs and numbers of workers.
+	want, err := descriptorData(serial)
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+	for _, workers := range []int{1, 3, 8, 16} {
+		descriptor, err := cacheDescriptor(indicatorByCachePth, XXH64, nil, SYMLINKTARGET, false, workers, nil)
+		if err != nil {
+			t.Fatalf("cacheDescriptor() error = %v", err)
+		}
+		if got, err := descriptorData(descriptor); err != nil {
+			t.Fatalf("descriptorData() error = %v", err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("descriptorData() with %d workers = %s, want %s", workers, got, want)
+		}
+	}
+	digest, err := descriptorDigest(serial)
+	if err != nil {
+		t.Fatalf("descriptorDigest() error = %v", err)
+	}
+	if again, err := descriptorDigest(parallel); err != nil || again != digest {
+		t.Errorf("descriptorDigest() = %v, %v, want %v", again, err, digest)
+	}
+
+	// The error of the first missing path is returned regardless of the order the workers fail in.
+	indicatorByCachePth[filepath.Join(tmpDir, "missing1")] = filepath.Join(tmpDir, "missing1")
+	indicatorByCachePth[filepath.Join(tmpDir, "missing2")] = filepath.Join(tmpDir, "missing2")
+	for i := 0; i < 10; i++ {
+		_, err := cacheDescriptor(indicatorByCachePth, XXH64, nil, SYMLINKTARGET, false, 8, nil)
+		if err == nil || !strings.Contains(err.Error(), "missing1") {
+			t.Fatalf("cacheDescriptor() error = %v, want the error of missing1", err)
+		}
+	}
+}
+
+func Test_cacheDescriptor_methodByCachePth(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	indicator := filepath.Join(tmpDir, "indicator")
+	createDirStruct(t, map[string]string{indicator: "content"})
+	hashed := filepath.Join(tmpDir, "hashed")
+	timed := filepath.Join(tmpDir, "timed")
+	indicatorByCachePth := map[string]string{hashed: indicator, timed: indicator}
+
+	descriptor, err := cacheDescriptor(indicatorByCachePth, MD5, map[string]ChangeIndicator{timed: MODTIME}, SYMLINKTARGET, false, 2, nil)
+	if err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	}
+
+	wantHash, err := fileContentHash(indicator, md5.New)
+	if err != nil {
+		t.Fatalf("fileContentHash() error = %v", err)
+	}
+	wantModtime, err := fileModtime(indicator)
+	if err != nil {
+		t.Fatalf("fileModtime() error = %v", err)
+	}
+	if want := map[string]string{hashed: wantHash, timed: wantModtime}; !reflect.DeepEqual(descriptor, want) {
+		t.Errorf("cacheDescriptor() = %v, want %v", descriptor, want)
+	}
+}
+
+func Test_cacheSize(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	file1 := filepath.Join(tmpDir, "file1")
+	file2 := filepath.Join(tmpDir, "subdir", "file2")
+	createDirStruct(t, map[string]string{
+		file1: "some content",
+		file2: "other",
+	})
+
+	got, err := cacheSize([]string{file1, file2, filepath.Join(tmpDir, "subdir")})
+	if err != nil {
+		t.Fatalf("cacheSize() error = %v", err)
+	}
+	if want := int64(len("some content") + len("other")); got != want {
+		t.Errorf("cacheSize() = %d, want %d", got, want)
+	}
+
+	if _, err := cacheSize([]string{filepath.Join(tmpDir, "not-existing")}); err == nil {
+		t.Errorf("cacheSize() expected error for not existing path")
+	}
+}
+
 func Test_compare(t *testing.T) {
 	tests := []struct {
-		name string
-		old  map[string]string
-		new  map[string]string
-		want result
+		name     string
+		old      map[string]string
+		new      map[string]string
+		oldSizes map[string]int64
+		newSizes map[string]int64
+		want     result
 	}{
 		{
 			name: "empty test",
@@ -156,7 +331,7 @@ func Test_compare(t *testing.T) {
 			name: "matching",
 			old:  map[string]string{"pth": "indicator"},
 			new:  map[string]string{"pth": "indicator"},
-			want: result{matching: []string{"pth"}},
+			want: result{matching: 1},
 		},
 		{
 			name: "added",
@@ -192,15 +367,110 @@ func Test_compare(t *testing.T) {
 				removed:        []string{"removedPth"},
 				removedIgnored: []string{"ignoredRemovedPth"},
 				changed:        []string{"changed"},
-				matching:       []string{"matching"},
+				matching:       1,
 				added:          []string{"added"},
 				addedIgnored:   []string{"ignoredAdded"},
+				moved:          []fileMove{{from: "removedPth", to: "added"}},
 			},
 		},
+		{
+			name: "sized",
+			old: map[string]string{
+				"removedPth":        "indicator",
+				"ignoredRemovedPth": "-",
+				"changed":           "indicator1",
+				"matching":          "indicator",
+			},
+			new: map[string]string{
+				"changed":      "indicator2",
+				"matching":     "indicator",
+				"added":        "indicator",
+				"ignoredAdded": "-",
+			},
+			oldSizes: map[string]int64{"removedPth": 1, "ignoredRemovedPth": 10, "changed": 100, "matching": 1000},
+			newSizes: map[string]int64{"changed": 200, "matching": 1000, "added": 2000, "ignoredAdded": 20000},
+			want: result{
+				removed:        []string{"removedPth"},
+				removedIgnored: []string{"ignoredRemovedPth"},
+				changed:        []string{"changed"},
+				matching:       1,
+				added:          []string{"added"},
+				addedIgnored:   []string{"ignoredAdded"},
+				moved:          []fileMove{{from: "removedPth", to: "added"}},
+				changedBytes:   200,
+			},
+		},
+		{
+			name: "nested directories",
+			old: map[string]string{
+				"/cache/same/a":      "indicator",
+				"/cache/same/sub/b":  "indicator",
+				"/cache/other/c":     "indicator1",
+				"/cache/other/d":     "indicator",
+				"/cache/removed/e":   "indicator",
+				"/cache/composite/":  "tree: 1",
+				"/cache/ignored/f":   "-",
+				"/cache/other/sub/g": "indicator",
+			},
+			new: map[string]string{
+				"/cache/same/a":      "indicator",
+				"/cache/same/sub/b":  "indicator",
+				"/cache/other/c":     "indicator2",
+				"/cache/other/d":     "indicator",
+				"/cache/composite/":  "tree: 2",
+				"/cache/added/sub/h": "indicator",
+				"/cache/other/sub/g": "indicator",
+			},
+			want: result{
+				removed:        []string{"/cache/removed/e"},
+				removedIgnored: []string{"/cache/ignored/f"},
+				changed:        []string{"/cache/composite/", "/cache/other/c"},
+				matching:       4,
+				added:          []string{"/cache/added/sub/h"},
+				moved:          []fileMove{{from: "/cache/removed/e", to: "/cache/added/sub/h"}},
+			},
+		},
+		{
+			name: "moved directory",
+			old: map[string]string{
+				"/cache/old/a": "fingerprint a",
+				"/cache/old/b": "fingerprint b",
+				"/cache/old/c": "shared",
+				"/cache/old/d": "shared",
+			},
+			new: map[string]string{
+				"/cache/new/a": "fingerprint a",
+				"/cache/new/b": "fingerprint b",
+				"/cache/new/c": "shared",
+				"/cache/new/d": "shared",
+			},
+			oldSizes: map[string]int64{"/cache/old/a": 1, "/cache/old/b": 10, "/cache/old/c": 100, "/cache/old/d": 100},
+			newSizes: map[string]int64{"/cache/new/a": 1, "/cache/new/b": 10, "/cache/new/c": 100, "/cache/new/d": 100},
+			want: result{
+				removed: []string{"/cache/old/a", "/cache/old/b", "/cache/old/c", "/cache/old/d"},
+				added:   []string{"/cache/new/a", "/cache/new/b", "/cache/new/c", "/cache/new/d"},
+				moved: []fileMove{
+					{from: "/cache/old/a", to: "/cache/new/a"},
+					{from: "/cache/old/b", to: "/cache/new/b"},
+				},
+				changedBytes: 400,
+			},
+		},
+		{
+			name:     "removed without previous sizes",
+			old:      map[string]string{"pth": "indicator"},
+			new:      map[string]string{},
+			newSizes: map[string]int64{},
+			want:     result{removed: []string{"pth"}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if gotR := compare(tt.old, tt.new); !reflect.DeepEqual(gotR, tt.want) {
+			gotR := compare(tt.old, tt.new, tt.oldSizes, tt.newSizes)
+			sort.Strings(gotR.changed)
+			sort.Strings(gotR.removed)
+			sort.Strings(gotR.added)
+			if !reflect.DeepEqual(gotR, tt.want) {
 				t.Errorf("compare() = %v, want %v", gotR, tt.want)
 			}
 		})
@@ -213,7 +483,7 @@ func Test_result_hasChanges(t *testing.T) {
 		removedIgnored  []string
 		removed         []string
 		changed         []string
-		matching        []string
+		matching        int
 		addedIgnored    []string
 		added           []string
 		triggerNewCache bool
@@ -230,7 +500,7 @@ func Test_result_hasChanges(t *testing.T) {
 		},
 		{
 			name:            "matching",
-			matching:        []string{"pth"},
+			matching:        1,
 			triggerNewCache: false,
 		},
 		{
@@ -259,7 +529,7 @@ func Test_result_hasChanges(t *testing.T) {
 			removedIgnored:  []string{"pth"},
 			removed:         []string{"pth"},
 			changed:         []string{"pth"},
-			matching:        []string{"pth"},
+			matching:        1,
 			addedIgnored:    []string{"pth"},
 			added:           []string{"pth"},
 			triggerNewCache: true,
@@ -282,6 +552,33 @@ func Test_result_hasChanges(t *testing.T) {
 	}
 }
 
+func Test_result_belowThresholds(t *testing.T) {
+	tests := []struct {
+		name         string
+		changedBytes int64
+		minFiles     int
+		minBytes     int64
+		want         bool
+	}{
+		{name: "no thresholds", changedBytes: 10, want: false},
+		{name: "fewer files", changedBytes: 10, minFiles: 3, want: true},
+		{name: "more files", changedBytes: 10, minFiles: 2, want: false},
+		{name: "fewer bytes", changedBytes: 10, minBytes: 10, want: true},
+		{name: "more bytes", changedBytes: 11, minBytes: 10, want: false},
+		{name: "fewer files and bytes", changedBytes: 10, minFiles: 3, minBytes: 10, want: true},
+		{name: "fewer files but more bytes", changedBytes: 11, minFiles: 3, minBytes: 10, want: false},
+		{name: "more files but fewer bytes", changedBytes: 10, minFiles: 2, minBytes: 10, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := result{removed: []string{"pth1"}, changed: []string{"pth2"}, added: []string{"pth3"}, changedBytes: tt.changedBytes}
+			if got := r.belowThresholds(tt.minFiles, tt.minBytes); got != tt.want {
+				t.Errorf("result.belowThresholds() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_readCacheDescriptor(t *testing.T) {
 	desired := map[string]string{
 		"pacth/to/cache": "indicator",
@@ -301,12 +598,55 @@ func Test_readCacheDescriptor(t *testing.T) {
 
 	createDirStruct(t, map[string]string{pth: string(content)})
 
+	versioned, err := descriptorData(desired)
+	if err != nil {
+		t.Fatalf("Failed to create descriptor: %s", err)
+	}
+	compressed, err := compressedDescriptorData(desired)
+	if err != nil {
+		t.Fatalf("Failed to create descriptor: %s", err)
+	}
+	versionedPth := filepath.Join(tmpDir, "versioned")
+	futurePth := filepath.Join(tmpDir, "future")
+	compressedPth := filepath.Join(tmpDir, "compressed")
+	corruptedPth := filepath.Join(tmpDir, "corrupted")
+	createDirStruct(t, map[string]string{
+		versionedPth:  string(versioned),
+		compressedPth: string(compressed),
+		corruptedPth:  string(compressed[:len(compressed)/2]),
+		futurePth:     `{"#schema_version": "1000", "pacth/to/cache": {"fingerprint": "indicator"}}`,
+	})
+
 	tests := []struct {
 		name       string
 		pth        string
 		descriptor map[string]string
 		wantErr    bool
 	}{
+		{
+			name:       "Newer schema version",
+			pth:        futurePth,
+			descriptor: nil,
+			wantErr:    false,
+		},
+		{
+			name:       "Versioned descriptor",
+			pth:        versionedPth,
+			descriptor: desired,
+			wantErr:    false,
+		},
+		{
+			name:       "Compressed descriptor",
+			pth:        compressedPth,
+			descriptor: desired,
+			wantErr:    false,
+		},
+		{
+			name:       "Truncated compressed descriptor",
+			pth:        corruptedPth,
+			descriptor: nil,
+			wantErr:    true,
+		},
 		{
 			name:       "No path provided",
 			pth:        "",
@@ -328,7 +668,7 @@ func Test_readCacheDescriptor(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			descriptor, err := readCacheDescriptor(tt.pth)
+			descriptor, _, err := readCacheDescriptor(tt.pth)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("readCacheDescriptor() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -339,3 +679,120 @@ func Test_readCacheDescriptor(t *testing.T) {
 		})
 	}
 }
+
+func Test_modTimeSeconds(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "file")
+	createDirStruct(t, map[string]string{pth: "content"})
+
+	// The same file restored on a file system storing seconds only.
+	var fingerprints []string
+	for _, modTime := range []time.Time{time.Unix(1000000000, 700000000), time.Unix(1000000000, 0)} {
+		if err := os.Chtimes(pth, modTime, modTime); err != nil {
+			t.Fatalf("failed to set mod time: %s", err)
+		}
+		fingerprint, err := fileModtime(pth)
+		if err != nil {
+			t.Fatalf("fileModtime() error = %v", err)
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	if fingerprints[0] != "1000000000" || fingerprints[1] != fingerprints[0] {
+		t.Errorf("fileModtime() = %v, want 1000000000 regardless of the precision", fingerprints)
+	}
+}
+
+func Test_cacheDescriptor_modes(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "tool")
+	createDirStruct(t, map[string]string{pth: "#!/bin/sh"})
+	if err := os.Chmod(pth, 0644); err != nil {
+		t.Fatalf("failed to set mode: %s", err)
+	}
+	indicatorByCachePth := map[string]string{pth: pth, filepath.Join(tmpDir, "ignored"): ""}
+
+	before, err := cacheDescriptor(indicatorByCachePth, MD5, nil, SYMLINKTARGET, true, 1, nil)
+	if err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	}
+	if !strings.HasSuffix(before[pth], "-0644") || before[filepath.Join(tmpDir, "ignored")] != "-" {
+		t.Errorf("cacheDescriptor() = %v, want the mode of %s", before, pth)
+	}
+
+	if err := os.Chmod(pth, 0755); err != nil {
+		t.Fatalf("failed to set mode: %s", err)
+	}
+	if after, err := cacheDescriptor(indicatorByCachePth, MD5, nil, SYMLINKTARGET, true, 1, nil); err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	} else if after[pth] == before[pth] {
+		t.Errorf("cacheDescriptor() = %v after chmod, want another fingerprint", after)
+	}
+	if without, err := cacheDescriptor(indicatorByCachePth, MD5, nil, SYMLINKTARGET, false, 1, nil); err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	} else if strings.HasSuffix(without[pth], "-0755") {
+		t.Errorf("cacheDescriptor() = %v without modes, want no mode", without)
+	}
+}
+
+func Test_fileSizes(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	file := filepath.Join(tmpDir, "file")
+	empty := filepath.Join(tmpDir, "empty")
+	symlink := filepath.Join(tmpDir, "symlink")
+	createDirStruct(t, map[string]string{file: "content", empty: ""})
+	if err := os.Symlink(file, symlink); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+
+	sizes, err := fileSizes([]string{file, empty, symlink})
+	if err != nil {
+		t.Fatalf("fileSizes() error = %v", err)
+	}
+	if want := map[string]int64{file: 7, empty: 0}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("fileSizes() = %v, want %v", sizes, want)
+	}
+	if total := totalSize(sizes); total != 7 {
+		t.Errorf("totalSize() = %d, want 7", total)
+	}
+	if _, err := fileSizes([]string{filepath.Join(tmpDir, "missing")}); err == nil {
+		t.Errorf("fileSizes() of missing file, want error")
+	}
+}
+
+func Test_result_ignoreRemovals(t *testing.T) {
+	old := map[string]string{"/cache/removed": "1", "/cache/old": "moved", "/cache/changed": "1"}
+	new := map[string]string{"/cache/new": "moved", "/cache/changed": "2", "/cache/added": "1"}
+	oldSizes := map[string]int64{"/cache/removed": 1, "/cache/old": 10, "/cache/changed": 100}
+	newSizes := map[string]int64{"/cache/new": 10, "/cache/changed": 200, "/cache/added": 1000}
+
+	r := compare(old, new, oldSizes, newSizes)
+	r.ignoreRemovals(oldSizes, newSizes)
+	sort.Strings(r.removedIgnored)
+	sort.Strings(r.added)
+	want := result{
+		removedIgnored: []string{"/cache/old", "/cache/removed"},
+		changed:        []string{"/cache/changed"},
+		added:          []string{"/cache/added", "/cache/new"},
+		changedBytes:   1210,
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("result.ignoreRemovals() = %v, want %v", r, want)
+	}
+
+	removedOnly := compare(map[string]string{"/cache/removed": "1"}, map[string]string{}, nil, nil)
+	if removedOnly.ignoreRemovals(nil, nil); removedOnly.hasChanges() {
+		t.Errorf("result.hasChanges() = true with removals only, want false")
+	}
+}
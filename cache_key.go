@@ -0,0 +1,67 @@
+// Branch-scoped cache key related models and functions.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// cacheKey is the key the cache is stored with, the caches of different keys are stored separately, empty stores a single cache.
+// It is configured by the step inputs.
+var cacheKey string
+
+// descriptorCacheKeyKey is the key of the cache key in the cache descriptor file, like descriptorSchemaKey.
+const descriptorCacheKeyKey = "#cache_key"
+
+// renderCacheKey returns the cache key of the build described by configs, rendered from tmpl with the fields of the build info,
+// for example {{ .Branch }}. An empty template renders an empty key.
+func renderCacheKey(tmpl string, configs Config) (string, error) {
+	if strings.TrimSpace(tmpl) == "" {
+		return "", nil
+	}
+	t, err := template.New("cache_key").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse cache key template: %s", err)
+	}
+
+	var b bytes.Buffer
+	info := buildInfo{
+		Branch:   configs.GitBranch,
+		Commit:   configs.GitCommit,
+		Workflow: configs.WorkflowID,
+		AppSlug:  configs.AppSlug,
+	}
+	if err := t.Execute(&b, info); err != nil {
+		return "", fmt.Errorf("failed to render cache key template: %s", err)
+	}
+	key := strings.TrimSpace(b.String())
+	if key == "" {
+		return "", fmt.Errorf("cache key template (%s) rendered an empty key", tmpl)
+	}
+	return key, nil
+}
+
+// unsafeCacheKeyChars matches the characters replaced in the path element of a cache key.
+var unsafeCacheKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// cacheKeyPathElement returns the cache key as a single path element of the storage destination,
+// the branch names such as feature/login contain separators.
+func cacheKeyPathElement(key string) string {
+	elem := unsafeCacheKeyChars.ReplaceAllString(key, "-")
+	if elem == "." || elem == ".." {
+		elem = strings.Replace(elem, ".", "-", -1)
+	}
+	return elem
+}
+
+// scopedDirectory returns the directory of the cache of the current cache key in dir, dir itself without a key.
+func scopedDirectory(dir string) string {
+	if cacheKey == "" {
+		return dir
+	}
+	return path.Join(dir, cacheKeyPathElement(cacheKey))
+}
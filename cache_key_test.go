@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_renderCacheKey(t *testing.T) {
+	configs := Config{GitBranch: "feature/login", WorkflowID: "primary"}
+	tests := []struct {
+		name    string
+		tmpl    string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", "", false},
+		{"branch", "{{ .Branch }}", "feature/login", false},
+		{"branch and workflow", "{{ .Branch }}-{{ .Workflow }}", "feature/login-primary", false},
+		{"empty key", "{{ .Commit }}", "", true},
+		{"unknown field", "{{ .Tag }}", "", true},
+		{"invalid", "{{ .Branch", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderCacheKey(tt.tmpl, configs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderCacheKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("renderCacheKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cacheKeyPathElement(t *testing.T) {
+	for key, want := range map[string]string{
+		"master":              "master",
+		"feature/login":       "feature-login",
+		"fix/#12 crash":       "fix-12-crash",
+		"release-1.2_rc":      "release-1.2_rc",
+		"..":                  "--",
+		"../../etc/passwd":    "..-..-etc-passwd",
+		"feature//double/sep": "feature-double-sep",
+	} {
+		if got := cacheKeyPathElement(key); got != want {
+			t.Errorf("cacheKeyPathElement(%s) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func Test_parseCacheDescriptor_cacheKey(t *testing.T) {
+	defer func(key string) {
+		cacheKey = key
+	}(cacheKey)
+
+	cacheKey = "feature/login"
+	b, err := descriptorData(map[string]string{"/cache/file": "1"})
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+
+	got, err := parseCacheDescriptor(b)
+	if err != nil {
+		t.Fatalf("parseCacheDescriptor() error = %v", err)
+	}
+	if want := map[string]string{"/cache/file": "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCacheDescriptor() = %v, want %v", got, want)
+	}
+
+	for _, key := range []string{"master", ""} {
+		cacheKey = key
+		if got, err := parseCacheDescriptor(b); err != nil || got != nil {
+			t.Errorf("parseCacheDescriptor() with cache key %q = %v, %v, want nil", key, got, err)
+		}
+	}
+}
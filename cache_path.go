@@ -2,20 +2,90 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/bitrise-io/go-utils/log"
 	"github.com/bitrise-io/go-utils/pathutil"
 	glob "github.com/ryanuber/go-glob"
 )
 
+// SymlinkMode ...
+type SymlinkMode string
+
+const (
+	// PRESERVE ...
+	PRESERVE = SymlinkMode("preserve")
+	// DEREFERENCE ...
+	DEREFERENCE = SymlinkMode("dereference")
+)
+
+// includeOptions stores the options of an include item.
+type includeOptions struct {
+	// store archives the item's files without compression.
+	store bool
+	// symlinks overrides how the item's symlinks are archived, empty if not overridden.
+	symlinks SymlinkMode
+	// priority orders the items when the archive is trimmed to its size limit, the items of lower priority are dropped first.
+	priority int
+	// method overrides the fingerprint method of the item's files (or its indicator), empty if not overridden.
+	method ChangeIndicator
+}
+
+// includePriorityOptionPrefix prefixes the priority option of include items.
+const includePriorityOptionPrefix = "priority="
+
+// includeOptionsPattern matches the options at the end of an include item, separated by a whitespace.
+var includeOptionsPattern = regexp.MustCompile(`\s\[([^\[\]]*)\]$`)
+
+// parseIncludeListItemOptions separates the include item and its options.
+func parseIncludeListItemOptions(item string) (string, includeOptions) {
+	// file/or/dir/to/cache -> indicator/file [store]
+	// file/or/dir/to/cache [store, dereference]
+	// file/or/dir/to/cache [priority=10]
+	// file/or/dir/to/cache [file-mod-time]
+	var options includeOptions
+	item = strings.TrimSpace(item)
+	match := includeOptionsPattern.FindStringSubmatchIndex(item)
+	if match == nil {
+		return item, options
+	}
+
+	for _, option := range strings.Split(item[match[2]:match[3]], ",") {
+		switch option = strings.TrimSpace(option); {
+		case option == "store":
+			options.store = true
+		case option == string(PRESERVE), option == string(DEREFERENCE):
+			options.symlinks = SymlinkMode(option)
+		case isChangeIndicator(option):
+			options.method = ChangeIndicator(option)
+		case option == "":
+		default:
+			if value := strings.TrimPrefix(option, includePriorityOptionPrefix); value != option {
+				if priority, err := strconv.Atoi(value); err == nil {
+					options.priority = priority
+					continue
+				}
+			}
+			log.Warnf("unknown include option: %s", option)
+		}
+	}
+	return item[:match[0]], options
+}
+
 // parseIncludeListItem separates path to cache and change indicator path.
 func parseIncludeListItem(item string) (string, string) {
 	// file/or/dir/to/cache -> indicator/file
 	// file/or/dir/to/cache
-	if parts := strings.Split(item, "->"); len(parts) > 1 {
+	// The indicator is split at the first arrow only, a command indicator may contain arrows.
+	if parts := strings.SplitN(item, "->", 2); len(parts) > 1 {
 		return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
 	}
 	return strings.TrimSpace(item), ""
@@ -32,9 +102,55 @@ func parseIgnoreListItem(item string) (string, bool) {
 	return strings.TrimPrefix(item, "!"), false
 }
 
+// expandIncludeList replaces the include items whose path is a glob pattern with an item of every path the pattern matches,
+// with the same indicator and options, and logs the matched paths of every pattern.
+// A pattern element of `**` matches any number of directories, an existing path named as the pattern is not expanded.
+func expandIncludeList(list []string) ([]string, error) {
+	var expanded []string
+	for _, line := range list {
+		item := strings.TrimSpace(line)
+		withoutOptions, _ := parseIncludeListItemOptions(item)
+		pth, indicator := parseIncludeListItem(withoutOptions)
+		if !strings.ContainsAny(pth, globMeta) {
+			expanded = append(expanded, line)
+			continue
+		}
+
+		pattern, err := absPath(pth)
+		if err != nil {
+			return nil, err
+		}
+		if exist, err := pathutil.IsPathExists(pattern); err != nil {
+			return nil, err
+		} else if exist {
+			expanded = append(expanded, line)
+			continue
+		}
+
+		pths, err := globPaths(pattern, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to match include pattern (%s): %s", pth, err)
+		}
+		if len(pths) == 0 {
+			log.Warnf("include pattern does not match any path: %s", pth)
+			continue
+		}
+		log.Printf("Include pattern %s matched %d paths:", pth, len(pths))
+		for _, matched := range pths {
+			log.Printf("- %s", matched)
+			if indicator != "" {
+				matched += " -> " + indicator
+			}
+			expanded = append(expanded, matched+item[len(withoutOptions):])
+		}
+	}
+	return expanded, nil
+}
+
 func parseIncludeList(list []string) map[string]string {
 	indicatorByPath := map[string]string{}
 	for _, item := range list {
+		item, _ = parseIncludeListItemOptions(item)
 		pth, indicator := parseIncludeListItem(item)
 		if len(pth) == 0 {
 			continue
@@ -44,6 +160,20 @@ func parseIncludeList(list []string) map[string]string {
 	return indicatorByPath
 }
 
+// parseIncludeOptionsList returns the options of the include items having any option.
+func parseIncludeOptionsList(list []string) map[string]includeOptions {
+	optionsByPath := map[string]includeOptions{}
+	for _, item := range list {
+		item, options := parseIncludeListItemOptions(item)
+		pth, _ := parseIncludeListItem(item)
+		if len(pth) == 0 || options == (includeOptions{}) {
+			continue
+		}
+		optionsByPath[pth] = options
+	}
+	return optionsByPath
+}
+
 func parseIgnoreList(list []string) map[string]bool {
 	ignoreByPath := map[string]bool{}
 	for _, item := range list {
@@ -56,6 +186,85 @@ func parseIgnoreList(list []string) map[string]bool {
 	return ignoreByPath
 }
 
+// envDefaultSeparator separates the name of an environment variable from its default value: ${NAME:-default}.
+const envDefaultSeparator = ":-"
+
+// expandEnvs expands the environment variables in s as os.ExpandEnv, and ${NAME:-default} to default if NAME is unset or empty,
+// so that an item refers to the directory of a tool on the stacks setting its variable, and to the default directory on the others.
+// The default value is expanded too, the values of the variables are not.
+func expandEnvs(s string) string {
+	return os.Expand(s, func(name string) string {
+		if i := strings.Index(name, envDefaultSeparator); i >= 0 {
+			if value := os.Getenv(name[:i]); value != "" {
+				return value
+			}
+			return expandEnvs(name[i+len(envDefaultSeparator):])
+		}
+		return os.Getenv(name)
+	})
+}
+
+// unsetEnvs returns the names of the environment variables in s which are unset, and expand to an empty string.
+func unsetEnvs(s string) []string {
+	var names []string
+	os.Expand(s, func(name string) string {
+		if _, ok := os.LookupEnv(name); !ok && !strings.Contains(name, envDefaultSeparator) {
+			names = append(names, name)
+		}
+		return ""
+	})
+	return names
+}
+
+// homeDir returns the home directory of the current user: $HOME, or the home directory in the user database if HOME is unset,
+// as in some containers.
+func homeDir() (string, error) {
+	if home := os.Getenv("HOME"); home != "" {
+		return home, nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %s", err)
+	}
+	return usr.HomeDir, nil
+}
+
+// absPath returns the absolute path of the item pth, expanding the environment variables as expandEnvs,
+// a leading ~ to the home directory of the current user and ~name to the home directory of the user name.
+// The default value of a variable can refer to other variables and ~, for example ${GRADLE_USER_HOME:-~/.gradle}.
+// The item is expanded once, a $ in the value of a variable is kept.
+func absPath(pth string) (string, error) {
+	expanded := expandEnvs(pth)
+	if expanded == "" {
+		return "", fmt.Errorf("no path provided: %s", pth)
+	}
+	if expanded == "~" || strings.HasPrefix(expanded, "~/") {
+		home, err := homeDir()
+		if err != nil {
+			return "", err
+		}
+		expanded = home + expanded[1:]
+	} else if strings.HasPrefix(expanded, "~") {
+		parts := strings.SplitN(expanded[1:], "/", 2)
+		usr, err := user.Lookup(parts[0])
+		if err != nil {
+			return "", err
+		}
+		expanded = usr.HomeDir
+		if len(parts) > 1 {
+			expanded = filepath.Join(expanded, parts[1])
+		}
+	}
+	return filepath.Abs(expanded)
+}
+
+// warnUnsetEnvs warns about the unset environment variables of the item pth.
+func warnUnsetEnvs(pth string) {
+	for _, name := range unsetEnvs(pth) {
+		log.Warnf("environment variable %s is not set, expanded to an empty string in: %s", name, pth)
+	}
+}
+
 // expandPath returns every file included in pth (recursively) if it is a dir,
 // if pth is a file it will be returned as an array.
 func expandPath(pth string) ([]string, error) {
@@ -78,15 +287,51 @@ func expandPath(pth string) ([]string, error) {
 }
 
 // normalizeIndicatorByPath modifies indicatorByPath:
-// expands both path to cache and indicator path
-// removes the item if any of path to cache or indicator path is not exist or if the indicator is a dir
+// expands both path to cache and indicator path (also the path of a git indicator), unquotes the command of a command indicator
+// removes the item if any of path to cache or indicator path is not exist or if the indicator is a dir (except for a git indicator)
+// or if the variable name of an environment variable indicator or the command of a command indicator is invalid or the patterns of a multi-file indicator do not match any file
+// expands the patterns of a multi-file indicator into the matching files
 // replaces path to cache (if it is a directory) by every file (recursively) in the directory.
 func normalizeIndicatorByPath(indicatorByPath map[string]string) (map[string]string, error) {
 	normalized := map[string]string{}
 	for pth, indicator := range indicatorByPath {
-		if len(indicator) > 0 {
+		if name, ok, err := parseEnvIndicator(indicator); ok {
+			if err != nil {
+				log.Warnf("invalid environment variable indicator (%s): %s", indicator, err)
+				continue
+			}
+			indicator = envIndicatorPrefix + name
+		} else if cmd, ok, err := parseCmdIndicator(indicator); ok {
+			if err != nil {
+				log.Warnf("invalid command indicator (%s): %s", indicator, err)
+				continue
+			}
+			indicator = cmdIndicatorPrefix + cmd
+		} else if target, ok := parseGitIndicator(indicator); ok {
+			var exist bool
 			var err error
-			indicator, err = pathutil.AbsPath(indicator)
+			indicator, exist, err = normalizeGitIndicator(target)
+			if err != nil {
+				return nil, err
+			}
+			if !exist {
+				log.Warnf("git indicator does not exists at: %s", target)
+				continue
+			}
+		} else if isMultiFileIndicator(indicator) {
+			normalizedIndicator, err := normalizeMultiFileIndicator(indicator)
+			if err != nil {
+				return nil, err
+			}
+			if normalizedIndicator == "" {
+				log.Warnf("indicator does not match any file: %s", indicator)
+				continue
+			}
+			indicator = normalizedIndicator
+		} else if len(indicator) > 0 {
+			warnUnsetEnvs(indicator)
+			var err error
+			indicator, err = absPath(indicator)
 			if err != nil {
 				return nil, err
 			}
@@ -103,8 +348,9 @@ func normalizeIndicatorByPath(indicatorByPath map[string]string) (map[string]str
 			}
 		}
 
+		warnUnsetEnvs(pth)
 		var err error
-		pth, err = pathutil.AbsPath(pth)
+		pth, err = absPath(pth)
 		if err != nil {
 			return nil, err
 		}
@@ -129,12 +375,100 @@ func normalizeIndicatorByPath(indicatorByPath map[string]string) (map[string]str
 	return normalized, nil
 }
 
+// dereferenceSymlinks follows the symlinks in indicatorByPath for which dereference reports true:
+// symlinks to directories are replaced by every file (recursively) in the target directory, under the symlink's path,
+// symlinks to files are returned, to be archived as their target.
+// Broken symlinks and symlinks to an already followed directory are kept as symlinks.
+func dereferenceSymlinks(indicatorByPath map[string]string, dereference func(pth string) bool) (map[string]string, map[string]bool, error) {
+	normalized := map[string]string{}
+	dereferenced := map[string]bool{}
+	visited := map[string]bool{}
+
+	pending := indicatorByPath
+	for len(pending) > 0 {
+		next := map[string]string{}
+		for pth, indicator := range pending {
+			info, err := os.Lstat(pth)
+			if err != nil {
+				return nil, nil, err
+			}
+			if info.Mode()&os.ModeSymlink == 0 || !dereference(pth) {
+				normalized[pth] = indicator
+				continue
+			}
+
+			target, err := filepath.EvalSymlinks(pth)
+			if err != nil {
+				log.Warnf("Failed to follow symlink (%s), archiving it as a symlink: %s", pth, err)
+				normalized[pth] = indicator
+				continue
+			}
+
+			targetInfo, err := os.Stat(target)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !targetInfo.IsDir() {
+				normalized[pth] = indicator
+				dereferenced[pth] = true
+				continue
+			}
+
+			if visited[target] {
+				log.Warnf("Symlink (%s) points to an already followed directory, archiving it as a symlink", pth)
+				normalized[pth] = indicator
+				continue
+			}
+			visited[target] = true
+
+			// The trailing separator makes Walk follow the symlink, the walked paths stay under the symlink's path.
+			subPths, err := expandPath(pth + string(filepath.Separator))
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, p := range subPths {
+				// Nested symlinks are followed in the next round.
+				next[filepath.Clean(p)] = indicator
+			}
+		}
+		pending = next
+	}
+	return normalized, dereferenced, nil
+}
+
+// regexpPatternPrefix prefixes the ignore items which are regular expressions, matched against the absolute paths.
+const regexpPatternPrefix = "re:"
+
+// ignoreRegexps caches the compiled regular expressions of the ignore items by the items.
+var ignoreRegexps sync.Map
+
+// ignoreRegexp returns the compiled regular expression of the ignore item pattern, compiled once.
+func ignoreRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := ignoreRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(strings.TrimPrefix(pattern, regexpPatternPrefix))
+	if err != nil {
+		return nil, err
+	}
+	ignoreRegexps.Store(pattern, re)
+	return re, nil
+}
+
 // normalizeExcludeByPattern modifies excludeByPattern:
-// expands patterns.
+// expands patterns, and validates the regular expressions, which are not expanded.
 func normalizeExcludeByPattern(excludeByPattern map[string]bool) (map[string]bool, error) {
 	normalized := map[string]bool{}
 	for pattern, exclude := range excludeByPattern {
-		pattern, err := pathutil.AbsPath(pattern)
+		if strings.HasPrefix(pattern, regexpPatternPrefix) {
+			if _, err := ignoreRegexp(pattern); err != nil {
+				return nil, fmt.Errorf("invalid regular expression ignore item (%s): %s", pattern, err)
+			}
+			normalized[pattern] = exclude
+			continue
+		}
+
+		pattern, err := absPath(pattern)
 		if err != nil {
 			return nil, err
 		}
@@ -144,10 +478,49 @@ func normalizeExcludeByPattern(excludeByPattern map[string]bool) (map[string]boo
 	return normalized, nil
 }
 
+// normalizeOptionsByPath expands the include item paths of optionsByPath.
+func normalizeOptionsByPath(optionsByPath map[string]includeOptions) (map[string]includeOptions, error) {
+	normalized := map[string]includeOptions{}
+	for pth, options := range optionsByPath {
+		pth, err := absPath(pth)
+		if err != nil {
+			return nil, err
+		}
+
+		normalized[pth] = options
+	}
+	return normalized, nil
+}
+
+// optionsForPath returns the options of the most specific include item containing pth.
+func optionsForPath(pth string, optionsByPath map[string]includeOptions) includeOptions {
+	var options includeOptions
+	var longest int
+	for itemPth, itemOptions := range optionsByPath {
+		itemPth = strings.TrimSuffix(itemPth, string(filepath.Separator))
+		if pth != itemPth && !strings.HasPrefix(pth, itemPth+string(filepath.Separator)) {
+			continue
+		}
+		if len(itemPth) >= longest {
+			options = itemOptions
+			longest = len(itemPth)
+		}
+	}
+	return options
+}
+
 // match reports whether the path matches to any of the given ignore items
 // and returns the exclude property of the matching ignore item.
 func match(pth string, excludeByPattern map[string]bool) (bool, bool) {
 	for pattern, exclude := range excludeByPattern {
+		if strings.HasPrefix(pattern, regexpPatternPrefix) {
+			// The expressions are validated by normalizeExcludeByPattern.
+			if re, err := ignoreRegexp(pattern); err == nil && re.MatchString(pth) {
+				return true, exclude
+			}
+			continue
+		}
+
 		if strings.Contains(pattern, "*") && glob.Glob(pattern, pth) {
 			return true, exclude
 		}
@@ -190,3 +563,45 @@ func interleave(indicatorByPth map[string]string, excludeByPattern map[string]bo
 
 	return indicatorByCachePth, nil
 }
+
+// ignoreFingerprints excludes the paths matching any of patterns from the change check, keeping them in the archive
+// regardless of whether the ignored paths are excluded from the archive.
+func ignoreFingerprints(indicatorByCachePth map[string]string, patterns map[string]bool) map[string]string {
+	ignored := map[string]string{}
+	for pth, indicator := range indicatorByCachePth {
+		if ok, _ := match(pth, patterns); ok {
+			indicator = ""
+		}
+		ignored[pth] = indicator
+	}
+	return ignored
+}
+
+// ignoreSelfIndicated excludes the paths fingerprinted by their own content, rather than by an indicator, from the change check,
+// keeping them in the archive, for the indicator-only invalidation policy.
+func ignoreSelfIndicated(indicatorByCachePth map[string]string) map[string]string {
+	ignored := map[string]string{}
+	for pth, indicator := range indicatorByCachePth {
+		if indicator == pth {
+			indicator = ""
+		}
+		ignored[pth] = indicator
+	}
+	return ignored
+}
+
+// excludeIgnored removes the paths matching an ignore item (the paths without indicator after interleave)
+// and returns the remaining paths along with the removed ones.
+func excludeIgnored(indicatorByCachePth map[string]string) (map[string]string, []string) {
+	included := map[string]string{}
+	var excluded []string
+	for pth, indicator := range indicatorByCachePth {
+		if indicator == "" {
+			excluded = append(excluded, pth)
+			continue
+		}
+		included[pth] = indicator
+	}
+	sort.Strings(excluded)
+	return included, excluded
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"os"
+	"os/user"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/bitrise-io/go-utils/fileutil"
@@ -150,6 +153,12 @@ func Test_parseIncludeListItem(t *testing.T) {
 			wantPth:       "path/to/include",
 			wantIndicator: "",
 		},
+		{
+			name:          "command indicator with arrow",
+			item:          `path/to/include -> cmd:"echo a->b"`,
+			wantPth:       "path/to/include",
+			wantIndicator: `cmd:"echo a->b"`,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -164,6 +173,122 @@ func Test_parseIncludeListItem(t *testing.T) {
 	}
 }
 
+func Test_parseIncludeListItemOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		item        string
+		wantItem    string
+		wantOptions includeOptions
+	}{
+		{
+			name:        "no options",
+			item:        "path/to/include -> indicator/path",
+			wantItem:    "path/to/include -> indicator/path",
+			wantOptions: includeOptions{},
+		},
+		{
+			name:        "store option",
+			item:        "path/to/include -> indicator/path [store]",
+			wantItem:    "path/to/include -> indicator/path",
+			wantOptions: includeOptions{store: true},
+		},
+		{
+			name:        "store option without indicator",
+			item:        " path/to/include  [ store ] ",
+			wantItem:    " path/to/include ",
+			wantOptions: includeOptions{store: true},
+		},
+		{
+			name:        "multiple options",
+			item:        "path/to/include [store, dereference]",
+			wantItem:    "path/to/include",
+			wantOptions: includeOptions{store: true, symlinks: DEREFERENCE},
+		},
+		{
+			name:        "priority option",
+			item:        "path/to/include [store, priority=-2]",
+			wantItem:    "path/to/include",
+			wantOptions: includeOptions{store: true, priority: -2},
+		},
+		{
+			name:        "fingerprint method option",
+			item:        "path/to/include -> indicator/path [file-mod-time, store]",
+			wantItem:    "path/to/include -> indicator/path",
+			wantOptions: includeOptions{store: true, method: MODTIME},
+		},
+		{
+			name:        "invalid priority option",
+			item:        "path/to/include [priority=high]",
+			wantItem:    "path/to/include",
+			wantOptions: includeOptions{},
+		},
+		{
+			name:        "unknown option",
+			item:        "path/to/include [unknown]",
+			wantItem:    "path/to/include",
+			wantOptions: includeOptions{},
+		},
+		{
+			name:        "brackets in path",
+			item:        "path/to/[include]",
+			wantItem:    "path/to/[include]",
+			wantOptions: includeOptions{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item, options := parseIncludeListItemOptions(tt.item)
+			if strings.TrimSpace(item) != strings.TrimSpace(tt.wantItem) {
+				t.Errorf("parseIncludeListItemOptions() item = %v, want %v", item, tt.wantItem)
+			}
+			if options != tt.wantOptions {
+				t.Errorf("parseIncludeListItemOptions() options = %v, want %v", options, tt.wantOptions)
+			}
+		})
+	}
+}
+
+func Test_optionsForPath(t *testing.T) {
+	optionsByPth := map[string]includeOptions{
+		"/path/to/store":          {store: true},
+		"/path/to/store/compress": {},
+	}
+
+	tests := []struct {
+		name    string
+		pth     string
+		options includeOptions
+	}{
+		{
+			name:    "file in item",
+			pth:     "/path/to/store/file",
+			options: includeOptions{store: true},
+		},
+		{
+			name:    "file in nested item",
+			pth:     "/path/to/store/compress/file",
+			options: includeOptions{},
+		},
+		{
+			name:    "item with common prefix",
+			pth:     "/path/to/stored/file",
+			options: includeOptions{},
+		},
+		{
+			name:    "file item",
+			pth:     "/path/to/store",
+			options: includeOptions{store: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := optionsForPath(tt.pth, optionsByPth); got != tt.options {
+				t.Errorf("optionsForPath() = %v, want %v", got, tt.options)
+			}
+		})
+	}
+}
+
 func Test_parseIncludeList(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -190,6 +315,11 @@ func Test_parseIncludeList(t *testing.T) {
 			list:           []string{"->indicator/path", "path/to/include->indicator/path"},
 			indicatorByPth: map[string]string{"path/to/include": "indicator/path"},
 		},
+		{
+			name:           "options",
+			list:           []string{"path1/to/include [store]", "path2/to/include->indicator/path [store]"},
+			indicatorByPth: map[string]string{"path1/to/include": "", "path2/to/include": "indicator/path"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -201,6 +331,75 @@ func Test_parseIncludeList(t *testing.T) {
 	}
 }
 
+func Test_expandIncludeList(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	createDirStruct(t, map[string]string{
+		filepath.Join(tmpDir, "Caches/org.swift.swiftpm/a"):                                   "",
+		filepath.Join(tmpDir, "Caches/org.swift.foundation.json"):                             "",
+		filepath.Join(tmpDir, "Caches/com.apple.dt/b"):                                        "",
+		filepath.Join(tmpDir, "project/app/build/intermediates/c"):                            "",
+		filepath.Join(tmpDir, "project/lib/build/intermediates/d"):                            "",
+		filepath.Join(tmpDir, "project/lib/build/intermediates/nested/build/intermediates/e"): "",
+		filepath.Join(tmpDir, "literal[1]/f"):                                                 "",
+	})
+
+	tests := []struct {
+		name    string
+		list    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "literal paths",
+			list: []string{"", "path/to/include -> indicator [store]"},
+			want: []string{"", "path/to/include -> indicator [store]"},
+		},
+		{
+			name: "files and directories",
+			list: []string{filepath.Join(tmpDir, "Caches/org.swift.*")},
+			want: []string{filepath.Join(tmpDir, "Caches/org.swift.foundation.json"), filepath.Join(tmpDir, "Caches/org.swift.swiftpm")},
+		},
+		{
+			name: "recursive pattern with indicator and options",
+			list: []string{filepath.Join(tmpDir, "project/**/build/intermediates") + " -> indicator [store]"},
+			want: []string{
+				filepath.Join(tmpDir, "project/app/build/intermediates") + " -> indicator [store]",
+				filepath.Join(tmpDir, "project/lib/build/intermediates") + " -> indicator [store]",
+			},
+		},
+		{
+			name: "existing path named as a pattern",
+			list: []string{filepath.Join(tmpDir, "literal[1]")},
+			want: []string{filepath.Join(tmpDir, "literal[1]")},
+		},
+		{
+			name: "no match",
+			list: []string{filepath.Join(tmpDir, "missing/*")},
+			want: nil,
+		},
+		{
+			name:    "invalid pattern",
+			list:    []string{filepath.Join(tmpDir, "[")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandIncludeList(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandIncludeList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandIncludeList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_parseIgnoreList(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -325,6 +524,36 @@ func Test_normalizeIndicatorByPath(t *testing.T) {
 			normalized:      map[string]string{filepath.Join(tmpDir, "subdir", "file1"): filepath.Join(tmpDir, "subdir", "file2")},
 			wantErr:         false,
 		},
+		{
+			name:            "keeps git indicator of HEAD",
+			indicatorByPath: map[string]string{filepath.Join(tmpDir, "subdir", "file1"): "git:HEAD"},
+			normalized:      map[string]string{filepath.Join(tmpDir, "subdir", "file1"): "git:HEAD"},
+			wantErr:         false,
+		},
+		{
+			name:            "expands git indicator of a dir",
+			indicatorByPath: map[string]string{filepath.Join(tmpDir, "subdir", "file1"): "git:" + filepath.Join("$NORMALIZE_INDICATOR_BY_PATH_TMP_DIR", "subdir")},
+			normalized:      map[string]string{filepath.Join(tmpDir, "subdir", "file1"): "git:" + filepath.Join(tmpDir, "subdir")},
+			wantErr:         false,
+		},
+		{
+			name:            "unquotes command indicator",
+			indicatorByPath: map[string]string{filepath.Join(tmpDir, "subdir", "file1"): `cmd:"echo \"a\""`},
+			normalized:      map[string]string{filepath.Join(tmpDir, "subdir", "file1"): `cmd:echo "a"`},
+			wantErr:         false,
+		},
+		{
+			name:            "drops item if command indicator is invalid",
+			indicatorByPath: map[string]string{filepath.Join(tmpDir, "subdir", "file1"): `cmd:"echo`},
+			normalized:      map[string]string{},
+			wantErr:         false,
+		},
+		{
+			name:            "drops item if git indicator does not exists",
+			indicatorByPath: map[string]string{filepath.Join(tmpDir, "subdir", "file1"): "git:non/existing/indicator"},
+			normalized:      map[string]string{},
+			wantErr:         false,
+		},
 		{
 			name:            "drops item if path does not exists",
 			indicatorByPath: map[string]string{"non/existing/path": ""},
@@ -389,6 +618,24 @@ func Test_normalizeExcludeByPattern(t *testing.T) {
 			normalized:       map[string]bool{filepath.Join(currentDir, "path/to/ignore"): false},
 			wantErr:          false,
 		},
+		{
+			name:             "expands tilde in pattern",
+			excludeByPattern: map[string]bool{"~/.gradle/caches/*.lock": true},
+			normalized:       map[string]bool{filepath.Join(os.Getenv("HOME"), ".gradle/caches/*.lock"): true},
+			wantErr:          false,
+		},
+		{
+			name:             "keeps regular expression",
+			excludeByPattern: map[string]bool{`re:\.lock$`: true},
+			normalized:       map[string]bool{`re:\.lock$`: true},
+			wantErr:          false,
+		},
+		{
+			name:             "invalid regular expression",
+			excludeByPattern: map[string]bool{"re:(": false},
+			normalized:       nil,
+			wantErr:          true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -447,6 +694,27 @@ func Test_match(t *testing.T) {
 			doNotTrack:       true,
 			exclude:          true,
 		},
+		{
+			name:             "regular expression match",
+			pth:              "/project/Podfile.lock",
+			excludeByPattern: map[string]bool{`re:\.lock$`: true},
+			doNotTrack:       true,
+			exclude:          true,
+		},
+		{
+			name:             "regular expression no match",
+			pth:              "/project/Podfile.lock.bak",
+			excludeByPattern: map[string]bool{`re:\.lock$`: true},
+			doNotTrack:       false,
+			exclude:          false,
+		},
+		{
+			name:             "regular expression with glob characters",
+			pth:              "/project/build/tmp-12/a",
+			excludeByPattern: map[string]bool{"re:/build/tmp-[0-9]+/": false},
+			doNotTrack:       true,
+			exclude:          false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -511,3 +779,207 @@ func Test_interleave(t *testing.T) {
 		})
 	}
 }
+
+func Test_dereferenceSymlinks(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	createDirStruct(t, map[string]string{
+		filepath.Join(tmpDir, "Checkouts", "Package", "Sources", "file.swift"): "",
+		filepath.Join(tmpDir, "Checkouts", "file"):                             "",
+	})
+	symlinks := map[string]string{
+		filepath.Join(tmpDir, "Build", "Package"):                        filepath.Join(tmpDir, "Checkouts", "Package"),
+		filepath.Join(tmpDir, "Build", "file"):                           filepath.Join(tmpDir, "Checkouts", "file"),
+		filepath.Join(tmpDir, "Build", "broken"):                         filepath.Join(tmpDir, "not-existing"),
+		filepath.Join(tmpDir, "Checkouts", "Package", "Sources", "loop"): filepath.Join(tmpDir, "Checkouts", "Package"),
+		filepath.Join(tmpDir, "preserved"):                               filepath.Join(tmpDir, "Checkouts", "file"),
+	}
+	if err := os.MkdirAll(filepath.Join(tmpDir, "Build"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	indicatorByPath := map[string]string{}
+	for link, target := range symlinks {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("failed to create symlink: %s", err)
+		}
+		if !strings.Contains(link, "Sources") {
+			indicatorByPath[link] = "indicator"
+		}
+	}
+
+	got, gotDereferenced, err := dereferenceSymlinks(indicatorByPath, func(pth string) bool {
+		return pth != filepath.Join(tmpDir, "preserved")
+	})
+	if err != nil {
+		t.Fatalf("dereferenceSymlinks() error = %v", err)
+	}
+
+	want := map[string]string{
+		filepath.Join(tmpDir, "Build", "Package", "Sources", "file.swift"): "indicator",
+		filepath.Join(tmpDir, "Build", "Package", "Sources", "loop"):       "indicator",
+		filepath.Join(tmpDir, "Build", "file"):                             "indicator",
+		filepath.Join(tmpDir, "Build", "broken"):                           "indicator",
+		filepath.Join(tmpDir, "preserved"):                                 "indicator",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dereferenceSymlinks() = %v, want %v", got, want)
+	}
+
+	wantDereferenced := map[string]bool{filepath.Join(tmpDir, "Build", "file"): true}
+	if !reflect.DeepEqual(gotDereferenced, wantDereferenced) {
+		t.Errorf("dereferenceSymlinks() dereferenced = %v, want %v", gotDereferenced, wantDereferenced)
+	}
+}
+
+func Test_excludeIgnored(t *testing.T) {
+	indicatorByCachePth := map[string]string{
+		"path/to/cache":      "indicator/path",
+		"path/to/cache/file": "path/to/cache/file",
+		"path/to/ignored/b":  "",
+		"path/to/ignored/a":  "",
+	}
+
+	gotIncluded, gotExcluded := excludeIgnored(indicatorByCachePth)
+
+	wantIncluded := map[string]string{
+		"path/to/cache":      "indicator/path",
+		"path/to/cache/file": "path/to/cache/file",
+	}
+	if !reflect.DeepEqual(gotIncluded, wantIncluded) {
+		t.Errorf("excludeIgnored() included = %v, want %v", gotIncluded, wantIncluded)
+	}
+
+	wantExcluded := []string{"path/to/ignored/a", "path/to/ignored/b"}
+	if !reflect.DeepEqual(gotExcluded, wantExcluded) {
+		t.Errorf("excludeIgnored() excluded = %v, want %v", gotExcluded, wantExcluded)
+	}
+}
+
+func Test_ignoreFingerprints(t *testing.T) {
+	indicatorByCachePth := map[string]string{
+		"/path/to/cache/file":       "/path/to/cache/file",
+		"/path/to/cache/build.log":  "/path/to/cache/build.log",
+		"/path/to/cache/sub/a.log":  "/indicator/path",
+		"/path/to/cache/ignored/b":  "",
+		"/path/to/other/daemon.log": "/path/to/other/daemon.log",
+	}
+
+	got := ignoreFingerprints(indicatorByCachePth, map[string]bool{"/path/to/cache/*.log": false})
+
+	want := map[string]string{
+		"/path/to/cache/file":       "/path/to/cache/file",
+		"/path/to/cache/build.log":  "",
+		"/path/to/cache/sub/a.log":  "",
+		"/path/to/cache/ignored/b":  "",
+		"/path/to/other/daemon.log": "/path/to/other/daemon.log",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ignoreFingerprints() = %v, want %v", got, want)
+	}
+}
+
+func Test_ignoreSelfIndicated(t *testing.T) {
+	indicatorByCachePth := map[string]string{
+		"/path/to/cache/file":      "/path/to/cache/file",
+		"/path/to/cache/indicated": "/indicator/path",
+		"/path/to/cache/env":       envIndicatorPrefix + "HOME",
+		"/path/to/cache/ignored":   "",
+	}
+
+	got := ignoreSelfIndicated(indicatorByCachePth)
+
+	want := map[string]string{
+		"/path/to/cache/file":      "",
+		"/path/to/cache/indicated": "/indicator/path",
+		"/path/to/cache/env":       envIndicatorPrefix + "HOME",
+		"/path/to/cache/ignored":   "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ignoreSelfIndicated() = %v, want %v", got, want)
+	}
+}
+
+func Test_expandEnvs(t *testing.T) {
+	for key, value := range map[string]string{"EXPAND_ENVS_SET": "/set", "EXPAND_ENVS_EMPTY": ""} {
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatalf("failed to set %s: %s", key, err)
+		}
+	}
+	if err := os.Unsetenv("EXPAND_ENVS_UNSET"); err != nil {
+		t.Fatalf("failed to unset EXPAND_ENVS_UNSET: %s", err)
+	}
+
+	tests := []struct {
+		s     string
+		want  string
+		unset []string
+	}{
+		{"$EXPAND_ENVS_SET/cache", "/set/cache", nil},
+		{"${EXPAND_ENVS_SET:-/default}/cache", "/set/cache", nil},
+		{"${EXPAND_ENVS_EMPTY:-/default}/cache", "/default/cache", nil},
+		{"${EXPAND_ENVS_UNSET:-/default}/cache", "/default/cache", nil},
+		{"$EXPAND_ENVS_UNSET/cache", "/cache", []string{"EXPAND_ENVS_UNSET"}},
+		{"$EXPAND_ENVS_EMPTY/cache", "/cache", nil},
+	}
+	for _, tt := range tests {
+		if got := expandEnvs(tt.s); got != tt.want {
+			t.Errorf("expandEnvs(%s) = %s, want %s", tt.s, got, tt.want)
+		}
+		if got := unsetEnvs(tt.s); !reflect.DeepEqual(got, tt.unset) {
+			t.Errorf("unsetEnvs(%s) = %v, want %v", tt.s, got, tt.unset)
+		}
+	}
+}
+
+func Test_absPath(t *testing.T) {
+	if err := os.Unsetenv("ABS_PATH_UNSET"); err != nil {
+		t.Fatalf("failed to unset ABS_PATH_UNSET: %s", err)
+	}
+	if err := os.Setenv("ABS_PATH_DOLLAR", "/tmp/$HOME/cache"); err != nil {
+		t.Fatalf("failed to set ABS_PATH_DOLLAR: %s", err)
+	}
+	defer func() {
+		if err := os.Unsetenv("ABS_PATH_DOLLAR"); err != nil {
+			t.Fatalf("failed to unset ABS_PATH_DOLLAR: %s", err)
+		}
+	}()
+	home := os.Getenv("HOME")
+
+	for pth, want := range map[string]string{
+		"~":                                     home,
+		"~/Library/Developer/Xcode/DerivedData": filepath.Join(home, "Library/Developer/Xcode/DerivedData"),
+		"${ABS_PATH_UNSET:-~/.gradle}":          filepath.Join(home, ".gradle"),
+		"${ABS_PATH_UNSET:-$HOME/.gradle}":      filepath.Join(home, ".gradle"),
+		"~/.gradle":                             filepath.Join(home, ".gradle"),
+		"$ABS_PATH_DOLLAR":                      "/tmp/$HOME/cache",
+		"${ABS_PATH_UNSET:-$ABS_PATH_DOLLAR}":   "/tmp/$HOME/cache",
+	} {
+		if got, err := absPath(pth); err != nil || got != want {
+			t.Errorf("absPath(%s) = %v, %v, want %v", pth, got, err, want)
+		}
+	}
+	defer func() {
+		if err := os.Setenv("HOME", home); err != nil {
+			t.Fatalf("failed to restore HOME: %s", err)
+		}
+	}()
+	if err := os.Unsetenv("HOME"); err != nil {
+		t.Fatalf("failed to unset HOME: %s", err)
+	}
+	usr, err := user.Current()
+	if err != nil {
+		t.Fatalf("failed to get current user: %s", err)
+	}
+	if got, err := absPath("~/.gradle"); err != nil || got != filepath.Join(usr.HomeDir, ".gradle") {
+		t.Errorf("absPath(~/.gradle) without HOME = %v, %v, want %v", got, err, filepath.Join(usr.HomeDir, ".gradle"))
+	}
+	if got, err := absPath("~" + usr.Username + "/.gradle"); err != nil || got != filepath.Join(usr.HomeDir, ".gradle") {
+		t.Errorf("absPath(~%s/.gradle) = %v, %v, want %v", usr.Username, got, err, filepath.Join(usr.HomeDir, ".gradle"))
+	}
+	if _, err := absPath("$ABS_PATH_UNSET"); err == nil {
+		t.Errorf("absPath() of empty item error = nil, want error")
+	}
+}
@@ -0,0 +1,80 @@
+// Cache change report related models and functions.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+)
+
+// changeReport is the JSON report of the differences between the previous and the current cache descriptor,
+// attached to the builds to investigate the cache invalidations offline.
+type changeReport struct {
+	Removed        []string    `json:"removed"`
+	Changed        []string    `json:"changed"`
+	Added          []string    `json:"added"`
+	RemovedIgnored []string    `json:"removed_ignored"`
+	AddedIgnored   []string    `json:"added_ignored"`
+	Moved          []movedPath `json:"moved"`
+	Matching       []string    `json:"matching"`
+	ChangedBytes   int64       `json:"changed_bytes"`
+}
+
+// movedPath is a moved file of the change report, which is listed in Removed and Added too.
+type movedPath struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// sortedPaths returns a sorted copy of pths, an empty list rather than null if there is none.
+func sortedPaths(pths []string) []string {
+	sorted := append([]string{}, pths...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// matchingPaths returns the paths of descriptor, the current cache descriptor, which did not change in r.
+// compare only counts them, the unchanged directories are not walked.
+func matchingPaths(descriptor map[string]string, r result) []string {
+	changed := map[string]bool{}
+	for _, pths := range [][]string{r.changed, r.added, r.addedIgnored} {
+		for _, pth := range pths {
+			changed[pth] = true
+		}
+	}
+	var matching []string
+	for pth := range descriptor {
+		if !changed[pth] {
+			matching = append(matching, pth)
+		}
+	}
+	return matching
+}
+
+// writeChangeReport writes the change report of r, the differences from the previous cache to descriptor, to pth, creating its directory.
+func writeChangeReport(pth string, descriptor map[string]string, r result) error {
+	moved := []movedPath{}
+	for _, move := range r.moved {
+		moved = append(moved, movedPath{From: move.from, To: move.to})
+	}
+	b, err := json.MarshalIndent(changeReport{
+		Removed:        sortedPaths(r.removed),
+		Changed:        sortedPaths(r.changed),
+		Added:          sortedPaths(r.added),
+		RemovedIgnored: sortedPaths(r.removedIgnored),
+		AddedIgnored:   sortedPaths(r.addedIgnored),
+		Moved:          moved,
+		Matching:       sortedPaths(matchingPaths(descriptor, r)),
+		ChangedBytes:   r.changedBytes,
+	}, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return err
+	}
+	return fileutil.WriteBytesToFile(pth, b)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_writeChangeReport(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	pth := filepath.Join(tmpDir, "deploy", "cache-changes.json")
+
+	descriptor := map[string]string{"/cache/changed": "2", "/cache/matching": "1", "/cache/b": "1", "/cache/a": "1", "/cache/ignored": "-"}
+	r := compare(
+		map[string]string{"/cache/removed": "1", "/cache/changed": "1", "/cache/matching": "1"},
+		descriptor,
+		nil, map[string]int64{"/cache/changed": 10, "/cache/a": 1, "/cache/b": 2},
+	)
+	if err := writeChangeReport(pth, descriptor, r); err != nil {
+		t.Fatalf("writeChangeReport() error = %v", err)
+	}
+
+	b, err := fileutil.ReadBytesFromFile(pth)
+	if err != nil {
+		t.Fatalf("failed to read change report: %s", err)
+	}
+	var report changeReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatalf("failed to parse change report: %s", err)
+	}
+	want := changeReport{
+		Removed:        []string{"/cache/removed"},
+		Changed:        []string{"/cache/changed"},
+		Added:          []string{"/cache/a", "/cache/b"},
+		RemovedIgnored: []string{},
+		AddedIgnored:   []string{"/cache/ignored"},
+		Moved:          []movedPath{},
+		Matching:       []string{"/cache/matching"},
+		ChangedBytes:   13,
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("writeChangeReport() wrote %+v, want %+v", report, want)
+	}
+}
@@ -0,0 +1,80 @@
+// Checksum manifest related models and functions.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// fileChecksum describes an archived file in the checksum manifest,
+// the pull step verifies the extracted files against it.
+type fileChecksum struct {
+	// SHA256 is the hex encoded SHA256 checksum of the content of regular files, empty for other file types.
+	SHA256 string      `json:"sha256,omitempty"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+}
+
+// dryChecksum replaces the checksums of dry runs, it has the length of the real checksums,
+// so that the manifest's size matches the manifest of the real archive.
+var dryChecksum = strings.Repeat("0", sha256.Size*2)
+
+// zeroReader reads zero bytes, the content of the holes of sparse files.
+type zeroReader struct{}
+
+func (reader zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// newChecksum returns the hash of a regular file's content, nil in dry runs.
+func newChecksum(dry bool) hash.Hash {
+	if dry {
+		return nil
+	}
+	return sha256.New()
+}
+
+// addChecksum records the file written into the archive as pth in the checksum manifest,
+// sum is the hash of the file's content, nil in dry runs and for non regular files.
+func (a *Archive) addChecksum(pth string, info os.FileInfo, sum hash.Hash) {
+	if a.checksums == nil {
+		a.checksums = map[string]fileChecksum{}
+	}
+
+	checksum := fileChecksum{Mode: info.Mode()}
+	if info.Mode().IsRegular() {
+		checksum.Size = info.Size()
+		checksum.SHA256 = dryChecksum
+		if sum != nil {
+			checksum.SHA256 = hex.EncodeToString(sum.Sum(nil))
+		}
+	}
+	a.checksums[pth] = checksum
+}
+
+// hashWriter returns a writer writing to entry and sum, or entry only if sum is nil.
+func hashWriter(entry io.Writer, sum hash.Hash) io.Writer {
+	if sum == nil {
+		return entry
+	}
+	return io.MultiWriter(entry, sum)
+}
+
+// writeChecksums writes the checksum manifest into the archive,
+// mapping the archived files' paths to their checksum, size and mode.
+func (a *Archive) writeChecksums(checksumsPth string) error {
+	b, err := json.Marshal(a.checksums)
+	if err != nil {
+		return err
+	}
+
+	return a.writeData(b, checksumsPth)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func TestArchive_writeChecksums(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	file := filepath.Join(tmpDir, "file")
+	empty := filepath.Join(tmpDir, "empty")
+	link := filepath.Join(tmpDir, "link")
+	createDirStruct(t, map[string]string{
+		file:  "content",
+		empty: "",
+	})
+	if err := os.Symlink(file, link); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+	pths := []string{file, empty, link}
+
+	mode := func(pth string) os.FileMode {
+		info, err := os.Lstat(pth)
+		if err != nil {
+			t.Fatalf("failed to lstat: %s", err)
+		}
+		return info.Mode()
+	}
+	want := map[string]fileChecksum{
+		file:  {SHA256: "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73", Size: 7, Mode: mode(file)},
+		empty: {SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Size: 0, Mode: mode(empty)},
+		link:  {Mode: mode(link)},
+	}
+
+	tests := []struct {
+		name string
+		dry  bool
+		want map[string]fileChecksum
+	}{
+		{
+			name: "files",
+			want: want,
+		},
+		{
+			name: "dry run",
+			dry:  true,
+			want: map[string]fileChecksum{
+				file:  {SHA256: dryChecksum, Size: 7, Mode: mode(file)},
+				empty: {SHA256: dryChecksum, Size: 0, Mode: mode(empty)},
+				link:  {Mode: mode(link)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var writer bufferWriteCloser
+			archive, err := NewArchive(&writer, TAR, Compression{Method: NONE})
+			if err != nil {
+				t.Fatalf("failed to create archive: %s", err)
+			}
+			if err := archive.Write(pths, tt.dry); err != nil {
+				t.Fatalf("failed to write archive: %s", err)
+			}
+			if err := archive.writeChecksums(cacheChecksumsPath); err != nil {
+				t.Fatalf("failed to write checksums: %s", err)
+			}
+			if err := archive.Close(); err != nil {
+				t.Fatalf("failed to close archive: %s", err)
+			}
+
+			reader := tar.NewReader(&writer)
+			for {
+				header, err := reader.Next()
+				if err != nil {
+					t.Fatalf("checksum manifest not found: %s", err)
+				}
+				if header.Name == cacheChecksumsPath {
+					break
+				}
+			}
+
+			b, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("failed to read checksum manifest: %s", err)
+			}
+			var got map[string]fileChecksum
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("failed to decode checksum manifest: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checksum manifest = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+// Content-defined chunking related models and functions.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const (
+	// chunkMinSize is the minimum size of a chunk, the content is not hashed until a chunk reaches this size.
+	chunkMinSize = 256 * 1024
+	// chunkAvgSize is the normal size of a chunk, boundaries are less likely before and more likely after it.
+	chunkAvgSize = 1024 * 1024
+	// chunkMaxSize is the maximum size of a chunk, a boundary is forced if none was found.
+	chunkMaxSize = 4 * 1024 * 1024
+
+	// chunkMaskSmall and chunkMaskLarge select the bits of the fingerprint which must be zero at a boundary,
+	// before and after the normal size: 2 bits more and less than log2(chunkAvgSize) as FastCDC's normalized chunking.
+	chunkMaskSmall = uint64(1<<22-1) << (64 - 22)
+	chunkMaskLarge = uint64(1<<18-1) << (64 - 18)
+)
+
+// chunkIndexSuffix is appended to the archive path to get the path of the chunk index.
+const chunkIndexSuffix = ".chunks.json"
+
+// chunkGear is the random value of each byte in the FastCDC gear hash.
+// It is generated with the fixed seed, the boundaries must not change between builds to deduplicate the chunks.
+var chunkGear = func() [256]uint64 {
+	var gear [256]uint64
+	// splitmix64
+	state := uint64(0x5CA1AB1E)
+	for i := range gear {
+		state += 0x9E3779B97F4A7C15
+		z := state
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		gear[i] = z ^ (z >> 31)
+	}
+	return gear
+}()
+
+// chunk describes a chunk of a chunked archive.
+type chunk struct {
+	// Hash is the hex encoded SHA256 checksum of the chunk's uncompressed content, the name of the chunk file.
+	Hash           string `json:"hash"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressed_size"`
+}
+
+// chunkIndex lists the chunks of a chunked archive,
+// decompressing and concatenating the chunks in order restores the uncompressed archive.
+type chunkIndex struct {
+	Compression CompressionMethod `json:"compression"`
+	Chunks      []chunk           `json:"chunks"`
+	Size        int64             `json:"size"`
+}
+
+// chunkBoundary returns the size of the first chunk of data with FastCDC,
+// data is expected to be at least chunkMaxSize long unless it is the end of the archive.
+func chunkBoundary(data []byte) int {
+	n := len(data)
+	if n <= chunkMinSize {
+		return n
+	}
+	if n > chunkMaxSize {
+		n = chunkMaxSize
+	}
+	normal := chunkAvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fingerprint uint64
+	i := chunkMinSize
+	for ; i < normal; i++ {
+		fingerprint = fingerprint<<1 + chunkGear[data[i]]
+		if fingerprint&chunkMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fingerprint = fingerprint<<1 + chunkGear[data[i]]
+		if fingerprint&chunkMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// readChunkIndex reads the chunk index at pth, returns nil if it does not exist.
+func readChunkIndex(pth string) (*chunkIndex, error) {
+	if exists, err := pathutil.IsPathExists(pth); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, nil
+	}
+
+	b, err := fileutil.ReadBytesFromFile(pth)
+	if err != nil {
+		return nil, err
+	}
+
+	var index chunkIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// downloadChunkIndex downloads the chunk index of the chunked archive at pth previously uploaded to the destination url,
+// returns nil if it does not exist.
+// The index is uploaded after all of its chunks, so the chunks it lists are stored by the destination.
+func downloadChunkIndex(pth, url string) (*chunkIndex, error) {
+	b, err := downloadArchiveFile(pth+chunkIndexSuffix, url)
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	var index chunkIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse chunk index: %s", err)
+	}
+	return &index, nil
+}
+
+// chunkWriter splits the written archive into content-defined chunks and compresses them individually,
+// so that the unchanged parts of the archive produce the same chunks in subsequent builds.
+// The chunks not stored by the cache yet are written into the chunk directory named by their hash,
+// the chunk index is written on Close.
+type chunkWriter struct {
+	pth         string
+	dir         string
+	compression Compression
+	// known maps the hashes of the chunks stored by the cache to the chunks.
+	known map[string]chunk
+	// buf holds the written content not split into chunks yet.
+	buf    []byte
+	chunks []chunk
+	// written lists the chunks written into the chunk directory.
+	written []chunk
+}
+
+// newChunkWriter creates a chunkWriter writing the chunk index to the archive path suffixed with chunkIndexSuffix,
+// the chunks of the previous index are not written again if they were compressed with the same method.
+func newChunkWriter(pth, dir string, compression Compression, previous *chunkIndex) (*chunkWriter, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to remove chunk directory (%s): %s", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create chunk directory (%s): %s", dir, err)
+	}
+
+	known := map[string]chunk{}
+	if previous != nil && previous.Compression == compression.Method {
+		for _, chunk := range previous.Chunks {
+			known[chunk.Hash] = chunk
+		}
+	}
+
+	return &chunkWriter{
+		pth:         pth,
+		dir:         dir,
+		compression: compression,
+		known:       known,
+	}, nil
+}
+
+// Write buffers b and writes the chunks found in the buffer,
+// a chunk is only split when the buffer is full, since its boundary may be anywhere up to chunkMaxSize.
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for len(w.buf) >= chunkMaxSize {
+		if err := w.writeChunk(chunkBoundary(w.buf)); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// writeChunk writes the first size bytes of the buffer as a chunk, unless the chunk is already known.
+func (w *chunkWriter) writeChunk(size int) error {
+	data := w.buf[:size]
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	c, ok := w.known[hash]
+	if !ok {
+		var err error
+		c, err = w.compressChunk(hash, data)
+		if err != nil {
+			return err
+		}
+		w.known[hash] = c
+		w.written = append(w.written, c)
+	}
+	w.chunks = append(w.chunks, c)
+
+	w.buf = append(w.buf[:0], w.buf[size:]...)
+	return nil
+}
+
+// compressChunk compresses data into the chunk file of the given hash.
+func (w *chunkWriter) compressChunk(hash string, data []byte) (chunk, error) {
+	pth := w.chunkPath(hash)
+	file, err := os.Create(pth)
+	if err != nil {
+		return chunk{}, fmt.Errorf("failed to create chunk (%s): %s", pth, err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warnf("Failed to close chunk (%s): %s", pth, err)
+		}
+	}()
+
+	counter := &countingWriter{writer: file}
+	compressor, err := newCompressor(counter, w.compression)
+	if err != nil {
+		return chunk{}, err
+	}
+
+	if compressor == nil {
+		_, err = counter.Write(data)
+	} else if _, err = compressor.Write(data); err == nil {
+		err = compressor.Close()
+	}
+	if err != nil {
+		return chunk{}, fmt.Errorf("failed to write chunk (%s): %s", pth, err)
+	}
+
+	return chunk{
+		Hash:           hash,
+		Size:           int64(len(data)),
+		CompressedSize: counter.n,
+	}, nil
+}
+
+// chunkPath returns the path of the chunk file of the given hash.
+func (w *chunkWriter) chunkPath(hash string) string {
+	return filepath.Join(w.dir, hash)
+}
+
+// indexPath returns the path of the chunk index.
+func (w *chunkWriter) indexPath() string {
+	return w.pth + chunkIndexSuffix
+}
+
+// compressedSize returns the size of all of the archive's chunks after compression.
+func (w *chunkWriter) compressedSize() int64 {
+	var size int64
+	for _, chunk := range w.chunks {
+		size += chunk.CompressedSize
+	}
+	return size
+}
+
+// Close writes the rest of the buffer as chunks and writes the chunk index.
+func (w *chunkWriter) Close() error {
+	for len(w.buf) > 0 {
+		if err := w.writeChunk(chunkBoundary(w.buf)); err != nil {
+			return err
+		}
+	}
+
+	index := chunkIndex{
+		Compression: w.compression.Method,
+		Chunks:      w.chunks,
+	}
+	for _, chunk := range w.chunks {
+		index.Size += chunk.Size
+	}
+
+	b, err := json.MarshalIndent(index, "", " ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteBytesToFile(w.indexPath(), b)
+}
+
+// uploadChunks uploads the chunks written by the given writer with at most parallel concurrent uploads, then the chunk index,
+// so that the index is only uploaded if all of its chunks are stored by the cache.
+func uploadChunks(writer *chunkWriter, url string, parallel int, state *uploadState) error {
+	log.Printf("Uploading %d new chunks of %d chunks", len(writer.written), len(writer.chunks))
+	var pths []string
+	for _, chunk := range writer.written {
+		pths = append(pths, writer.chunkPath(chunk.Hash))
+	}
+	if err := uploadFiles("chunk", pths, url, parallel, state, log.Debugf); err != nil {
+		return err
+	}
+
+	log.Printf("Uploading chunk index: %s", writer.indexPath())
+	if err := uploadArchiveFile(writer.indexPath(), url); err != nil {
+		return fmt.Errorf("failed to upload chunk index: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_chunkBoundary(t *testing.T) {
+	data := make([]byte, 3*chunkMaxSize)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	tests := []struct {
+		name string
+		data []byte
+		min  int
+		max  int
+	}{
+		{name: "shorter than minimum", data: data[:chunkMinSize-1], min: chunkMinSize - 1, max: chunkMinSize - 1},
+		{name: "random", data: data, min: chunkMinSize + 1, max: chunkMaxSize},
+		{name: "no boundary", data: make([]byte, 2*chunkMaxSize), min: chunkMaxSize, max: chunkMaxSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chunkBoundary(tt.data); got < tt.min || got > tt.max {
+				t.Errorf("chunkBoundary() = %d, want between %d and %d", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func Test_chunkWriter(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	data := make([]byte, 16*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	compression := Compression{Method: ZSTD}
+
+	write := func(data []byte, previous *chunkIndex) *chunkWriter {
+		writer, err := newChunkWriter(filepath.Join(tmpDir, "cache-archive.tar"), filepath.Join(tmpDir, "chunks"), compression, previous)
+		if err != nil {
+			t.Fatalf("failed to create chunk writer: %s", err)
+		}
+		// Write in pieces smaller than the chunks.
+		for len(data) > 0 {
+			n := 100 * 1024
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := writer.Write(data[:n]); err != nil {
+				t.Fatalf("failed to write: %s", err)
+			}
+			data = data[n:]
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("failed to close: %s", err)
+		}
+		return writer
+	}
+
+	first := write(data, nil)
+	if len(first.chunks) < 2 || len(first.written) != len(first.chunks) {
+		t.Fatalf("first archive: %d chunks, %d written, want multiple chunks all written", len(first.chunks), len(first.written))
+	}
+
+	var joined []byte
+	for _, chunk := range first.chunks {
+		file, err := os.Open(first.chunkPath(chunk.Hash))
+		if err != nil {
+			t.Fatalf("failed to open chunk: %s", err)
+		}
+		decompressor, err := newDecompressor(file, compression)
+		if err != nil {
+			t.Fatalf("failed to decompress chunk: %s", err)
+		}
+		b, err := ioutil.ReadAll(decompressor)
+		if err != nil {
+			t.Fatalf("failed to read chunk: %s", err)
+		}
+		joined = append(joined, b...)
+		if err := file.Close(); err != nil {
+			t.Fatalf("failed to close chunk: %s", err)
+		}
+	}
+	if !bytes.Equal(joined, data) {
+		t.Errorf("joined chunks do not match the written content")
+	}
+
+	previous, err := readChunkIndex(first.indexPath())
+	if err != nil {
+		t.Fatalf("failed to read chunk index: %s", err)
+	}
+	if previous.Size != int64(len(data)) || len(previous.Chunks) != len(first.chunks) {
+		t.Errorf("chunk index: %d chunks of %d bytes, want %d chunks of %d bytes", len(previous.Chunks), previous.Size, len(first.chunks), len(data))
+	}
+
+	// Inserting content shifts the rest of the archive, only the chunks around the change are new.
+	changed := append(append(append([]byte{}, data[:len(data)/2]...), []byte("changed")...), data[len(data)/2:]...)
+	second := write(changed, previous)
+	if len(second.written) == 0 || len(second.written) > 2 {
+		t.Errorf("second archive: %d new chunks, want 1 or 2", len(second.written))
+	}
+
+	third := write(changed, &chunkIndex{Compression: LZ4, Chunks: previous.Chunks})
+	if len(third.written) != len(third.chunks) {
+		t.Errorf("archive with different compression: %d new chunks, want all %d chunks", len(third.written), len(third.chunks))
+	}
+}
+
+func Test_downloadChunkIndex(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "cache-archive.tar")
+	url := fileDestinationURL(filepath.Join(tmpDir, "nfs"), 1)
+
+	index, err := downloadChunkIndex(pth, url)
+	if err != nil || index != nil {
+		t.Fatalf("downloadChunkIndex() = %v, %v, want no index before the upload", index, err)
+	}
+
+	writer, err := newChunkWriter(pth, filepath.Join(tmpDir, "chunks"), Compression{Method: NONE}, nil)
+	if err != nil {
+		t.Fatalf("newChunkWriter() error = %v", err)
+	}
+	if _, err := writer.Write(bytes.Repeat([]byte("cache"), chunkMaxSize)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := uploadChunks(writer, url, 1, nil); err != nil {
+		t.Fatalf("uploadChunks() error = %v", err)
+	}
+
+	index, err = downloadChunkIndex(pth, url)
+	if err != nil {
+		t.Fatalf("downloadChunkIndex() error = %v", err)
+	}
+	if index == nil || len(index.Chunks) != len(writer.chunks) || index.Compression != NONE {
+		t.Errorf("downloadChunkIndex() = %+v, want the index of %d chunks", index, len(writer.chunks))
+	}
+}
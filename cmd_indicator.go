@@ -0,0 +1,45 @@
+// Command output change indicator related models and functions.
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+)
+
+// cmdIndicatorPrefix prefixes the change indicators fingerprinted by the output of a command, instead of the content of a file.
+const cmdIndicatorPrefix = "cmd:"
+
+// parseCmdIndicator returns the command of a command indicator, and reports whether indicator is a command indicator.
+// The command may be double-quoted, with the escapes of Go string literals.
+func parseCmdIndicator(indicator string) (string, bool, error) {
+	if !strings.HasPrefix(indicator, cmdIndicatorPrefix) {
+		return "", false, nil
+	}
+
+	cmd := strings.TrimSpace(strings.TrimPrefix(indicator, cmdIndicatorPrefix))
+	if strings.HasPrefix(cmd, `"`) {
+		var err error
+		if cmd, err = strconv.Unquote(cmd); err != nil {
+			return "", true, fmt.Errorf("invalid quoted command (%s): %s", cmd, err)
+		}
+	}
+	if cmd == "" {
+		return "", true, fmt.Errorf("empty command")
+	}
+	return cmd, true, nil
+}
+
+// cmdIndicator returns the fingerprint of a command indicator: the SHA-256 hash of the command's stdout without surrounding whitespaces,
+// the command is run by bash in the working directory, and fails the fingerprint if it exits with an error.
+func cmdIndicator(cmd string) (string, error) {
+	out, err := command.New("bash", "-c", cmd).SetStderr(os.Stderr).RunAndReturnTrimmedOutput()
+	if err != nil {
+		return "", fmt.Errorf("indicator command (%s) failed: %s", cmd, err)
+	}
+	return fmt.Sprintf("cmd: %x", sha256.Sum256([]byte(out))), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func Test_parseCmdIndicator(t *testing.T) {
+	tests := []struct {
+		name      string
+		indicator string
+		wantCmd   string
+		wantOk    bool
+		wantErr   bool
+	}{
+		{name: "file indicator", indicator: "indicator/path", wantCmd: "", wantOk: false, wantErr: false},
+		{name: "unquoted command", indicator: "cmd: ./gradlew dependencies", wantCmd: "./gradlew dependencies", wantOk: true, wantErr: false},
+		{name: "quoted command", indicator: `cmd:"./gradlew dependencies --write-hash"`, wantCmd: "./gradlew dependencies --write-hash", wantOk: true, wantErr: false},
+		{name: "escaped quotes", indicator: `cmd:"echo \"a b\""`, wantCmd: `echo "a b"`, wantOk: true, wantErr: false},
+		{name: "unterminated quote", indicator: `cmd:"echo`, wantCmd: "", wantOk: true, wantErr: true},
+		{name: "empty command", indicator: `cmd:""`, wantCmd: "", wantOk: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, ok, err := parseCmdIndicator(tt.indicator)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCmdIndicator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cmd != tt.wantCmd || ok != tt.wantOk {
+				t.Errorf("parseCmdIndicator() = %v, %v, want %v, %v", cmd, ok, tt.wantCmd, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_cmdIndicator(t *testing.T) {
+	got, err := cmdIndicator("echo a; echo b >&2")
+	if err != nil {
+		t.Fatalf("cmdIndicator() error = %v", err)
+	}
+	if want := fmt.Sprintf("cmd: %x", sha256.Sum256([]byte("a"))); got != want {
+		t.Errorf("cmdIndicator() = %v, want the hash of the stdout %v", got, want)
+	}
+
+	if _, err := cmdIndicator("exit 1"); err == nil {
+		t.Errorf("cmdIndicator() of failing command error = nil, want error")
+	}
+}
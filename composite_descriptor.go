@@ -0,0 +1,124 @@
+// Composite cache descriptor related models and functions.
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// compositeTree is a directory of the fingerprinted files, hashed into one digest like a Merkle tree.
+type compositeTree struct {
+	files map[string]string
+	dirs  map[string]*compositeTree
+	// sum and count memoize the digest and the number of the files of the tree, it is not modified once digested.
+	sum   string
+	count int
+}
+
+// newCompositeTree creates an empty compositeTree.
+func newCompositeTree() *compositeTree {
+	return &compositeTree{files: map[string]string{}, dirs: map[string]*compositeTree{}}
+}
+
+// add adds the fingerprint of the file at the path relative to the tree.
+func (t *compositeTree) add(rel, fingerprint string) {
+	names := strings.Split(filepath.ToSlash(rel), "/")
+	for _, name := range names[:len(names)-1] {
+		dir, ok := t.dirs[name]
+		if !ok {
+			dir = newCompositeTree()
+			t.dirs[name] = dir
+		}
+		t = dir
+	}
+	t.files[names[len(names)-1]] = fingerprint
+}
+
+// digest returns the hash of the sorted entries of the tree, each entry is either a file's fingerprint or a directory's digest.
+func (t *compositeTree) digest() string {
+	if t.sum != "" {
+		return t.sum
+	}
+
+	t.count = len(t.files)
+	names := make([]string, 0, len(t.files)+len(t.dirs))
+	for name := range t.files {
+		names = append(names, name)
+	}
+	for name := range t.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		if fingerprint, ok := t.files[name]; ok {
+			fmt.Fprintf(h, "file %s\x00%s\n", name, fingerprint)
+		} else {
+			fmt.Fprintf(h, "dir %s\x00%s\n", name, t.dirs[name].digest())
+			t.count += t.dirs[name].count
+		}
+	}
+	t.sum = fmt.Sprintf("%x", h.Sum(nil))
+	return t.sum
+}
+
+// fileCount returns the number of the files in the tree and its subdirectories.
+func (t *compositeTree) fileCount() int {
+	t.digest()
+	return t.count
+}
+
+// isCompositeDescriptorPath reports whether pth is the key of a directory's digest in a composite cache descriptor.
+func isCompositeDescriptorPath(pth string) bool {
+	return strings.HasSuffix(pth, string(filepath.Separator))
+}
+
+// compositeDescriptor collapses the fingerprints of the files under each directory include item into one digest,
+// keyed by the directory's path with a trailing separator; the files of the file include items are kept as they are.
+// The ignored files are left out of the digests, a directory of ignored files only is ignored as well.
+func compositeDescriptor(descriptor map[string]string, itemPths []string) map[string]string {
+	composite := map[string]string{}
+	treeByItem := map[string]*compositeTree{}
+	for pth, fingerprint := range descriptor {
+		item, ok := includeItemOf(pth, itemPths)
+		if !ok || item == pth {
+			composite[pth] = fingerprint
+			continue
+		}
+
+		tree, ok := treeByItem[item]
+		if !ok {
+			tree = newCompositeTree()
+			treeByItem[item] = tree
+		}
+		if fingerprint != "-" {
+			tree.add(strings.TrimPrefix(pth, item+string(filepath.Separator)), fingerprint)
+		}
+	}
+
+	for item, tree := range treeByItem {
+		digest := "-"
+		if len(tree.files) > 0 || len(tree.dirs) > 0 {
+			digest = "tree: " + tree.digest()
+		}
+		composite[item+string(filepath.Separator)] = digest
+	}
+	return composite
+}
+
+// compositeSizes sums the sizes of the files under each directory include item,
+// keyed as the directory's digest in the composite descriptor.
+func compositeSizes(sizes map[string]int64, itemPths []string) map[string]int64 {
+	composite := map[string]int64{}
+	for pth, size := range sizes {
+		if item, ok := includeItemOf(pth, itemPths); ok && item != pth {
+			pth = item + string(filepath.Separator)
+		}
+		composite[pth] += size
+	}
+	return composite
+}
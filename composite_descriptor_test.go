@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_compositeDescriptor(t *testing.T) {
+	itemPths := []string{"/cache/dir", "/cache/file", "/cache/ignored"}
+	descriptor := map[string]string{
+		"/cache/dir/a":       "fingerprint a",
+		"/cache/dir/sub/b":   "fingerprint b",
+		"/cache/dir/sub/c":   "-",
+		"/cache/file":        "fingerprint file",
+		"/cache/ignored/d":   "-",
+		"/cache/other/file2": "fingerprint file2",
+	}
+
+	composite := compositeDescriptor(descriptor, itemPths)
+	if len(composite) != 4 {
+		t.Fatalf("compositeDescriptor() = %v, want 4 entries", composite)
+	}
+	for _, pth := range []string{"/cache/file", "/cache/other/file2"} {
+		if composite[pth] != descriptor[pth] {
+			t.Errorf("compositeDescriptor()[%s] = %v, want %v", pth, composite[pth], descriptor[pth])
+		}
+	}
+	if composite["/cache/ignored/"] != "-" {
+		t.Errorf("compositeDescriptor() of ignored directory = %v, want -", composite["/cache/ignored/"])
+	}
+
+	digest := composite["/cache/dir/"]
+	tests := []struct {
+		name    string
+		change  map[string]string
+		changed bool
+	}{
+		{name: "ignored file changes", change: map[string]string{"/cache/dir/sub/c": "-", "/cache/dir/sub/e": "-"}, changed: false},
+		{name: "file changes", change: map[string]string{"/cache/dir/sub/b": "fingerprint b2"}, changed: true},
+		{name: "file added", change: map[string]string{"/cache/dir/e": "fingerprint e"}, changed: true},
+		{name: "file moved into subdirectory", change: map[string]string{"/cache/dir/a": "", "/cache/dir/sub/a": "fingerprint a"}, changed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := map[string]string{}
+			for pth, fingerprint := range descriptor {
+				changed[pth] = fingerprint
+			}
+			for pth, fingerprint := range tt.change {
+				if fingerprint == "" {
+					delete(changed, pth)
+				} else {
+					changed[pth] = fingerprint
+				}
+			}
+
+			got := compositeDescriptor(changed, itemPths)["/cache/dir/"]
+			if (got != digest) != tt.changed {
+				t.Errorf("compositeDescriptor() digest = %v, previous %v, want changed %v", got, digest, tt.changed)
+			}
+		})
+	}
+
+	if again := compositeDescriptor(descriptor, itemPths); !reflect.DeepEqual(again, composite) {
+		t.Errorf("compositeDescriptor() = %v, want stable %v", again, composite)
+	}
+}
+
+func Test_compositeSizes(t *testing.T) {
+	itemPths := []string{"/cache/dir", "/cache/file"}
+	sizes := map[string]int64{
+		"/cache/dir/a":       1,
+		"/cache/dir/sub/b":   10,
+		"/cache/file":        100,
+		"/cache/other/file2": 1000,
+	}
+	want := map[string]int64{
+		"/cache/dir/":        11,
+		"/cache/file":        100,
+		"/cache/other/file2": 1000,
+	}
+	if got := compositeSizes(sizes, itemPths); !reflect.DeepEqual(got, want) {
+		t.Errorf("compositeSizes() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,362 @@
+// Cache archive compression related models and functions.
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/andybalholm/brotli"
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+	"github.com/klauspost/compress"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+)
+
+// CompressionMethod ...
+type CompressionMethod string
+
+const (
+	// NONE ...
+	NONE = CompressionMethod("none")
+	// GZIP ...
+	GZIP = CompressionMethod("gzip")
+	// ZSTD ...
+	ZSTD = CompressionMethod("zstd")
+	// LZ4 ...
+	LZ4 = CompressionMethod("lz4")
+	// XZ ...
+	XZ = CompressionMethod("xz")
+	// BROTLI ...
+	BROTLI = CompressionMethod("brotli")
+	// AUTO ...
+	AUTO = CompressionMethod("auto")
+)
+
+const (
+	// dictionaryFrameMagic is the magic number of the skippable frame containing the zstd dictionary.
+	dictionaryFrameMagic = 0x184D2A50
+	// dictionarySampleFiles is the maximum number of files sampled to train a zstd dictionary.
+	dictionarySampleFiles = 1000
+	// dictionarySampleSize is the maximum number of bytes sampled from the beginning of a file to train a zstd dictionary.
+	dictionarySampleSize = 16 * 1024
+	// dictionaryMaxSize is the maximum size of a trained zstd dictionary, the zstd CLI's default.
+	dictionaryMaxSize = 110 * 1024
+	// dictionaryMinID is the smallest dictionary ID not reserved by the zstd format.
+	dictionaryMinID = 32768
+)
+
+const (
+	// autoCompressionSampleFiles is the maximum number of files sampled to estimate compressibility.
+	autoCompressionSampleFiles = 100
+	// autoCompressionSampleSize is the maximum number of bytes sampled from the beginning of a file.
+	autoCompressionSampleSize = 64 * 1024
+	// autoCompressionThreshold is the compressibility estimate below which the archive is not compressed.
+	autoCompressionThreshold = 0.1
+)
+
+const (
+	// zstdMinWindowLog is the base 2 logarithm of the smallest zstd window size (1KB).
+	zstdMinWindowLog = 10
+	// zstdMaxWindowLog is the base 2 logarithm of the largest zstd window size the encoder supports (512MB).
+	zstdMaxWindowLog = 29
+)
+
+// xzDictCap is the xz dictionary size, the same as `xz -9` uses to produce the smallest archives.
+const xzDictCap = 64 << 20
+
+// Compression describes how the cache archive is compressed.
+type Compression struct {
+	Method CompressionMethod
+	// Level is the gzip compression level (1-9), 0 means the method's default.
+	Level int
+	// Seekable compresses the archive entries into independent zstd frames and writes an entry index,
+	// so that individual entries can be extracted without decompressing the whole archive.
+	Seekable bool
+	// Dictionary is the zstd dictionary used to compress the archive,
+	// it is written as a skippable frame to the beginning of the archive to allow decompression.
+	Dictionary []byte
+	// WindowLog is the base 2 logarithm of the zstd window size, 0 means the level's default (at most 8MB).
+	// Larger windows find matches in distant parts of huge archives, similar to the zstd CLI's long mode.
+	WindowLog int
+	// GzipCommand is the path of the gzip compatible command compressing the archive,
+	// empty compresses the archive with klauspost/compress.
+	GzipCommand string
+	// Bandwidth receives the measured upload bandwidth (in bytes per second) while the archive is written,
+	// if set the compression level is adjusted to the bandwidth between the archive entries.
+	Bandwidth <-chan float64
+}
+
+// newCompressor wraps the given writer with a compressing writer of the given compression.
+// Returns nil if the method is NONE.
+func newCompressor(writer io.Writer, compression Compression) (io.WriteCloser, error) {
+	if compression.Seekable {
+		switch compression.Method {
+		case NONE:
+			return nil, nil
+		case ZSTD:
+			zstdWriter, err := newZstdFrameWriter(writer, true, zstdOptions(compression)...)
+			if err != nil {
+				return nil, err
+			}
+			return zstdWriter, nil
+		default:
+			return nil, fmt.Errorf("seekable archive is not supported with compression method: %s", compression.Method)
+		}
+	}
+
+	switch compression.Method {
+	case NONE:
+		return nil, nil
+	case GZIP:
+		level := compression.Level
+		if level == 0 {
+			level = gzip.BestCompression
+		}
+		if compression.GzipCommand != "" {
+			return newCommandFrameWriter(writer, compression.GzipCommand, level), nil
+		}
+		gzipWriter, err := newGzipFrameWriter(writer, level)
+		if err != nil {
+			return nil, err
+		}
+		return gzipWriter, nil
+	case ZSTD:
+		options := zstdOptions(compression)
+		if len(compression.Dictionary) > 0 {
+			if err := writeSkippableFrame(writer, dictionaryFrameMagic, compression.Dictionary); err != nil {
+				return nil, err
+			}
+			options = append(options, zstd.WithEncoderDict(compression.Dictionary))
+		}
+
+		zstdWriter, err := newZstdFrameWriter(writer, false, options...)
+		if err != nil {
+			return nil, err
+		}
+		return zstdWriter, nil
+	case LZ4:
+		return lz4.NewWriter(writer), nil
+	case XZ:
+		xzWriter, err := xz.WriterConfig{DictCap: xzDictCap}.NewWriter(writer)
+		if err != nil {
+			return nil, err
+		}
+		return xzWriter, nil
+	case BROTLI:
+		return brotli.NewWriter(writer), nil
+	default:
+		return nil, fmt.Errorf("unknown compression method: %s", compression.Method)
+	}
+}
+
+// zstdOptions returns the zstd encoder options of the given compression.
+func zstdOptions(compression Compression) []zstd.EOption {
+	var options []zstd.EOption
+	if compression.WindowLog > 0 {
+		options = append(options, zstd.WithWindowSize(1<<uint(compression.WindowLog)))
+	}
+	return options
+}
+
+// gzipFrameWriter writes a gzip stream as a sequence of members, each member is either compressed or stored.
+// Concatenated gzip members are decompressed as a single stream.
+type gzipFrameWriter struct {
+	writer io.Writer
+	level  int
+	member *gzip.Writer
+}
+
+func newGzipFrameWriter(writer io.Writer, level int) (*gzipFrameWriter, error) {
+	member, err := gzip.NewWriterLevel(writer, level)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipFrameWriter{
+		writer: writer,
+		level:  level,
+		member: member,
+	}, nil
+}
+
+// setLevel sets the compression level of the members started by the subsequent nextFrame calls.
+func (w *gzipFrameWriter) setLevel(level int) {
+	w.level = level
+}
+
+// Write compresses b into the current member.
+func (w *gzipFrameWriter) Write(b []byte) (int, error) {
+	return w.member.Write(b)
+}
+
+// nextFrame ends the current member, the next write starts a new one, stored without compression if store is set.
+func (w *gzipFrameWriter) nextFrame(store bool) error {
+	if err := w.member.Close(); err != nil {
+		return err
+	}
+
+	level := w.level
+	if store {
+		level = gzip.NoCompression
+	}
+
+	member, err := gzip.NewWriterLevel(w.writer, level)
+	if err != nil {
+		return err
+	}
+	w.member = member
+	return nil
+}
+
+// Close closes the current member.
+func (w *gzipFrameWriter) Close() error {
+	return w.member.Close()
+}
+
+// readSamples reads the beginning (up to size bytes) of at most count files evenly distributed in pths.
+func readSamples(pths []string, count, size int) ([][]byte, error) {
+	sorted := make([]string, len(pths))
+	copy(sorted, pths)
+	sort.Strings(sorted)
+
+	step := 1
+	if len(sorted) > count {
+		step = len(sorted) / count
+	}
+
+	var samples [][]byte
+	for i := 0; i < len(sorted); i += step {
+		buf := make([]byte, size)
+		n, err := readSample(sorted[i], buf)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			samples = append(samples, buf[:n])
+		}
+	}
+	return samples, nil
+}
+
+// estimateCompressibility samples the beginning of files evenly distributed in pths
+// and returns the compressibility estimate of the samples weighted by their size:
+// values close to zero are likely uncompressible, values above 0.5 are very compressible.
+func estimateCompressibility(pths []string) (float64, error) {
+	samples, err := readSamples(pths, autoCompressionSampleFiles, autoCompressionSampleSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var estimate float64
+	var sampled int
+	for _, sample := range samples {
+		estimate += compress.Estimate(sample) * float64(len(sample))
+		sampled += len(sample)
+	}
+
+	if sampled == 0 {
+		return 0, nil
+	}
+	return estimate / float64(sampled), nil
+}
+
+// readSample reads the beginning of the regular file at pth into buf.
+func readSample(pth string, buf []byte) (int, error) {
+	info, err := os.Lstat(pth)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, nil
+	}
+
+	file, err := os.Open(pth)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warnf("Failed to close file (%s): %s", pth, err)
+		}
+	}()
+
+	n, err := io.ReadFull(file, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+// selectCompressionMethod returns ZSTD if the files in pths are likely compressible, NONE otherwise
+// (for example if the files are mostly already compressed artifacts like ipa, apk or jar files).
+func selectCompressionMethod(pths []string) (CompressionMethod, float64, error) {
+	estimate, err := estimateCompressibility(pths)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if estimate < autoCompressionThreshold {
+		return NONE, estimate, nil
+	}
+	return ZSTD, estimate, nil
+}
+
+// writeSkippableFrame writes data as a zstd skippable frame, which is ignored by zstd decoders.
+func writeSkippableFrame(writer io.Writer, magic uint32, data []byte) error {
+	header := make([]byte, skippableHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], magic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(data)))
+
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+// trainDictionary builds a zstd dictionary from samples of the files in pths.
+func trainDictionary(pths []string) ([]byte, error) {
+	samples, err := readSamples(pths, dictionarySampleFiles, dictionarySampleSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []byte
+	for _, sample := range samples {
+		if len(history)+len(sample) > dictionaryMaxSize {
+			history = append(history, sample[:dictionaryMaxSize-len(history)]...)
+			break
+		}
+		history = append(history, sample...)
+	}
+
+	return zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       dictionaryMinID + crc32.ChecksumIEEE(history)%(math.MaxInt32-dictionaryMinID),
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+}
+
+// loadOrTrainDictionary returns the zstd dictionary of the previous cache archive stored at pth,
+// or trains a new dictionary from samples of the files in pths if no previous dictionary exists.
+func loadOrTrainDictionary(pth string, pths []string) ([]byte, error) {
+	if exists, err := pathutil.IsPathExists(pth); err != nil {
+		return nil, err
+	} else if exists {
+		log.Printf("Previous compression dictionary found at: %s", pth)
+		return fileutil.ReadBytesFromFile(pth)
+	}
+
+	log.Printf("No previous compression dictionary found, training a new one")
+	return trainDictionary(pths)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+	"github.com/klauspost/compress/zstd"
+)
+
+func Test_newCompressor(t *testing.T) {
+	tests := []struct {
+		name           string
+		compression    Compression
+		wantCompressor bool
+		wantErr        bool
+	}{
+		{
+			name:           "no compression",
+			compression:    Compression{Method: NONE},
+			wantCompressor: false,
+			wantErr:        false,
+		},
+		{
+			name:           "gzip default level",
+			compression:    Compression{Method: GZIP},
+			wantCompressor: true,
+			wantErr:        false,
+		},
+		{
+			name:           "gzip fastest level",
+			compression:    Compression{Method: GZIP, Level: 1},
+			wantCompressor: true,
+			wantErr:        false,
+		},
+		{
+			name:           "zstd long window",
+			compression:    Compression{Method: ZSTD, WindowLog: 27},
+			wantCompressor: true,
+			wantErr:        false,
+		},
+		{
+			name:           "zstd invalid window",
+			compression:    Compression{Method: ZSTD, WindowLog: 30},
+			wantCompressor: false,
+			wantErr:        true,
+		},
+		{
+			name:           "lz4",
+			compression:    Compression{Method: LZ4},
+			wantCompressor: true,
+			wantErr:        false,
+		},
+		{
+			name:           "xz",
+			compression:    Compression{Method: XZ},
+			wantCompressor: true,
+			wantErr:        false,
+		},
+		{
+			name:           "brotli",
+			compression:    Compression{Method: BROTLI},
+			wantCompressor: true,
+			wantErr:        false,
+		},
+		{
+			name:           "gzip invalid level",
+			compression:    Compression{Method: GZIP, Level: 10},
+			wantCompressor: false,
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var writer nopWriteCloser
+			got, err := newCompressor(writer, tt.compression)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newCompressor() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantCompressor != (got != nil) {
+				t.Errorf("newCompressor() has compressor = %v, want %v", got != nil, tt.wantCompressor)
+			}
+		})
+	}
+}
+
+func Test_selectCompressionMethod(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	random := make([]byte, 64*1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("failed to generate random content: %s", err)
+	}
+
+	textPth := filepath.Join(tmpDir, "text")
+	randomPth := filepath.Join(tmpDir, "random")
+	createDirStruct(t, map[string]string{
+		textPth:   strings.Repeat("<dependency>compressible</dependency>\n", 1024),
+		randomPth: string(random),
+	})
+
+	tests := []struct {
+		name   string
+		pths   []string
+		method CompressionMethod
+	}{
+		{
+			name:   "no files",
+			pths:   nil,
+			method: NONE,
+		},
+		{
+			name:   "compressible file",
+			pths:   []string{textPth},
+			method: ZSTD,
+		},
+		{
+			name:   "uncompressible file",
+			pths:   []string{randomPth},
+			method: NONE,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, _, err := selectCompressionMethod(tt.pths)
+			if err != nil {
+				t.Fatalf("selectCompressionMethod() error = %v", err)
+			}
+			if method != tt.method {
+				t.Errorf("selectCompressionMethod() = %v, want %v", method, tt.method)
+			}
+		})
+	}
+}
+
+func Test_newCompressor_dictionary(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	contentByPth := map[string]string{}
+	var pths []string
+	for i := 0; i < 50; i++ {
+		pth := filepath.Join(tmpDir, fmt.Sprintf("module%d.pom", i))
+		contentByPth[pth] = fmt.Sprintf("<project><groupId>group%d</groupId><artifactId>artifact%d</artifactId><version>1.%d</version></project>", i, i, i)
+		pths = append(pths, pth)
+	}
+	createDirStruct(t, contentByPth)
+
+	dictionary, err := trainDictionary(pths)
+	if err != nil {
+		t.Fatalf("trainDictionary() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	compressor, err := newCompressor(&buf, Compression{Method: ZSTD, Dictionary: dictionary})
+	if err != nil {
+		t.Fatalf("newCompressor() error = %v", err)
+	}
+	if _, err := compressor.Write([]byte(contentByPth[pths[0]])); err != nil {
+		t.Fatalf("failed to compress: %s", err)
+	}
+	if err := compressor.Close(); err != nil {
+		t.Fatalf("failed to close compressor: %s", err)
+	}
+
+	// the pull step reads the dictionary from the skippable frame at the beginning of the archive
+	data := buf.Bytes()
+	if magic := binary.LittleEndian.Uint32(data); magic != dictionaryFrameMagic {
+		t.Fatalf("first frame magic = %x, want %x", magic, dictionaryFrameMagic)
+	}
+	size := binary.LittleEndian.Uint32(data[4:])
+	if !bytes.Equal(data[skippableHeaderSize:skippableHeaderSize+size], dictionary) {
+		t.Fatalf("skippable frame does not contain the dictionary")
+	}
+
+	decoder, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderDicts(dictionary))
+	if err != nil {
+		t.Fatalf("failed to create decoder: %s", err)
+	}
+	defer decoder.Close()
+
+	decompressed, err := ioutil.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+	if string(decompressed) != contentByPth[pths[0]] {
+		t.Errorf("decompressed = %s, want %s", decompressed, contentByPth[pths[0]])
+	}
+}
+
+func Test_gzipFrameWriter_store(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := newGzipFrameWriter(&buf, gzip.BestCompression)
+	if err != nil {
+		t.Fatalf("failed to create frame writer: %s", err)
+	}
+
+	if _, err := writer.Write([]byte("compressed")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := writer.nextFrame(true); err != nil {
+		t.Fatalf("failed to start stored member: %s", err)
+	}
+	if _, err := writer.Write([]byte("stored")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	reader, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("failed to create reader: %s", err)
+	}
+
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+	if string(decompressed) != "compressedstored" {
+		t.Errorf("decompressed = %s, want %s", decompressed, "compressedstored")
+	}
+}
@@ -1,21 +1,113 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/bitrise-io/go-steputils/stepconf"
 )
 
 // Config stores the step inputs
 type Config struct {
-	Paths               string `env:"cache_paths"`
-	IgnoredPaths        string `env:"ignore_check_on_paths"`
-	CacheAPIURL         string `env:"cache_api_url,required"`
-	FingerprintMethodID string `env:"fingerprint_method,opt[file-content-hash,file-mod-time]"`
-	CompressArchive     string `env:"compress_archive,opt[true,false]"`
-	DebugMode           string `env:"is_debug_mode,opt[true,false]"`
-	StackID             string `env:"BITRISE_STACK_ID"`
-	Pipe                string `env:"pipe,opt[true,false]"`
+	Paths                        string          `env:"cache_paths"`
+	IgnoredPaths                 string          `env:"ignore_check_on_paths"`
+	CacheInfoPath                string          `env:"cache_info_path"`
+	CacheArchivePath             string          `env:"cache_archive_path"`
+	ArchiveInfoPath              string          `env:"archive_info_path"`
+	ExcludeIgnoredPaths          string          `env:"exclude_ignored_paths,opt[true,false]"`
+	AutoIndicators               string          `env:"auto_indicators,opt[true,false]"`
+	FingerprintIgnoredPaths      string          `env:"ignore_fingerprint_on_paths"`
+	InvalidationPolicy           string          `env:"invalidation_policy,opt[any,indicator-only,never-shrink]"`
+	FingerprintProviders         string          `env:"fingerprint_providers"`
+	CacheAPIURL                  string          `env:"cache_api_url"`
+	FetchPreviousDescriptor      string          `env:"fetch_previous_descriptor,opt[true,false]"`
+	FingerprintMethodID          string          `env:"fingerprint_method,opt[file-content-hash,file-content-hash-xxh64,file-content-hash-blake3,file-content-hash-sha256,file-mod-time,file-size-mod-time,file-mod-time-content]"`
+	FingerprintMethodByExtension string          `env:"fingerprint_method_by_extension"`
+	FingerprintWorkers           int             `env:"fingerprint_workers,required"`
+	FingerprintCache             string          `env:"fingerprint_cache,opt[true,false]"`
+	CompressDescriptor           string          `env:"compress_descriptor,opt[true,false]"`
+	DescriptorSigningKey         stepconf.Secret `env:"descriptor_signing_key"`
+	DescriptorCache              string          `env:"descriptor_cache,opt[true,false]"`
+	CompositeFingerprints        string          `env:"composite_fingerprints,opt[true,false]"`
+	ArchiveFormat                string          `env:"archive_format,opt[tar,zip,squashfs]"`
+	CompressArchive              string          `env:"compress_archive,opt[true,false]"`
+	PreserveXattrs               string          `env:"preserve_xattrs,opt[true,false]"`
+	NormalizeOwnership           string          `env:"normalize_ownership,opt[true,false]"`
+	StripSetuid                  string          `env:"strip_setuid,opt[true,false]"`
+	SymlinkHandling              string          `env:"symlink_handling,opt[preserve,dereference]"`
+	SymlinkFingerprint           string          `env:"symlink_fingerprint,opt[target,content]"`
+	FingerprintFileMode          string          `env:"fingerprint_file_mode,opt[true,false]"`
+	CompressionMethod            string          `env:"compression_method,opt[gzip,zstd,lz4,xz,brotli,auto]"`
+	CompressionLevel             int             `env:"compression_level,required"`
+	CompressionMinSize           int             `env:"compression_min_size,required"`
+	SeekableArchive              string          `env:"seekable_archive,opt[true,false]"`
+	ZstdDictionary               string          `env:"zstd_dictionary,opt[true,false]"`
+	EntryIndex                   string          `env:"entry_index,opt[true,false]"`
+	ZstdWindowLog                int             `env:"zstd_window_log,required"`
+	AdaptiveCompression          string          `env:"adaptive_compression,opt[true,false]"`
+	DebugMode                    string          `env:"is_debug_mode,opt[true,false]"`
+	StackID                      string          `env:"BITRISE_STACK_ID"`
+	GitBranch                    string          `env:"BITRISE_GIT_BRANCH"`
+	GitCommit                    string          `env:"BITRISE_GIT_COMMIT"`
+	WorkflowID                   string          `env:"BITRISE_TRIGGERED_WORKFLOW_ID"`
+	AppSlug                      string          `env:"BITRISE_APP_SLUG"`
+	Pipe                         string          `env:"pipe,opt[true,false]"`
+	VolumeSize                   int             `env:"volume_size,required"`
+	VerifyArchive                string          `env:"verify_archive,opt[true,false]"`
+	ReproducibleArchive          string          `env:"reproducible_archive,opt[true,false]"`
+	ContentPreflight             string          `env:"content_preflight,opt[true,false]"`
+	ChunkedArchive               string          `env:"chunked_archive,opt[true,false]"`
+	RemoteChunkIndex             string          `env:"remote_chunk_index,opt[true,false]"`
+	ArchivePerPath               string          `env:"archive_per_path,opt[true,false]"`
+	IncrementalArchive           string          `env:"incremental_archive,opt[true,false]"`
+	MaxArchiveSize               int             `env:"max_archive_size,required"`
+	MaxArchiveSizeAction         string          `env:"max_archive_size_action,opt[fail,trim]"`
+	MinChangedFiles              int             `env:"min_changed_files,required"`
+	MinChangedSize               int             `env:"min_changed_size,required"`
+	StackChangePolicy            string          `env:"stack_change_policy,opt[ignore,push,skip]"`
+	PushCooldown                 int             `env:"push_cooldown,required"`
+	PushCooldownMaxChangedSize   int             `env:"push_cooldown_max_changed_size,required"`
+	MaxCacheAge                  int             `env:"max_cache_age,required"`
+	ChangeReportPath             string          `env:"change_report_path"`
+	UploadRetries                int             `env:"upload_retries,required"`
+	UploadRetryWait              int             `env:"upload_retry_wait,required"`
+	ConnectTimeout               int             `env:"connect_timeout,required"`
+	ReadTimeout                  int             `env:"read_timeout,required"`
+	WriteTimeout                 int             `env:"write_timeout,required"`
+	StepDeadline                 int             `env:"step_deadline,required"`
+	HTTP2                        string          `env:"http2,opt[true,false]"`
+	KeepAlive                    string          `env:"keep_alive,opt[true,false]"`
+	WriteBufferSize              int             `env:"write_buffer_size,required"`
+	ProxyURL                     string          `env:"proxy_url"`
+	ProxyUser                    string          `env:"proxy_user"`
+	ProxyPassword                stepconf.Secret `env:"proxy_password"`
+	ParallelUploads              int             `env:"parallel_uploads,required"`
+	ResumableUpload              string          `env:"resumable_upload,opt[true,false]"`
+	CacheTTL                     int             `env:"cache_ttl,required"`
+	CacheKeyTemplate             string          `env:"cache_key_template"`
+	UploadChecksum               string          `env:"upload_checksum,opt[true,false]"`
+	ProgressInterval             int             `env:"progress_interval,required"`
+	ProgressBar                  string          `env:"progress_bar,opt[true,false]"`
+	StorageBackend               string          `env:"storage_backend,opt[bitrise,s3,file,sftp,http]"`
+	FallbackStorageBackend       string          `env:"fallback_storage_backend,opt[none,bitrise,s3,file,sftp,http]"`
+	S3Bucket                     string          `env:"s3_bucket"`
+	S3Prefix                     string          `env:"s3_prefix"`
+	S3Region                     string          `env:"s3_region"`
+	S3Endpoint                   string          `env:"s3_endpoint"`
+	S3PathStyle                  string          `env:"s3_path_style,opt[true,false]"`
+	S3SkipTLSVerify              string          `env:"s3_skip_tls_verify,opt[true,false]"`
+	FileDestination              string          `env:"file_destination"`
+	FileRetention                int             `env:"file_retention,required"`
+	SFTPHost                     string          `env:"sftp_host"`
+	SFTPPort                     int             `env:"sftp_port,required"`
+	SFTPUser                     string          `env:"sftp_user"`
+	SFTPDirectory                string          `env:"sftp_directory"`
+	SFTPPrivateKey               stepconf.Secret `env:"sftp_private_key"`
+	SFTPKnownHosts               string          `env:"sftp_known_hosts"`
+	HTTPUploadURL                string          `env:"http_upload_url"`
+	HTTPUploadMethod             string          `env:"http_upload_method,opt[PUT,POST]"`
+	HTTPUploadHeaders            stepconf.Secret `env:"http_upload_headers"`
 }
 
 // ParseConfig expands the step inputs from the current environment
@@ -24,10 +116,194 @@ func ParseConfig() (c Config, err error) {
 	if err == nil {
 		c.Paths += "\n" + os.Getenv("bitrise_cache_include_paths")
 		c.IgnoredPaths += "\n" + os.Getenv("bitrise_cache_exclude_paths")
+		c.CacheInfoPath = inputOrEnv(c.CacheInfoPath, "BITRISE_CACHE_INFO_PATH")
+		c.CacheArchivePath = inputOrEnv(c.CacheArchivePath, "BITRISE_CACHE_ARCHIVE_PATH")
+		c.ArchiveInfoPath = inputOrEnv(c.ArchiveInfoPath, "BITRISE_CACHE_ARCHIVE_INFO_PATH")
+
+		err = c.validate()
 	}
 	return
 }
 
+// validate checks the combinations of the step inputs.
+func (c Config) validate() (err error) {
+	if pth := firstRelativePath(c.CacheInfoPath, c.CacheArchivePath, c.ArchiveInfoPath); pth != "" {
+		err = fmt.Errorf("cache info path, cache archive path and archive info path should be absolute, got: %s", pth)
+	} else if c.FallbackStorageBackend == c.StorageBackend {
+		err = fmt.Errorf("fallback storage backend should differ from the storage backend, got: %s", c.FallbackStorageBackend)
+	} else if c.FallbackStorageBackend != "none" && c.Pipe == "true" {
+		err = fmt.Errorf("fallback storage backend can not be used with pipe cache")
+	} else if c.usesStorageBackend("bitrise") && c.CacheAPIURL == "" {
+		err = fmt.Errorf("cache api url is required with the bitrise storage backend")
+	} else if c.FetchPreviousDescriptor == "true" && c.CacheAPIURL == "" {
+		err = fmt.Errorf("cache api url is required to fetch the previous descriptor")
+	} else if c.usesStorageBackend("s3") && (c.S3Bucket == "" || c.S3Region == "") {
+		err = fmt.Errorf("s3 storage backend requires s3 bucket and s3 region")
+	} else if c.usesStorageBackend("file") && c.FileDestination == "" {
+		err = fmt.Errorf("file storage backend requires file destination")
+	} else if c.usesStorageBackend("sftp") && (c.SFTPHost == "" || c.SFTPUser == "" || c.SFTPPrivateKey == "") {
+		err = fmt.Errorf("sftp storage backend requires sftp host, sftp user and sftp private key")
+	} else if c.usesStorageBackend("sftp") && (c.SFTPPort < 1 || c.SFTPPort > 65535) {
+		err = fmt.Errorf("sftp port should be between 1 and 65535, got: %d", c.SFTPPort)
+	} else if c.StorageBackend == "sftp" && c.Pipe == "true" {
+		err = fmt.Errorf("sftp storage backend can not be used with pipe cache")
+	} else if c.usesStorageBackend("http") && c.HTTPUploadURL == "" {
+		err = fmt.Errorf("http storage backend requires http upload url")
+	} else if c.FileRetention < 1 {
+		err = fmt.Errorf("file retention should be at least 1, got: %d", c.FileRetention)
+	} else if c.CompressionLevel < 1 || c.CompressionLevel > 9 {
+		err = fmt.Errorf("compression level should be between 1 and 9, got: %d", c.CompressionLevel)
+	} else if c.CompressionMinSize < 0 {
+		err = fmt.Errorf("compression minimum size should not be negative, got: %d", c.CompressionMinSize)
+	} else if c.ZstdWindowLog != 0 && (c.ZstdWindowLog < zstdMinWindowLog || c.ZstdWindowLog > zstdMaxWindowLog) {
+		err = fmt.Errorf("zstd window log should be 0 or between %d and %d, got: %d", zstdMinWindowLog, zstdMaxWindowLog, c.ZstdWindowLog)
+	} else if c.ArchiveFormat == string(ZIP) && c.CompressArchive == "true" && c.CompressionMethod != string(GZIP) {
+		err = fmt.Errorf("zip archive format requires gzip compression method, got: %s", c.CompressionMethod)
+	} else if c.ArchiveFormat == string(ZIP) && c.PreserveXattrs == "true" {
+		err = fmt.Errorf("preserving extended attributes requires tar archive format")
+	} else if c.ArchiveFormat == string(ZIP) && c.NormalizeOwnership == "true" {
+		err = fmt.Errorf("normalizing ownership requires tar archive format")
+	} else if c.ArchiveFormat == string(ZIP) && c.SeekableArchive == "true" {
+		err = fmt.Errorf("seekable archive requires tar archive format")
+	} else if c.SeekableArchive == "true" && c.CompressArchive == "true" && c.CompressionMethod != string(ZSTD) && c.CompressionMethod != string(AUTO) {
+		err = fmt.Errorf("seekable archive requires zstd compression method, got: %s", c.CompressionMethod)
+	} else if c.SeekableArchive == "true" && c.ZstdDictionary == "true" {
+		err = fmt.Errorf("seekable archive can not be compressed with zstd dictionary")
+	} else if c.UploadRetries < 0 || c.UploadRetryWait < 0 {
+		err = fmt.Errorf("upload retries and upload retry wait should not be negative, got: %d, %d", c.UploadRetries, c.UploadRetryWait)
+	} else if c.ConnectTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.StepDeadline < 0 {
+		err = fmt.Errorf("connect timeout, read timeout, write timeout and step deadline should not be negative, got: %d, %d, %d, %d", c.ConnectTimeout, c.ReadTimeout, c.WriteTimeout, c.StepDeadline)
+	} else if c.WriteBufferSize < 0 {
+		err = fmt.Errorf("write buffer size should not be negative, got: %d", c.WriteBufferSize)
+	} else if c.CacheTTL < 0 {
+		err = fmt.Errorf("cache ttl should not be negative, got: %d", c.CacheTTL)
+	} else if c.ProgressInterval < 0 {
+		err = fmt.Errorf("progress interval should not be negative, got: %d", c.ProgressInterval)
+	} else if c.MinChangedFiles < 0 || c.MinChangedSize < 0 {
+		err = fmt.Errorf("minimum changed files and minimum changed size should not be negative, got: %d, %d", c.MinChangedFiles, c.MinChangedSize)
+	} else if c.PushCooldown < 0 || c.PushCooldownMaxChangedSize < 0 {
+		err = fmt.Errorf("push cooldown and push cooldown maximum changed size should not be negative, got: %d, %d", c.PushCooldown, c.PushCooldownMaxChangedSize)
+	} else if c.MaxCacheAge < 0 {
+		err = fmt.Errorf("maximum cache age should not be negative, got: %d", c.MaxCacheAge)
+	} else if (c.PushCooldown > 0 || c.MaxCacheAge > 0) && c.ReproducibleArchive == "true" {
+		// The push time recorded in the descriptor differs in every build.
+		err = fmt.Errorf("push cooldown and maximum cache age can not be used with reproducible archive")
+	} else if c.FingerprintWorkers < 0 {
+		err = fmt.Errorf("fingerprint workers should not be negative, got: %d", c.FingerprintWorkers)
+	} else if c.FingerprintCache == "true" && (c.FingerprintMethodID == string(MODTIME) || c.FingerprintMethodID == string(SIZEMODTIME)) {
+		err = fmt.Errorf("fingerprint cache requires a content hash fingerprint method")
+	} else if c.FingerprintMethodID == string(MODTIMECONTENT) && c.FingerprintCache != "true" {
+		err = fmt.Errorf("file-mod-time-content fingerprint method requires fingerprint cache")
+	} else if c.FingerprintCache == "true" && c.ReproducibleArchive == "true" {
+		err = fmt.Errorf("fingerprint cache can not be used with reproducible archive")
+	} else if c.DescriptorSigningKey != "" && (c.FingerprintCache == "true" || c.DescriptorCache == "true") {
+		// The reused fingerprints and descriptors are not signed, a tampered one would be signed with the new descriptor.
+		err = fmt.Errorf("fingerprint cache and descriptor cache can not be used with descriptor signing key")
+	} else if c.CompositeFingerprints == "true" && c.IncrementalArchive == "true" {
+		err = fmt.Errorf("composite fingerprints can not be used with incremental archive")
+	} else if c.ParallelUploads < 1 {
+		err = fmt.Errorf("parallel uploads should be at least 1, got: %d", c.ParallelUploads)
+	} else if c.ResumableUpload == "true" && c.VolumeSize == 0 && c.ChunkedArchive != "true" && c.ArchivePerPath != "true" {
+		err = fmt.Errorf("resumable upload requires volumes, chunked archive or archive per path")
+	} else if c.ArchiveFormat == string(SQUASHFS) && c.CompressArchive == "true" && (c.CompressionMethod == string(BROTLI) || c.CompressionMethod == string(AUTO)) {
+		err = fmt.Errorf("squashfs archive format does not support compression method: %s", c.CompressionMethod)
+	} else if c.ArchiveFormat == string(SQUASHFS) && (c.SeekableArchive == "true" || c.ZstdDictionary == "true") {
+		err = fmt.Errorf("squashfs archive format can not be seekable or compressed with zstd dictionary")
+	} else if c.ArchiveFormat == string(SQUASHFS) && (c.Pipe == "true" || c.VolumeSize > 0 || c.VerifyArchive == "true" || c.MaxArchiveSize > 0) {
+		err = fmt.Errorf("squashfs archive format can not be used with pipe cache, volumes, archive verification or maximum archive size")
+	} else if c.EntryIndex == "true" && c.ArchiveFormat != string(TAR) {
+		err = fmt.Errorf("entry index requires tar archive format")
+	} else if c.EntryIndex == "true" && c.CompressArchive == "true" && c.SeekableArchive != "true" {
+		err = fmt.Errorf("entry index requires uncompressed or seekable archive")
+	} else if c.EntryIndex == "true" && c.usesStorageBackend("bitrise") {
+		// The cache API stores a single object per cache, the entry index would replace the archive.
+		err = fmt.Errorf("entry index can not be used with bitrise storage backend")
+	} else if c.VolumeSize < 0 {
+		err = fmt.Errorf("volume size should not be negative, got: %d", c.VolumeSize)
+	} else if c.VolumeSize > 0 && c.Pipe == "true" {
+		err = fmt.Errorf("splitting the archive into volumes can not be used with pipe cache")
+	} else if c.VolumeSize > 0 && c.usesStorageBackend("bitrise") {
+		// The cache API stores a single object per cache, each volume would replace the previous one.
+		err = fmt.Errorf("splitting the archive into volumes can not be used with bitrise storage backend")
+	} else if c.AdaptiveCompression == "true" && c.Pipe != "true" {
+		err = fmt.Errorf("adaptive compression requires pipe cache")
+	} else if c.AdaptiveCompression == "true" && c.StorageBackend == "bitrise" {
+		err = fmt.Errorf("adaptive compression can not be used with bitrise storage backend")
+	} else if c.VerifyArchive == "true" && c.Pipe == "true" {
+		err = fmt.Errorf("archive verification can not be used with pipe cache")
+	} else if c.ReproducibleArchive == "true" && c.AdaptiveCompression == "true" {
+		err = fmt.Errorf("reproducible archive can not be compressed with adaptive compression")
+	} else if c.ContentPreflight == "true" && c.ReproducibleArchive != "true" {
+		err = fmt.Errorf("content preflight requires reproducible archive")
+	} else if c.ContentPreflight == "true" && (c.Pipe == "true" || c.VolumeSize > 0 || c.ChunkedArchive == "true" || c.ArchivePerPath == "true") {
+		err = fmt.Errorf("content preflight can not be used with pipe cache, volumes, chunked archive or archive per path")
+	} else if c.ContentPreflight == "true" && c.StorageBackend != "s3" && c.StorageBackend != "file" && c.StorageBackend != "http" {
+		err = fmt.Errorf("content preflight requires s3, file or http storage backend, got: %s", c.StorageBackend)
+	} else if c.ContentPreflight == "true" && c.StorageBackend == "s3" && c.UploadChecksum != "true" {
+		// The checksums are only stored with the objects uploaded with them.
+		err = fmt.Errorf("content preflight with s3 storage backend requires upload checksum")
+	} else if c.ChunkedArchive == "true" && c.Pipe == "true" {
+		err = fmt.Errorf("chunked archive can not be used with pipe cache")
+	} else if c.ChunkedArchive == "true" && c.usesStorageBackend("bitrise") {
+		// The cache API stores a single object per cache, each chunk would replace the previous one.
+		err = fmt.Errorf("chunked archive can not be used with bitrise storage backend")
+	} else if c.ChunkedArchive == "true" && c.ArchiveFormat != string(TAR) {
+		err = fmt.Errorf("chunked archive requires tar archive format")
+	} else if c.ChunkedArchive == "true" && c.VolumeSize > 0 {
+		err = fmt.Errorf("chunked archive can not be split into volumes")
+	} else if c.ChunkedArchive == "true" && (c.SeekableArchive == "true" || c.ZstdDictionary == "true") {
+		err = fmt.Errorf("chunked archive can not be seekable or compressed with zstd dictionary")
+	} else if c.ChunkedArchive == "true" && c.VerifyArchive == "true" {
+		err = fmt.Errorf("archive verification can not be used with chunked archive")
+	} else if c.RemoteChunkIndex == "true" && c.ChunkedArchive != "true" {
+		err = fmt.Errorf("remote chunk index requires chunked archive")
+	} else if c.RemoteChunkIndex == "true" && c.FallbackStorageBackend != "none" {
+		// The fallback would only receive the new chunks, missing the chunks stored by the storage backend.
+		err = fmt.Errorf("remote chunk index can not be used with fallback storage backend")
+	} else if c.ArchivePerPath == "true" && (c.Pipe == "true" || c.VolumeSize > 0 || c.ChunkedArchive == "true") {
+		err = fmt.Errorf("archive per path can not be used with pipe cache, volumes or chunked archive")
+	} else if c.ArchivePerPath == "true" && c.usesStorageBackend("bitrise") {
+		// The cache API stores a single object per cache, each archive would replace the previous one.
+		err = fmt.Errorf("archive per path can not be used with bitrise storage backend")
+	} else if c.ArchivePerPath == "true" && (c.VerifyArchive == "true" || c.EntryIndex == "true") {
+		err = fmt.Errorf("archive per path can not be used with archive verification or entry index")
+	} else if c.IncrementalArchive == "true" && (c.ArchiveFormat != string(TAR) || c.CompressArchive == "true") {
+		err = fmt.Errorf("incremental archive requires uncompressed tar archive")
+	} else if c.IncrementalArchive == "true" && (c.Pipe == "true" || c.VolumeSize > 0 || c.ChunkedArchive == "true" || c.ArchivePerPath == "true") {
+		err = fmt.Errorf("incremental archive can not be used with pipe cache, volumes, chunked archive or archive per path")
+	} else if c.IncrementalArchive == "true" && (c.VerifyArchive == "true" || c.EntryIndex == "true") {
+		err = fmt.Errorf("incremental archive can not be used with archive verification or entry index")
+	} else if c.MaxArchiveSize < 0 {
+		err = fmt.Errorf("maximum archive size should not be negative, got: %d", c.MaxArchiveSize)
+	} else if c.MaxArchiveSize > 0 && (c.Pipe == "true" || c.ArchivePerPath == "true" || c.IncrementalArchive == "true") {
+		err = fmt.Errorf("maximum archive size can not be used with pipe cache, archive per path or incremental archive")
+	}
+	return
+}
+
+// inputOrEnv returns the input value, or the value of the env named key if the input is empty.
+func inputOrEnv(value, key string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+// firstRelativePath returns the first non-empty relative path of pths, empty if every path is absolute or empty.
+func firstRelativePath(pths ...string) string {
+	for _, pth := range pths {
+		if pth != "" && !filepath.IsAbs(pth) {
+			return pth
+		}
+	}
+	return ""
+}
+
+// usesStorageBackend reports whether the cache is uploaded to the storage backend, as the primary or the fallback storage backend.
+func (c Config) usesStorageBackend(backend string) bool {
+	return c.StorageBackend == backend || c.FallbackStorageBackend == backend
+}
+
 // Print prints the config
 func (c Config) Print() {
 	// TODO: update stepconf.Print to receive the output writer
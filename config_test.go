@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// defaultConfig returns the config of the default step inputs.
+func defaultConfig() Config {
+	return Config{
+		FingerprintMethodID:    "file-content-hash",
+		CompressArchive:        "false",
+		CompressionMethod:      "gzip",
+		CompressionLevel:       9,
+		ArchiveFormat:          string(TAR),
+		ParallelUploads:        1,
+		StorageBackend:         "bitrise",
+		FallbackStorageBackend: "none",
+		CacheAPIURL:            "https://cache.bitrise.io",
+		FileRetention:          1,
+		SFTPPort:               22,
+	}
+}
+
+func TestConfig_validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(c *Config)
+		wantErr   string
+	}{
+		{
+			name:      "defaults",
+			configure: func(c *Config) {},
+		},
+		{
+			name: "relative cache archive path",
+			configure: func(c *Config) {
+				c.CacheInfoPath, c.CacheArchivePath = "/tmp/cache-info.json", "cache/archive.tar"
+			},
+			wantErr: "cache info path, cache archive path and archive info path should be absolute, got: cache/archive.tar",
+		},
+		{
+			name: "entry index with file storage backend",
+			configure: func(c *Config) {
+				c.StorageBackend, c.FileDestination, c.EntryIndex = "file", "/mnt/cache", "true"
+			},
+		},
+		{
+			name: "entry index with bitrise storage backend",
+			configure: func(c *Config) {
+				c.EntryIndex = "true"
+			},
+			wantErr: "entry index can not be used with bitrise storage backend",
+		},
+		{
+			name: "entry index with bitrise fallback storage backend",
+			configure: func(c *Config) {
+				c.StorageBackend, c.FileDestination, c.FallbackStorageBackend, c.EntryIndex = "file", "/mnt/cache", "bitrise", "true"
+			},
+			wantErr: "entry index can not be used with bitrise storage backend",
+		},
+		{
+			name: "volumes with s3 storage backend",
+			configure: func(c *Config) {
+				c.StorageBackend, c.S3Bucket, c.S3Region, c.VolumeSize = "s3", "cache", "us-east-1", 4
+			},
+		},
+		{
+			name: "volumes with bitrise storage backend",
+			configure: func(c *Config) {
+				c.VolumeSize = 4
+			},
+			wantErr: "splitting the archive into volumes can not be used with bitrise storage backend",
+		},
+		{
+			name: "chunked archive with file storage backend",
+			configure: func(c *Config) {
+				c.StorageBackend, c.FileDestination, c.ChunkedArchive = "file", "/mnt/cache", "true"
+			},
+		},
+		{
+			name: "chunked archive with bitrise storage backend",
+			configure: func(c *Config) {
+				c.ChunkedArchive = "true"
+			},
+			wantErr: "chunked archive can not be used with bitrise storage backend",
+		},
+		{
+			name: "archive per path with sftp storage backend",
+			configure: func(c *Config) {
+				c.StorageBackend, c.SFTPHost, c.SFTPUser, c.SFTPPrivateKey, c.ArchivePerPath = "sftp", "cache.example.com", "ci", "key", "true"
+			},
+		},
+		{
+			name: "archive per path with bitrise storage backend",
+			configure: func(c *Config) {
+				c.ArchivePerPath = "true"
+			},
+			wantErr: "archive per path can not be used with bitrise storage backend",
+		},
+		{
+			name: "descriptor signing key",
+			configure: func(c *Config) {
+				c.DescriptorSigningKey = "secret"
+			},
+		},
+		{
+			name: "fingerprint cache with descriptor signing key",
+			configure: func(c *Config) {
+				c.DescriptorSigningKey, c.FingerprintCache = "secret", "true"
+			},
+			wantErr: "fingerprint cache and descriptor cache can not be used with descriptor signing key",
+		},
+		{
+			name: "descriptor cache with descriptor signing key",
+			configure: func(c *Config) {
+				c.DescriptorSigningKey, c.DescriptorCache = "secret", "true"
+			},
+			wantErr: "fingerprint cache and descriptor cache can not be used with descriptor signing key",
+		},
+		{
+			name: "fallback storage backend",
+			configure: func(c *Config) {
+				c.FallbackStorageBackend, c.FileDestination = "file", "/mnt/cache"
+			},
+		},
+		{
+			name: "fallback storage backend with pipe cache",
+			configure: func(c *Config) {
+				c.FallbackStorageBackend, c.FileDestination, c.Pipe = "file", "/mnt/cache", "true"
+			},
+			wantErr: "fallback storage backend can not be used with pipe cache",
+		},
+		{
+			name: "fallback storage backend same as the storage backend",
+			configure: func(c *Config) {
+				c.StorageBackend, c.FileDestination, c.FallbackStorageBackend = "file", "/mnt/cache", "file"
+			},
+			wantErr: "fallback storage backend should differ from the storage backend, got: file",
+		},
+		{
+			name: "fallback storage backend without its inputs",
+			configure: func(c *Config) {
+				c.FallbackStorageBackend = "file"
+			},
+			wantErr: "file storage backend requires file destination",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := defaultConfig()
+			tt.configure(&configs)
+			err := configs.validate()
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_inputOrEnv(t *testing.T) {
+	if err := os.Setenv("INPUT_OR_ENV_TEST", "/mnt/cache-info.json"); err != nil {
+		t.Fatalf("failed to set INPUT_OR_ENV_TEST: %s", err)
+	}
+	defer func() {
+		if err := os.Unsetenv("INPUT_OR_ENV_TEST"); err != nil {
+			t.Fatalf("failed to unset INPUT_OR_ENV_TEST: %s", err)
+		}
+	}()
+
+	if got := inputOrEnv("/tmp/cache-info.json", "INPUT_OR_ENV_TEST"); got != "/tmp/cache-info.json" {
+		t.Errorf("inputOrEnv() = %s, want the input", got)
+	}
+	if got := inputOrEnv("", "INPUT_OR_ENV_TEST"); got != "/mnt/cache-info.json" {
+		t.Errorf("inputOrEnv() without input = %s, want the env", got)
+	}
+	if got := inputOrEnv("", "INPUT_OR_ENV_UNSET"); got != "" {
+		t.Errorf("inputOrEnv() without input and env = %s, want empty", got)
+	}
+}
+
+func Test_firstRelativePath(t *testing.T) {
+	tests := []struct {
+		pths []string
+		want string
+	}{
+		{[]string{"/tmp/cache-info.json", "", "/tmp/archive_info.json"}, ""},
+		{[]string{"/tmp/cache-info.json", "cache-archive.tar", "./archive_info.json"}, "cache-archive.tar"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := firstRelativePath(tt.pths...); got != tt.want {
+			t.Errorf("firstRelativePath(%v) = %q, want %q", tt.pths, got, tt.want)
+		}
+	}
+}
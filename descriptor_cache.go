@@ -0,0 +1,121 @@
+// Local cache descriptor cache related models and functions.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+// indicatorStat is the state of an indicator file the descriptor was computed from.
+type indicatorStat struct {
+	Size int64 `json:"size"`
+	// ModTime is the modification time in nanoseconds since the Unix epoch, the snapshot never leaves the machine.
+	ModTime int64       `json:"mod_time"`
+	Mode    os.FileMode `json:"mode"`
+}
+
+// descriptorSnapshot records the cache descriptor computed by the step on this machine, so that a retried build,
+// or the step run again by a later step of the same build, reuses it without fingerprinting any file.
+// The descriptor is reused if the configuration and the state of every indicator file are the same.
+type descriptorSnapshot struct {
+	// ConfigHash is the hex encoded SHA256 hash of the indicators and the fingerprint options.
+	ConfigHash string                   `json:"config_hash"`
+	Stats      map[string]indicatorStat `json:"stats"`
+	Descriptor map[string]string        `json:"descriptor,omitempty"`
+	// Fingerprints is the fingerprint cache recorded with the descriptor, restored when the descriptor is reused.
+	Fingerprints map[string]cachedFingerprint `json:"fingerprints,omitempty"`
+}
+
+// newDescriptorSnapshot stats the indicator files of indicatorByCachePth before they are fingerprinted.
+// It returns nil if an indicator can change without changing any file, such as an env, a command or a git indicator.
+func newDescriptorSnapshot(indicatorByCachePth map[string]string, method ChangeIndicator, methodByCachePth map[string]ChangeIndicator, symlinks SymlinkFingerprint, modes bool, fingerprints *fingerprintCache) (*descriptorSnapshot, error) {
+	config, err := json.Marshal(struct {
+		Indicators   map[string]string          `json:"indicators"`
+		Method       ChangeIndicator            `json:"method"`
+		Methods      map[string]ChangeIndicator `json:"methods"`
+		Symlinks     SymlinkFingerprint         `json:"symlinks"`
+		Modes        bool                       `json:"modes"`
+		Fingerprints bool                       `json:"fingerprints"`
+	}{indicatorByCachePth, method, methodByCachePth, symlinks, modes, fingerprints != nil})
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(config)
+	snapshot := &descriptorSnapshot{ConfigHash: hex.EncodeToString(hash[:]), Stats: map[string]indicatorStat{}}
+
+	for _, indicator := range indicatorByCachePth {
+		var pths []string
+		switch {
+		case indicator == "":
+		case strings.HasPrefix(indicator, multiFileIndicatorPrefix):
+			pths = strings.Split(strings.TrimPrefix(indicator, multiFileIndicatorPrefix), multiFileIndicatorSeparator)
+		case isFileIndicator(indicator):
+			pths = []string{indicator}
+		default:
+			return nil, nil
+		}
+
+		for _, pth := range pths {
+			if _, ok := snapshot.Stats[pth]; ok {
+				continue
+			}
+			info, err := os.Lstat(pth)
+			if err != nil {
+				return nil, err
+			}
+			// The target's content is fingerprinted instead of the symlink
+			if info.Mode()&os.ModeSymlink != 0 && symlinks == SYMLINKCONTENT {
+				if target, err := os.Stat(pth); err == nil {
+					info = target
+				}
+			}
+			snapshot.Stats[pth] = indicatorStat{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Mode: info.Mode()}
+		}
+	}
+	return snapshot, nil
+}
+
+// previousDescriptor returns the descriptor and the fingerprint cache of the snapshot at pth if it matches s,
+// or nil if it does not exist or does not match.
+func (s *descriptorSnapshot) previousDescriptor(pth string) (map[string]string, map[string]cachedFingerprint) {
+	if exists, err := pathutil.IsPathExists(pth); err != nil || !exists {
+		return nil, nil
+	}
+	b, err := fileutil.ReadBytesFromFile(pth)
+	if err != nil {
+		log.Warnf("Failed to read the previous descriptor, fingerprinting every file: %s", err)
+		return nil, nil
+	}
+
+	var previous descriptorSnapshot
+	if err := json.Unmarshal(b, &previous); err != nil {
+		log.Warnf("Failed to parse the previous descriptor, fingerprinting every file: %s", err)
+		return nil, nil
+	}
+	if previous.ConfigHash != s.ConfigHash || previous.Descriptor == nil || !reflect.DeepEqual(previous.Stats, s.Stats) {
+		return nil, nil
+	}
+	return previous.Descriptor, previous.Fingerprints
+}
+
+// write writes the snapshot with the computed descriptor and fingerprint cache to pth.
+func (s *descriptorSnapshot) write(pth string, descriptor map[string]string, fingerprints *fingerprintCache) error {
+	s.Descriptor = descriptor
+	if fingerprints != nil {
+		s.Fingerprints = fingerprints.current
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteBytesToFile(pth, b)
+}
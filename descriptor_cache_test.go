@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_descriptorSnapshot(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "file")
+	createDirStruct(t, map[string]string{pth: "content"})
+	indicatorByCachePth := map[string]string{pth: pth}
+	snapshotPth := filepath.Join(tmpDir, "descriptor.json")
+
+	snapshot, err := newDescriptorSnapshot(indicatorByCachePth, MD5, nil, SYMLINKTARGET, false, nil)
+	if err != nil || snapshot == nil {
+		t.Fatalf("newDescriptorSnapshot() = %v, %v", snapshot, err)
+	}
+	if descriptor, _ := snapshot.previousDescriptor(snapshotPth); descriptor != nil {
+		t.Fatalf("previousDescriptor() without snapshot = %v, want nil", descriptor)
+	}
+	descriptor := map[string]string{pth: "fingerprint"}
+	if err := snapshot.write(snapshotPth, descriptor, nil); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+
+	unchanged, err := newDescriptorSnapshot(indicatorByCachePth, MD5, nil, SYMLINKTARGET, false, nil)
+	if err != nil {
+		t.Fatalf("newDescriptorSnapshot() error = %v", err)
+	}
+	if got, _ := unchanged.previousDescriptor(snapshotPth); got[pth] != "fingerprint" {
+		t.Errorf("previousDescriptor() = %v, want %v", got, descriptor)
+	}
+
+	otherMethod, err := newDescriptorSnapshot(indicatorByCachePth, XXH64, nil, SYMLINKTARGET, false, nil)
+	if err != nil {
+		t.Fatalf("newDescriptorSnapshot() error = %v", err)
+	}
+	if got, _ := otherMethod.previousDescriptor(snapshotPth); got != nil {
+		t.Errorf("previousDescriptor() with another method = %v, want nil", got)
+	}
+
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(pth, modTime, modTime); err != nil {
+		t.Fatalf("failed to set mod time: %s", err)
+	}
+	touched, err := newDescriptorSnapshot(indicatorByCachePth, MD5, nil, SYMLINKTARGET, false, nil)
+	if err != nil {
+		t.Fatalf("newDescriptorSnapshot() error = %v", err)
+	}
+	if got, _ := touched.previousDescriptor(snapshotPth); got != nil {
+		t.Errorf("previousDescriptor() of touched file = %v, want nil", got)
+	}
+
+	if env, err := newDescriptorSnapshot(map[string]string{pth: envIndicatorPrefix + "HOME"}, MD5, nil, SYMLINKTARGET, false, nil); err != nil || env != nil {
+		t.Errorf("newDescriptorSnapshot() with env indicator = %v, %v, want nil", env, err)
+	}
+}
@@ -0,0 +1,43 @@
+// Cache descriptor signature related models and functions.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// descriptorSignatureKey is the key of the signature in the cache descriptor file, like descriptorSchemaKey.
+const descriptorSignatureKey = "#signature"
+
+// descriptorSigningKey is the secret the cache descriptor is signed with, nil writes and trusts unsigned descriptors.
+// It is configured by the step inputs.
+var descriptorSigningKey []byte
+
+// descriptorSignature returns the hex encoded HMAC-SHA256 of the versioned descriptor without its signature, signed with key.
+// The descriptor is signed as compact JSON with sorted keys, regardless of how the descriptor file is formatted.
+func descriptorSignature(versioned map[string]string, key []byte) string {
+	unsigned := make(map[string]string, len(versioned))
+	for k, v := range versioned {
+		if k != descriptorSignatureKey {
+			unsigned[k] = v
+		}
+	}
+	// Marshalling a map of strings never fails
+	b, _ := json.Marshal(unsigned)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hasValidSignature reports whether the versioned descriptor is signed with key, and was not modified since it was signed.
+func hasValidSignature(versioned map[string]string, key []byte) bool {
+	signature, err := hex.DecodeString(versioned[descriptorSignatureKey])
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+	want, _ := hex.DecodeString(descriptorSignature(versioned, key))
+	return hmac.Equal(signature, want)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func Test_parseCacheDescriptor_signature(t *testing.T) {
+	defer func(key []byte) {
+		descriptorSigningKey = key
+	}(descriptorSigningKey)
+
+	descriptor := map[string]string{"/cache/file": "1"}
+	unsigned, err := descriptorData(descriptor)
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+	descriptorSigningKey = []byte("secret")
+	signed, err := descriptorData(descriptor)
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+	tampered := bytes.Replace(signed, []byte(`"/cache/file": "1"`), []byte(`"/cache/file": "2"`), 1)
+	if bytes.Equal(tampered, signed) {
+		t.Fatalf("failed to tamper descriptor: %s", signed)
+	}
+
+	tests := []struct {
+		name string
+		key  []byte
+		data []byte
+		want map[string]string
+	}{
+		{"signed", []byte("secret"), signed, descriptor},
+		{"unsigned", []byte("secret"), unsigned, nil},
+		{"tampered", []byte("secret"), tampered, nil},
+		{"other key", []byte("other"), signed, nil},
+		{"signed without key", nil, signed, descriptor},
+		{"tampered without key", nil, tampered, map[string]string{"/cache/file": "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			descriptorSigningKey = tt.key
+			got, err := parseCacheDescriptor(tt.data)
+			if err != nil {
+				t.Fatalf("parseCacheDescriptor() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCacheDescriptor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_descriptorDigest_signature(t *testing.T) {
+	defer func(key []byte) {
+		descriptorSigningKey = key
+	}(descriptorSigningKey)
+
+	descriptor := map[string]string{"/cache/file": "1"}
+	unsigned, err := descriptorDigest(descriptor)
+	if err != nil {
+		t.Fatalf("descriptorDigest() error = %v", err)
+	}
+	descriptorSigningKey = []byte("secret")
+	if signed, err := descriptorDigest(descriptor); err != nil || signed != unsigned {
+		t.Errorf("descriptorDigest() of signed descriptor = %v, %v, want %v", signed, err, unsigned)
+	}
+}
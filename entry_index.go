@@ -0,0 +1,41 @@
+// Archive entry index related models and functions.
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+)
+
+// entryIndexSuffix is appended to the archive path to get the path of the entry index.
+const entryIndexSuffix = ".index.json"
+
+// entryOffset locates an entry in the archive.
+type entryOffset struct {
+	// Offset is the offset in the archive where reading the entry's header can start:
+	// the start of the entry's frame in seekable archives, the header itself in uncompressed archives.
+	Offset int64 `json:"offset"`
+	// UncompressedOffset is the offset of the entry's header in the uncompressed tar stream.
+	UncompressedOffset int64 `json:"uncompressed_offset"`
+}
+
+// entryIndex maps the entry names of an archive to their offset,
+// it is uploaded next to the archive so that a subset of the entries can be extracted without reading the whole archive.
+type entryIndex struct {
+	Compression CompressionMethod      `json:"compression"`
+	Entries     map[string]entryOffset `json:"entries"`
+}
+
+// writeEntryIndex writes the entry index of the archive to pth.
+func (a *Archive) writeEntryIndex(pth string, compression CompressionMethod) error {
+	index := entryIndex{
+		Compression: compression,
+		Entries:     a.offsets,
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteBytesToFile(pth, b)
+}
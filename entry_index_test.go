@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func TestArchive_writeEntryIndex(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pths := []string{filepath.Join(tmpDir, "Pods", "a"), filepath.Join(tmpDir, "Pods", "b"), filepath.Join(tmpDir, "c")}
+	createDirStruct(t, map[string]string{
+		pths[0]: "a",
+		pths[1]: "b",
+		pths[2]: "c",
+	})
+
+	tests := []struct {
+		name        string
+		compression Compression
+	}{
+		{name: "uncompressed", compression: Compression{Method: NONE}},
+		{name: "seekable", compression: Compression{Method: ZSTD, Seekable: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var writer bufferWriteCloser
+			archive, err := NewArchive(&writer, TAR, tt.compression)
+			if err != nil {
+				t.Fatalf("failed to create archive: %s", err)
+			}
+			archive.offsets = map[string]entryOffset{}
+			if err := archive.Write(pths, false); err != nil {
+				t.Fatalf("failed to write archive: %s", err)
+			}
+			if err := archive.Close(); err != nil {
+				t.Fatalf("failed to close archive: %s", err)
+			}
+
+			indexPth := filepath.Join(tmpDir, "cache-archive.tar"+entryIndexSuffix)
+			if err := archive.writeEntryIndex(indexPth, tt.compression.Method); err != nil {
+				t.Fatalf("failed to write entry index: %s", err)
+			}
+
+			b, err := fileutil.ReadBytesFromFile(indexPth)
+			if err != nil {
+				t.Fatalf("failed to read entry index: %s", err)
+			}
+			var index entryIndex
+			if err := json.Unmarshal(b, &index); err != nil {
+				t.Fatalf("failed to unmarshal entry index: %s", err)
+			}
+			if index.Compression != tt.compression.Method {
+				t.Errorf("entry index compression = %s, want %s", index.Compression, tt.compression.Method)
+			}
+
+			// Every entry can be read starting at its offset.
+			archiveBytes := writer.Bytes()
+			for _, pth := range pths {
+				offset, ok := index.Entries[pth]
+				if !ok {
+					t.Fatalf("entry index does not contain: %s", pth)
+				}
+
+				decompressor, err := newDecompressor(bytes.NewReader(archiveBytes[offset.Offset:]), Compression{Method: tt.compression.Method})
+				if err != nil {
+					t.Fatalf("failed to decompress: %s", err)
+				}
+				header, err := tar.NewReader(decompressor).Next()
+				if err != nil {
+					t.Fatalf("failed to read header at %d: %s", offset.Offset, err)
+				}
+				if header.Name != pth {
+					t.Errorf("entry at %d = %s, want %s", offset.Offset, header.Name, pth)
+				}
+				if err := decompressor.Close(); err != nil {
+					t.Fatalf("failed to close decompressor: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func Test_uploadEntryIndex_keepsArchive(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	archivePth := filepath.Join(tmpDir, "cache-archive.tar")
+	indexPth := archivePth + entryIndexSuffix
+	createDirStruct(t, map[string]string{archivePth: "archive", indexPth: "index"})
+
+	// The entry index is uploaded after the archive to the same destination, as a file of its own.
+	dstDir := filepath.Join(tmpDir, "nfs")
+	url := fileDestinationURL(dstDir, 1)
+	for _, pth := range []string{archivePth, indexPth} {
+		if err := uploadArchiveFile(pth, url); err != nil {
+			t.Fatalf("uploadArchiveFile(%s) error = %v", pth, err)
+		}
+	}
+
+	for pth, want := range map[string]string{
+		filepath.Join(dstDir, "cache-archive.tar"):                  "archive",
+		filepath.Join(dstDir, "cache-archive.tar"+entryIndexSuffix): "index",
+	} {
+		if got, err := fileutil.ReadStringFromFile(pth); err != nil || got != want {
+			t.Errorf("stored %s = %s, %v, want %s", pth, got, err, want)
+		}
+	}
+}
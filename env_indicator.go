@@ -0,0 +1,37 @@
+// Environment variable change indicator related models and functions.
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envIndicatorPrefix prefixes the change indicators fingerprinted by the value of an environment variable.
+const envIndicatorPrefix = "env:"
+
+// parseEnvIndicator returns the variable name of an environment variable indicator,
+// and reports whether indicator is an environment variable indicator.
+func parseEnvIndicator(indicator string) (string, bool, error) {
+	if !strings.HasPrefix(indicator, envIndicatorPrefix) {
+		return "", false, nil
+	}
+
+	name := strings.TrimSpace(strings.TrimPrefix(indicator, envIndicatorPrefix))
+	if name == "" || strings.ContainsAny(name, "= \t") {
+		return "", true, fmt.Errorf("invalid environment variable name: %q", name)
+	}
+	return name, true, nil
+}
+
+// envIndicator returns the fingerprint of an environment variable indicator:
+// the SHA-256 hash of the variable's value, so that a secret value is not stored in the cache descriptor.
+// An unset variable is fingerprinted differently from an empty one.
+func envIndicator(name string) string {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "env: unset"
+	}
+	return fmt.Sprintf("env: %x", sha256.Sum256([]byte(value)))
+}
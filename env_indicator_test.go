@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_parseEnvIndicator(t *testing.T) {
+	tests := []struct {
+		name      string
+		indicator string
+		wantName  string
+		wantOk    bool
+		wantErr   bool
+	}{
+		{name: "file indicator", indicator: "indicator/path", wantName: "", wantOk: false, wantErr: false},
+		{name: "variable", indicator: "env:XCODE_VERSION", wantName: "XCODE_VERSION", wantOk: true, wantErr: false},
+		{name: "variable surrounding spaces", indicator: "env: XCODE_VERSION ", wantName: "XCODE_VERSION", wantOk: true, wantErr: false},
+		{name: "empty name", indicator: "env:", wantName: "", wantOk: true, wantErr: true},
+		{name: "invalid name", indicator: "env:A=B", wantName: "", wantOk: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, ok, err := parseEnvIndicator(tt.indicator)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEnvIndicator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if name != tt.wantName || ok != tt.wantOk {
+				t.Errorf("parseEnvIndicator() = %v, %v, want %v, %v", name, ok, tt.wantName, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_envIndicator(t *testing.T) {
+	const name = "ENV_INDICATOR_TEST"
+	if err := os.Unsetenv(name); err != nil {
+		t.Fatalf("failed to unset %s: %s", name, err)
+	}
+	unset := envIndicator(name)
+
+	if err := os.Setenv(name, ""); err != nil {
+		t.Fatalf("failed to set %s: %s", name, err)
+	}
+	empty := envIndicator(name)
+
+	if err := os.Setenv(name, "secret"); err != nil {
+		t.Fatalf("failed to set %s: %s", name, err)
+	}
+	value := envIndicator(name)
+	defer func() {
+		if err := os.Unsetenv(name); err != nil {
+			t.Errorf("failed to unset %s: %s", name, err)
+		}
+	}()
+
+	if unset == empty || empty == value || unset == value {
+		t.Errorf("envIndicator() = %v, %v, %v, want distinct fingerprints for unset, empty and set", unset, empty, value)
+	}
+	if value != envIndicator(name) {
+		t.Errorf("envIndicator() is not stable for the same value")
+	}
+}
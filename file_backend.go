@@ -0,0 +1,210 @@
+// Local filesystem storage backend related models and functions.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// fileScheme prefixes the local file destinations: file://<path> is the destination file,
+// file://<dir>/?retention=<n> is a directory the files are copied into, keeping the n most recent versions of each file.
+const fileScheme = "file://"
+
+// fileBackupTimeFormat formats the modification time suffixed to the previous versions of the files kept by the retention,
+// the suffixes are sorted by time.
+const fileBackupTimeFormat = "20060102T150405.000000000Z"
+
+// fileDestinationURL returns the destination of the file storage backend copying the files into dir,
+// keeping the given number of the most recent versions of each file.
+func fileDestinationURL(dir string, retention int) string {
+	return fileScheme + strings.TrimSuffix(dir, "/") + "/?retention=" + strconv.Itoa(retention)
+}
+
+// parseFileDestination returns the destination path of the file at pth and the number of versions to keep.
+func parseFileDestination(url, pth string) (string, int, error) {
+	dst := strings.TrimPrefix(url, fileScheme)
+	retention := 1
+	if i := strings.LastIndex(dst, "?retention="); i >= 0 {
+		var err error
+		retention, err = strconv.Atoi(dst[i+len("?retention="):])
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid retention of file destination (%s): %s", url, err)
+		}
+		dst = dst[:i]
+	}
+	if strings.HasSuffix(dst, "/") {
+		dst = filepath.Join(dst, filepath.Base(pth))
+	}
+	return dst, retention, nil
+}
+
+// copyFileAtomically copies the content read from reader to the destination path of the file at pth:
+// the content is written into a temporary file in the destination directory which is renamed into place,
+// so that readers of the destination (for example on a shared NFS path) never read a partially written file.
+func copyFileAtomically(reader io.Reader, pth, url string) error {
+	dst, retention, err := parseFileDestination(url, pth)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(dst)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	tmpPth := tmp.Name()
+	defer func() {
+		if err := os.RemoveAll(tmpPth); err != nil {
+			log.Warnf("Failed to remove temporary file (%s): %s", tmpPth, err)
+		}
+	}()
+
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy to %s: %s", tmpPth, err)
+	}
+	// The content has to reach the disk before the rename.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPth, 0644); err != nil {
+		return err
+	}
+
+	if retention > 1 {
+		if err := backupFile(dst); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpPth, dst); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %s", tmpPth, dst, err)
+	}
+	log.Printf("Copied to: %s", dst)
+
+	if retention > 1 {
+		return removeFileBackups(dst, retention-1)
+	}
+	return nil
+}
+
+// copyLocalFile copies the file at pth to the file destination url.
+func copyLocalFile(pth, url string) error {
+	file, err := os.Open(pth)
+	if err != nil {
+		return fmt.Errorf("failed to open file (%s): %s", pth, err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warnf("Failed to close file (%s): %s", pth, err)
+		}
+	}()
+
+	return copyFileAtomically(file, pth, url)
+}
+
+// readLocalFile returns the content of the file copied from pth to the file destination url, or nil if it does not exist.
+func readLocalFile(pth, url string) ([]byte, error) {
+	dst, _, err := parseFileDestination(url, pth)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(dst)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read file (%s): %s", dst, err)
+	}
+	return b, nil
+}
+
+// refreshStoredFile reports whether the file copied from pth to the file destination url has the given SHA256 checksum,
+// if it has, its modification time is updated so that it is the latest cache for the cleanups of the directory.
+func refreshStoredFile(pth, url string, sha256Sum []byte) (bool, error) {
+	dst, _, err := parseFileDestination(url, pth)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get file info (%s): %s", dst, err)
+	}
+
+	checksums, err := computeContentChecksums(dst)
+	if err != nil {
+		return false, fmt.Errorf("failed to compute checksums of stored file: %s", err)
+	}
+	if !bytes.Equal(checksums.sha256, sha256Sum) {
+		return false, nil
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(dst, now, now); err != nil {
+		return false, fmt.Errorf("failed to update modification time (%s): %s", dst, err)
+	}
+	return true, nil
+}
+
+// backupFile renames the file at pth if it exists, suffixed with its modification time.
+func backupFile(pth string) error {
+	info, err := os.Stat(pth)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	backup := pth + "." + info.ModTime().UTC().Format(fileBackupTimeFormat)
+	if err := os.Rename(pth, backup); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %s", pth, backup, err)
+	}
+	return nil
+}
+
+// removeFileBackups removes the previous versions of the file at pth renamed by backupFile, except the keep most recent ones.
+func removeFileBackups(pth string, keep int) error {
+	dir, base := filepath.Split(pth)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, info := range infos {
+		suffix := strings.TrimPrefix(info.Name(), base+".")
+		if _, err := time.Parse(fileBackupTimeFormat, suffix); suffix == info.Name() || err != nil {
+			continue
+		}
+		backups = append(backups, info.Name())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i := keep; i < len(backups); i++ {
+		backup := filepath.Join(dir, backups[i])
+		log.Printf("Removing previous version: %s", backup)
+		if err := os.Remove(backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
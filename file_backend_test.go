@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_parseFileDestination(t *testing.T) {
+	tests := []struct {
+		name          string
+		url           string
+		wantDst       string
+		wantRetention int
+		wantErr       bool
+	}{
+		{name: "file", url: "file:///mnt/cache/archive.tar", wantDst: "/mnt/cache/archive.tar", wantRetention: 1},
+		{name: "relative file", url: "file://cache/archive.tar", wantDst: "cache/archive.tar", wantRetention: 1},
+		{name: "directory", url: fileDestinationURL("/mnt/cache/", 3), wantDst: "/mnt/cache/cache-archive.tar", wantRetention: 3},
+		{name: "invalid retention", url: "file:///mnt/cache/?retention=all", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, retention, err := parseFileDestination(tt.url, "/tmp/cache-archive.tar")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFileDestination() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if dst != tt.wantDst || retention != tt.wantRetention {
+				t.Errorf("parseFileDestination() = %s, %d, want %s, %d", dst, retention, tt.wantDst, tt.wantRetention)
+			}
+		})
+	}
+}
+
+func Test_copyLocalFile(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "cache-archive.tar")
+	dstDir := filepath.Join(tmpDir, "nfs")
+	dst := filepath.Join(dstDir, "cache-archive.tar")
+	url := fileDestinationURL(dstDir, 2)
+
+	for i, content := range []string{"first", "second", "third"} {
+		createDirStruct(t, map[string]string{pth: content})
+		if err := copyLocalFile(pth, url); err != nil {
+			t.Fatalf("copyLocalFile() error = %v", err)
+		}
+		// The backups are named by the modification time of the previous versions.
+		if err := os.Chtimes(dst, time.Now(), time.Unix(int64(i), 0)); err != nil {
+			t.Fatalf("failed to change modification time: %s", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("failed to read destination: %s", err)
+	}
+	if string(b) != "third" {
+		t.Errorf("destination content = %s, want third", b)
+	}
+
+	infos, err := ioutil.ReadDir(dstDir)
+	if err != nil {
+		t.Fatalf("failed to read destination directory: %s", err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	backup := "cache-archive.tar." + time.Unix(1, 0).UTC().Format(fileBackupTimeFormat)
+	if len(names) != 2 || names[0] != "cache-archive.tar" || names[1] != backup {
+		t.Errorf("destination directory = %s, want the archive and its previous version %s", strings.Join(names, ", "), backup)
+	}
+}
+
+func Test_refreshStoredFile(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "cache-archive.tar")
+	dstDir := filepath.Join(tmpDir, "nfs")
+	dst := filepath.Join(dstDir, "cache-archive.tar")
+	url := fileDestinationURL(dstDir, 1)
+	sum := sha256.Sum256([]byte("archive"))
+
+	if stored, err := refreshStoredFile(pth, url, sum[:]); err != nil || stored {
+		t.Fatalf("refreshStoredFile() = %v, %v, want not stored before the copy", stored, err)
+	}
+
+	createDirStruct(t, map[string]string{dst: "previous"})
+	if stored, err := refreshStoredFile(pth, url, sum[:]); err != nil || stored {
+		t.Fatalf("refreshStoredFile() = %v, %v, want not stored with a different content", stored, err)
+	}
+
+	createDirStruct(t, map[string]string{dst: "archive"})
+	if err := os.Chtimes(dst, time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		t.Fatalf("failed to change modification time: %s", err)
+	}
+	if stored, err := refreshStoredFile(pth, url, sum[:]); err != nil || !stored {
+		t.Fatalf("refreshStoredFile() = %v, %v, want stored", stored, err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("failed to get file info: %s", err)
+	}
+	if info.ModTime().Before(time.Now().Add(-time.Minute)) {
+		t.Errorf("modification time = %s, want refreshed", info.ModTime())
+	}
+}
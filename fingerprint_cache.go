@@ -0,0 +1,99 @@
+// Fingerprint cache related models and functions.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+// cachedFingerprint is the content fingerprint of a file,
+// recorded with the size and the modification time the file had when it was hashed.
+type cachedFingerprint struct {
+	Size int64 `json:"size"`
+	// ModTime is the modification time in nanoseconds since the Unix epoch, not truncated as the fingerprints,
+	// so that a file rewritten with the same size within a second is hashed again.
+	ModTime     int64           `json:"mod_time"`
+	Method      ChangeIndicator `json:"method"`
+	Fingerprint string          `json:"fingerprint"`
+}
+
+// fingerprintCache reuses the content fingerprints of the previous cache for the files whose size and modification time
+// did not change, and records the fingerprints of the current cache for the next one.
+type fingerprintCache struct {
+	previous map[string]cachedFingerprint
+	mu       sync.Mutex
+	current  map[string]cachedFingerprint
+	// reused counts the fingerprints reused from the previous cache.
+	reused int
+}
+
+// newFingerprintCache creates a fingerprintCache reusing the given fingerprints of the previous cache.
+func newFingerprintCache(previous map[string]cachedFingerprint) *fingerprintCache {
+	return &fingerprintCache{previous: previous, current: map[string]cachedFingerprint{}}
+}
+
+// readFingerprintCache reads the fingerprints of the previous cache at pth, the cache is empty if it does not exist.
+func readFingerprintCache(pth string) (*fingerprintCache, error) {
+	if exists, err := pathutil.IsPathExists(pth); err != nil {
+		return nil, err
+	} else if !exists {
+		return newFingerprintCache(nil), nil
+	}
+
+	b, err := fileutil.ReadBytesFromFile(pth)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous map[string]cachedFingerprint
+	if err := json.Unmarshal(b, &previous); err != nil {
+		return nil, err
+	}
+	return newFingerprintCache(previous), nil
+}
+
+// fingerprint returns the content fingerprint of the file at pth computed with the given method,
+// reusing the previous fingerprint if the file's size and modification time match, or calling compute otherwise.
+// The receiver may be nil, in this case the fingerprint is always computed.
+func (c *fingerprintCache) fingerprint(pth string, method ChangeIndicator, compute func() (string, error)) (string, error) {
+	if c == nil {
+		return compute()
+	}
+
+	// The file is stat'ed before it is hashed, a file changed while it is hashed is hashed again by the next cache.
+	info, err := os.Stat(pth)
+	if err != nil {
+		return "", err
+	}
+	entry := cachedFingerprint{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Method: method}
+
+	previous, ok := c.previous[pth]
+	reused := ok && previous.Size == entry.Size && previous.ModTime == entry.ModTime && previous.Method == method
+	if reused {
+		entry.Fingerprint = previous.Fingerprint
+	} else if entry.Fingerprint, err = compute(); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current[pth] = entry
+	if reused {
+		c.reused++
+	}
+	return entry.Fingerprint, nil
+}
+
+// data returns the fingerprints of the current cache, written into the cache archive.
+func (c *fingerprintCache) data() ([]byte, error) {
+	b, err := json.Marshal(c.current)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal fingerprint cache: %s", err)
+	}
+	return b, nil
+}
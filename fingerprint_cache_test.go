@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_fingerprintCache(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "file")
+	createDirStruct(t, map[string]string{pth: "content 1"})
+	modTime := time.Unix(1000000000, 0)
+	if err := os.Chtimes(pth, modTime, modTime); err != nil {
+		t.Fatalf("failed to set mod time: %s", err)
+	}
+	indicatorByCachePth := map[string]string{pth: pth}
+
+	first := newFingerprintCache(nil)
+	original, err := cacheDescriptor(indicatorByCachePth, XXH64, nil, SYMLINKTARGET, false, 1, first)
+	if err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	}
+	if first.reused != 0 {
+		t.Errorf("reused = %d, want 0", first.reused)
+	}
+
+	data, err := first.data()
+	if err != nil {
+		t.Fatalf("data() error = %v", err)
+	}
+	dataPth := filepath.Join(tmpDir, "fingerprints.json")
+	if err := ioutil.WriteFile(dataPth, data, 0600); err != nil {
+		t.Fatalf("failed to write fingerprint cache: %s", err)
+	}
+
+	// Same size and mod time, the previous fingerprint is reused even though the content changed.
+	createDirStruct(t, map[string]string{pth: "content 2"})
+	if err := os.Chtimes(pth, modTime, modTime); err != nil {
+		t.Fatalf("failed to set mod time: %s", err)
+	}
+	second, err := readFingerprintCache(dataPth)
+	if err != nil {
+		t.Fatalf("readFingerprintCache() error = %v", err)
+	}
+	if descriptor, err := cacheDescriptor(indicatorByCachePth, XXH64, nil, SYMLINKTARGET, false, 1, second); err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	} else if descriptor[pth] != original[pth] || second.reused != 1 {
+		t.Errorf("cacheDescriptor() = %v, reused = %d, want %v reused", descriptor, second.reused, original)
+	}
+
+	// Another method is hashed again.
+	third, err := readFingerprintCache(dataPth)
+	if err != nil {
+		t.Fatalf("readFingerprintCache() error = %v", err)
+	}
+	if _, err := cacheDescriptor(indicatorByCachePth, MD5, nil, SYMLINKTARGET, false, 1, third); err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	} else if third.reused != 0 {
+		t.Errorf("reused = %d with another method, want 0", third.reused)
+	}
+
+	// A mod time changed within the same second is hashed again.
+	if err := os.Chtimes(pth, modTime.Add(500*time.Millisecond), modTime.Add(500*time.Millisecond)); err != nil {
+		t.Fatalf("failed to set mod time: %s", err)
+	}
+	subsecond, err := readFingerprintCache(dataPth)
+	if err != nil {
+		t.Fatalf("readFingerprintCache() error = %v", err)
+	}
+	if descriptor, err := cacheDescriptor(indicatorByCachePth, XXH64, nil, SYMLINKTARGET, false, 1, subsecond); err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	} else if descriptor[pth] == original[pth] || subsecond.reused != 0 {
+		t.Errorf("cacheDescriptor() = %v, reused = %d, want hashed again", descriptor, subsecond.reused)
+	}
+
+	// A changed mod time is hashed again.
+	if err := os.Chtimes(pth, modTime.Add(time.Second), modTime.Add(time.Second)); err != nil {
+		t.Fatalf("failed to set mod time: %s", err)
+	}
+	fourth, err := readFingerprintCache(dataPth)
+	if err != nil {
+		t.Fatalf("readFingerprintCache() error = %v", err)
+	}
+	want, err := cacheDescriptor(indicatorByCachePth, XXH64, nil, SYMLINKTARGET, false, 1, nil)
+	if err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	}
+	if descriptor, err := cacheDescriptor(indicatorByCachePth, XXH64, nil, SYMLINKTARGET, false, 1, fourth); err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	} else if descriptor[pth] != want[pth] || descriptor[pth] == original[pth] || fourth.reused != 0 {
+		t.Errorf("cacheDescriptor() = %v, reused = %d, want %v hashed again", descriptor, fourth.reused, want)
+	}
+
+	if missing, err := readFingerprintCache(filepath.Join(tmpDir, "missing.json")); err != nil {
+		t.Errorf("readFingerprintCache() of missing file error = %v", err)
+	} else if len(missing.previous) != 0 {
+		t.Errorf("readFingerprintCache() of missing file = %v, want empty", missing.previous)
+	}
+}
+
+func Test_fingerprintCache_modTimeContent(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "file")
+	createDirStruct(t, map[string]string{pth: "content"})
+	modTime := time.Unix(1000000000, 0)
+	if err := os.Chtimes(pth, modTime, modTime); err != nil {
+		t.Fatalf("failed to set mod time: %s", err)
+	}
+
+	fingerprints := newFingerprintCache(nil)
+	original, err := fileIndicator(pth, MODTIMECONTENT, SYMLINKTARGET, fingerprints)
+	if err != nil {
+		t.Fatalf("fileIndicator() error = %v", err)
+	}
+
+	// Touched without changing the content.
+	if err := os.Chtimes(pth, modTime.Add(time.Hour), modTime.Add(time.Hour)); err != nil {
+		t.Fatalf("failed to set mod time: %s", err)
+	}
+	touched := newFingerprintCache(fingerprints.current)
+	if got, err := fileIndicator(pth, MODTIMECONTENT, SYMLINKTARGET, touched); err != nil || got != original {
+		t.Errorf("fileIndicator() of touched file = %v, %v, want %v", got, err, original)
+	}
+	if touched.reused != 0 {
+		t.Errorf("reused = %d for touched file, want it hashed again", touched.reused)
+	}
+
+	createDirStruct(t, map[string]string{pth: "changed"})
+	changed := newFingerprintCache(touched.current)
+	if got, err := fileIndicator(pth, MODTIMECONTENT, SYMLINKTARGET, changed); err != nil || got == original {
+		t.Errorf("fileIndicator() of changed file = %v, %v, want another fingerprint", got, err)
+	}
+}
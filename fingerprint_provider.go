@@ -0,0 +1,78 @@
+// External fingerprint provider related models and functions.
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseFingerprintProviderList returns the provider commands by the absolute paths they fingerprint.
+func parseFingerprintProviderList(list []string) (map[string]string, error) {
+	// path/to/cache -> command
+	// path/to/cache -> "quoted command"
+	cmdByPth := map[string]string{}
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "->", 2)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("fingerprint provider without a command: %s", item)
+		}
+
+		pth, err := absPath(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, err
+		}
+		cmd := strings.TrimSpace(parts[1])
+		if strings.HasPrefix(cmd, `"`) {
+			if cmd, err = strconv.Unquote(cmd); err != nil {
+				return nil, fmt.Errorf("invalid quoted fingerprint provider command (%s): %s", cmd, err)
+			}
+		}
+		if cmd == "" {
+			return nil, fmt.Errorf("fingerprint provider without a command: %s", item)
+		}
+		cmdByPth[pth] = cmd
+	}
+	return cmdByPth, nil
+}
+
+// providerForPath returns the provider command of the most specific provider path containing pth, or empty if there is none.
+func providerForPath(pth string, cmdByPth map[string]string) string {
+	var cmd string
+	var longest int
+	for providerPth, providerCmd := range cmdByPth {
+		providerPth = strings.TrimSuffix(providerPth, string(filepath.Separator))
+		if pth != providerPth && !strings.HasPrefix(pth, providerPth+string(filepath.Separator)) {
+			continue
+		}
+		if len(providerPth) >= longest {
+			cmd = providerCmd
+			longest = len(providerPth)
+		}
+	}
+	return cmd
+}
+
+// shellQuote quotes s as a single word of bash.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// providerIndicators replaces the indicator files of the cache paths having a fingerprint provider with command indicators,
+// which run the provider command with the indicator file's path as its argument, and fingerprint the digest it prints.
+// The other indicators, and the ignored paths, are kept as they are.
+func providerIndicators(indicatorByPth map[string]string, cmdByPth map[string]string) map[string]string {
+	indicators := make(map[string]string, len(indicatorByPth))
+	for pth, indicator := range indicatorByPth {
+		if cmd := providerForPath(pth, cmdByPth); cmd != "" && isFileIndicator(indicator) {
+			indicator = cmdIndicatorPrefix + strconv.Quote(cmd+" "+shellQuote(indicator))
+		}
+		indicators[pth] = indicator
+	}
+	return indicators
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_providerIndicators(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	jar := filepath.Join(tmpDir, "libs", "it's.jar")
+	lockfile := filepath.Join(tmpDir, "gradle.lockfile")
+	createDirStruct(t, map[string]string{jar: "jar", lockfile: "lockfile"})
+
+	cmdByPth, err := parseFingerprintProviderList([]string{
+		filepath.Join(tmpDir, "libs") + ` -> "echo provided"`,
+		"",
+		tmpDir + " -> echo outer",
+	})
+	if err != nil {
+		t.Fatalf("parseFingerprintProviderList() error = %v", err)
+	}
+	if _, err := parseFingerprintProviderList([]string{tmpDir}); err == nil {
+		t.Errorf("parseFingerprintProviderList() without a command, want error")
+	}
+
+	indicators := providerIndicators(map[string]string{
+		jar:                                   jar,
+		filepath.Join(tmpDir, "ignored"):      "",
+		filepath.Join(tmpDir, "env"):          envIndicatorPrefix + "HOME",
+		filepath.Join(tmpDir, "other", "dep"): lockfile,
+	}, cmdByPth)
+	if got := indicators[filepath.Join(tmpDir, "ignored")]; got != "" {
+		t.Errorf("providerIndicators() of ignored path = %v, want empty", got)
+	}
+	if got := indicators[filepath.Join(tmpDir, "env")]; got != envIndicatorPrefix+"HOME" {
+		t.Errorf("providerIndicators() of env indicator = %v, want it kept", got)
+	}
+
+	descriptor, err := cacheDescriptor(indicators, MD5, nil, SYMLINKTARGET, false, 2, nil)
+	if err != nil {
+		t.Fatalf("cacheDescriptor() error = %v", err)
+	}
+	provided, err := cmdIndicator("echo provided " + shellQuote(jar))
+	if err != nil {
+		t.Fatalf("cmdIndicator() error = %v", err)
+	}
+	outer, err := cmdIndicator("echo outer " + shellQuote(lockfile))
+	if err != nil {
+		t.Fatalf("cmdIndicator() error = %v", err)
+	}
+	if descriptor[jar] != provided || descriptor[filepath.Join(tmpDir, "other", "dep")] != outer {
+		t.Errorf("cacheDescriptor() = %v, want the digests of the most specific providers", descriptor)
+	}
+}
@@ -0,0 +1,71 @@
+// Git change indicator related models and functions.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const (
+	// gitIndicatorPrefix prefixes the change indicators fingerprinted by git, instead of the content of a file.
+	gitIndicatorPrefix = "git:"
+	// gitIndicatorHead is the git indicator of the checked out commit.
+	gitIndicatorHead = "HEAD"
+)
+
+// parseGitIndicator returns the target of a git indicator, HEAD or a path, and reports whether indicator is a git indicator.
+func parseGitIndicator(indicator string) (string, bool) {
+	if !strings.HasPrefix(indicator, gitIndicatorPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(indicator, gitIndicatorPrefix)), true
+}
+
+// normalizeGitIndicator expands the path of a git indicator and reports whether it exists, a HEAD indicator always exists.
+func normalizeGitIndicator(target string) (string, bool, error) {
+	if target == gitIndicatorHead {
+		return gitIndicatorPrefix + target, true, nil
+	}
+
+	pth, err := absPath(target)
+	if err != nil {
+		return "", false, err
+	}
+	exist, err := pathutil.IsPathExists(pth)
+	if err != nil {
+		return "", false, err
+	}
+	return gitIndicatorPrefix + pth, exist, nil
+}
+
+// gitIndicator returns the fingerprint of a git indicator: the SHA of the checked out commit for HEAD,
+// or the hash of the tree (or the blob) the path has in the checked out commit.
+// Only the committed changes fluctuate the cache invalidation, the uncommitted changes of the path do not.
+func gitIndicator(target string) (string, error) {
+	dir, object := "", ""
+	if target == gitIndicatorHead {
+		object = gitIndicatorHead
+	} else {
+		info, err := os.Stat(target)
+		if err != nil {
+			return "", err
+		}
+		// The ./ prefix resolves the path relative to the directory git runs in, instead of the repository's root.
+		if info.IsDir() {
+			dir, object = target, gitIndicatorHead+":./"
+		} else {
+			dir, object = filepath.Dir(target), gitIndicatorHead+":./"+filepath.Base(target)
+		}
+	}
+
+	out, err := command.New("git", "rev-parse", "--verify", object).SetDir(dir).SetStderr(os.Stderr).RunAndReturnTrimmedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get git hash of %s: %s", target, err)
+	}
+	return "git: " + out, nil
+}
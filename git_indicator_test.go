@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_gitIndicator(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = tmpDir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v failed: %s", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	commit := func(pths map[string]string) {
+		createDirStruct(t, pths)
+		git("add", "-A")
+		git("commit", "-q", "-m", "commit")
+	}
+
+	git("init", "-q")
+	commit(map[string]string{
+		filepath.Join(tmpDir, "src", "file1"):   "content 1",
+		filepath.Join(tmpDir, "other", "file2"): "content 2",
+	})
+	srcDir := filepath.Join(tmpDir, "src")
+	srcTree := git("rev-parse", "HEAD:src")
+
+	if got, err := gitIndicator(srcDir); err != nil || got != "git: "+srcTree {
+		t.Errorf("gitIndicator(src) = %v, %v, want git: %v", got, err, srcTree)
+	}
+	if got, err := gitIndicator(filepath.Join(srcDir, "file1")); err != nil || got != "git: "+git("rev-parse", "HEAD:src/file1") {
+		t.Errorf("gitIndicator(src/file1) = %v, %v, want the blob hash", got, err)
+	}
+
+	// The tree of src does not change when the sources outside of it change.
+	commit(map[string]string{filepath.Join(tmpDir, "other", "file2"): "content 3"})
+	if got, err := gitIndicator(srcDir); err != nil || got != "git: "+srcTree {
+		t.Errorf("gitIndicator(src) = %v, %v after other changed, want git: %v", got, err, srcTree)
+	}
+
+	// Uncommitted changes do not change the tree.
+	createDirStruct(t, map[string]string{filepath.Join(srcDir, "file1"): "uncommitted"})
+	if got, err := gitIndicator(srcDir); err != nil || got != "git: "+srcTree {
+		t.Errorf("gitIndicator(src) = %v, %v with uncommitted changes, want git: %v", got, err, srcTree)
+	}
+
+	commit(nil)
+	if got, err := gitIndicator(srcDir); err != nil || got == "git: "+srcTree {
+		t.Errorf("gitIndicator(src) = %v, %v after src changed, want another tree", got, err)
+	}
+
+	if _, err := gitIndicator(filepath.Join(srcDir, "missing")); err == nil {
+		t.Errorf("gitIndicator(src/missing) error = nil, want error")
+	}
+}
@@ -0,0 +1,129 @@
+// Hardware accelerated gzip compression related models and functions.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/klauspost/compress/gzip"
+)
+
+// gzipCommands lists the external gzip compatible commands in the order of preference:
+// igzip (Intel ISA-L) compresses with SIMD instructions, pigz compresses with multiple threads
+// (and with zlib-ng's SIMD implementation if it is linked to zlib-ng).
+// If none of them is available the archive is compressed with klauspost/compress, which is faster than compress/gzip.
+var gzipCommands = []string{"igzip", "pigz"}
+
+// detectGzipCommand returns the path of the fastest available gzip compatible command, or empty if none is available.
+func detectGzipCommand() string {
+	for _, name := range gzipCommands {
+		if pth, err := exec.LookPath(name); err == nil {
+			return pth
+		}
+	}
+	return ""
+}
+
+// gzipCommandArgs returns the arguments of the command at pth to compress its stdin to its stdout with the given gzip level.
+func gzipCommandArgs(pth string, level int) []string {
+	if filepath.Base(pth) == "igzip" {
+		// igzip supports the levels 0 to 3.
+		level = (level + 2) / 3
+	}
+	// -n omits the modification time from the header, the output only depends on the input.
+	return []string{"-c", "-n", fmt.Sprintf("-%d", level)}
+}
+
+// commandFrameWriter writes a gzip stream as a sequence of members, each compressed member is written by a separate run
+// of a gzip compatible command, while stored members are written by gzip.Writer.
+// Concatenated gzip members are decompressed as a single stream.
+type commandFrameWriter struct {
+	writer io.Writer
+	pth    string
+	level  int
+	store  bool
+	// cmd and stdin are the running command of the current compressed member, nil until the member's first write.
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// stored is the writer of the current stored member, nil until the member's first write.
+	stored *gzip.Writer
+}
+
+func newCommandFrameWriter(writer io.Writer, pth string, level int) *commandFrameWriter {
+	return &commandFrameWriter{
+		writer: writer,
+		pth:    pth,
+		level:  level,
+	}
+}
+
+// Write writes b into the current member, starting the command (or the stored member) on the member's first write.
+func (w *commandFrameWriter) Write(b []byte) (int, error) {
+	if w.store {
+		if w.stored == nil {
+			stored, err := gzip.NewWriterLevel(w.writer, gzip.NoCompression)
+			if err != nil {
+				return 0, err
+			}
+			w.stored = stored
+		}
+		return w.stored.Write(b)
+	}
+
+	if w.cmd == nil {
+		cmd := command.New(w.pth, gzipCommandArgs(w.pth, w.level)...).SetStdout(w.writer).SetStderr(os.Stderr).GetCmd()
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return 0, err
+		}
+		if err := cmd.Start(); err != nil {
+			return 0, fmt.Errorf("failed to start %s: %s", w.pth, err)
+		}
+		w.cmd, w.stdin = cmd, stdin
+	}
+	return w.stdin.Write(b)
+}
+
+// nextFrame ends the current member, the next write starts a new one, stored without compression if store is set.
+func (w *commandFrameWriter) nextFrame(store bool) error {
+	if err := w.endFrame(); err != nil {
+		return err
+	}
+	w.store = store
+	return nil
+}
+
+// setLevel sets the compression level of the members started by the subsequent nextFrame calls.
+func (w *commandFrameWriter) setLevel(level int) {
+	w.level = level
+}
+
+// endFrame finishes the current member, waiting for the command to write the compressed member.
+func (w *commandFrameWriter) endFrame() error {
+	if w.stored != nil {
+		err := w.stored.Close()
+		w.stored = nil
+		return err
+	}
+
+	if w.cmd != nil {
+		cmd := w.cmd
+		w.cmd = nil
+		if err := w.stdin.Close(); err != nil {
+			return err
+		}
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("%s failed: %s", w.pth, err)
+		}
+	}
+	return nil
+}
+
+// Close finishes the current member.
+func (w *commandFrameWriter) Close() error {
+	return w.endFrame()
+}
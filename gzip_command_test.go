@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func Test_gzipCommandArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		pth   string
+		level int
+		want  []string
+	}{
+		{name: "pigz", pth: "/usr/bin/pigz", level: 9, want: []string{"-c", "-n", "-9"}},
+		{name: "igzip fastest", pth: "/usr/bin/igzip", level: 1, want: []string{"-c", "-n", "-1"}},
+		{name: "igzip best", pth: "/usr/bin/igzip", level: 9, want: []string{"-c", "-n", "-3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := gzipCommandArgs(tt.pth, tt.level); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("gzipCommandArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_commandFrameWriter(t *testing.T) {
+	// gzip accepts the same arguments as pigz.
+	pth, err := exec.LookPath("gzip")
+	if err != nil {
+		t.Skip("gzip is not available")
+	}
+
+	var buf bytes.Buffer
+	writer := newCommandFrameWriter(&buf, pth, 6)
+
+	if _, err := writer.Write([]byte("compressed")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := writer.nextFrame(true); err != nil {
+		t.Fatalf("failed to start stored member: %s", err)
+	}
+	if _, err := writer.Write([]byte("stored")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := writer.nextFrame(false); err != nil {
+		t.Fatalf("failed to start compressed member: %s", err)
+	}
+	if _, err := writer.Write([]byte("again")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	reader, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("failed to create gzip reader: %s", err)
+	}
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+	if got, want := string(decompressed), "compressedstoredagain"; got != want {
+		t.Errorf("decompressed content = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+// Hardlink related models and functions.
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+)
+
+// inode identifies a file on the system by its device and inode number.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkTarget returns the path of the file previously written into the archive with the same inode as the file at pth.
+// Returns false if the file at pth is the first written link of the inode, or its inode has a single link.
+func (a *Archive) hardlinkTarget(pth string, info os.FileInfo) (string, bool) {
+	id, ok := fileInode(info)
+	if !ok {
+		return "", false
+	}
+
+	if target, ok := a.links[id]; ok {
+		return target, true
+	}
+
+	if a.links == nil {
+		a.links = map[inode]string{}
+	}
+	a.links[id] = pth
+	return "", false
+}
+
+// writeHardlink writes a hardlink entry into the tar archive, referencing the previously written target with the same content.
+func (a *Archive) writeHardlink(pth string, info os.FileInfo, target string) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("failed to get tar file header(%s), error: %s", pth, err)
+	}
+
+	header.Name = pth
+	header.ModTime = info.ModTime()
+	header.Typeflag = tar.TypeLink
+	header.Linkname = target
+	header.Size = 0
+	header.Format = tar.FormatPAX
+	a.normalizeHeader(header)
+
+	if err := a.tar.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write header(%v), error: %s", header, err)
+	}
+	return nil
+}
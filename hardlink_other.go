@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "os"
+
+// fileInode returns the inode of the file, hardlinks are not detected on this platform.
+func fileInode(info os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode of the file, false if the file has a single link.
+func fileInode(info os.FileInfo) (inode, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return inode{}, false
+	}
+	return inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
@@ -0,0 +1,65 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func TestArchive_hardlinks(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	original := filepath.Join(tmpDir, "store", "package.json")
+	unrelated := filepath.Join(tmpDir, "store", "index.js")
+	createDirStruct(t, map[string]string{original: "content", unrelated: "content"})
+
+	link := filepath.Join(tmpDir, "node_modules", "package", "package.json")
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	if err := os.Link(original, link); err != nil {
+		t.Fatalf("failed to create hardlink: %s", err)
+	}
+
+	var writer bufferWriteCloser
+	archive, err := NewArchive(&writer, TAR, Compression{Method: NONE})
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	if err := archive.Write([]string{original, unrelated, link}, false); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+
+	want := []struct {
+		name     string
+		typeflag byte
+		linkname string
+	}{
+		{name: original, typeflag: tar.TypeReg},
+		{name: unrelated, typeflag: tar.TypeReg},
+		{name: link, typeflag: tar.TypeLink, linkname: original},
+	}
+
+	reader := tar.NewReader(&writer)
+	for _, w := range want {
+		header, err := reader.Next()
+		if err != nil {
+			t.Fatalf("failed to read header: %s", err)
+		}
+		if header.Name != w.name || header.Typeflag != w.typeflag || header.Linkname != w.linkname {
+			t.Errorf("header = %s (%c, %s), want %s (%c, %s)", header.Name, header.Typeflag, header.Linkname, w.name, w.typeflag, w.linkname)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Generic HTTP storage backend related models and functions.
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// httpScheme prefixes the destinations of the generic HTTP backend: http+<url>,
+// the files are uploaded to the <url>/<file name> urls, for example the generic repositories of Artifactory or Nexus.
+const httpScheme = "http+"
+
+// httpUploadOptions describes the upload requests of the generic HTTP backend,
+// the headers are not part of the destination url, so that the credentials are not logged.
+type httpUploadOptions struct {
+	method string
+	header http.Header
+}
+
+// httpUpload is the upload request options of the generic HTTP backend, configured by the step inputs.
+var httpUpload = httpUploadOptions{method: http.MethodPut}
+
+// httpDestinationURL returns the destination of the generic HTTP backend uploading the files under url.
+func httpDestinationURL(url string) string {
+	return httpScheme + strings.TrimSuffix(url, "/")
+}
+
+// httpFileURL returns the url the file at pth is uploaded to with the destination url of the generic HTTP backend.
+func httpFileURL(url, pth string) string {
+	return strings.TrimPrefix(url, httpScheme) + "/" + neturl.PathEscape(filepath.Base(pth))
+}
+
+// parseHTTPHeaders parses the headers given one per line in the "Name: value" form, the empty lines are skipped.
+func parseHTTPHeaders(s string) (http.Header, error) {
+	header := http.Header{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		split := strings.SplitN(line, ":", 2)
+		name := strings.TrimSpace(split[0])
+		if len(split) != 2 || name == "" {
+			// The line is not printed, it may contain a credential.
+			return nil, fmt.Errorf("invalid header, should be in the \"Name: value\" form")
+		}
+		header.Add(name, strings.TrimSpace(split[1]))
+	}
+	return header, nil
+}
+
+// sendHTTPUpload uploads body to the file url with the method and the headers of httpUpload,
+// size is the length of body, or 0 if it is unknown.
+// If checksums is not nil, the Content-MD5 header and the X-Checksum-Sha256 header of Artifactory are sent.
+func sendHTTPUpload(fileURL string, body io.Reader, size int64, checksums *contentChecksums) error {
+	req, err := http.NewRequest(httpUpload.method, fileURL, body)
+	if err != nil {
+		return fmt.Errorf("failed to create upload request: %s", err)
+	}
+	for name, values := range httpUpload.header {
+		req.Header[name] = values
+	}
+	if size > 0 {
+		req.ContentLength = size
+	}
+	if checksums != nil {
+		checksums.setContentMD5(req.Header)
+		req.Header.Set("X-Checksum-Sha256", hex.EncodeToString(checksums.sha256))
+	}
+
+	resp, err := uploadHTTPClient().Do(req)
+	if err != nil {
+		return newRequestError("failed to upload: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	// The repositories respond to the uploads with 200, 201 or 204.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newStatusError("upload failed with status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// uploadHTTPFile uploads the file at pth to the destination url of the generic HTTP backend, retrying with uploadRetryPolicy.
+func uploadHTTPFile(pth, url string) error {
+	fileURL := httpFileURL(url, pth)
+	log.Printf("Uploading to %s", fileURL)
+
+	checksums, err := loadContentChecksums(pth)
+	if err != nil {
+		return fmt.Errorf("failed to compute checksums: %s", err)
+	}
+
+	return uploadRetryPolicy.do(func() error {
+		file, err := os.Open(pth)
+		if err != nil {
+			return fmt.Errorf("failed to open archive file for upload (%s): %s", pth, err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				log.Warnf("Failed to close archive file (%s): %s", pth, err)
+			}
+		}()
+
+		info, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to get file info (%s): %s", pth, err)
+		}
+		return sendHTTPUpload(fileURL, newProgressReader(file, pth, info.Size()), info.Size(), checksums)
+	})
+}
+
+// downloadHTTPFile returns the content of the file uploaded from pth to the destination url of the generic HTTP backend,
+// or nil if the server responds with 404; the download is retried with uploadRetryPolicy.
+// The download request is sent with the headers of httpUpload, since they usually authenticate the downloads too.
+func downloadHTTPFile(pth, url string) ([]byte, error) {
+	fileURL := httpFileURL(url, pth)
+	log.Printf("Downloading %s", fileURL)
+
+	var b []byte
+	err := uploadRetryPolicy.do(func() error {
+		req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create download request: %s", err)
+		}
+		for name, values := range httpUpload.header {
+			req.Header[name] = values
+		}
+
+		resp, err := uploadHTTPClient().Do(req)
+		if err != nil {
+			return newRequestError("failed to download: %s", err)
+		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				log.Warnf("Failed to close response body: %s", err)
+			}
+		}()
+
+		if resp.StatusCode != http.StatusOK {
+			return newStatusError("download failed with status code: %d", resp.StatusCode)
+		}
+		b, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return newRequestError("failed to read response body: %s", err)
+		}
+		return nil
+	})
+	if isNotFoundError(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// refreshStoredHTTPFile reports whether the file uploaded from pth to the destination url of the generic HTTP backend
+// has the given SHA256 checksum, which Artifactory responds with in the X-Checksum-Sha256 header.
+// The stored file is kept as is, it is the latest cache already.
+func refreshStoredHTTPFile(pth, url string, sha256Sum []byte) (bool, error) {
+	fileURL := httpFileURL(url, pth)
+
+	var stored bool
+	err := uploadRetryPolicy.do(func() error {
+		req, err := http.NewRequest(http.MethodHead, fileURL, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %s", err)
+		}
+		for name, values := range httpUpload.header {
+			req.Header[name] = values
+		}
+
+		resp, err := uploadHTTPClient().Do(req)
+		if err != nil {
+			return newRequestError("failed to send request: %s", err)
+		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				log.Warnf("Failed to close response body: %s", err)
+			}
+		}()
+
+		if resp.StatusCode != http.StatusOK {
+			return newStatusError("request failed with status code: %d", resp.StatusCode)
+		}
+		stored = strings.EqualFold(resp.Header.Get("X-Checksum-Sha256"), hex.EncodeToString(sha256Sum))
+		return nil
+	})
+	if isNotFoundError(err) {
+		return false, nil
+	}
+	return stored, err
+}
+
+// uploadHTTPReader uploads the archive read from reader to the archive's url of the generic HTTP backend with chunked encoding,
+// the upload is not retried since the reader can not be read again.
+func uploadHTTPReader(reader io.Reader, url string) error {
+	fileURL := httpFileURL(url, cacheArchivePath)
+	log.Printf("Uploading to %s", fileURL)
+
+	return sendHTTPUpload(fileURL, newProgressReader(reader, cacheArchivePath, 0), 0, nil)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_parseHTTPHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		want    http.Header
+		wantErr bool
+	}{
+		{name: "empty", headers: "\n", want: http.Header{}},
+		{
+			name:    "headers",
+			headers: "Authorization: Bearer token\n\nx-ms-blob-type: BlockBlob\nX-Checksum: a:b\n",
+			want:    http.Header{"Authorization": {"Bearer token"}, "X-Ms-Blob-Type": {"BlockBlob"}, "X-Checksum": {"a:b"}},
+		},
+		{name: "missing value", headers: "Authorization", wantErr: true},
+		{name: "missing name", headers: ": value", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHTTPHeaders(tt.headers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHTTPHeaders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHTTPHeaders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_uploadArchiveFile_http(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	pth := filepath.Join(tmpDir, "cache-archive.tar")
+	createDirStruct(t, map[string]string{pth: "archive"})
+
+	options := httpUpload
+	httpUpload = httpUploadOptions{method: http.MethodPost, header: http.Header{"Authorization": {"Bearer token"}}}
+	defer func() {
+		httpUpload = options
+	}()
+
+	var method, path, authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, authorization = r.Method, r.URL.Path, r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	if err := uploadArchiveFile(pth, httpDestinationURL(server.URL+"/generic/cache/")); err != nil {
+		t.Fatalf("uploadArchiveFile() error = %v", err)
+	}
+	if method != http.MethodPost || path != "/generic/cache/cache-archive.tar" || authorization != "Bearer token" {
+		t.Errorf("uploadArchiveFile() requested %s %s with authorization %q", method, path, authorization)
+	}
+}
+
+func Test_downloadArchiveFile_http(t *testing.T) {
+	options := httpUpload
+	httpUpload = httpUploadOptions{method: http.MethodPut, header: http.Header{"Authorization": {"Bearer token"}}}
+	defer func() {
+		httpUpload = options
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else if r.URL.Path == "/generic/cache/cache-archive.tar.chunks.json" {
+			if _, err := w.Write([]byte("index")); err != nil {
+				t.Errorf("failed to write response: %s", err)
+			}
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		pth     string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "existing file", pth: "/tmp/cache-archive.tar.chunks.json", want: []byte("index")},
+		{name: "missing file", pth: "/tmp/cache-archive.tar.entries.json", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := downloadArchiveFile(tt.pth, httpDestinationURL(server.URL+"/generic/cache"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("downloadArchiveFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("downloadArchiveFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
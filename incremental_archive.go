@@ -0,0 +1,154 @@
+// Incremental archive related models and functions.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// tarTrailerSize is the size of the end-of-archive marker of tar archives: two zero blocks.
+const tarTrailerSize = 2 * 512
+
+// appendableArchive describes the previous uncompressed tar archive the changed entries are appended to.
+// The pull step extracts the entries in order, the appended entries replace the previous entries of the same path.
+type appendableArchive struct {
+	pth string
+	// end is the offset of the end-of-archive marker, the appended entries overwrite it.
+	end int64
+	// stackData, descriptor and checksums are the contents of the last archive info, cache info and checksum manifest entries.
+	stackData  []byte
+	descriptor map[string]string
+	checksums  map[string]fileChecksum
+	// leadingDescriptor reports whether the archive has a leading descriptor, which appending would make stale.
+	leadingDescriptor bool
+}
+
+// readAppendableArchive reads the uncompressed tar archive at pth, the archive of the previous cache.
+func readAppendableArchive(pth string) (*appendableArchive, error) {
+	file, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warnf("Failed to close archive (%s): %s", pth, err)
+		}
+	}()
+
+	archive := &appendableArchive{pth: pth}
+	tarReader := tar.NewReader(file)
+	for i := 0; ; i++ {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %s", err)
+		}
+
+		var v interface{}
+		switch header.Name {
+		case stackVersionsPath:
+			if archive.stackData == nil {
+				archive.stackData, err = ioutil.ReadAll(tarReader)
+			}
+		case cacheInfoFilePath:
+			archive.leadingDescriptor = archive.leadingDescriptor || i == leadingDescriptorIndex
+			archive.descriptor = nil
+			var b []byte
+			if b, err = ioutil.ReadAll(tarReader); err == nil {
+				if b, err = decompressDescriptorData(b); err == nil {
+					err = json.Unmarshal(b, &archive.descriptor)
+				}
+			}
+		case cacheChecksumsPath:
+			archive.checksums = nil
+			v = &archive.checksums
+		}
+		if v != nil {
+			err = json.NewDecoder(tarReader).Decode(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entry (%s): %s", header.Name, err)
+		}
+	}
+
+	// Compared with the descriptor read by readCacheDescriptor, without the metadata
+	stripDescriptorMetadata(archive.descriptor)
+
+	// The tar reader reads the archive unbuffered, it stops right after the end-of-archive marker.
+	pos, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	archive.end = pos - tarTrailerSize
+	trailer := make([]byte, tarTrailerSize)
+	if _, err := file.ReadAt(trailer, archive.end); err != nil || !bytes.Equal(trailer, make([]byte, tarTrailerSize)) {
+		return nil, fmt.Errorf("failed to find the end of the archive")
+	}
+	return archive, nil
+}
+
+// checkAppendable returns an error if the changes can not be appended to the archive,
+// if the archive does not belong to the previous cache, or has a leading descriptor, or its archive info differs from the current one,
+// or if files were removed, which can not be removed from the archive by appending.
+// The moved files are let through: their new paths are appended, and their old paths are recorded in the tombstone list.
+func (a *appendableArchive) checkAppendable(descriptor map[string]string, changes result, stackData []byte) error {
+	if !reflect.DeepEqual(a.descriptor, descriptor) {
+		return fmt.Errorf("the archive does not belong to the previous cache")
+	}
+	if a.leadingDescriptor {
+		return fmt.Errorf("the archive has a leading descriptor")
+	}
+	if !bytes.Equal(a.stackData, stackData) {
+		return fmt.Errorf("the archive info changed: %s", a.stackData)
+	}
+	moved := map[string]bool{}
+	for _, move := range changes.moved {
+		moved[move.from] = true
+	}
+	removed := len(changes.removedIgnored)
+	for _, pth := range changes.removed {
+		if !moved[pth] {
+			removed++
+		}
+	}
+	if removed > 0 {
+		return fmt.Errorf("%d files were removed", removed)
+	}
+	return nil
+}
+
+// open opens the archive for appending entries in place of its end-of-archive marker.
+func (a *appendableArchive) open() (*os.File, error) {
+	file, err := os.OpenFile(a.pth, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(a.end); err == nil {
+		_, err = file.Seek(a.end, io.SeekStart)
+	}
+	if err != nil {
+		if err := file.Close(); err != nil {
+			log.Warnf("Failed to close archive (%s): %s", a.pth, err)
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// appendedPaths returns the paths to append to the archive of the previous cache: the changed and added ones.
+func appendedPaths(changes result) []string {
+	var pths []string
+	pths = append(pths, changes.changed...)
+	pths = append(pths, changes.added...)
+	return append(pths, changes.addedIgnored...)
+}
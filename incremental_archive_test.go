@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_appendableArchive(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pthA, pthB, pthC := filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b"), filepath.Join(tmpDir, "c")
+	createDirStruct(t, map[string]string{pthA: "a", pthB: "b"})
+	archivePth := filepath.Join(tmpDir, "cache-archive.tar")
+	stackData := []byte(`{"stack_id":"osx-xcode-12.0.x"}`)
+
+	write := func(writer io.WriteCloser, appendTo *appendableArchive, descriptor map[string]string, pths []string) {
+		archive, err := NewArchive(writer, TAR, Compression{Method: NONE})
+		if err != nil {
+			t.Fatalf("failed to create archive: %s", err)
+		}
+		if appendTo != nil {
+			archive.checksums = appendTo.checksums
+		} else if err := archive.writeData(stackData, stackVersionsPath); err != nil {
+			t.Fatalf("failed to write archive info: %s", err)
+		}
+		if err := archive.Write(pths, false); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		if err := archive.writeChecksums(cacheChecksumsPath); err != nil {
+			t.Fatalf("failed to write checksums: %s", err)
+		}
+		if err := archive.WriteHeader(descriptor, cacheInfoFilePath); err != nil {
+			t.Fatalf("failed to write header: %s", err)
+		}
+		if err := archive.Close(); err != nil {
+			t.Fatalf("failed to close archive: %s", err)
+		}
+	}
+
+	file, err := os.Create(archivePth)
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	prevDescriptor := map[string]string{pthA: "1", pthB: "1"}
+	write(file, nil, prevDescriptor, []string{pthA, pthB})
+
+	previous, err := readAppendableArchive(archivePth)
+	if err != nil {
+		t.Fatalf("readAppendableArchive() error = %v", err)
+	}
+	if string(previous.stackData) != string(stackData) || len(previous.descriptor) != 2 || len(previous.checksums) != 2 {
+		t.Errorf("readAppendableArchive() = %s, %v, %v, want the archive info, the descriptor and the checksums of 2 files", previous.stackData, previous.descriptor, previous.checksums)
+	}
+
+	curDescriptor := map[string]string{pthA: "2", pthB: "1"}
+	tests := []struct {
+		name       string
+		descriptor map[string]string
+		changes    result
+		stackData  []byte
+		wantErr    bool
+	}{
+		{name: "changed", descriptor: prevDescriptor, changes: compare(prevDescriptor, curDescriptor, nil, nil), stackData: stackData},
+		{name: "other cache", descriptor: curDescriptor, changes: compare(curDescriptor, curDescriptor, nil, nil), stackData: stackData, wantErr: true},
+		{name: "stack changed", descriptor: prevDescriptor, changes: compare(prevDescriptor, curDescriptor, nil, nil), stackData: []byte(`{}`), wantErr: true},
+		{name: "removed", descriptor: prevDescriptor, changes: compare(prevDescriptor, map[string]string{pthA: "1"}, nil, nil), stackData: stackData, wantErr: true},
+		{name: "moved", descriptor: prevDescriptor, changes: compare(prevDescriptor, map[string]string{pthA: "2", pthC: "1"}, nil, nil), stackData: stackData},
+		{name: "moved and removed", descriptor: prevDescriptor, changes: compare(prevDescriptor, map[string]string{pthC: "1"}, nil, nil), stackData: stackData, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := previous.checkAppendable(tt.descriptor, tt.changes, tt.stackData); (err != nil) != tt.wantErr {
+				t.Errorf("checkAppendable() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	leading := *previous
+	leading.leadingDescriptor = true
+	if err := leading.checkAppendable(prevDescriptor, compare(prevDescriptor, curDescriptor, nil, nil), stackData); err == nil {
+		t.Errorf("checkAppendable() of archive with leading descriptor error = nil, want error")
+	}
+
+	createDirStruct(t, map[string]string{pthA: "changed"})
+	pths := appendedPaths(compare(prevDescriptor, curDescriptor, nil, nil))
+	if len(pths) != 1 || pths[0] != pthA {
+		t.Fatalf("appendedPaths() = %v, want [%s]", pths, pthA)
+	}
+
+	if pths := appendedPaths(compare(prevDescriptor, map[string]string{pthA: "2", pthC: "1"}, nil, nil)); !reflect.DeepEqual(pths, []string{pthA, pthC}) {
+		t.Errorf("appendedPaths() of moved file = %v, want [%s %s]", pths, pthA, pthC)
+	}
+
+	file, err = previous.open()
+	if err != nil {
+		t.Fatalf("failed to open archive: %s", err)
+	}
+	write(file, previous, curDescriptor, pths)
+
+	appended, err := readAppendableArchive(archivePth)
+	if err != nil {
+		t.Fatalf("readAppendableArchive() of appended archive error = %v", err)
+	}
+	if appended.descriptor[pthA] != "2" || appended.checksums[pthA].Size != int64(len("changed")) || appended.checksums[pthB].Size != 1 {
+		t.Errorf("readAppendableArchive() of appended archive = %v, %v, want the current descriptor and the checksums of both files", appended.descriptor, appended.checksums)
+	}
+
+	file, err = os.Open(archivePth)
+	if err != nil {
+		t.Fatalf("failed to open archive: %s", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			t.Errorf("failed to close archive: %s", err)
+		}
+	}()
+
+	var names []string
+	var content string
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read appended archive: %s", err)
+		}
+		names = append(names, header.Name)
+		if header.Name == pthA {
+			b, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("failed to read entry: %s", err)
+			}
+			content = string(b)
+		}
+	}
+	if len(names) != 8 || names[0] != stackVersionsPath || names[5] != pthA {
+		t.Errorf("entries of appended archive = %v, want the previous entries followed by the appended ones", names)
+	}
+	if content != "changed" {
+		t.Errorf("last entry of %s = %s, want changed", pthA, content)
+	}
+}
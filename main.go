@@ -4,27 +4,51 @@
 // Files to be cached can be referred by direct file path while multiple files can be selected by referring the container directory.
 // Optional indicator represents a files, based on which the step synchronizes the given file(s).
 // Syntax: file/path/to/cache, dir/to/cache, file/path/to/cache -> based/on/this/file, dir/to/cache -> based/on/this/file
+// Options can be appended to the items in brackets: dir/to/cache -> based/on/this/file [store, dereference]
 //
 // Ignore items are used to ignore certain file(s) from a directory to be cached or to mark that certain file(s) not relevant in cache synchronization.
 // Syntax: not/relevant/file/or/pattern, !file/or/pattern/to/remove/from/cache
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	neturl "net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/bitrise-io/go-utils/log"
 )
 
-const (
+// The paths of the cache descriptor, the cache archive and the archive info, also the names of their archive entries.
+// They are configured by the step inputs.
+var (
 	cacheInfoFilePath = "/tmp/cache-info.json"
 	cacheArchivePath  = "/tmp/cache-archive.tar"
 	stackVersionsPath = "/tmp/archive_info.json"
 )
 
+const (
+	buildInfoPath         = "/tmp/build_info.json"
+	cacheIndexFilePath    = "/tmp/cache-index.json"
+	cacheChecksumsPath    = "/tmp/cache-checksums.json"
+	cacheChunksDir        = "/tmp/cache-chunks"
+	cacheChunkIndexPath   = "/tmp/cache-chunks.json"
+	cacheTombstonesPath   = "/tmp/cache-tombstones.json"
+	cacheArchivesDir      = "/tmp/cache-archives"
+	cacheArchivesPath     = "/tmp/cache-archives.json"
+	cacheUploadStatePth   = "/tmp/cache-upload-state.json"
+	cacheDictionaryPath   = "/tmp/cache-dictionary.zstd"
+	cacheFingerprintsPath = "/tmp/cache-fingerprints.json"
+	cacheSizesPath        = "/tmp/cache-sizes.json"
+	descriptorCachePath   = "/tmp/cache-push-descriptor.json"
+)
+
 type sizeWriteCloser int64
 
 func (writer *sizeWriteCloser) Write(b []byte) (int, error) {
@@ -41,7 +65,75 @@ func logErrorfAndExit(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
-func writeArchive(descriptor map[string]string, stackData []byte, compress bool, dry bool, writer io.WriteCloser, pths []string) {
+// archiveReport stores the size of the generated archive and the time its generation took.
+type archiveReport struct {
+	uncompressed int64
+	compressed   int64
+	entries      int
+	duration     time.Duration
+}
+
+// ratio returns the compressed size relative to the uncompressed size.
+func (r archiveReport) ratio() float64 {
+	if r.uncompressed == 0 {
+		return 1
+	}
+	return float64(r.compressed) / float64(r.uncompressed)
+}
+
+// throughput returns the processed uncompressed MB per second.
+func (r archiveReport) throughput() float64 {
+	if r.duration <= 0 {
+		return 0
+	}
+	return float64(r.uncompressed) / 1024.0 / 1024.0 / r.duration.Seconds()
+}
+
+// archiveOptions stores how the cache archive is written besides its compression.
+type archiveOptions struct {
+	format ArchiveFormat
+	// storedPths lists the paths to archive without compression.
+	storedPths map[string]bool
+	// preserveXattrs stores the extended attributes of the files in the archive.
+	preserveXattrs bool
+	// dereferencedPths lists the symlinks to archive as their target.
+	dereferencedPths map[string]bool
+	// reproducible writes identical archives from identical inputs.
+	reproducible bool
+	// owner replaces the owner of the archived files, nil preserves the owners.
+	owner *entryOwner
+	// stripSetuid clears the setuid and setgid bits of the archived files.
+	stripSetuid bool
+	// entryIndexPth is the path of the entry index written next to the archive, empty if not written.
+	entryIndexPth string
+	// tombstones lists the paths of the previous cache which were removed.
+	tombstones []string
+	// buildData is the build info written after the archive info, nil if not written.
+	buildData []byte
+	// fingerprintData is the fingerprint cache for the next build, nil if not written.
+	fingerprintData []byte
+	// compressDescriptor writes the cache descriptor compressed with gzip.
+	compressDescriptor bool
+	// leadingDescriptor also writes the cache descriptor right after the archive info,
+	// so that the descriptor of the previous cache is fetched without downloading the whole archive.
+	leadingDescriptor bool
+	// sizeData is the file sizes of the cache descriptor for the next build, nil if not written.
+	// It is written before the files, so that the pull step can pre-allocate the space of the extracted files.
+	sizeData []byte
+	// appendTo is the archive of the previous cache the files are appended to, nil if a full archive is written.
+	appendTo *appendableArchive
+	// maxSize limits the size of the archive, 0 if not limited, trim drops the paths exceeding the limit instead of failing.
+	// itemPths lists the include items to break the size of the archived paths down by.
+	maxSize  int64
+	trim     bool
+	itemPths []string
+	// dataModTime is the modification time of the data entries, zero writes the current time.
+	// The pipe cache fixes it, so that the archive written to learn its size is identical to the uploaded one.
+	dataModTime time.Time
+}
+
+// writeArchive writes the archive of pths into writer, the errors are returned so that the pipe cache can stop the upload.
+func writeArchive(descriptor map[string]string, stackData []byte, compression Compression, options archiveOptions, dry bool, writer io.WriteCloser, pths []string) (archiveReport, error) {
 	// Generate cache archive
 	startTime := time.Now()
 
@@ -49,31 +141,193 @@ func writeArchive(descriptor map[string]string, stackData []byte, compress bool,
 		log.Infof("Generating cache archive")
 	}
 
-	archive, err := NewArchive(writer, compress)
+	archive, err := NewArchive(writer, options.format, compression)
 	if err != nil {
-		logErrorfAndExit("Failed to create archive: %s", err)
+		return archiveReport{}, fmt.Errorf("failed to create archive: %s", err)
+	}
+	archive.stored = options.storedPths
+	archive.xattrs = options.preserveXattrs
+	archive.dereferenced = options.dereferencedPths
+	archive.reproducible = options.reproducible
+	archive.owner = options.owner
+	archive.stripSetuid = options.stripSetuid
+	archive.maxSize = options.maxSize
+	archive.trim = options.trim
+	archive.dataModTime = options.dataModTime
+	if options.appendTo != nil {
+		archive.checksums = options.appendTo.checksums
+	}
+	if options.entryIndexPth != "" && !dry {
+		archive.offsets = map[string]entryOffset{}
+	}
+
+	writeHeader := archive.WriteHeader
+	if options.compressDescriptor {
+		writeHeader = archive.WriteCompressedHeader
 	}
 
 	// This is the first file written, to speed up reading it in subsequent builds
-	if err = archive.writeData(stackData, stackVersionsPath); err != nil {
-		logErrorfAndExit("Failed to write cache info to archive, error: %s", err)
+	// The archive appended to starts with the same archive info
+	if options.appendTo == nil {
+		if err = archive.writeData(stackData, stackVersionsPath); err != nil {
+			return archiveReport{}, fmt.Errorf("failed to write cache info to archive: %s", err)
+		}
+
+		if descriptor != nil && options.leadingDescriptor {
+			if err := writeHeader(descriptor, cacheInfoFilePath); err != nil {
+				return archiveReport{}, fmt.Errorf("failed to write archive header: %s", err)
+			}
+		}
+	}
+
+	if options.buildData != nil {
+		if err := archive.writeData(options.buildData, buildInfoPath); err != nil {
+			return archiveReport{}, fmt.Errorf("failed to write build info to archive: %s", err)
+		}
+	}
+
+	if options.fingerprintData != nil {
+		if err := archive.writeData(options.fingerprintData, cacheFingerprintsPath); err != nil {
+			return archiveReport{}, fmt.Errorf("failed to write fingerprint cache to archive: %s", err)
+		}
+	}
+
+	if options.sizeData != nil {
+		if err := archive.writeData(options.sizeData, cacheSizesPath); err != nil {
+			return archiveReport{}, fmt.Errorf("failed to write file sizes to archive: %s", err)
+		}
+	}
+
+	// Written at the beginning of the archive, the pull step can delete the stale files before extracting
+	if len(options.tombstones) > 0 {
+		if err := archive.writeTombstones(options.tombstones, cacheTombstonesPath); err != nil {
+			return archiveReport{}, fmt.Errorf("failed to write tombstone list to archive: %s", err)
+		}
+	}
+
+	// The dictionary is cached to compress subsequent archives with the same dictionary
+	if len(compression.Dictionary) > 0 {
+		if err := archive.writeData(compression.Dictionary, cacheDictionaryPath); err != nil {
+			return archiveReport{}, fmt.Errorf("failed to write compression dictionary to archive: %s", err)
+		}
 	}
 
 	if err := archive.Write(pths, dry); err != nil {
-		logErrorfAndExit("Failed to populate archive: %s", err)
+		if _, ok := err.(*sizeLimitError); ok {
+			log.Warnf("Size of the cache paths:")
+			logSizeBreakdown(pths, options.itemPths)
+		}
+		return archiveReport{}, fmt.Errorf("failed to populate archive: %s", err)
+	}
+
+	if len(archive.dropped) > 0 && !dry {
+		log.Warnf("Archive size limit reached, dropped %d paths of the lowest priority:", len(archive.dropped))
+		logSizeBreakdown(archive.dropped, options.itemPths)
 	}
 
-	if err := archive.WriteHeader(descriptor, cacheInfoFilePath); err != nil {
-		logErrorfAndExit("Failed to write archive header: %s", err)
+	if err := archive.writeChecksums(cacheChecksumsPath); err != nil {
+		return archiveReport{}, fmt.Errorf("failed to write checksum manifest to archive: %s", err)
+	}
+
+	// The descriptor is written into the manifest of per include item archives
+	if descriptor != nil {
+		if err := writeHeader(descriptor, cacheInfoFilePath); err != nil {
+			return archiveReport{}, fmt.Errorf("failed to write archive header: %s", err)
+		}
 	}
 
 	if err := archive.Close(); err != nil {
-		logErrorfAndExit("Failed to close archive: %s", err)
+		return archiveReport{}, fmt.Errorf("failed to close archive: %s", err)
+	}
+
+	if archive.offsets != nil {
+		if err := archive.writeEntryIndex(options.entryIndexPth, compression.Method); err != nil {
+			return archiveReport{}, fmt.Errorf("failed to write entry index: %s", err)
+		}
+	}
+
+	uncompressed, compressed := archive.Size()
+	report := archiveReport{
+		uncompressed: uncompressed,
+		compressed:   compressed,
+		entries:      archive.Entries(),
+		duration:     time.Since(startTime),
 	}
 
 	if !dry {
-		log.Donef("Done in %s\n", time.Since(startTime))
+		log.Printf("Archive size: %d bytes, uncompressed: %d bytes, ratio: %.2f, throughput: %.2f MB/s", report.compressed, report.uncompressed, report.ratio(), report.throughput())
+		log.Donef("Done in %s\n", report.duration)
+	}
+
+	return report, nil
+}
+
+// storageBackendURL returns the destination url of the storage backend, and configures the backend's credentials.
+func storageBackendURL(configs Config, backend string) (string, error) {
+	switch backend {
+	case "s3":
+		return s3URL(configs.S3Bucket, scopedDirectory(configs.S3Prefix), configs.S3Region, s3EndpointOptions{
+			endpoint:           configs.S3Endpoint,
+			pathStyle:          configs.S3PathStyle == "true",
+			insecureSkipVerify: configs.S3SkipTLSVerify == "true",
+		}), nil
+	case "file":
+		return fileDestinationURL(scopedDirectory(configs.FileDestination), configs.FileRetention), nil
+	case "sftp":
+		sftpKeys = sftpIdentity{privateKey: string(configs.SFTPPrivateKey), knownHosts: configs.SFTPKnownHosts}
+		return sftpURL(configs.SFTPUser, configs.SFTPHost, configs.SFTPPort, scopedDirectory(configs.SFTPDirectory)), nil
+	case "http":
+		header, err := parseHTTPHeaders(string(configs.HTTPUploadHeaders))
+		if err != nil {
+			return "", fmt.Errorf("failed to parse http upload headers: %s", err)
+		}
+		httpUpload = httpUploadOptions{method: configs.HTTPUploadMethod, header: header}
+		url := configs.HTTPUploadURL
+		if cacheKey != "" {
+			url = strings.TrimSuffix(url, "/") + "/" + cacheKeyPathElement(cacheKey)
+		}
+		return httpDestinationURL(url), nil
+	default:
+		return configs.CacheAPIURL, nil
+	}
+}
+
+// configurePaths sets the paths of the cache descriptor, the cache archive and the archive info configured by the step inputs,
+// and creates the directory of the cache archive. The empty inputs keep the default paths.
+func configurePaths(configs Config) error {
+	if configs.CacheInfoPath != "" {
+		cacheInfoFilePath = configs.CacheInfoPath
+	}
+	if configs.CacheArchivePath != "" {
+		cacheArchivePath = configs.CacheArchivePath
+		if err := os.MkdirAll(filepath.Dir(cacheArchivePath), 0755); err != nil {
+			return fmt.Errorf("failed to create cache archive directory: %s", err)
+		}
+	}
+	if configs.ArchiveInfoPath != "" {
+		stackVersionsPath = configs.ArchiveInfoPath
+	}
+	return nil
+}
+
+// uploadFallback uploads the archive with upload to the fallback storage backend after the upload to the storage backend failed with uploadErr,
+// uploadErr is returned if there is no fallback storage backend.
+// The upload state records the files uploaded to the primary storage backend, the fallback uploads every file.
+func uploadFallback(configs Config, upload func(url string, state *uploadState) error, uploadErr error) error {
+	if configs.FallbackStorageBackend == "none" {
+		return uploadErr
+	}
+	log.Warnf("Failed to upload archive: %s", uploadErr)
+
+	url, err := storageBackendURL(configs, configs.FallbackStorageBackend)
+	if err != nil {
+		return fmt.Errorf("failed to configure fallback storage backend: %s", err)
 	}
+	log.Warnf("Uploading to the fallback storage backend: %s", configs.FallbackStorageBackend)
+	if err := upload(url, nil); err != nil {
+		return fmt.Errorf("failed to upload to the fallback storage backend: %s", err)
+	}
+	return nil
 }
 
 func main() {
@@ -87,25 +341,120 @@ func main() {
 	configs.Print()
 	fmt.Println()
 
-	compress := configs.CompressArchive == "true"
+	if configs.StepDeadline > 0 {
+		deadline := time.Duration(configs.StepDeadline) * time.Second
+		// Fails the step instead of stalling the build until the global timeout of the build kills it.
+		time.AfterFunc(deadline, func() {
+			logErrorfAndExit("Step deadline (%s) exceeded", deadline)
+		})
+	}
+
+	compression := Compression{Method: NONE}
+	if configs.CompressArchive == "true" {
+		compression = Compression{
+			Method:    CompressionMethod(configs.CompressionMethod),
+			Level:     configs.CompressionLevel,
+			Seekable:  configs.SeekableArchive == "true",
+			WindowLog: configs.ZstdWindowLog,
+		}
+	}
 	pipe := configs.Pipe == "true"
+	uploadRetryPolicy = retryPolicy{
+		retries: configs.UploadRetries,
+		wait:    time.Duration(configs.UploadRetryWait) * time.Second,
+	}
+	var proxy *neturl.URL
+	if configs.ProxyURL != "" {
+		proxy, err = parseProxyURL(configs.ProxyURL, configs.ProxyUser, string(configs.ProxyPassword))
+		if err != nil {
+			logErrorfAndExit("Failed to configure proxy: %s", err)
+		}
+	}
+	uploadChecksums = configs.UploadChecksum == "true"
+	uploadTTLDays = configs.CacheTTL
+	if err := configurePaths(configs); err != nil {
+		logErrorfAndExit("Failed to configure paths: %s", err)
+	}
+	if configs.PushCooldown > 0 || configs.MaxCacheAge > 0 {
+		pushTime = time.Now()
+	}
+	if configs.DescriptorSigningKey != "" {
+		descriptorSigningKey = []byte(configs.DescriptorSigningKey)
+	}
+	cacheKey, err = renderCacheKey(configs.CacheKeyTemplate, configs)
+	if err != nil {
+		logErrorfAndExit("Failed to configure cache key: %s", err)
+	}
+	if cacheKey != "" {
+		log.Printf("Cache key: %s", cacheKey)
+	}
+	uploadProgress = progressOptions{
+		interval: time.Duration(configs.ProgressInterval) * time.Second,
+		// The bars of the parallel uploads would overwrite each other.
+		bar: configs.ProgressBar == "true" && configs.ParallelUploads == 1 && isTerminal(os.Stdout),
+	}
+	uploadTransport = newUploadTransport(uploadTransportOptions{
+		timeouts: uploadTimeouts{
+			connect: time.Duration(configs.ConnectTimeout) * time.Second,
+			read:    time.Duration(configs.ReadTimeout) * time.Second,
+			write:   time.Duration(configs.WriteTimeout) * time.Second,
+		},
+		proxy:           proxy,
+		http2:           configs.HTTP2 == "true",
+		keepAlive:       configs.KeepAlive == "true",
+		writeBufferSize: configs.WriteBufferSize * 1024,
+		// Keeps a connection of each parallel upload for the subsequent uploads.
+		maxIdleConnsPerHost: configs.ParallelUploads,
+	})
 
 	// Cleaning paths
 	startTime := time.Now()
 
 	log.Infof("Cleaning paths")
 
-	indicatorByPth := parseIncludeList(strings.Split(configs.Paths, "\n"))
+	includeList, err := expandIncludeList(strings.Split(configs.Paths, "\n"))
+	if err != nil {
+		logErrorfAndExit("Failed to expand include list: %s", err)
+	}
+	indicatorByPth := parseIncludeList(includeList)
 	if len(indicatorByPth) == 0 {
 		log.Warnf("No path to cache, skip caching...")
+		exportPushSkipped(true)
 		os.Exit(0)
 	}
 
+	if configs.AutoIndicators == "true" {
+		workDir, err := os.Getwd()
+		if err != nil {
+			logErrorfAndExit("Failed to get working directory: %s", err)
+		}
+		indicatorByPth, err = autoIndicators(indicatorByPth, workDir)
+		if err != nil {
+			logErrorfAndExit("Failed to detect lockfile indicators: %s", err)
+		}
+	}
+
 	indicatorByPth, err = normalizeIndicatorByPath(indicatorByPth)
 	if err != nil {
 		logErrorfAndExit("Failed to parse include list: %s", err)
 	}
 
+	optionsByPth, err := normalizeOptionsByPath(parseIncludeOptionsList(includeList))
+	if err != nil {
+		logErrorfAndExit("Failed to parse include list options: %s", err)
+	}
+
+	indicatorByPth, dereferencedPths, err := dereferenceSymlinks(indicatorByPth, func(pth string) bool {
+		symlinks := optionsForPath(pth, optionsByPth).symlinks
+		if symlinks == "" {
+			symlinks = SymlinkMode(configs.SymlinkHandling)
+		}
+		return symlinks == DEREFERENCE
+	})
+	if err != nil {
+		logErrorfAndExit("Failed to follow symlinks: %s", err)
+	}
+
 	excludeByPattern := parseIgnoreList(strings.Split(configs.IgnoredPaths, "\n"))
 	excludeByPattern, err = normalizeExcludeByPattern(excludeByPattern)
 	if err != nil {
@@ -117,10 +466,55 @@ func main() {
 		logErrorfAndExit("Failed to interleave include and ignore list: %s", err)
 	}
 
+	if configs.ExcludeIgnoredPaths == "true" {
+		var excludedPths []string
+		indicatorByPth, excludedPths = excludeIgnored(indicatorByPth)
+
+		size, err := cacheSize(excludedPths)
+		if err != nil {
+			logErrorfAndExit("Failed to calculate the size of the ignored paths: %s", err)
+		}
+		log.Printf("Excluded %d ignored paths (%d bytes) from the cache archive", len(excludedPths), size)
+		if configs.DebugMode == "true" {
+			for _, pth := range excludedPths {
+				log.Debugf("- %s", pth)
+			}
+		}
+	}
+
+	// Applied after the ignored paths are excluded, these paths are archived in any case
+	if configs.FingerprintIgnoredPaths != "" {
+		fingerprintIgnoreByPattern := parseIgnoreList(strings.Split(configs.FingerprintIgnoredPaths, "\n"))
+		for pattern, exclude := range fingerprintIgnoreByPattern {
+			if exclude {
+				log.Warnf("The ! prefix is not supported by ignore fingerprint on paths, the path is still archived: %s", pattern)
+			}
+		}
+		fingerprintIgnoreByPattern, err = normalizeExcludeByPattern(fingerprintIgnoreByPattern)
+		if err != nil {
+			logErrorfAndExit("Failed to parse ignore fingerprint list: %s", err)
+		}
+		indicatorByPth = ignoreFingerprints(indicatorByPth, fingerprintIgnoreByPattern)
+	}
+
+	// The paths without an indicator are ignored before the providers replace their indicators
+	if InvalidationPolicy(configs.InvalidationPolicy) == INDICATORONLY {
+		indicatorByPth = ignoreSelfIndicated(indicatorByPth)
+	}
+
+	if configs.FingerprintProviders != "" {
+		cmdByPth, err := parseFingerprintProviderList(strings.Split(configs.FingerprintProviders, "\n"))
+		if err != nil {
+			logErrorfAndExit("Failed to parse fingerprint providers: %s", err)
+		}
+		indicatorByPth = providerIndicators(indicatorByPth, cmdByPth)
+	}
+
 	log.Donef("Done in %s\n", time.Since(startTime))
 
 	if len(indicatorByPth) == 0 {
 		log.Warnf("No path to cache, skip caching...")
+		exportPushSkipped(true)
 		os.Exit(0)
 	}
 
@@ -129,25 +523,147 @@ func main() {
 
 	log.Infof("Checking previous cache status")
 
-	prevDescriptor, err := readCacheDescriptor(cacheInfoFilePath)
+	prevDescriptor, prevPushedAt, err := readCacheDescriptor(cacheInfoFilePath)
 	if err != nil {
 		logErrorfAndExit("Failed to read previous cache descriptor: %s", err)
 	}
 
 	if prevDescriptor != nil {
 		log.Printf("Previous cache info found at: %s", cacheInfoFilePath)
+		if cacheExpired(prevPushedAt, time.Now(), time.Duration(configs.MaxCacheAge)*24*time.Hour) {
+			if prevPushedAt.IsZero() {
+				log.Warnf("Previous cache has no push time, new cache will be generated")
+			} else {
+				log.Warnf("Previous cache was pushed at %s, older than the maximum cache age, new cache will be generated", prevPushedAt.Format(time.RFC3339))
+			}
+			prevDescriptor = nil
+		}
+	} else if configs.FetchPreviousDescriptor == "true" {
+		log.Printf("No previous cache info found, fetching it from the cache API")
+		prevDescriptor, err = fetchPreviousDescriptor(configs.CacheAPIURL)
+		if err != nil {
+			log.Warnf("Failed to fetch previous cache descriptor, new cache will be generated: %s", err)
+		} else if prevDescriptor == nil {
+			log.Printf("No previous cache found")
+		} else {
+			log.Printf("Previous cache info fetched")
+		}
 	} else {
 		log.Printf("No previous cache info found")
 	}
 
-	curDescriptor, err := cacheDescriptor(indicatorByPth, ChangeIndicator(configs.FingerprintMethodID))
+	if configs.StackChangePolicy != "ignore" {
+		previousStackID, err := readStackID(stackVersionsPath)
+		if err != nil {
+			log.Warnf("Failed to read the stack of the previous cache, ignoring the stack: %s", err)
+		} else if stackChanged(previousStackID, configs.StackID) {
+			if configs.StackChangePolicy == "skip" {
+				log.Warnf("Previous cache was created on another stack (%s), skip caching...", previousStackID)
+				log.Printf("Total time: %s", time.Since(stepStartedAt))
+				exportPushSkipped(true)
+				os.Exit(0)
+			}
+			log.Warnf("Previous cache was created on another stack (%s), new cache will be generated", previousStackID)
+			prevDescriptor = nil
+		}
+	}
+
+	// The file sizes are not signed, the sizes of a tampered file would decide the change thresholds and the cooldown.
+	var prevSizes map[string]int64
+	if descriptorSigningKey != nil {
+		log.Printf("The previous file sizes are not signed, the removed files are not sized")
+	} else if prevSizes, err = readCacheSizes(cacheSizesPath); err != nil {
+		log.Warnf("Failed to read previous file sizes, the removed files are not sized: %s", err)
+	}
+
+	fingerprintWorkers := configs.FingerprintWorkers
+	if fingerprintWorkers == 0 {
+		fingerprintWorkers = runtime.GOMAXPROCS(0)
+	}
+	var fingerprints *fingerprintCache
+	if configs.FingerprintCache == "true" {
+		fingerprints, err = readFingerprintCache(cacheFingerprintsPath)
+		if err != nil {
+			log.Warnf("Failed to read fingerprint cache, hashing all files: %s", err)
+			fingerprints = newFingerprintCache(nil)
+		}
+	}
+	methodByExt, err := parseMethodByExtensionList(strings.Split(configs.FingerprintMethodByExtension, "\n"))
+	if err != nil {
+		logErrorfAndExit("Failed to parse fingerprint method by extension: %s", err)
+	}
+	// The method of the include item overrides the method of the indicator file's extension
+	methodByPth := map[string]ChangeIndicator{}
+	for pth, indicator := range indicatorByPth {
+		if method := optionsForPath(pth, optionsByPth).method; method != "" {
+			methodByPth[pth] = method
+		} else if method := methodForExtension(indicator, methodByExt); method != "" && isFileIndicator(indicator) {
+			methodByPth[pth] = method
+		}
+	}
+	var snapshot *descriptorSnapshot
+	var curDescriptor map[string]string
+	if configs.DescriptorCache == "true" {
+		snapshot, err = newDescriptorSnapshot(indicatorByPth, ChangeIndicator(configs.FingerprintMethodID), methodByPth, SymlinkFingerprint(configs.SymlinkFingerprint), configs.FingerprintFileMode == "true", fingerprints)
+		if err != nil {
+			log.Warnf("Failed to stat the indicator files, the descriptor is not reused: %s", err)
+		} else if snapshot == nil {
+			log.Printf("Env, command and git indicators change without changing any file, the descriptor is not reused")
+		} else if descriptor, previousFingerprints := snapshot.previousDescriptor(descriptorCachePath); descriptor != nil {
+			log.Printf("No indicator file changed since the descriptor was computed, reusing it")
+			curDescriptor = descriptor
+			if fingerprints != nil && previousFingerprints != nil {
+				fingerprints.current = previousFingerprints
+				fingerprints.reused = len(previousFingerprints)
+			}
+		}
+	}
+	if curDescriptor == nil {
+		curDescriptor, err = cacheDescriptor(indicatorByPth, ChangeIndicator(configs.FingerprintMethodID), methodByPth, SymlinkFingerprint(configs.SymlinkFingerprint), configs.FingerprintFileMode == "true", fingerprintWorkers, fingerprints)
+		if err != nil {
+			logErrorfAndExit("Failed to create current cache descriptor: %s", err)
+		}
+		if snapshot != nil {
+			if err := snapshot.write(descriptorCachePath, curDescriptor, fingerprints); err != nil {
+				log.Warnf("Failed to write the descriptor for a retried build: %s", err)
+			}
+		}
+	}
+	if fingerprints != nil {
+		log.Printf("Reused %d of %d fingerprints", fingerprints.reused, len(fingerprints.current))
+	}
+	sizedPths := make([]string, 0, len(indicatorByPth))
+	for pth := range indicatorByPth {
+		sizedPths = append(sizedPths, pth)
+	}
+	curSizes, err := fileSizes(sizedPths)
 	if err != nil {
-		logErrorfAndExit("Failed to create current cache descriptor: %s", err)
+		logErrorfAndExit("Failed to get the file sizes: %s", err)
+	}
+	log.Printf("Cache size: %d bytes in %d files", totalSize(curSizes), len(curSizes))
+
+	if configs.CompositeFingerprints == "true" {
+		itemPths, err := includeItemPaths(parseIncludeList(includeList))
+		if err != nil {
+			logErrorfAndExit("Failed to get include item paths: %s", err)
+		}
+		fileCount := len(curDescriptor)
+		curDescriptor = compositeDescriptor(curDescriptor, itemPths)
+		curSizes = compositeSizes(curSizes, itemPths)
+		log.Printf("Collapsed %d fingerprints into %d", fileCount, len(curDescriptor))
+	}
+
+	if digest, err := descriptorDigest(curDescriptor); err != nil {
+		logErrorfAndExit("Failed to get cache descriptor digest: %s", err)
+	} else {
+		log.Printf("Cache descriptor digest: %s", digest)
 	}
 
 	log.Donef("Done in %s\n", time.Since(startTime))
 
 	// Checking file changes
+	var tombstones []string
+	var changes *result
 	if prevDescriptor != nil {
 		startTime = time.Now()
 
@@ -161,7 +677,11 @@ func main() {
 			}
 		}
 
-		result := compare(prevDescriptor, curDescriptor)
+		result := compare(prevDescriptor, curDescriptor, prevSizes, curSizes)
+		if InvalidationPolicy(configs.InvalidationPolicy) == NEVERSHRINK {
+			result.ignoreRemovals(prevSizes, curSizes)
+		}
+		changes = &result
 
 		log.Warnf("Previous cache is invalid, new cache will be generated:")
 		log.Warnf("%d files needs to be removed", len(result.removed))
@@ -170,45 +690,317 @@ func main() {
 		logDebugPaths(result.changed)
 		log.Warnf("%d files added", len(result.added))
 		logDebugPaths(result.added)
+		log.Warnf("%d files moved", len(result.moved))
+		if configs.DebugMode == "true" {
+			for _, move := range result.moved {
+				log.Debugf("- %s -> %s", move.from, move.to)
+			}
+		}
+		log.Warnf("%d bytes changed", result.changedBytes)
 		log.Debugf("%d ignored files removed", len(result.removedIgnored))
 		logDebugPaths(result.removedIgnored)
-		log.Debugf("%d files did not change", len(result.matching))
-		logDebugPaths(result.matching)
+		log.Debugf("%d files did not change", result.matching)
 		log.Debugf("%d ignored files added", len(result.addedIgnored))
 		logDebugPaths(result.addedIgnored)
 
-		if result.hasChanges() {
-			log.Donef("File changes found in %s\n", time.Since(startTime))
-		} else {
+		if configs.ChangeReportPath != "" {
+			if err := writeChangeReport(configs.ChangeReportPath, curDescriptor, result); err != nil {
+				log.Warnf("Failed to write change report: %s", err)
+			} else {
+				log.Printf("Change report written to: %s", configs.ChangeReportPath)
+			}
+		}
+
+		exportChangeSummary(result)
+
+		// Ignored files are archived too, the removed ones are stale as well
+		for _, pth := range append(append([]string{}, result.removed...), result.removedIgnored...) {
+			// The files removed from a directory are not known from its digest, the directory itself is not deleted
+			if !isCompositeDescriptorPath(pth) {
+				tombstones = append(tombstones, pth)
+			}
+		}
+		sort.Strings(tombstones)
+
+		if !result.hasChanges() {
 			log.Donef("No files found in %s\n", time.Since(startTime))
 			log.Printf("Total time: %s", time.Since(stepStartedAt))
+			exportPushSkipped(true)
+			os.Exit(0)
+		}
+		log.Donef("File changes found in %s\n", time.Since(startTime))
+
+		if result.belowThresholds(configs.MinChangedFiles, int64(configs.MinChangedSize)*1024*1024) {
+			log.Warnf("%d files (%d bytes) changed, not more than the change thresholds, skip caching...", result.changedFiles(), result.changedBytes)
+			log.Printf("Total time: %s", time.Since(stepStartedAt))
+			exportPushSkipped(true)
+			os.Exit(0)
+		}
+
+		if result.inCooldown(prevPushedAt, time.Now(), time.Duration(configs.PushCooldown)*time.Minute, int64(configs.PushCooldownMaxChangedSize)*1024*1024) {
+			log.Warnf("Previous cache was pushed at %s, within the push cooldown, and %d bytes changed, skip caching...", prevPushedAt.Format(time.RFC3339), result.changedBytes)
+			log.Printf("Total time: %s", time.Since(stepStartedAt))
+			exportPushSkipped(true)
 			os.Exit(0)
 		}
 	}
 
 	var pths []string
+	storedPths := map[string]bool{}
 	for pth := range indicatorByPth {
 		pths = append(pths, pth)
+		if optionsForPath(pth, optionsByPth).store {
+			storedPths[pth] = true
+		}
+	}
+
+	// The paths are collected from maps in random order.
+	if configs.ReproducibleArchive == "true" {
+		sort.Strings(pths)
 	}
 
-	stackData, err := stackVersionData(configs.StackID)
+	if compression.Method != NONE && configs.CompressionMinSize > 0 {
+		// Estimated from the sizes recorded with the descriptor, without stat'ing the paths again
+		size := totalSize(curSizes)
+		if size < int64(configs.CompressionMinSize)*1024*1024 {
+			log.Printf("Estimated cache size: %d bytes is below the compression minimum size: %d MB, skipping compression", size, configs.CompressionMinSize)
+			compression = Compression{Method: NONE, Seekable: compression.Seekable}
+		}
+	}
+
+	if compression.Method == AUTO {
+		var estimate float64
+		compression.Method, estimate, err = selectCompressionMethod(pths)
+		if err != nil {
+			logErrorfAndExit("Failed to select compression method: %s", err)
+		}
+		log.Printf("Estimated compressibility: %.2f, selected compression method: %s", estimate, compression.Method)
+	}
+
+	if compression.Method == GZIP && configs.ArchiveFormat == string(TAR) {
+		compression.GzipCommand = detectGzipCommand()
+		if compression.GzipCommand != "" {
+			log.Printf("Compressing with accelerated gzip implementation: %s", compression.GzipCommand)
+		} else {
+			log.Printf("No accelerated gzip implementation found, compressing with klauspost/compress")
+		}
+	}
+
+	if compression.Method == ZSTD && configs.ZstdDictionary == "true" {
+		compression.Dictionary, err = loadOrTrainDictionary(cacheDictionaryPath, pths)
+		if err != nil {
+			log.Warnf("Failed to get compression dictionary, compressing without dictionary: %s", err)
+			compression.Dictionary = nil
+		}
+	}
+
+	if len(storedPths) > 0 && compression.Method != GZIP && compression.Method != ZSTD && compression.Method != NONE {
+		log.Warnf("The store include option is not supported with compression method: %s, storing %d files compressed", compression.Method, len(storedPths))
+	}
+	if len(storedPths) > 0 && configs.ArchiveFormat == string(SQUASHFS) && compression.Method != NONE {
+		log.Warnf("The store include option is not supported with archive format: %s, storing %d files compressed", SQUASHFS, len(storedPths))
+	}
+
+	bandwidth := make(chan float64, 1)
+	if configs.AdaptiveCompression == "true" && compression.Method != NONE {
+		if configs.ArchiveFormat == string(TAR) && (compression.Method == GZIP || compression.Method == ZSTD) {
+			compression.Bandwidth = bandwidth
+		} else {
+			log.Warnf("Adaptive compression is not supported with compression method: %s, compressing with a fixed level", compression.Method)
+		}
+	}
+
+	options := archiveOptions{
+		format:           ArchiveFormat(configs.ArchiveFormat),
+		storedPths:       storedPths,
+		preserveXattrs:   configs.PreserveXattrs == "true",
+		dereferencedPths: dereferencedPths,
+		reproducible:     configs.ReproducibleArchive == "true",
+		stripSetuid:      configs.StripSetuid == "true",
+		tombstones:       tombstones,
+	}
+	if configs.EntryIndex == "true" {
+		options.entryIndexPth = cacheArchivePath + entryIndexSuffix
+	}
+	if configs.NormalizeOwnership == "true" {
+		options.owner = currentOwner()
+		log.Printf("Archiving the files owned by: %s:%s (%d:%d)", options.owner.uname, options.owner.gname, options.owner.uid, options.owner.gid)
+	}
+
+	// The chunks of chunked archives are compressed individually, the archive itself is not compressed.
+	var chunkCompression Compression
+	if configs.ChunkedArchive == "true" {
+		chunkCompression = compression
+		compression = Compression{Method: NONE}
+	}
+
+	stackData, err := stackVersionData(configs.StackID, options.format, compression)
 	if err != nil {
 		logErrorfAndExit("Failed to get stack version info: %s", err)
 	}
 
+	// The build info differs between builds of identical files
+	if !options.reproducible {
+		options.buildData, err = buildInfoData(configs)
+		if err != nil {
+			logErrorfAndExit("Failed to get build info: %s", err)
+		}
+	}
+
+	if fingerprints != nil {
+		options.fingerprintData, err = fingerprints.data()
+		if err != nil {
+			logErrorfAndExit("Failed to get fingerprint cache: %s", err)
+		}
+	}
+
+	options.compressDescriptor = configs.CompressDescriptor == "true"
+	// The appended entries would make the leading descriptor stale
+	options.leadingDescriptor = configs.IncrementalArchive != "true"
+	options.sizeData, err = json.Marshal(curSizes)
+	if err != nil {
+		logErrorfAndExit("Failed to get file sizes: %s", err)
+	}
+
+	if configs.MaxArchiveSize > 0 {
+		options.maxSize = int64(configs.MaxArchiveSize) * 1024 * 1024
+		options.trim = configs.MaxArchiveSizeAction == "trim"
+		options.itemPths, err = includeItemPaths(parseIncludeList(includeList))
+		if err != nil {
+			logErrorfAndExit("Failed to parse include list: %s", err)
+		}
+		if options.trim {
+			sortByPriority(pths, optionsByPth)
+		}
+	}
+
+	if configs.IncrementalArchive == "true" {
+		if changes == nil {
+			log.Printf("No previous cache, writing a full archive")
+		} else if appendTo, err := readAppendableArchive(cacheArchivePath); err != nil {
+			log.Warnf("Failed to read the previous cache archive, writing a full archive: %s", err)
+		} else if err := appendTo.checkAppendable(prevDescriptor, *changes, stackData); err != nil {
+			log.Printf("Can not append to the previous cache archive, writing a full archive: %s", err)
+		} else {
+			options.appendTo = appendTo
+			pths = appendedPaths(*changes)
+			log.Printf("Appending %d changed files to the previous cache archive", len(pths))
+		}
+	}
+
 	var reader io.Reader
 	var writer io.WriteCloser
+	var pipeline *archivePipeline
+	var volumes *volumeWriter
+	var chunks *chunkWriter
+	var pathArchives []string
+	reports := make(chan archiveReport, 1)
 
 	if pipe {
-		reader, writer = io.Pipe()
-		go writeArchive(curDescriptor, stackData, false, compress, writer, pths)
+		options.dataModTime = time.Now()
+		pipeline = startArchivePipeline(func(writer io.WriteCloser) (archiveReport, error) {
+			return writeArchive(curDescriptor, stackData, compression, options, false, writer, pths)
+		})
+		reader = pipeline.reader
+		if compression.Bandwidth != nil {
+			reader = &bandwidthReader{reader: reader, bandwidth: bandwidth}
+		}
+	} else if configs.VolumeSize > 0 {
+		volumes = newVolumeWriter(cacheArchivePath, int64(configs.VolumeSize)*1024*1024*1024)
+		report, err := writeArchive(curDescriptor, stackData, compression, options, false, volumes, pths)
+		if err != nil {
+			logErrorfAndExit("Failed to generate cache archive: %s", err)
+		}
+		reports <- report
+	} else if configs.ChunkedArchive == "true" {
+		previousIndex, err := readChunkIndex(cacheChunkIndexPath)
+		if err != nil {
+			log.Warnf("Failed to read previous chunk index, uploading all chunks: %s", err)
+		} else if previousIndex != nil {
+			log.Printf("Previous chunk index found at: %s", cacheChunkIndexPath)
+		} else if configs.RemoteChunkIndex == "true" {
+			url, err := storageBackendURL(configs, configs.StorageBackend)
+			if err != nil {
+				logErrorfAndExit("Failed to configure storage backend: %s", err)
+			}
+			if previousIndex, err = downloadChunkIndex(cacheArchivePath, url); err != nil {
+				log.Warnf("Failed to download previous chunk index, uploading all chunks: %s", err)
+			} else if previousIndex == nil {
+				log.Printf("No previous chunk index in the storage backend, uploading all chunks")
+			} else {
+				log.Printf("Previous chunk index downloaded from the storage backend: %d chunks", len(previousIndex.Chunks))
+			}
+		}
+
+		chunks, err = newChunkWriter(cacheArchivePath, cacheChunksDir, chunkCompression, previousIndex)
+		if err != nil {
+			logErrorfAndExit("Failed to create chunked archive: %s", err)
+		}
+
+		report, err := writeArchive(curDescriptor, stackData, compression, options, false, chunks, pths)
+		if err != nil {
+			logErrorfAndExit("Failed to generate cache archive: %s", err)
+		}
+		report.compressed = chunks.compressedSize()
+		log.Printf("Chunks: %d, new chunks: %d, compressed size: %d bytes", len(chunks.chunks), len(chunks.written), report.compressed)
+		reports <- report
+	} else if configs.ArchivePerPath == "true" {
+		itemPths, err := includeItemPaths(parseIncludeList(includeList))
+		if err != nil {
+			logErrorfAndExit("Failed to parse include list: %s", err)
+		}
+
+		var report archiveReport
+		pathArchives, report, err = writePathArchives(cacheArchivesDir, cacheArchivesPath, itemPths, curDescriptor, changes, stackData, compression, options, pths)
+		if err != nil {
+			logErrorfAndExit("Failed to write archives: %s", err)
+		}
+		log.Printf("Archives: %d written, %d bytes", len(pathArchives), report.compressed)
+		reports <- report
+	} else if options.appendTo != nil {
+		writer, err = options.appendTo.open()
+		if err != nil {
+			logErrorfAndExit("Failed to open the previous cache archive: %s", err)
+		}
+
+		report, err := writeArchive(curDescriptor, stackData, compression, options, false, writer, pths)
+		if err != nil {
+			logErrorfAndExit("Failed to generate cache archive: %s", err)
+		}
+		reports <- report
 	} else {
 		writer, err = os.Create(cacheArchivePath)
 		if err != nil {
 			logErrorfAndExit("Failed to create cache archive: %s", err)
 		}
 
-		writeArchive(curDescriptor, stackData, false, compress, writer, pths)
+		report, err := writeArchive(curDescriptor, stackData, compression, options, false, writer, pths)
+		if err != nil {
+			logErrorfAndExit("Failed to generate cache archive: %s", err)
+		}
+		reports <- report
+	}
+
+	if configs.VerifyArchive == "true" {
+		startTime = time.Now()
+
+		log.Infof("Verifying cache archive")
+
+		archivePths := []string{cacheArchivePath}
+		if volumes != nil {
+			archivePths = nil
+			for _, volume := range volumes.volumes {
+				archivePths = append(archivePths, volume.Path)
+			}
+		}
+
+		report := <-reports
+		if err := verifyArchiveFiles(archivePths, options.format, compression, report.entries); err != nil {
+			logErrorfAndExit("Cache archive is corrupt, skipping upload: %s", err)
+		}
+		reports <- report
+
+		log.Donef("Done in %s\n", time.Since(startTime))
 	}
 
 	// Upload cache archive
@@ -216,16 +1008,78 @@ func main() {
 
 	log.Infof("Uploading cache archive")
 
-	if pipe {
-		archiveSizeWriteCloser := sizeWriteCloser(0)
-		writeArchive(curDescriptor, stackData, true, false, &archiveSizeWriteCloser, pths)
-		err = uploadArchiveReader(reader, int64(archiveSizeWriteCloser), configs.CacheAPIURL)
-	} else {
-		err = uploadArchiveFile(cacheArchivePath, configs.CacheAPIURL)
+	url, err := storageBackendURL(configs, configs.StorageBackend)
+	if err != nil {
+		logErrorfAndExit("Failed to configure storage backend: %s", err)
+	}
+
+	var state *uploadState
+	if configs.ResumableUpload == "true" {
+		state = loadUploadState(cacheUploadStatePth, url)
+	}
+
+	upload := func(url string, state *uploadState) error {
+		var err error
+		if pipe {
+			// The archive is generated once more to learn its size only if the destination requires it.
+			var sizeInBytes int64
+			if uploadReaderRequiresSize(url) {
+				if sizeInBytes, err = pipeArchiveSize(curDescriptor, stackData, compression, options, pths); err != nil {
+					return err
+				}
+			}
+			err = uploadArchiveReader(reader, sizeInBytes, url)
+		} else if volumes != nil {
+			err = uploadVolumes(volumes, url, configs.ParallelUploads, state)
+		} else if chunks != nil {
+			err = uploadChunks(chunks, url, configs.ParallelUploads, state)
+		} else if configs.ArchivePerPath == "true" {
+			err = uploadPathArchives(pathArchives, cacheArchivesPath, url, configs.ParallelUploads, state)
+		} else {
+			err = uploadArchiveFile(cacheArchivePath, url)
+		}
+		if err != nil {
+			return err
+		}
+
+		if options.entryIndexPth != "" {
+			log.Printf("Uploading entry index: %s", options.entryIndexPth)
+			if err := uploadArchiveFile(options.entryIndexPth, url); err != nil {
+				return fmt.Errorf("failed to upload entry index: %s", err)
+			}
+		}
+		return nil
+	}
+
+	stored := false
+	if configs.ContentPreflight == "true" {
+		stored, err = refreshStoredArchive(cacheArchivePath, url)
+		if err != nil {
+			log.Warnf("Failed to check the cache archive stored by the storage backend, uploading: %s", err)
+		} else if stored {
+			log.Printf("Storage backend already stores an identical cache archive, skipping upload")
+		}
+	}
+	if !stored {
+		err = upload(url, state)
+	}
+	if pipeline != nil {
+		// Stops the archive if the upload failed, the error is the archive's if the upload failed because of it.
+		var report archiveReport
+		report, err = pipeline.finish(err)
+		reports <- report
 	}
 	if err != nil {
-		logErrorfAndExit("Failed to upload archive: %s", err)
+		if err := uploadFallback(configs, upload, err); err != nil {
+			logErrorfAndExit("Failed to upload archive: %s", err)
+		}
+	} else if err := state.clear(); err != nil {
+		log.Warnf("Failed to remove upload state: %s", err)
 	}
 	log.Donef("Done in %s\n", time.Since(startTime))
+
+	exportArchiveReport(<-reports)
+	exportPushSkipped(false)
+
 	log.Donef("Total time: %s", time.Since(stepStartedAt))
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_configurePaths(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	infoPth, archivePth, stackPth := cacheInfoFilePath, cacheArchivePath, stackVersionsPath
+	defer func() {
+		cacheInfoFilePath, cacheArchivePath, stackVersionsPath = infoPth, archivePth, stackPth
+	}()
+
+	archiveDir := filepath.Join(tmpDir, "archives")
+	configs := Config{CacheArchivePath: filepath.Join(archiveDir, "cache-archive.tar"), ArchiveInfoPath: "/var/cache/archive_info.json"}
+	if err := configurePaths(configs); err != nil {
+		t.Fatalf("configurePaths() error = %v", err)
+	}
+	if cacheInfoFilePath != infoPth || cacheArchivePath != configs.CacheArchivePath || stackVersionsPath != configs.ArchiveInfoPath {
+		t.Errorf("configurePaths() = %s, %s, %s, want default cache info path and configured others", cacheInfoFilePath, cacheArchivePath, stackVersionsPath)
+	}
+	if info, err := os.Stat(archiveDir); err != nil || !info.IsDir() {
+		t.Errorf("cache archive directory not created: %v", err)
+	}
+}
+
+func Test_uploadFallback(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	policy := uploadRetryPolicy
+	uploadRetryPolicy = retryPolicy{retries: 2, wait: time.Millisecond}
+	defer func() {
+		uploadRetryPolicy = policy
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	pth := filepath.Join(tmpDir, "cache-archive.tar")
+	createDirStruct(t, map[string]string{pth: "archive"})
+	dstDir := filepath.Join(tmpDir, "nfs")
+
+	var urls []string
+	upload := func(url string, state *uploadState) error {
+		urls = append(urls, url)
+		return uploadArchiveFile(pth, url)
+	}
+
+	configs := Config{StorageBackend: "bitrise", CacheAPIURL: server.URL, FallbackStorageBackend: "file", FileDestination: dstDir, FileRetention: 1}
+	uploadErr := upload(configs.CacheAPIURL, nil)
+	if uploadErr == nil {
+		t.Fatalf("upload() to the failing cache api error = nil, want error")
+	}
+	if err := uploadFallback(configs, upload, uploadErr); err != nil {
+		t.Fatalf("uploadFallback() error = %v", err)
+	}
+	if want := fileDestinationURL(dstDir, 1); len(urls) != 2 || urls[1] != want {
+		t.Errorf("uploaded to %v, want the fallback %s after the storage backend", urls, want)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dstDir, "cache-archive.tar")); err != nil || string(b) != "archive" {
+		t.Errorf("fallback archive = %s, %v, want archive", b, err)
+	}
+
+	// Without a fallback storage backend the error of the upload is returned.
+	urls = nil
+	configs.FallbackStorageBackend = "none"
+	if err := uploadFallback(configs, upload, uploadErr); err != uploadErr || len(urls) != 0 {
+		t.Errorf("uploadFallback() without fallback = %v, uploaded to %v, want %v", err, urls, uploadErr)
+	}
+
+	// A failed fallback upload is reported.
+	configs.FallbackStorageBackend = "file"
+	failing := func(url string, state *uploadState) error {
+		return errors.New("disk full")
+	}
+	if err := uploadFallback(configs, failing, uploadErr); err == nil || err.Error() != "failed to upload to the fallback storage backend: disk full" {
+		t.Errorf("uploadFallback() with failing fallback error = %v", err)
+	}
+}
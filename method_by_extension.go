@@ -0,0 +1,52 @@
+// Per-extension fingerprint method related models and functions.
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// parseMethodByExtensionList returns the fingerprint methods by the file name extensions (with the leading dot) they apply to.
+func parseMethodByExtensionList(list []string) (map[string]ChangeIndicator, error) {
+	// *.jar -> file-size-mod-time
+	// .swift -> file-content-hash-xxh64
+	methodByExt := map[string]ChangeIndicator{}
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "->", 2)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("extension without a fingerprint method: %s", item)
+		}
+
+		ext := strings.TrimPrefix(strings.TrimSpace(parts[0]), "*")
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 || strings.ContainsAny(ext, globMeta+string(filepath.Separator)) {
+			return nil, fmt.Errorf("invalid extension (%s), use *.ext", strings.TrimSpace(parts[0]))
+		}
+		method := strings.TrimSpace(parts[1])
+		if !isChangeIndicator(method) {
+			return nil, fmt.Errorf("unknown fingerprint method (%s) of extension %s", method, ext)
+		}
+		methodByExt[ext] = ChangeIndicator(method)
+	}
+	return methodByExt, nil
+}
+
+// methodForExtension returns the fingerprint method of the longest extension of the file at pth,
+// so that .gradle.kts overrides .kts, or empty if none of the extensions match.
+func methodForExtension(pth string, methodByExt map[string]ChangeIndicator) ChangeIndicator {
+	name := filepath.Base(pth)
+	var method ChangeIndicator
+	var longest int
+	for ext, extMethod := range methodByExt {
+		// A dot file, such as .swift, has no extension
+		if len(name) > len(ext) && strings.HasSuffix(name, ext) && len(ext) > longest {
+			method = extMethod
+			longest = len(ext)
+		}
+	}
+	return method
+}
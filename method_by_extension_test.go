@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseMethodByExtensionList(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    []string
+		want    map[string]ChangeIndicator
+		wantErr bool
+	}{
+		{
+			name: "extensions",
+			list: []string{"*.jar -> file-size-mod-time", "", " .swift->file-content-hash-xxh64 "},
+			want: map[string]ChangeIndicator{".jar": SIZEMODTIME, ".swift": XXH64},
+		},
+		{name: "no method", list: []string{"*.jar"}, wantErr: true},
+		{name: "unknown method", list: []string{"*.jar -> size"}, wantErr: true},
+		{name: "not an extension", list: []string{"lib/*.jar -> file-mod-time"}, wantErr: true},
+		{name: "empty extension", list: []string{"*. -> file-mod-time"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMethodByExtensionList(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMethodByExtensionList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMethodByExtensionList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_methodForExtension(t *testing.T) {
+	methodByExt := map[string]ChangeIndicator{".kts": MD5, ".gradle.kts": MODTIME, ".jar": SIZEMODTIME}
+	tests := []struct {
+		pth  string
+		want ChangeIndicator
+	}{
+		{pth: "/cache/lib.jar", want: SIZEMODTIME},
+		{pth: "/cache/build.gradle.kts", want: MODTIME},
+		{pth: "/cache/script.kts", want: MD5},
+		{pth: "/cache/.jar", want: ""},
+		{pth: "/cache/lib.jar.sha1", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pth, func(t *testing.T) {
+			if got := methodForExtension(tt.pth, methodByExt); got != tt.want {
+				t.Errorf("methodForExtension() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
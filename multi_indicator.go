@@ -0,0 +1,180 @@
+// Multi-file change indicator related models and functions.
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// multiFileIndicatorPrefix prefixes the normalized multi-file indicators, followed by the files separated by NUL.
+	multiFileIndicatorPrefix = "files:"
+	// multiFileIndicatorSeparator separates the files of a normalized multi-file indicator, which no path contains.
+	multiFileIndicatorSeparator = "\x00"
+	// globMeta are the characters making a path a glob pattern.
+	globMeta = "*?["
+)
+
+// isMultiFileIndicator reports whether indicator is a comma-separated list or a glob pattern of indicator files.
+func isMultiFileIndicator(indicator string) bool {
+	return strings.Contains(indicator, ",") || strings.ContainsAny(indicator, globMeta)
+}
+
+// normalizeMultiFileIndicator expands the comma-separated patterns of indicator into the files they match,
+// and returns the normalized multi-file indicator, or an empty string if no file matches.
+// An existing file named as indicator is returned as a single indicator file, as before the patterns were supported.
+func normalizeMultiFileIndicator(indicator string) (string, error) {
+	pth, err := absPath(indicator)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(pth); err == nil && !info.IsDir() {
+		return pth, nil
+	}
+
+	matched := map[string]bool{}
+	for _, pattern := range strings.Split(indicator, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		pattern, err := absPath(pattern)
+		if err != nil {
+			return "", err
+		}
+
+		pths, err := globFiles(pattern)
+		if err != nil {
+			return "", fmt.Errorf("failed to match indicator pattern (%s): %s", pattern, err)
+		}
+		for _, pth := range pths {
+			matched[pth] = true
+		}
+	}
+	if len(matched) == 0 {
+		return "", nil
+	}
+
+	pths := make([]string, 0, len(matched))
+	for pth := range matched {
+		pths = append(pths, pth)
+	}
+	sort.Strings(pths)
+	return multiFileIndicatorPrefix + strings.Join(pths, multiFileIndicatorSeparator), nil
+}
+
+// globFiles returns the files (not directories) matching the absolute pattern,
+// its elements are matched with filepath.Match, and a `**` element matches any number of directories.
+func globFiles(pattern string) ([]string, error) {
+	return globPaths(pattern, false)
+}
+
+// globPaths returns the paths matching the absolute pattern as globFiles, also the directories if dirs is true.
+// The paths in a matching directory are not matched, the directory contains them.
+func globPaths(pattern string, dirs bool) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	elements := strings.Split(filepath.ToSlash(filepath.Clean(pattern)), "/")
+	base := 0
+	for base < len(elements) && !strings.ContainsAny(elements[base], globMeta) {
+		base++
+	}
+	root := filepath.FromSlash(strings.Join(elements[:base], "/"))
+	if root == "" {
+		root = string(filepath.Separator)
+	}
+	elements = elements[base:]
+
+	if len(elements) == 0 {
+		if info, err := os.Stat(root); err != nil || (info.IsDir() && !dirs) {
+			return nil, nil
+		}
+		return []string{root}, nil
+	}
+
+	recursive := false
+	for _, element := range elements {
+		recursive = recursive || element == "**"
+	}
+
+	var pths []string
+	if err := filepath.Walk(root, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && pth == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(root, pth)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		names := strings.Split(filepath.ToSlash(rel), "/")
+
+		if info.IsDir() {
+			if dirs && matchGlobElements(elements, names) {
+				pths = append(pths, pth)
+				return filepath.SkipDir
+			}
+			// Without `**`, the pattern can not match deeper than its elements.
+			if !recursive && len(names) >= len(elements) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if matchGlobElements(elements, names) {
+			pths = append(pths, pth)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return pths, nil
+}
+
+// matchGlobElements reports whether the path elements names match the pattern elements.
+func matchGlobElements(elements, names []string) bool {
+	if len(elements) == 0 {
+		return len(names) == 0
+	}
+	if elements[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchGlobElements(elements[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	// The pattern is validated by globFiles.
+	if ok, _ := filepath.Match(elements[0], names[0]); !ok {
+		return false
+	}
+	return matchGlobElements(elements[1:], names[1:])
+}
+
+// multiFileIndicator returns the fingerprint of a normalized multi-file indicator:
+// the combined hash of the paths and the fingerprints of the files.
+func multiFileIndicator(indicator string, method ChangeIndicator, symlinks SymlinkFingerprint, fingerprints *fingerprintCache) (string, error) {
+	h := sha256.New()
+	for _, pth := range strings.Split(strings.TrimPrefix(indicator, multiFileIndicatorPrefix), multiFileIndicatorSeparator) {
+		fingerprint, err := fileIndicator(pth, method, symlinks, fingerprints)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\n", pth, fingerprint)
+	}
+	return fmt.Sprintf("files: %x", h.Sum(nil)), nil
+}
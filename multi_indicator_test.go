@@ -0,0 +1,129 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_globFiles(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	createDirStruct(t, map[string]string{
+		filepath.Join(tmpDir, "build.gradle"):                   "",
+		filepath.Join(tmpDir, "gradle.properties"):              "",
+		filepath.Join(tmpDir, "app", "build.gradle"):            "",
+		filepath.Join(tmpDir, "lib", "core", "build.gradle"):    "",
+		filepath.Join(tmpDir, "lib", "core", "build.gradle.kt"): "",
+	})
+
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "recursive pattern",
+			pattern: filepath.Join(tmpDir, "**", "*.gradle"),
+			want: []string{
+				filepath.Join(tmpDir, "app", "build.gradle"),
+				filepath.Join(tmpDir, "build.gradle"),
+				filepath.Join(tmpDir, "lib", "core", "build.gradle"),
+			},
+		},
+		{
+			name:    "single level pattern",
+			pattern: filepath.Join(tmpDir, "*", "build.gradle"),
+			want:    []string{filepath.Join(tmpDir, "app", "build.gradle")},
+		},
+		{
+			name:    "recursive pattern in the middle",
+			pattern: filepath.Join(tmpDir, "lib", "**", "build.*"),
+			want: []string{
+				filepath.Join(tmpDir, "lib", "core", "build.gradle"),
+				filepath.Join(tmpDir, "lib", "core", "build.gradle.kt"),
+			},
+		},
+		{
+			name:    "plain file",
+			pattern: filepath.Join(tmpDir, "gradle.properties"),
+			want:    []string{filepath.Join(tmpDir, "gradle.properties")},
+		},
+		{
+			name:    "directory is not matched",
+			pattern: filepath.Join(tmpDir, "li?"),
+			want:    nil,
+		},
+		{
+			name:    "missing base directory",
+			pattern: filepath.Join(tmpDir, "missing", "*"),
+			want:    nil,
+		},
+		{
+			name:    "invalid pattern",
+			pattern: filepath.Join(tmpDir, "[a"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := globFiles(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("globFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("globFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_multiFileIndicator(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	createDirStruct(t, map[string]string{
+		filepath.Join(tmpDir, "build.gradle"):        "root",
+		filepath.Join(tmpDir, "app", "build.gradle"): "app",
+		filepath.Join(tmpDir, "gradle.properties"):   "properties",
+	})
+	indicator := filepath.Join(tmpDir, "**", "*.gradle") + ", " + filepath.Join(tmpDir, "gradle.properties")
+
+	normalized, err := normalizeMultiFileIndicator(indicator)
+	if err != nil {
+		t.Fatalf("normalizeMultiFileIndicator() error = %v", err)
+	}
+	want := multiFileIndicatorPrefix + strings.Join([]string{
+		filepath.Join(tmpDir, "app", "build.gradle"),
+		filepath.Join(tmpDir, "build.gradle"),
+		filepath.Join(tmpDir, "gradle.properties"),
+	}, multiFileIndicatorSeparator)
+	if normalized != want {
+		t.Fatalf("normalizeMultiFileIndicator() = %q, want %q", normalized, want)
+	}
+
+	fingerprint, err := multiFileIndicator(normalized, MD5, SYMLINKTARGET, nil)
+	if err != nil {
+		t.Fatalf("multiFileIndicator() error = %v", err)
+	}
+
+	createDirStruct(t, map[string]string{filepath.Join(tmpDir, "app", "build.gradle"): "changed"})
+	if changed, err := multiFileIndicator(normalized, MD5, SYMLINKTARGET, nil); err != nil {
+		t.Fatalf("multiFileIndicator() error = %v", err)
+	} else if changed == fingerprint {
+		t.Errorf("multiFileIndicator() = %v after a file changed, want another fingerprint", changed)
+	}
+
+	if normalized, err := normalizeMultiFileIndicator(filepath.Join(tmpDir, "*.missing")); err != nil || normalized != "" {
+		t.Errorf("normalizeMultiFileIndicator() = %v, %v, want no match", normalized, err)
+	}
+}
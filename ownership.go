@@ -0,0 +1,43 @@
+// Entry ownership related models and functions.
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// setuidModeBits are the setuid and setgid bits of the tar header mode.
+const setuidModeBits = 06000
+
+// entryOwner is the owner of the entries of tar archives.
+type entryOwner struct {
+	uid   int
+	gid   int
+	uname string
+	gname string
+}
+
+// currentOwner returns the user running the step, the files owned by it can be restored without root privileges.
+// The user and group names are left empty if they can not be looked up, the ids are used to restore the owner then.
+func currentOwner() *entryOwner {
+	owner := &entryOwner{
+		uid: os.Getuid(),
+		gid: os.Getgid(),
+	}
+
+	if u, err := user.Current(); err != nil {
+		log.Warnf("Failed to look up the current user, archiving without user name: %s", err)
+	} else {
+		owner.uname = u.Username
+	}
+
+	if g, err := user.LookupGroupId(strconv.Itoa(owner.gid)); err != nil {
+		log.Warnf("Failed to look up the current group, archiving without group name: %s", err)
+	} else {
+		owner.gname = g.Name
+	}
+	return owner
+}
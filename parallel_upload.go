@@ -0,0 +1,117 @@
+// Parallel upload related models and functions.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// uploadFailure is a failed upload of uploadFiles.
+type uploadFailure struct {
+	i   int
+	pth string
+	err error
+}
+
+// uploadFilesError aggregates the failed uploads of uploadFiles: the uploads running concurrently with the first failed one
+// are completed, so every failure is reported, not only the first.
+type uploadFilesError struct {
+	name     string
+	failures []uploadFailure
+	// notStarted is the number of the files whose uploads were not started after the first failure.
+	notStarted int
+}
+
+func (e *uploadFilesError) Error() string {
+	var failures []string
+	for _, failure := range e.failures {
+		failures = append(failures, fmt.Sprintf("%s: %s", failure.pth, failure.err))
+	}
+	msg := fmt.Sprintf("failed to upload %d %s(s): %s", len(e.failures), e.name, strings.Join(failures, ", "))
+	if e.notStarted > 0 {
+		msg += fmt.Sprintf(", %d %s(s) not uploaded", e.notStarted, e.name)
+	}
+	return msg
+}
+
+// uploadFiles uploads the files at pths with at most parallel concurrent uploads, name describes the files in the logs.
+// No more uploads are started after an upload failed, an *uploadFilesError listing the failed uploads is returned.
+// The files recorded as uploaded by the upload state are skipped, the uploaded files are recorded, state may be nil.
+func uploadFiles(name string, pths []string, url string, parallel int, state *uploadState, logf func(format string, v ...interface{})) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	uploadErr := &uploadFilesError{name: name}
+	sem := make(chan struct{}, parallel)
+	for i, pth := range pths {
+		sem <- struct{}{}
+		mu.Lock()
+		failed := len(uploadErr.failures) > 0
+		mu.Unlock()
+		if failed {
+			<-sem
+			uploadErr.notStarted = len(pths) - i
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, pth string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := uploadFile(name, i, pths, url, state, logf)
+			if err != nil {
+				log.Warnf("Failed to upload %s %d/%d (%s): %s", name, i+1, len(pths), pth, err)
+				mu.Lock()
+				uploadErr.failures = append(uploadErr.failures, uploadFailure{i: i, pth: pth, err: err})
+				mu.Unlock()
+			}
+		}(i, pth)
+	}
+	wg.Wait()
+
+	if len(uploadErr.failures) == 0 {
+		return nil
+	}
+	sort.Slice(uploadErr.failures, func(i, j int) bool {
+		return uploadErr.failures[i].i < uploadErr.failures[j].i
+	})
+	return uploadErr
+}
+
+// uploadFile uploads the i-th file of pths, unless the upload state records it as uploaded.
+func uploadFile(name string, i int, pths []string, url string, state *uploadState, logf func(format string, v ...interface{})) error {
+	pth := pths[i]
+
+	var sum string
+	if state != nil {
+		var err error
+		sum, err = uploadFileChecksum(pth)
+		if err != nil {
+			return err
+		}
+		if state.isUploaded(sum) {
+			logf("Skipping %s %d/%d, already uploaded: %s", name, i+1, len(pths), pth)
+			return nil
+		}
+	}
+
+	logf("Uploading %s %d/%d: %s", name, i+1, len(pths), pth)
+	if err := uploadArchiveFile(pth, url); err != nil {
+		return err
+	}
+
+	if err := state.markUploaded(sum); err != nil {
+		log.Warnf("Failed to write upload state: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_uploadFiles(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	var pths []string
+	contentByPth := map[string]string{}
+	for i := 0; i < 8; i++ {
+		pth := filepath.Join(tmpDir, fmt.Sprintf("volume.%03d", i))
+		contentByPth[pth] = pth
+		pths = append(pths, pth)
+	}
+	createDirStruct(t, contentByPth)
+
+	tests := []struct {
+		name     string
+		parallel int
+		fail     bool
+	}{
+		{name: "serial", parallel: 1},
+		{name: "parallel", parallel: 4},
+		{name: "failure", parallel: 4, fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var uploads, running, maxRunning int
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPost {
+					fmt.Fprintf(w, `{"upload_url": "%s/upload"}`, server.URL)
+					return
+				}
+
+				mu.Lock()
+				uploads++
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+				if tt.fail {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			}))
+			defer server.Close()
+
+			if err := uploadFiles("volume", pths, server.URL, tt.parallel, nil, log.Debugf); (err != nil) != tt.fail {
+				t.Fatalf("uploadFiles() error = %v, wantErr %v", err, tt.fail)
+			}
+			if maxRunning > tt.parallel {
+				t.Errorf("uploadFiles() uploaded %d files concurrently, want at most %d", maxRunning, tt.parallel)
+			}
+			if tt.fail && uploads >= len(pths) {
+				t.Errorf("uploadFiles() uploaded %d files after a failure, want less than %d", uploads, len(pths))
+			} else if !tt.fail && uploads != len(pths) {
+				t.Errorf("uploadFiles() uploaded %d files, want %d", uploads, len(pths))
+			}
+		})
+	}
+}
+
+func Test_uploadFiles_resume(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pths := []string{filepath.Join(tmpDir, "volume.000"), filepath.Join(tmpDir, "volume.001")}
+	createDirStruct(t, map[string]string{pths[0]: "first", pths[1]: "second"})
+
+	var uploaded []string
+	fail := true
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			fmt.Fprintf(w, `{"upload_url": "%s/upload"}`, server.URL)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read upload: %s", err)
+		}
+		if string(b) == "second" && fail {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		uploaded = append(uploaded, string(b))
+	}))
+	defer server.Close()
+
+	statePth := filepath.Join(tmpDir, "cache-upload-state.json")
+	if err := uploadFiles("volume", pths, server.URL, 1, loadUploadState(statePth, server.URL), log.Debugf); err == nil {
+		t.Fatalf("uploadFiles() error = nil, want error")
+	}
+
+	fail = false
+	state := loadUploadState(statePth, server.URL)
+	if err := uploadFiles("volume", pths, server.URL, 1, state, log.Debugf); err != nil {
+		t.Fatalf("uploadFiles() of resumed upload error = %v", err)
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(uploaded, want) {
+		t.Errorf("uploaded %v, want %v", uploaded, want)
+	}
+
+	if err := uploadFiles("volume", pths, server.URL, 1, loadUploadState(statePth, "other"), log.Debugf); err != nil {
+		t.Fatalf("uploadFiles() to other url error = %v", err)
+	}
+	if len(uploaded) != 4 {
+		t.Errorf("uploaded %d files to other url, want every file uploaded again", len(uploaded)-2)
+	}
+
+	if err := state.clear(); err != nil {
+		t.Fatalf("failed to clear upload state: %s", err)
+	}
+	if exists, err := pathutil.IsPathExists(statePth); err != nil || exists {
+		t.Errorf("upload state exists after clear: %v, %v", exists, err)
+	}
+}
+
+func Test_uploadFiles_errors(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	var pths []string
+	contentByPth := map[string]string{}
+	for i := 0; i < 4; i++ {
+		pth := filepath.Join(tmpDir, fmt.Sprintf("volume.%03d", i))
+		contentByPth[pth] = pth
+		pths = append(pths, pth)
+	}
+	createDirStruct(t, contentByPth)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			fmt.Fprintf(w, `{"upload_url": "%s/upload"}`, server.URL)
+			return
+		}
+
+		// The uploads run concurrently, the failures are reported after all of them started.
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read upload: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if string(b) == pths[1] || string(b) == pths[3] {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	err = uploadFiles("volume", pths, server.URL, len(pths), nil, log.Debugf)
+	uploadErr, ok := err.(*uploadFilesError)
+	if !ok {
+		t.Fatalf("uploadFiles() error = %v, want *uploadFilesError", err)
+	}
+
+	var failed []string
+	for _, failure := range uploadErr.failures {
+		failed = append(failed, failure.pth)
+	}
+	if want := []string{pths[1], pths[3]}; !reflect.DeepEqual(failed, want) || uploadErr.notStarted != 0 {
+		t.Errorf("uploadFiles() failed %v with %d not started, want %v", failed, uploadErr.notStarted, want)
+	}
+}
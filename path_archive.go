@@ -0,0 +1,262 @@
+// Per include item archive related models and functions.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+// pathArchiveNameReplacer matches the characters replaced in the archive names derived from the include item paths.
+var pathArchiveNameReplacer = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// pathArchive describes the archive of an include item.
+type pathArchive struct {
+	// Name is the file name of the archive, derived from the include item path.
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Descriptor is the cache descriptor of the files in the archive, so that the archive is invalidated independently of the others.
+	// It is empty in the manifests written by the earlier versions of the step.
+	Descriptor map[string]string `json:"descriptor,omitempty"`
+}
+
+// pathArchiveManifest lists the archives of the include items along with the cache descriptor of all of the archives,
+// the pull step extracts every listed archive and writes the descriptor to the cache info path.
+type pathArchiveManifest struct {
+	Archives   []pathArchive     `json:"archives"`
+	Descriptor map[string]string `json:"descriptor"`
+}
+
+// includeItemPaths returns the absolute paths of the include items in order.
+func includeItemPaths(indicatorByPath map[string]string) ([]string, error) {
+	var itemPths []string
+	for pth := range indicatorByPath {
+		pth, err := absPath(pth)
+		if err != nil {
+			return nil, err
+		}
+		itemPths = append(itemPths, strings.TrimSuffix(pth, string(filepath.Separator)))
+	}
+	sort.Strings(itemPths)
+	return itemPths, nil
+}
+
+// includeItemOf returns the path of the most specific include item containing pth.
+func includeItemOf(pth string, itemPths []string) (string, bool) {
+	var item string
+	for _, itemPth := range itemPths {
+		if pth != itemPth && !strings.HasPrefix(pth, itemPth+string(filepath.Separator)) {
+			continue
+		}
+		if len(itemPth) > len(item) {
+			item = itemPth
+		}
+	}
+	return item, item != ""
+}
+
+// groupByIncludeItem groups the paths by the most specific include item containing them.
+func groupByIncludeItem(pths []string, itemPths []string) map[string][]string {
+	pthsByItem := map[string][]string{}
+	for _, pth := range pths {
+		item, ok := includeItemOf(pth, itemPths)
+		if !ok {
+			log.Warnf("No include item contains path: %s", pth)
+			continue
+		}
+		pthsByItem[item] = append(pthsByItem[item], pth)
+	}
+	return pthsByItem
+}
+
+// pathArchiveNames returns the archive file names of the include items: the base name of the item path (Pods.tar),
+// suffixed with the hash of the path if multiple items have the same base name,
+// so that the name of an item's archive does not change between builds.
+func pathArchiveNames(itemPths []string) map[string]string {
+	itemsByBase := map[string][]string{}
+	for _, itemPth := range itemPths {
+		base := pathArchiveNameReplacer.ReplaceAllString(filepath.Base(itemPth), "_")
+		itemsByBase[base] = append(itemsByBase[base], itemPth)
+	}
+
+	names := map[string]string{}
+	for base, items := range itemsByBase {
+		for _, itemPth := range items {
+			if len(items) == 1 {
+				names[itemPth] = base + ".tar"
+				continue
+			}
+			sum := sha256.Sum256([]byte(itemPth))
+			names[itemPth] = base + "-" + hex.EncodeToString(sum[:4]) + ".tar"
+		}
+	}
+	return names
+}
+
+// changedIncludeItems returns the include items containing the added, changed or removed paths of the comparison.
+func changedIncludeItems(r result, itemPths []string) map[string]bool {
+	changed := map[string]bool{}
+	for _, pths := range [][]string{r.added, r.changed, r.removed} {
+		for _, pth := range pths {
+			if item, ok := includeItemOf(pth, itemPths); ok {
+				changed[item] = true
+			}
+		}
+	}
+	return changed
+}
+
+// groupDescriptors splits descriptor into the cache descriptors of the include items, by the most specific item containing the paths.
+func groupDescriptors(descriptor map[string]string, itemPths []string) map[string]map[string]string {
+	descriptors := map[string]map[string]string{}
+	for pth, fingerprint := range descriptor {
+		item, ok := includeItemOf(pth, itemPths)
+		if !ok {
+			continue
+		}
+		if descriptors[item] == nil {
+			descriptors[item] = map[string]string{}
+		}
+		descriptors[item][pth] = fingerprint
+	}
+	return descriptors
+}
+
+// isPathArchiveUnchanged reports whether the previous archive of the include item itemPth can be kept for the item's current descriptor.
+// The previous archive's own descriptor is compared if the previous manifest has one, regardless of the other items,
+// otherwise the include item should have no changes in the comparison of the whole cache.
+func isPathArchiveUnchanged(previous *pathArchive, itemPth string, descriptor map[string]string, changes *result, changed map[string]bool) bool {
+	if previous == nil {
+		return false
+	}
+	if previous.Descriptor != nil {
+		return reflect.DeepEqual(previous.Descriptor, descriptor)
+	}
+	return changes != nil && !changed[itemPth]
+}
+
+// readPathArchiveManifest reads the manifest of the archives at pth, returns nil if it does not exist.
+func readPathArchiveManifest(pth string) (*pathArchiveManifest, error) {
+	if exists, err := pathutil.IsPathExists(pth); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, nil
+	}
+
+	b, err := fileutil.ReadBytesFromFile(pth)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest pathArchiveManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// writePathArchives writes a separate archive of every include item into dir and the manifest of the archives to manifestPth.
+// If the previous manifest at manifestPth lists the archive of an include item without changes, the archive is not written again,
+// the descriptor of every archive is written into the manifest to compare each item with its previous archive.
+// Returns the paths of the written archives and the summary of their reports.
+func writePathArchives(dir, manifestPth string, itemPths []string, descriptor map[string]string, changes *result, stackData []byte, compression Compression, options archiveOptions, pths []string) ([]string, archiveReport, error) {
+	previous, err := readPathArchiveManifest(manifestPth)
+	if err != nil {
+		log.Warnf("Failed to read previous archive manifest, writing every archive: %s", err)
+	}
+	previousByName := map[string]*pathArchive{}
+	if previous != nil {
+		for i, archive := range previous.Archives {
+			previousByName[archive.Name] = &previous.Archives[i]
+		}
+	}
+
+	var changed map[string]bool
+	if changes != nil {
+		changed = changedIncludeItems(*changes, itemPths)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, archiveReport{}, fmt.Errorf("failed to create archive directory (%s): %s", dir, err)
+	}
+
+	pthsByItem := groupByIncludeItem(pths, itemPths)
+	names := pathArchiveNames(itemPths)
+	descriptors := groupDescriptors(descriptor, itemPths)
+	manifest := pathArchiveManifest{Descriptor: versionedDescriptor(descriptor)}
+	var written []string
+	var report archiveReport
+	for _, itemPth := range itemPths {
+		groupPths, ok := pthsByItem[itemPth]
+		if !ok {
+			continue
+		}
+
+		name := names[itemPth]
+		manifest.Archives = append(manifest.Archives, pathArchive{Name: name, Path: itemPth, Descriptor: descriptors[itemPth]})
+		if isPathArchiveUnchanged(previousByName[name], itemPth, descriptors[itemPth], changes, changed) {
+			log.Printf("No changes in %s, keeping the previous archive: %s", itemPth, name)
+			continue
+		}
+
+		itemOptions := options
+		itemOptions.tombstones = nil
+		for _, pth := range options.tombstones {
+			if item, ok := includeItemOf(pth, itemPths); ok && item == itemPth {
+				itemOptions.tombstones = append(itemOptions.tombstones, pth)
+			}
+		}
+
+		pth := filepath.Join(dir, name)
+		file, err := os.Create(pth)
+		if err != nil {
+			return nil, archiveReport{}, fmt.Errorf("failed to create archive (%s): %s", pth, err)
+		}
+
+		log.Printf("Archiving %s into: %s", itemPth, name)
+		// The descriptor of all of the archives is written into the manifest
+		itemReport, err := writeArchive(nil, stackData, compression, itemOptions, false, file, groupPths)
+		if err != nil {
+			return nil, archiveReport{}, fmt.Errorf("failed to write archive (%s): %s", pth, err)
+		}
+		report.uncompressed += itemReport.uncompressed
+		report.compressed += itemReport.compressed
+		report.entries += itemReport.entries
+		report.duration += itemReport.duration
+		written = append(written, pth)
+	}
+
+	b, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return nil, archiveReport{}, err
+	}
+	if err := fileutil.WriteBytesToFile(manifestPth, b); err != nil {
+		return nil, archiveReport{}, fmt.Errorf("failed to write archive manifest: %s", err)
+	}
+	return written, report, nil
+}
+
+// uploadPathArchives uploads the written archives with at most parallel concurrent uploads, then the manifest of the archives,
+// so that the manifest is only uploaded if all of the archives are.
+func uploadPathArchives(pths []string, manifestPth, url string, parallel int, state *uploadState) error {
+	if err := uploadFiles("archive", pths, url, parallel, state, log.Printf); err != nil {
+		return err
+	}
+
+	log.Printf("Uploading archive manifest: %s", manifestPth)
+	if err := uploadArchiveFile(manifestPth, url); err != nil {
+		return fmt.Errorf("failed to upload archive manifest: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_includeItemOf(t *testing.T) {
+	itemPths := []string{"/project/Pods", "/project/Pods/Local", "/project/Carthage"}
+
+	tests := []struct {
+		name   string
+		pth    string
+		want   string
+		wantOk bool
+	}{
+		{name: "item itself", pth: "/project/Pods", want: "/project/Pods", wantOk: true},
+		{name: "file of item", pth: "/project/Pods/Manifest.lock", want: "/project/Pods", wantOk: true},
+		{name: "most specific item", pth: "/project/Pods/Local/file", want: "/project/Pods/Local", wantOk: true},
+		{name: "same prefix", pth: "/project/PodsBackup/file", want: "", wantOk: false},
+		{name: "outside items", pth: "/project/file", want: "", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := includeItemOf(tt.pth, itemPths)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("includeItemOf() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_groupByIncludeItem(t *testing.T) {
+	itemPths := []string{"/project/Carthage", "/project/Pods", "/project/Pods/Local"}
+	pths := []string{"/project/Pods/a", "/project/Carthage/b", "/project/Pods/Local/c", "/project/d", "/project/Pods/e"}
+
+	want := map[string][]string{
+		"/project/Pods":       {"/project/Pods/a", "/project/Pods/e"},
+		"/project/Carthage":   {"/project/Carthage/b"},
+		"/project/Pods/Local": {"/project/Pods/Local/c"},
+	}
+	if got := groupByIncludeItem(pths, itemPths); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupByIncludeItem() = %v, want %v", got, want)
+	}
+}
+
+func Test_pathArchiveNames(t *testing.T) {
+	names := pathArchiveNames([]string{"/project/Pods", "/a/build", "/b/build", "/project/my cache"})
+
+	if got := names["/project/Pods"]; got != "Pods.tar" {
+		t.Errorf("name of /project/Pods = %s, want Pods.tar", got)
+	}
+	if got := names["/project/my cache"]; got != "my_cache.tar" {
+		t.Errorf("name of /project/my cache = %s, want my_cache.tar", got)
+	}
+
+	a, b := names["/a/build"], names["/b/build"]
+	if a == b || !strings.HasPrefix(a, "build-") || !strings.HasPrefix(b, "build-") {
+		t.Errorf("names of items with the same base name = %s, %s, want distinct build-<hash>.tar names", a, b)
+	}
+	if again := pathArchiveNames([]string{"/b/build", "/a/build"}); again["/a/build"] != a {
+		t.Errorf("name of /a/build = %s, want the same name in every build %s", again["/a/build"], a)
+	}
+}
+
+func Test_changedIncludeItems(t *testing.T) {
+	itemPths := []string{"/project/Carthage", "/project/Pods", "/project/build"}
+	r := result{
+		added:   []string{"/project/Pods/a"},
+		removed: []string{"/project/build/b"},
+	}
+
+	want := map[string]bool{"/project/Pods": true, "/project/build": true}
+	if got := changedIncludeItems(r, itemPths); !reflect.DeepEqual(got, want) {
+		t.Errorf("changedIncludeItems() = %v, want %v", got, want)
+	}
+}
+
+func Test_groupDescriptors(t *testing.T) {
+	itemPths := []string{"/project/Pods", "/project/Pods/Local", "/project/build"}
+	descriptor := map[string]string{
+		"/project/Pods/a":       "1",
+		"/project/Pods/Local/b": "2",
+		"/project/build/c":      "3",
+		"/other/d":              "4",
+	}
+
+	want := map[string]map[string]string{
+		"/project/Pods":       {"/project/Pods/a": "1"},
+		"/project/Pods/Local": {"/project/Pods/Local/b": "2"},
+		"/project/build":      {"/project/build/c": "3"},
+	}
+	if got := groupDescriptors(descriptor, itemPths); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupDescriptors() = %v, want %v", got, want)
+	}
+}
+
+func Test_isPathArchiveUnchanged(t *testing.T) {
+	descriptor := map[string]string{"/project/Pods/a": "1"}
+	changes := &result{changed: []string{"/project/build/b"}}
+	tests := []struct {
+		name     string
+		previous *pathArchive
+		changes  *result
+		changed  map[string]bool
+		want     bool
+	}{
+		{"no previous archive", nil, changes, nil, false},
+		{"same descriptor", &pathArchive{Path: "/project/Pods", Descriptor: map[string]string{"/project/Pods/a": "1"}}, nil, nil, true},
+		{"changed descriptor", &pathArchive{Path: "/project/Pods", Descriptor: map[string]string{"/project/Pods/a": "0"}}, changes, nil, false},
+		{"same descriptor with other items changed", &pathArchive{Path: "/project/Pods", Descriptor: map[string]string{"/project/Pods/a": "1"}}, changes, map[string]bool{"/project/build": true}, true},
+		{"no descriptor without changes", &pathArchive{Path: "/project/Pods"}, changes, map[string]bool{"/project/build": true}, true},
+		{"no descriptor with changes", &pathArchive{Path: "/project/Pods"}, changes, map[string]bool{"/project/Pods": true}, false},
+		{"no descriptor without comparison", &pathArchive{Path: "/project/Pods"}, nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPathArchiveUnchanged(tt.previous, "/project/Pods", descriptor, tt.changes, tt.changed); got != tt.want {
+				t.Errorf("isPathArchiveUnchanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Presigned upload url expiration related models and functions.
+package main
+
+import (
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// presignedURLMinValidity is the validity a presigned upload url requires to be used for an upload attempt,
+// a fresh upload url is requested if the url expires sooner.
+const presignedURLMinValidity = time.Minute
+
+// expiredResponseCodes are the error codes of S3 and Google Cloud Storage responding to an expired presigned url,
+// some of them are responded with 400 instead of 403.
+var expiredResponseCodes = []string{"<Code>ExpiredToken</Code>", "<Code>TokenRefreshRequired</Code>", "Request has expired"}
+
+// presignedURLExpiry returns when the presigned url expires, if its query describes it:
+// the X-Amz-Date and X-Amz-Expires parameters of S3 (Signature Version 4),
+// the X-Goog-Date and X-Goog-Expires parameters of Google Cloud Storage (V4 signing),
+// or the Expires parameter of S3 (Signature Version 2) and Google Cloud Storage (V2 signing).
+func presignedURLExpiry(uploadURL string) (time.Time, bool) {
+	u, err := neturl.Parse(uploadURL)
+	if err != nil {
+		return time.Time{}, false
+	}
+	query := u.Query()
+
+	for _, prefix := range []string{"X-Amz-", "X-Goog-"} {
+		date, expires := query.Get(prefix+"Date"), query.Get(prefix+"Expires")
+		if date == "" || expires == "" {
+			continue
+		}
+		signed, err := time.Parse(s3TimeFormat, date)
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds, err := strconv.Atoi(expires)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return signed.Add(time.Duration(seconds) * time.Second), true
+	}
+
+	if expires := query.Get("Expires"); expires != "" {
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(seconds, 0), true
+	}
+	return time.Time{}, false
+}
+
+// presignedURLExpiresSoon reports whether the presigned url expires within presignedURLMinValidity from now.
+func presignedURLExpiresSoon(uploadURL string, now time.Time) bool {
+	expiry, ok := presignedURLExpiry(uploadURL)
+	return ok && expiry.Sub(now) < presignedURLMinValidity
+}
+
+// isExpiredResponse reports whether the body of an error response describes an expired presigned url.
+func isExpiredResponse(body string) bool {
+	for _, code := range expiredResponseCodes {
+		if strings.Contains(body, code) {
+			return true
+		}
+	}
+	return false
+}
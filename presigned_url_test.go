@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_presignedURLExpiresSoon(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		url  string
+		want bool
+	}{
+		{name: "valid sigv4", url: "https://bucket.s3.amazonaws.com/cache?X-Amz-Date=20200101T115500Z&X-Amz-Expires=3600", want: false},
+		{name: "expiring sigv4", url: "https://bucket.s3.amazonaws.com/cache?X-Amz-Date=20200101T110030Z&X-Amz-Expires=3600", want: true},
+		{name: "expired gcs v4", url: "https://storage.googleapis.com/bucket/cache?X-Goog-Date=20200101T100000Z&X-Goog-Expires=3600", want: true},
+		{name: "valid v2", url: fmt.Sprintf("https://storage.googleapis.com/bucket/cache?Expires=%d", now.Add(time.Hour).Unix()), want: false},
+		{name: "expiring v2", url: fmt.Sprintf("https://storage.googleapis.com/bucket/cache?Expires=%d", now.Add(30*time.Second).Unix()), want: true},
+		{name: "unknown expiry", url: "https://cache.example.com/upload", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := presignedURLExpiresSoon(tt.url, now); got != tt.want {
+				t.Errorf("presignedURLExpiresSoon() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_uploadArchiveFile_expiredResponse(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	pth := filepath.Join(tmpDir, "cache-archive.tar")
+	createDirStruct(t, map[string]string{pth: "archive"})
+
+	policy := uploadRetryPolicy
+	uploadRetryPolicy = retryPolicy{retries: 2, wait: time.Millisecond}
+	defer func() {
+		uploadRetryPolicy = policy
+	}()
+
+	expiredUploadURL, urlCalls := "", 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			urlCalls++
+			fmt.Fprintf(w, `{"upload_url": "%s/upload/%d"}`, server.URL, urlCalls)
+			return
+		}
+		if expiredUploadURL == "" {
+			expiredUploadURL = r.URL.Path
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "<Error><Code>ExpiredToken</Code><Message>The provided token has expired.</Message></Error>")
+		} else if r.URL.Path == expiredUploadURL {
+			t.Errorf("expired upload url is reused")
+		}
+	}))
+	defer server.Close()
+
+	if err := uploadArchiveFile(pth, server.URL); err != nil {
+		t.Fatalf("uploadArchiveFile() error = %v", err)
+	}
+	if urlCalls != 2 {
+		t.Errorf("uploadArchiveFile() requested %d upload urls, want 2", urlCalls)
+	}
+}
@@ -0,0 +1,172 @@
+// Remote previous cache descriptor related models and functions.
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// compressionMagics are the leading bytes of the compressed archives, detecting the compression of the previous cache archive.
+var compressionMagics = []struct {
+	method CompressionMethod
+	magic  []byte
+}{
+	{GZIP, []byte{0x1f, 0x8b}},
+	{ZSTD, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{LZ4, []byte{0x04, 0x22, 0x4d, 0x18}},
+	{XZ, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// leadingDescriptorIndex is the index of the leading descriptor entry, written right after the archive info.
+const leadingDescriptorIndex = 1
+
+// tarMagicOffset is the offset of the ustar magic in the header of a tar archive.
+const tarMagicOffset = 257
+
+// detectCompression returns the compression method of the archive starting with header.
+// The brotli streams have no magic, and the zstd archives starting with a skippable frame (a dictionary) are not detected.
+func detectCompression(header []byte) (CompressionMethod, error) {
+	for _, candidate := range compressionMagics {
+		if bytes.HasPrefix(header, candidate.magic) {
+			return candidate.method, nil
+		}
+	}
+	if len(header) >= tarMagicOffset+5 && string(header[tarMagicOffset:tarMagicOffset+5]) == "ustar" {
+		return NONE, nil
+	}
+	return "", fmt.Errorf("unknown archive compression")
+}
+
+// readArchiveDescriptor reads the cache descriptor of the tar archive read from reader, nil if it has none.
+// The leading descriptor, written right after the archive info, is returned without reading the rest of the archive.
+// Otherwise the descriptor written last is returned, as the incremental archives append the descriptor of each build.
+func readArchiveDescriptor(reader io.Reader) (map[string]string, error) {
+	buffered := bufio.NewReaderSize(reader, tarMagicOffset+8)
+	header, err := buffered.Peek(tarMagicOffset + 8)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read archive: %s", err)
+	}
+	method, err := detectCompression(header)
+	if err != nil {
+		return nil, err
+	}
+
+	decompressor, err := newDecompressor(buffered, Compression{Method: method})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress archive: %s", err)
+	}
+	defer func() {
+		if err := decompressor.Close(); err != nil {
+			log.Warnf("Failed to close decompressor: %s", err)
+		}
+	}()
+
+	var descriptor map[string]string
+	tarReader := tar.NewReader(decompressor)
+	for i := 0; ; i++ {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return descriptor, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %s", err)
+		}
+		if header.Name != cacheInfoFilePath {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entry (%s): %s", header.Name, err)
+		}
+		if descriptor, err = parseCacheDescriptor(b); err != nil {
+			return nil, fmt.Errorf("failed to parse entry (%s): %s", header.Name, err)
+		}
+		if i == leadingDescriptorIndex {
+			return descriptor, nil
+		}
+	}
+}
+
+// getCacheDownloadURL requests the download url of the previous cache from the Bitrise cache API server,
+// returns an empty url if there is no previous cache. The cache key is sent as the cache_key query parameter.
+func getCacheDownloadURL(cacheAPIURL string) (string, error) {
+	if cacheKey != "" {
+		u, err := neturl.Parse(cacheAPIURL)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse cache api url: %s", err)
+		}
+		query := u.Query()
+		query.Set("cache_key", cacheKey)
+		u.RawQuery = query.Encode()
+		cacheAPIURL = u.String()
+	}
+
+	client := uploadHTTPClient()
+	client.Timeout = 20 * time.Second
+	resp, err := client.Get(cacheAPIURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to send download url request: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 202 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("download url was rejected with status code: %d: %s", resp.StatusCode, cacheAPIErrorMessage(body))
+	}
+
+	var respModel map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&respModel); err != nil {
+		return "", fmt.Errorf("failed to decode response body: %s", err)
+	}
+	return respModel["download_url"], nil
+}
+
+// fetchPreviousDescriptor downloads the previous cache archive from the Bitrise cache API server
+// and returns its cache descriptor, nil if there is no previous cache.
+// The archive is streamed without being written to the disk, nor extracted.
+func fetchPreviousDescriptor(cacheAPIURL string) (map[string]string, error) {
+	downloadURL, err := getCacheDownloadURL(cacheAPIURL)
+	if err != nil {
+		return nil, err
+	}
+	if downloadURL == "" {
+		return nil, nil
+	}
+
+	// The download is not limited by a timeout, the archive may be large
+	resp, err := uploadHTTPClient().Get(downloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download previous cache: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("previous cache download failed with status code: %d", resp.StatusCode)
+	}
+	return readArchiveDescriptor(resp.Body)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+func Test_fetchPreviousDescriptor(t *testing.T) {
+	first, err := descriptorData(map[string]string{"/cache/a": "1"})
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+	appended, err := descriptorData(map[string]string{"/cache/a": "2", "/cache/b": "1"})
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+
+	var archive bytes.Buffer
+	gzipWriter := gzip.NewWriter(&archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{stackVersionsPath, []byte(`{}`)},
+		{"/cache/a", []byte("a")},
+		{cacheInfoFilePath, first},
+		{cacheInfoFilePath, appended},
+	} {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: entry.name, Size: int64(len(entry.data)), Mode: 0600, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		if _, err := tarWriter.Write(entry.data); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"download_url": "%s/archive"}`, server.URL)
+	})
+	mux.HandleFunc("/archive", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(archive.Bytes()); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	descriptor, err := fetchPreviousDescriptor(server.URL + "/api")
+	if err != nil {
+		t.Fatalf("fetchPreviousDescriptor() error = %v", err)
+	}
+	if want := map[string]string{"/cache/a": "2", "/cache/b": "1"}; !reflect.DeepEqual(descriptor, want) {
+		t.Errorf("fetchPreviousDescriptor() = %v, want the last descriptor %v", descriptor, want)
+	}
+
+	if descriptor, err := fetchPreviousDescriptor(server.URL + "/missing"); err != nil || descriptor != nil {
+		t.Errorf("fetchPreviousDescriptor() without previous cache = %v, %v, want nil", descriptor, err)
+	}
+}
+
+func Test_detectCompression(t *testing.T) {
+	var tarHeader [512]byte
+	copy(tarHeader[tarMagicOffset:], "ustar")
+	tests := []struct {
+		name    string
+		header  []byte
+		want    CompressionMethod
+		wantErr bool
+	}{
+		{name: "gzip", header: []byte{0x1f, 0x8b, 0x08}, want: GZIP},
+		{name: "zstd", header: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, want: ZSTD},
+		{name: "tar", header: tarHeader[:], want: NONE},
+		{name: "unknown", header: []byte("unknown"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectCompression(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("detectCompression() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("detectCompression() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_readArchiveDescriptor_configuredPath(t *testing.T) {
+	infoPth := cacheInfoFilePath
+	defer func() {
+		cacheInfoFilePath = infoPth
+	}()
+	cacheInfoFilePath = "/var/cache/cache-info.json"
+
+	configured, err := descriptorData(map[string]string{"/cache/a": "1"})
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+	other, err := descriptorData(map[string]string{"/cache/a": "2"})
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+
+	var archive bytes.Buffer
+	tarWriter := tar.NewWriter(&archive)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{cacheInfoFilePath, configured},
+		{infoPth, other},
+	} {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: entry.name, Size: int64(len(entry.data)), Mode: 0600, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		if _, err := tarWriter.Write(entry.data); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+
+	descriptor, err := readArchiveDescriptor(&archive)
+	if err != nil {
+		t.Fatalf("readArchiveDescriptor() error = %v", err)
+	}
+	if want := map[string]string{"/cache/a": "1"}; !reflect.DeepEqual(descriptor, want) {
+		t.Errorf("readArchiveDescriptor() = %v, want the descriptor at the configured path %v", descriptor, want)
+	}
+}
+
+// failingReader fails reading, the rest of an archive which must not be read.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("read past the leading descriptor")
+}
+
+func Test_readArchiveDescriptor_leading(t *testing.T) {
+	leading, err := descriptorData(map[string]string{"/cache/a": "1"})
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+
+	var archive bytes.Buffer
+	tarWriter := tar.NewWriter(&archive)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{stackVersionsPath, []byte(`{}`)},
+		{cacheInfoFilePath, leading},
+	} {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: entry.name, Size: int64(len(entry.data)), Mode: 0600, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		if _, err := tarWriter.Write(entry.data); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+	}
+	if err := tarWriter.Flush(); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+
+	descriptor, err := readArchiveDescriptor(io.MultiReader(&archive, failingReader{}))
+	if err != nil {
+		t.Fatalf("readArchiveDescriptor() error = %v, want the rest of the archive not read", err)
+	}
+	if want := map[string]string{"/cache/a": "1"}; !reflect.DeepEqual(descriptor, want) {
+		t.Errorf("readArchiveDescriptor() = %v, want the leading descriptor %v", descriptor, want)
+	}
+}
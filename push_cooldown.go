@@ -0,0 +1,46 @@
+// Push time, push cooldown and maximum cache age related models and functions.
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// descriptorPushTimeKey is the key of the time the cache was pushed at in the cache descriptor file, like descriptorSchemaKey.
+// The time is stored in seconds since the Unix epoch.
+const descriptorPushTimeKey = "#pushed_at"
+
+// pushTime is the time the cache is pushed at, recorded in the cache descriptor, zero records no time.
+// It is configured by the step inputs, the descriptor recording the time is not reproducible.
+var pushTime time.Time
+
+// descriptorPushTime returns the time the cache of the validated descriptor with its metadata was pushed at, zero if it records no time.
+func descriptorPushTime(descriptor map[string]string) (time.Time, error) {
+	pushedAt := descriptor[descriptorPushTimeKey]
+	if pushedAt == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(pushedAt, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// inCooldown reports whether the push of the changes is skipped: if the previous cache was pushed at pushedAt less than cooldown before now,
+// and less than maxBytes changed, 0 maxBytes skips the changes of any size.
+func (r result) inCooldown(pushedAt, now time.Time, cooldown time.Duration, maxBytes int64) bool {
+	if cooldown == 0 || pushedAt.IsZero() || now.Sub(pushedAt) >= cooldown {
+		return false
+	}
+	return maxBytes == 0 || r.changedBytes < maxBytes
+}
+
+// cacheExpired reports whether the previous cache pushed at pushedAt is older than maxAge at now, 0 maxAge never expires the cache.
+// A cache without a push time expires, so that the cache is pushed once more with the time.
+func cacheExpired(pushedAt, now time.Time, maxAge time.Duration) bool {
+	if maxAge == 0 {
+		return false
+	}
+	return pushedAt.IsZero() || now.Sub(pushedAt) >= maxAge
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_readCacheDescriptor_pushTime(t *testing.T) {
+	defer func(t time.Time, key []byte, cKey string) {
+		pushTime, descriptorSigningKey, cacheKey = t, key, cKey
+	}(pushTime, descriptorSigningKey, cacheKey)
+
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	descriptor := map[string]string{"/cache/file": "1"}
+
+	descriptorSigningKey = []byte("secret")
+	unpushed, err := descriptorData(descriptor)
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+	pushTime = time.Unix(1700000000, 0)
+	signed, err := descriptorData(descriptor)
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+	compressed, err := compressedDescriptorData(descriptor)
+	if err != nil {
+		t.Fatalf("compressedDescriptorData() error = %v", err)
+	}
+	descriptorSigningKey = []byte("forged")
+	forged, err := descriptorData(descriptor)
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+	descriptorSigningKey = []byte("secret")
+	cacheKey = "feature"
+	otherKey, err := descriptorData(descriptor)
+	if err != nil {
+		t.Fatalf("descriptorData() error = %v", err)
+	}
+	cacheKey = ""
+
+	tests := []struct {
+		name           string
+		data           []byte
+		wantDescriptor map[string]string
+		wantPushTime   time.Time
+	}{
+		{"signed", signed, descriptor, pushTime},
+		{"compressed", compressed, descriptor, pushTime},
+		{"without push time", unpushed, descriptor, time.Time{}},
+		{"bad signature", forged, nil, time.Time{}},
+		{"other cache key", otherKey, nil, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pth := filepath.Join(tmpDir, tt.name)
+			createDirStruct(t, map[string]string{pth: string(tt.data)})
+
+			got, pushedAt, err := readCacheDescriptor(pth)
+			if err != nil {
+				t.Fatalf("readCacheDescriptor() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.wantDescriptor) || !pushedAt.Equal(tt.wantPushTime) {
+				t.Errorf("readCacheDescriptor() = %v, %v, want %v, %v", got, pushedAt, tt.wantDescriptor, tt.wantPushTime)
+			}
+		})
+	}
+}
+
+func Test_result_inCooldown(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := result{changed: []string{"/cache/file"}, changedBytes: 10 * 1024 * 1024}
+	tests := []struct {
+		name     string
+		pushedAt time.Time
+		cooldown time.Duration
+		maxBytes int64
+		want     bool
+	}{
+		{"no cooldown", now.Add(-time.Minute), 0, 0, false},
+		{"no push time", time.Time{}, time.Hour, 0, false},
+		{"after cooldown", now.Add(-2 * time.Hour), time.Hour, 0, false},
+		{"within cooldown", now.Add(-time.Minute), time.Hour, 0, true},
+		{"within cooldown below maximum", now.Add(-time.Minute), time.Hour, 20 * 1024 * 1024, true},
+		{"within cooldown at maximum", now.Add(-time.Minute), time.Hour, 10 * 1024 * 1024, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.inCooldown(tt.pushedAt, now, tt.cooldown, tt.maxBytes); got != tt.want {
+				t.Errorf("result.inCooldown() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cacheExpired(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	day := 24 * time.Hour
+	tests := []struct {
+		name     string
+		pushedAt time.Time
+		maxAge   time.Duration
+		want     bool
+	}{
+		{"no maximum age", now.Add(-100 * day), 0, false},
+		{"no push time", time.Time{}, 7 * day, true},
+		{"younger", now.Add(-day), 7 * day, false},
+		{"older", now.Add(-8 * day), 7 * day, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cacheExpired(tt.pushedAt, now, tt.maxAge); got != tt.want {
+				t.Errorf("cacheExpired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,505 @@
+// S3 storage backend related models and functions.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// s3Scheme prefixes the destinations of the S3 backend: s3://<bucket>/<prefix>?region=<region>,
+// the files are uploaded to the <prefix>/<file name> keys of the bucket.
+// The endpoint, path_style and insecure_skip_verify query parameters configure S3-compatible services, for example MinIO or Ceph RGW.
+const s3Scheme = "s3://"
+
+const (
+	// s3UnsignedPayload is signed instead of the payload's hash, the payload is not read twice to hash it.
+	// The requests are sent over TLS, which protects the payload's integrity, unless an http:// endpoint is configured.
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	s3SigningAlgorithm = "AWS4-HMAC-SHA256"
+	s3TimeFormat       = "20060102T150405Z"
+	s3DateFormat       = "20060102"
+)
+
+// The endpoints of the IAM credentials of the ECS task and the EC2 instance.
+const (
+	ecsCredentialsEndpoint  = "http://169.254.170.2"
+	ec2MetadataEndpoint     = "http://169.254.169.254"
+	ec2MetadataTokenTTL     = "21600"
+	ec2CredentialsMetadata  = "/latest/meta-data/iam/security-credentials/"
+	ec2MetadataTokenPath    = "/latest/api/token"
+	awsCredentialsTimeout   = 5 * time.Second
+	ecsCredentialsURIEnvKey = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+)
+
+// awsCredentials are the credentials signing the S3 requests.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// s3EndpointOptions configure the endpoint of an S3-compatible service instead of AWS.
+type s3EndpointOptions struct {
+	// endpoint is the url of the service, for example https://minio.example.com:9000.
+	endpoint string
+	// pathStyle addresses the bucket in the path of the url instead of the host, as <endpoint>/<bucket>/<key>.
+	pathStyle bool
+	// insecureSkipVerify skips the verification of the TLS certificate of the endpoint, for example a self-signed one.
+	insecureSkipVerify bool
+}
+
+// s3Object is the destination of an upload to S3.
+type s3Object struct {
+	bucket  string
+	key     string
+	region  string
+	options s3EndpointOptions
+}
+
+// s3URL returns the destination of the S3 backend for the given bucket, prefix, region and endpoint options.
+func s3URL(bucket, prefix, region string, options s3EndpointOptions) string {
+	query := neturl.Values{"region": {region}}
+	if options.endpoint != "" {
+		query.Set("endpoint", options.endpoint)
+	}
+	if options.pathStyle {
+		query.Set("path_style", "true")
+	}
+	if options.insecureSkipVerify {
+		query.Set("insecure_skip_verify", "true")
+	}
+	return s3Scheme + path.Join(bucket, prefix) + "?" + query.Encode()
+}
+
+// parseS3Object returns the object of the file at pth uploaded to the destination url of the S3 backend.
+func parseS3Object(url, pth string) (s3Object, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return s3Object{}, fmt.Errorf("failed to parse S3 destination (%s): %s", url, err)
+	}
+
+	query := u.Query()
+	object := s3Object{
+		bucket: u.Host,
+		key:    strings.TrimPrefix(path.Join(u.Path, filepath.Base(pth)), "/"),
+		region: query.Get("region"),
+		options: s3EndpointOptions{
+			endpoint:           query.Get("endpoint"),
+			pathStyle:          query.Get("path_style") == "true",
+			insecureSkipVerify: query.Get("insecure_skip_verify") == "true",
+		},
+	}
+	if object.bucket == "" || object.region == "" {
+		return s3Object{}, fmt.Errorf("S3 destination requires a bucket and a region: %s", url)
+	}
+	if object.options.endpoint != "" {
+		endpoint, err := neturl.Parse(object.options.endpoint)
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return s3Object{}, fmt.Errorf("S3 endpoint should be an absolute url: %s", object.options.endpoint)
+		}
+	}
+	return object, nil
+}
+
+// endpoint returns the URL of the object, virtual-hosted-style unless the path-style addressing is configured.
+func (o s3Object) endpoint() string {
+	key := awsURIEscape(o.key)
+	if o.options.endpoint == "" {
+		if o.options.pathStyle {
+			return fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s", o.region, o.bucket, key)
+		}
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", o.bucket, o.region, key)
+	}
+
+	// The endpoint is validated by parseS3Object.
+	endpoint, _ := neturl.Parse(o.options.endpoint)
+	base := strings.TrimSuffix(endpoint.Path, "/")
+	if o.options.pathStyle {
+		return fmt.Sprintf("%s://%s%s/%s/%s", endpoint.Scheme, endpoint.Host, base, o.bucket, key)
+	}
+	return fmt.Sprintf("%s://%s.%s%s/%s", endpoint.Scheme, o.bucket, endpoint.Host, base, key)
+}
+
+// client returns the HTTP client of the uploads to the object.
+func (o s3Object) client() *http.Client {
+	if !o.options.insecureSkipVerify {
+		return uploadHTTPClient()
+	}
+	transport := uploadTransport.Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &http.Client{Transport: transport}
+}
+
+// awsCredentialsCache holds the credentials found by loadAWSCredentials, they are looked up once per step run.
+var awsCredentialsCache struct {
+	once        sync.Once
+	credentials awsCredentials
+	err         error
+}
+
+// loadAWSCredentials returns the credentials from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables, or the IAM role credentials of the ECS task or of the EC2 instance.
+func loadAWSCredentials() (awsCredentials, error) {
+	awsCredentialsCache.once.Do(func() {
+		c := &awsCredentialsCache
+		if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+			c.credentials = awsCredentials{AccessKeyID: id, SecretAccessKey: secret, Token: os.Getenv("AWS_SESSION_TOKEN")}
+		} else if uri := os.Getenv(ecsCredentialsURIEnvKey); uri != "" {
+			log.Printf("Using the IAM role credentials of the ECS task")
+			c.credentials, c.err = requestAWSCredentials(ecsCredentialsEndpoint+uri, nil)
+		} else {
+			log.Printf("Using the IAM role credentials of the EC2 instance")
+			c.credentials, c.err = ec2Credentials()
+		}
+	})
+	return awsCredentialsCache.credentials, awsCredentialsCache.err
+}
+
+// ec2Credentials returns the credentials of the IAM role of the EC2 instance from the instance metadata service (IMDSv2).
+func ec2Credentials() (awsCredentials, error) {
+	client := &http.Client{Timeout: awsCredentialsTimeout}
+
+	req, err := http.NewRequest(http.MethodPut, ec2MetadataEndpoint+ec2MetadataTokenPath, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", ec2MetadataTokenTTL)
+	token, err := readAWSResponse(client, req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to get instance metadata token: %s", err)
+	}
+	header := http.Header{"X-aws-ec2-metadata-token": []string{string(token)}}
+
+	req, err = http.NewRequest(http.MethodGet, ec2MetadataEndpoint+ec2CredentialsMetadata, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header = header
+	role, err := readAWSResponse(client, req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to get IAM role of the instance: %s", err)
+	}
+
+	return requestAWSCredentials(ec2MetadataEndpoint+ec2CredentialsMetadata+strings.TrimSpace(string(role)), header)
+}
+
+// requestAWSCredentials requests the credentials from the credentials endpoint of the ECS task or the EC2 instance.
+func requestAWSCredentials(url string, header http.Header) (awsCredentials, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if header != nil {
+		req.Header = header
+	}
+
+	b, err := readAWSResponse(&http.Client{Timeout: awsCredentialsTimeout}, req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to get IAM role credentials: %s", err)
+	}
+
+	var credentials awsCredentials
+	if err := json.Unmarshal(b, &credentials); err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to parse IAM role credentials: %s", err)
+	}
+	return credentials, nil
+}
+
+// readAWSResponse sends the request and returns the body of the response.
+func readAWSResponse(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status code: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// awsURIEscape escapes s as the canonical URI of the signature, every byte except the unreserved characters and '/'.
+func awsURIEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsCanonicalQuery returns the canonical query string of the signature, the query sorted by the names with the names and the values escaped.
+// The requests are sent with the canonical query string, so that the signed query matches the sent one.
+func awsCanonicalQuery(query neturl.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, strings.Replace(awsURIEscape(name)+"="+awsURIEscape(value), "/", "%2F", -1))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// signS3Request signs the request with AWS Signature Version 4, the host and all of the request's headers are signed.
+func signS3Request(req *http.Request, credentials awsCredentials, region, payloadHash string, now time.Time) {
+	amzTime := now.UTC().Format(s3TimeFormat)
+	date := now.UTC().Format(s3DateFormat)
+	req.Header.Set("X-Amz-Date", amzTime)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if credentials.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEscape(req.URL.Path),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{s3SigningAlgorithm, amzTime, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3SigningAlgorithm, credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// s3TTLTagKey is the key of the object tag the TTL of the cache is sent in, the lifecycle rules of the bucket
+// can expire the objects by the tag.
+const s3TTLTagKey = "cache-ttl-days"
+
+// s3ObjectHeader returns the headers of the requests creating an object: the checksums if they are not nil,
+// and the tag of the TTL of the cache if it is configured.
+func s3ObjectHeader(checksums *contentChecksums) http.Header {
+	header := http.Header{}
+	if checksums != nil {
+		checksums.setContentMD5(header)
+		header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(checksums.sha256))
+	}
+	if uploadTTLDays > 0 {
+		header.Set("X-Amz-Tagging", neturl.Values{s3TTLTagKey: {strconv.Itoa(uploadTTLDays)}}.Encode())
+	}
+	return header
+}
+
+// sendS3Request sends a signed request with the given headers to the object with size bytes of body.
+// It returns the body of the response if the request succeeded.
+func sendS3Request(object s3Object, method string, query neturl.Values, header http.Header, body io.Reader, size int64) ([]byte, http.Header, error) {
+	credentials, err := loadAWSCredentials()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get AWS credentials: %s", err)
+	}
+
+	req, err := http.NewRequest(method, object.endpoint(), body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %s", err)
+	}
+	req.URL.RawQuery = awsCanonicalQuery(query)
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signS3Request(req, credentials, object.region, s3UnsignedPayload, time.Now())
+
+	resp, err := object.client().Do(req)
+	if err != nil {
+		return nil, nil, newRequestError("failed to send request: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return nil, nil, newStatusError("request failed with status code: %d", resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, newRequestError("failed to read response body: %s", err)
+	}
+	return b, resp.Header, nil
+}
+
+// putS3Object uploads size bytes of body to the object, S3 verifies the checksums if they are not nil.
+func putS3Object(object s3Object, body io.Reader, size int64, checksums *contentChecksums) error {
+	_, _, err := sendS3Request(object, http.MethodPut, nil, s3ObjectHeader(checksums), body, size)
+	return err
+}
+
+// uploadS3File uploads the file at pth to the destination url of the S3 backend, retrying with uploadRetryPolicy.
+func uploadS3File(pth, url string) error {
+	object, err := parseS3Object(url, pth)
+	if err != nil {
+		return err
+	}
+	log.Printf("Uploading to s3://%s/%s", object.bucket, object.key)
+
+	checksums, err := loadContentChecksums(pth)
+	if err != nil {
+		return fmt.Errorf("failed to compute checksums: %s", err)
+	}
+
+	return uploadRetryPolicy.do(func() error {
+		file, err := os.Open(pth)
+		if err != nil {
+			return fmt.Errorf("failed to open archive file for upload (%s): %s", pth, err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				log.Warnf("Failed to close archive file (%s): %s", pth, err)
+			}
+		}()
+
+		info, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to get file info (%s): %s", pth, err)
+		}
+		return putS3Object(object, newProgressReader(file, pth, info.Size()), info.Size(), checksums)
+	})
+}
+
+// downloadS3File returns the content of the object of the file uploaded from pth to the destination url of the S3 backend,
+// or nil if the object does not exist; the download is retried with uploadRetryPolicy.
+func downloadS3File(pth, url string) ([]byte, error) {
+	object, err := parseS3Object(url, pth)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Downloading s3://%s/%s", object.bucket, object.key)
+
+	var b []byte
+	err = uploadRetryPolicy.do(func() error {
+		var err error
+		b, _, err = sendS3Request(object, http.MethodGet, nil, nil, nil, 0)
+		return err
+	})
+	if isNotFoundError(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// refreshS3Object reports whether the object of the file uploaded from pth to the destination url of the S3 backend
+// has the given SHA256 checksum, which is stored with the objects uploaded with the checksums.
+// If it has, the object is copied onto itself: S3 copies it without transferring the content,
+// and its modification time, tags and TTL start over as if it was uploaded again.
+func refreshS3Object(pth, url string, sha256Sum []byte) (bool, error) {
+	object, err := parseS3Object(url, pth)
+	if err != nil {
+		return false, err
+	}
+
+	var header http.Header
+	err = uploadRetryPolicy.do(func() error {
+		var err error
+		_, header, err = sendS3Request(object, http.MethodHead, nil, http.Header{"X-Amz-Checksum-Mode": {"ENABLED"}}, nil, 0)
+		return err
+	})
+	if isNotFoundError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if header.Get("X-Amz-Checksum-Sha256") != base64.StdEncoding.EncodeToString(sha256Sum) {
+		return false, nil
+	}
+
+	copyHeader := s3ObjectHeader(nil)
+	copyHeader.Set("X-Amz-Copy-Source", "/"+object.bucket+"/"+awsURIEscape(object.key))
+	// S3 only copies an object onto itself if something is replaced.
+	copyHeader.Set("X-Amz-Metadata-Directive", "REPLACE")
+	copyHeader.Set("X-Amz-Checksum-Algorithm", "SHA256")
+	if copyHeader.Get("X-Amz-Tagging") != "" {
+		copyHeader.Set("X-Amz-Tagging-Directive", "REPLACE")
+	}
+	log.Printf("Refreshing s3://%s/%s", object.bucket, object.key)
+	if err := uploadRetryPolicy.do(func() error {
+		b, _, err := sendS3Request(object, http.MethodPut, nil, copyHeader, nil, 0)
+		if err != nil {
+			return err
+		}
+
+		// S3 may respond to the copy with an error even if the status code is 200.
+		var s3Err s3Error
+		if xml.Unmarshal(b, &s3Err) == nil {
+			return &uploadError{err: fmt.Errorf("%s: %s", s3Err.Code, s3Err.Message), retryable: true}
+		}
+		return nil
+	}); err != nil {
+		return false, fmt.Errorf("failed to refresh object: %s", err)
+	}
+	return true, nil
+}
+
+// uploadS3Reader uploads the archive read from reader to the archive's object of the S3 backend with a multipart upload,
+// so that the archive is uploaded as it is written, without knowing its size.
+func uploadS3Reader(reader io.Reader, url string) error {
+	object, err := parseS3Object(url, cacheArchivePath)
+	if err != nil {
+		return err
+	}
+	log.Printf("Uploading to s3://%s/%s", object.bucket, object.key)
+
+	return uploadS3Multipart(object, newProgressReader(reader, cacheArchivePath, 0), s3PartSize)
+}
@@ -0,0 +1,139 @@
+// S3 multipart upload related models and functions.
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// s3PartSize is the size of the parts of the multipart uploads, S3 requires at least 5MB except for the last part.
+// Each part is buffered in memory, so that it can be retried; at most 10000 parts are allowed, 160GB of archive.
+const s3PartSize = 16 * 1024 * 1024
+
+// s3CompletedPart is a part listed in the CompleteMultipartUpload request.
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3CompleteMultipartUpload is the body of the CompleteMultipartUpload request.
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// s3InitiateMultipartUploadResult is the response of the CreateMultipartUpload request.
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// s3Error is the error S3 may respond to the CompleteMultipartUpload request with, even if the status code is 200.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// uploadS3Multipart uploads the content read from reader to the object in parts of partSize,
+// each part is uploaded once it is read, retrying with uploadRetryPolicy.
+// The multipart upload is aborted if it fails, so that the uploaded parts are not kept.
+func uploadS3Multipart(object s3Object, reader io.Reader, partSize int) error {
+	var uploadID string
+	if err := uploadRetryPolicy.do(func() error {
+		b, _, err := sendS3Request(object, http.MethodPost, neturl.Values{"uploads": {""}}, s3ObjectHeader(nil), nil, 0)
+		if err != nil {
+			return err
+		}
+
+		var result s3InitiateMultipartUploadResult
+		if err := xml.Unmarshal(b, &result); err != nil {
+			return fmt.Errorf("failed to parse multipart upload: %s", err)
+		}
+		uploadID = result.UploadID
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to create multipart upload: %s", err)
+	}
+
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		if _, _, err := sendS3Request(object, http.MethodDelete, neturl.Values{"uploadId": {uploadID}}, nil, nil, 0); err != nil {
+			log.Warnf("Failed to abort multipart upload: %s", err)
+		}
+	}()
+
+	var parts []s3CompletedPart
+	buf := make([]byte, partSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(reader, buf)
+		if err == io.EOF && number > 1 {
+			break
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read archive: %s", err)
+		}
+
+		// S3 requires at least one part, which is empty if the content is empty.
+		etag, uploadErr := uploadS3Part(object, uploadID, number, buf[:n])
+		if uploadErr != nil {
+			return fmt.Errorf("failed to upload part %d: %s", number, uploadErr)
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: number, ETag: etag})
+
+		if err != nil {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	if err := uploadRetryPolicy.do(func() error {
+		b, _, err := sendS3Request(object, http.MethodPost, neturl.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			return err
+		}
+
+		var s3Err s3Error
+		if xml.Unmarshal(b, &s3Err) == nil {
+			return &uploadError{err: fmt.Errorf("%s: %s", s3Err.Code, s3Err.Message), retryable: true}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %s", err)
+	}
+
+	completed = true
+	log.Printf("Uploaded %d parts", len(parts))
+	return nil
+}
+
+// uploadS3Part uploads the part of the multipart upload and returns its ETag.
+func uploadS3Part(object s3Object, uploadID string, number int, part []byte) (string, error) {
+	query := neturl.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+
+	var etag string
+	err := uploadRetryPolicy.do(func() error {
+		_, header, err := sendS3Request(object, http.MethodPut, query, nil, bytes.NewReader(part), int64(len(part)))
+		if err != nil {
+			return err
+		}
+
+		etag = header.Get("ETag")
+		if etag == "" {
+			return fmt.Errorf("part uploaded, but ETag isn't received")
+		}
+		return nil
+	})
+	return etag, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_uploadS3Multipart(t *testing.T) {
+	awsCredentialsCache.once.Do(func() {
+		awsCredentialsCache.credentials = awsCredentials{AccessKeyID: "id", SecretAccessKey: "secret"}
+	})
+
+	tests := []struct {
+		name        string
+		content     string
+		failPart    int
+		wantParts   []string
+		wantErr     bool
+		wantAborted bool
+	}{
+		{name: "parts", content: "aaaaaaaaaabbbbbbbbbbccccc", wantParts: []string{"aaaaaaaaaa", "bbbbbbbbbb", "ccccc"}},
+		{name: "exact parts", content: "aaaaaaaaaabbbbbbbbbb", wantParts: []string{"aaaaaaaaaa", "bbbbbbbbbb"}},
+		{name: "empty", content: "", wantParts: []string{""}},
+		{name: "failed part", content: "aaaaaaaaaabbbbbbbbbbccccc", failPart: 2, wantParts: []string{"aaaaaaaaaa"}, wantErr: true, wantAborted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parts []string
+			var completed []s3CompletedPart
+			aborted := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query := r.URL.Query()
+				switch {
+				case r.Method == http.MethodPost && query.Get("uploadId") == "":
+					fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>upload id</UploadId></InitiateMultipartUploadResult>")
+				case r.Method == http.MethodPut:
+					if query.Get("partNumber") == fmt.Sprint(tt.failPart) {
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+					b, _ := ioutil.ReadAll(r.Body)
+					parts = append(parts, string(b))
+					w.Header().Set("ETag", `"`+query.Get("partNumber")+`"`)
+				case r.Method == http.MethodPost:
+					var body s3CompleteMultipartUpload
+					if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+						t.Errorf("failed to decode complete request: %s", err)
+					}
+					completed = body.Parts
+					fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+				case r.Method == http.MethodDelete && query.Get("uploadId") == "upload id":
+					aborted = true
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+			defer server.Close()
+
+			object := s3Object{bucket: "bucket", key: "cache-archive.tar", region: "us-east-1", options: s3EndpointOptions{endpoint: server.URL, pathStyle: true}}
+			if err := uploadS3Multipart(object, strings.NewReader(tt.content), 10); (err != nil) != tt.wantErr {
+				t.Fatalf("uploadS3Multipart() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(parts, tt.wantParts) {
+				t.Errorf("uploaded parts = %q, want %q", parts, tt.wantParts)
+			}
+			if aborted != tt.wantAborted {
+				t.Errorf("aborted = %v, want %v", aborted, tt.wantAborted)
+			}
+			if !tt.wantErr && len(completed) != len(tt.wantParts) {
+				t.Errorf("completed parts = %v, want %d parts", completed, len(tt.wantParts))
+			}
+		})
+	}
+}
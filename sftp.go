@@ -0,0 +1,246 @@
+// SFTP storage backend related models and functions.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// sftpScheme prefixes the destinations of the SFTP backend: sftp://<user>@<host>:<port>/<dir>,
+// the files are uploaded into the <dir> directory of the host.
+const sftpScheme = "sftp://"
+
+// sftpCommand uploads the files in batch mode, the OpenSSH client renames the uploaded files with the posix-rename extension
+// if the server supports it, replacing the previous files atomically.
+const sftpCommand = "sftp"
+
+// sftpIdentity holds the keys of the SFTP backend, they are not part of the destination url, so that they are not logged.
+type sftpIdentity struct {
+	// privateKey authenticates the user, the content of an OpenSSH private key without passphrase.
+	privateKey string
+	// knownHosts lists the public keys of the host in known_hosts format,
+	// if it is empty the host key is accepted when it is not known yet.
+	knownHosts string
+}
+
+// sftpKeys is the identity of the SFTP backend, configured by the step inputs.
+var sftpKeys sftpIdentity
+
+// sftpDestination is the destination of an upload to the SFTP backend.
+type sftpDestination struct {
+	user string
+	host string
+	port string
+	dir  string
+}
+
+// sftpURL returns the destination of the SFTP backend for the given user, host, port and directory.
+func sftpURL(user, host string, port int, dir string) string {
+	u := neturl.URL{
+		Scheme: strings.TrimSuffix(sftpScheme, "://"),
+		User:   neturl.User(user),
+		Host:   fmt.Sprintf("%s:%d", host, port),
+		Path:   "/" + strings.TrimPrefix(dir, "/"),
+	}
+	return u.String()
+}
+
+// parseSFTPDestination returns the destination of the SFTP backend described by url.
+func parseSFTPDestination(url string) (sftpDestination, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return sftpDestination{}, fmt.Errorf("failed to parse SFTP destination (%s): %s", url, err)
+	}
+
+	destination := sftpDestination{
+		host: u.Hostname(),
+		port: u.Port(),
+		dir:  u.Path,
+	}
+	if u.User != nil {
+		destination.user = u.User.Username()
+	}
+	if destination.user == "" || destination.host == "" {
+		return sftpDestination{}, fmt.Errorf("SFTP destination requires a user and a host: %s", url)
+	}
+	if destination.port == "" {
+		destination.port = "22"
+	}
+	return destination, nil
+}
+
+// sftpQuote quotes s as an argument of the sftp batch commands.
+func sftpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// sftpBatch returns the sftp batch commands uploading the file at pth into dir:
+// the missing directories are created, the file is uploaded to a temporary name and renamed into place,
+// so that the cache is never downloaded partially uploaded.
+func sftpBatch(pth, dir string) string {
+	var dirs []string
+	for d := path.Clean(dir); d != "/" && d != "."; d = path.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+	}
+
+	var b strings.Builder
+	for _, d := range dirs {
+		// The '-' prefix ignores the errors of the directories which already exist.
+		fmt.Fprintf(&b, "-mkdir %s\n", sftpQuote(d))
+	}
+
+	dst := path.Join(dir, filepath.Base(pth))
+	tmp := dst + ".tmp"
+	fmt.Fprintf(&b, "put %s %s\n", sftpQuote(pth), sftpQuote(tmp))
+	fmt.Fprintf(&b, "rename %s %s\n", sftpQuote(tmp), sftpQuote(dst))
+	return b.String()
+}
+
+// writeSFTPKeyFile writes the content into a temporary file readable only by the user, as ssh requires for the private keys.
+func writeSFTPKeyFile(name, content string) (string, error) {
+	file, err := ioutil.TempFile("", name)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
+
+// sftpArgs returns the sftp arguments connecting to the destination with the key files.
+func sftpArgs(destination sftpDestination, keyPth, knownHostsPth string) []string {
+	args := []string{"-b", "-", "-P", destination.port, "-o", "BatchMode=yes", "-i", keyPth, "-o", "IdentitiesOnly=yes"}
+	if knownHostsPth != "" {
+		args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+knownHostsPth)
+	} else {
+		args = append(args, "-o", "StrictHostKeyChecking=accept-new")
+	}
+	return append(args, destination.user+"@"+destination.host)
+}
+
+// sftpSession runs the sftp command connecting to a destination of the SFTP backend,
+// the keys are written into temporary files removed on close.
+type sftpSession struct {
+	destination sftpDestination
+	pth         string
+	args        []string
+	keyPths     []string
+}
+
+// newSFTPSession creates the session of the destination url of the SFTP backend.
+func newSFTPSession(url string) (*sftpSession, error) {
+	destination, err := parseSFTPDestination(url)
+	if err != nil {
+		return nil, err
+	}
+	if sftpKeys.privateKey == "" {
+		return nil, fmt.Errorf("SFTP destination requires a private key")
+	}
+
+	sftpPth, err := exec.LookPath(sftpCommand)
+	if err != nil {
+		return nil, fmt.Errorf("SFTP storage backend requires %s: %s", sftpCommand, err)
+	}
+
+	session := &sftpSession{destination: destination, pth: sftpPth}
+	keyPth, err := writeSFTPKeyFile("sftp-key", sftpKeys.privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write SFTP private key: %s", err)
+	}
+	session.keyPths = append(session.keyPths, keyPth)
+
+	var knownHostsPth string
+	if sftpKeys.knownHosts != "" {
+		knownHostsPth, err = writeSFTPKeyFile("sftp-known-hosts", sftpKeys.knownHosts)
+		if err != nil {
+			session.close()
+			return nil, fmt.Errorf("failed to write SFTP known hosts: %s", err)
+		}
+		session.keyPths = append(session.keyPths, knownHostsPth)
+	}
+
+	session.args = sftpArgs(destination, keyPth, knownHostsPth)
+	return session, nil
+}
+
+// run runs the sftp batch commands.
+func (s *sftpSession) run(batch string) error {
+	cmd := command.New(s.pth, s.args...).SetStdin(strings.NewReader(batch)).SetStdout(os.Stdout).SetStderr(os.Stderr)
+	if err := cmd.Run(); err != nil {
+		// The connection errors and the rejected commands can not be told apart.
+		return newRequestError(sftpCommand+" failed: %s", err)
+	}
+	return nil
+}
+
+// close removes the key files of the session.
+func (s *sftpSession) close() {
+	for _, pth := range s.keyPths {
+		if err := os.Remove(pth); err != nil {
+			log.Warnf("Failed to remove SFTP key file (%s): %s", pth, err)
+		}
+	}
+}
+
+// uploadSFTPFile uploads the file at pth to the destination url of the SFTP backend, retrying with uploadRetryPolicy.
+func uploadSFTPFile(pth, url string) error {
+	session, err := newSFTPSession(url)
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	log.Printf("Uploading to %s@%s:%s", session.destination.user, session.destination.host, path.Join(session.destination.dir, filepath.Base(pth)))
+
+	batch := sftpBatch(pth, session.destination.dir)
+	// All of the failures are retried.
+	return uploadRetryPolicy.do(func() error {
+		return session.run(batch)
+	})
+}
+
+// downloadSFTPFile returns the content of the file uploaded from pth to the destination url of the SFTP backend.
+// The download is not retried, and a missing file is reported as an error,
+// since they can not be told apart from a failed connection.
+func downloadSFTPFile(pth, url string) ([]byte, error) {
+	session, err := newSFTPSession(url)
+	if err != nil {
+		return nil, err
+	}
+	defer session.close()
+
+	file, err := ioutil.TempFile("", "sftp-download")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	tmpPth := file.Name()
+	defer func() {
+		if err := os.Remove(tmpPth); err != nil {
+			log.Warnf("Failed to remove temporary file (%s): %s", tmpPth, err)
+		}
+	}()
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close temporary file (%s): %s", tmpPth, err)
+	}
+
+	src := path.Join(session.destination.dir, filepath.Base(pth))
+	log.Printf("Downloading %s@%s:%s", session.destination.user, session.destination.host, src)
+	if err := session.run(fmt.Sprintf("get %s %s\n", sftpQuote(src), sftpQuote(tmpPth))); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(tmpPth)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseSFTPDestination(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		want    sftpDestination
+		wantErr bool
+	}{
+		{name: "absolute directory", url: sftpURL("ci", "cache.internal", 2222, "/srv/cache"), want: sftpDestination{user: "ci", host: "cache.internal", port: "2222", dir: "/srv/cache"}},
+		{name: "relative directory", url: sftpURL("ci", "cache.internal", 22, "cache"), want: sftpDestination{user: "ci", host: "cache.internal", port: "22", dir: "/cache"}},
+		{name: "default port", url: "sftp://ci@cache.internal/cache", want: sftpDestination{user: "ci", host: "cache.internal", port: "22", dir: "/cache"}},
+		{name: "missing user", url: "sftp://cache.internal/cache", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSFTPDestination(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSFTPDestination() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSFTPDestination() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sftpBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  string
+		want string
+	}{
+		{
+			name: "nested directory",
+			dir:  "/srv/cache",
+			want: "-mkdir \"/srv\"\n-mkdir \"/srv/cache\"\n" +
+				"put \"/tmp/cache-archive.tar\" \"/srv/cache/cache-archive.tar.tmp\"\n" +
+				"rename \"/srv/cache/cache-archive.tar.tmp\" \"/srv/cache/cache-archive.tar\"\n",
+		},
+		{
+			name: "root directory",
+			dir:  "/",
+			want: "put \"/tmp/cache-archive.tar\" \"/cache-archive.tar.tmp\"\n" +
+				"rename \"/cache-archive.tar.tmp\" \"/cache-archive.tar\"\n",
+		},
+		{
+			name: "quoted directory",
+			dir:  `/my "cache"`,
+			want: "-mkdir \"/my \\\"cache\\\"\"\n" +
+				"put \"/tmp/cache-archive.tar\" \"/my \\\"cache\\\"/cache-archive.tar.tmp\"\n" +
+				"rename \"/my \\\"cache\\\"/cache-archive.tar.tmp\" \"/my \\\"cache\\\"/cache-archive.tar\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sftpBatch("/tmp/cache-archive.tar", tt.dir); got != tt.want {
+				t.Errorf("sftpBatch() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+// Sparse file related models and functions.
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	tarBlockSize = 512
+	// sparseHeaderDir and sparsePAXHeaderDir prefix the names of the ustar headers of sparse entries,
+	// like GNU tar does, the real name is stored in the PAX records.
+	sparseHeaderDir    = "GNUSparseFile.0"
+	sparsePAXHeaderDir = "PaxHeaders.0"
+	// sparseMaxBaseName is the maximum length of the base name in the ustar headers of sparse entries.
+	sparseMaxBaseName = 80
+)
+
+// sparseRegion is a data region of a sparse file, the rest of the file consists of holes.
+type sparseRegion struct {
+	offset int64
+	length int64
+}
+
+// sparseRegions returns the data regions of the file at pth, found with SEEK_DATA and SEEK_HOLE.
+// sparse is false if the file has no holes.
+func sparseRegions(pth string, info os.FileInfo) (regions []sparseRegion, sparse bool, err error) {
+	if !hasHoles(info) {
+		return nil, false, nil
+	}
+
+	file, err := os.Open(pth)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warnf("Failed to close file (%s): %s", pth, err)
+		}
+	}()
+
+	size := info.Size()
+	for offset := int64(0); offset < size; {
+		data, err := file.Seek(offset, seekData)
+		if isNoDataError(err) {
+			break
+		} else if err != nil {
+			return nil, false, err
+		}
+
+		hole, err := file.Seek(data, seekHole)
+		if err != nil {
+			return nil, false, err
+		}
+
+		regions = append(regions, sparseRegion{offset: data, length: hole - data})
+		offset = hole
+	}
+
+	// File systems not supporting SEEK_HOLE report the whole file as data.
+	if len(regions) == 1 && regions[0].offset == 0 && regions[0].length == size {
+		return nil, false, nil
+	}
+
+	// GNU tar extracts the file up to the end of the last region, an empty region marks the end of a trailing hole.
+	if len(regions) == 0 || regions[len(regions)-1].offset+regions[len(regions)-1].length < size {
+		regions = append(regions, sparseRegion{offset: size})
+	}
+	return regions, true, nil
+}
+
+// isNoDataError reports whether err is returned by seeking for data after the last data region.
+func isNoDataError(err error) bool {
+	pathError, ok := err.(*os.PathError)
+	return ok && pathError.Err == syscall.ENXIO
+}
+
+// writeSparse writes the sparse file at pth into the tar archive in the PAX sparse format 1.0:
+// the PAX records describe the real name and size, the content starts with the map of the data regions,
+// followed by the data regions, the holes are omitted.
+func (a *Archive) writeSparse(pth string, info os.FileInfo, regions []sparseRegion, xattrs map[string]string, dry bool) error {
+	// Flush writes the padding of the previous entry, the sparse entry's blocks are written directly.
+	if err := a.tar.Flush(); err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("failed to get tar file header(%s), error: %s", pth, err)
+	}
+	a.normalizeHeader(header)
+
+	sparseMap := formatSparseMap(regions)
+	var dataSize int64
+	for _, region := range regions {
+		dataSize += region.length
+	}
+	header.Size = int64(len(sparseMap)) + dataSize
+
+	var keys []string
+	for key := range xattrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var records string
+	for _, key := range keys {
+		records += formatPAXRecord(paxXattrPrefix+key, xattrs[key])
+	}
+	for _, record := range [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", pth},
+		{"GNU.sparse.realsize", strconv.FormatInt(info.Size(), 10)},
+		{"size", strconv.FormatInt(header.Size, 10)},
+		{"uid", strconv.Itoa(header.Uid)},
+		{"gid", strconv.Itoa(header.Gid)},
+		{"mtime", strconv.FormatInt(header.ModTime.Unix(), 10)},
+	} {
+		records += formatPAXRecord(record[0], record[1])
+	}
+
+	baseName := filepath.Base(pth)
+	if len(baseName) > sparseMaxBaseName {
+		baseName = baseName[:sparseMaxBaseName]
+	}
+
+	paxHeader := *header
+	paxHeader.Name = sparsePAXHeaderDir + "/" + baseName
+	paxHeader.Typeflag = tar.TypeXHeader
+	paxHeader.Size = int64(len(records))
+	if err := writeBlocks(a.uncompressed, formatTarHeader(&paxHeader), []byte(records)); err != nil {
+		return err
+	}
+
+	header.Name = sparseHeaderDir + "/" + baseName
+	header.Typeflag = tar.TypeReg
+	if err := writeBlocks(a.uncompressed, formatTarHeader(header), sparseMap); err != nil {
+		return err
+	}
+
+	var file *os.File
+	if !dry {
+		file, err = os.Open(pth)
+		if err != nil {
+			return fmt.Errorf("failed to open file(%s), error: %s", pth, err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				log.Warnf("Failed to close file (%s): %s", pth, err)
+			}
+		}()
+	}
+
+	// The checksum covers the file's real content, the holes are hashed as zeros.
+	sum := newChecksum(dry)
+	var hashed int64
+	for _, region := range regions {
+		if sum != nil {
+			if _, err := io.CopyN(sum, zeroReader{}, region.offset-hashed); err != nil {
+				return err
+			}
+			hashed = region.offset + region.length
+		}
+
+		var reader io.Reader = nopReader{}
+		if file != nil {
+			if _, err := file.Seek(region.offset, io.SeekStart); err != nil {
+				return err
+			}
+			reader = file
+		}
+		if _, err := io.CopyN(hashWriter(a.uncompressed, sum), reader, region.length); err != nil {
+			return fmt.Errorf("failed to copy, error: %s, file: %s, region: %v", err, pth, region)
+		}
+	}
+	a.addChecksum(pth, info, sum)
+
+	return writeBlocks(a.uncompressed, nil, make([]byte, (tarBlockSize-dataSize%tarBlockSize)%tarBlockSize))
+}
+
+// formatSparseMap returns the map of the data regions in the PAX sparse format 1.0, padded to the tar block size:
+// the number of regions followed by the offset and length of each region, as newline terminated decimals.
+func formatSparseMap(regions []sparseRegion) []byte {
+	sparseMap := strconv.Itoa(len(regions)) + "\n"
+	for _, region := range regions {
+		sparseMap += strconv.FormatInt(region.offset, 10) + "\n" + strconv.FormatInt(region.length, 10) + "\n"
+	}
+	return padBlock([]byte(sparseMap))
+}
+
+// formatPAXRecord returns a PAX record: "%d %s=%s\n", where the decimal is the length of the whole record.
+func formatPAXRecord(key, value string) string {
+	size := len(key) + len(value) + len(" =\n")
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + key + "=" + value + "\n"
+	if len(record) != size {
+		// The size field got one digit longer.
+		record = strconv.Itoa(len(record)) + " " + key + "=" + value + "\n"
+	}
+	return record
+}
+
+// formatTarHeader returns the ustar header block of the given header, fields not fitting ustar are left zero,
+// they are expected to be stored in PAX records.
+func formatTarHeader(header *tar.Header) []byte {
+	block := make([]byte, tarBlockSize)
+	copy(block[0:100], header.Name)
+	formatOctal(block[100:108], header.Mode)
+	formatOctal(block[108:116], int64(header.Uid))
+	formatOctal(block[116:124], int64(header.Gid))
+	formatOctal(block[124:136], header.Size)
+	formatOctal(block[136:148], header.ModTime.Unix())
+	block[156] = header.Typeflag
+	copy(block[257:263], "ustar\x00")
+	copy(block[263:265], "00")
+	copy(block[265:297], header.Uname)
+	copy(block[297:329], header.Gname)
+
+	// The checksum is calculated with the checksum field filled with spaces.
+	copy(block[148:156], strings.Repeat(" ", 8))
+	var checksum int64
+	for _, b := range block {
+		checksum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", checksum))
+	return block
+}
+
+// formatOctal writes n as a NUL terminated, zero padded octal number into b, if it fits.
+func formatOctal(b []byte, n int64) {
+	s := strconv.FormatInt(n, 8)
+	if n < 0 || len(s) >= len(b) {
+		return
+	}
+	copy(b, strings.Repeat("0", len(b)-1-len(s))+s)
+}
+
+// padBlock pads b with zeros to a multiple of the tar block size.
+func padBlock(b []byte) []byte {
+	return append(b, make([]byte, (tarBlockSize-len(b)%tarBlockSize)%tarBlockSize)...)
+}
+
+// writeBlocks writes the header block and the content padded to the tar block size.
+func writeBlocks(writer io.Writer, header []byte, content []byte) error {
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	_, err := writer.Write(padBlock(content))
+	return err
+}
@@ -0,0 +1,21 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// SEEK_HOLE and SEEK_DATA whence values of lseek.
+const (
+	seekHole = 3
+	seekData = 4
+)
+
+// hasHoles reports whether the file may have holes: it occupies less blocks than its size.
+func hasHoles(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode().IsRegular() && stat.Blocks*512 < info.Size()
+}
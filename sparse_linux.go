@@ -0,0 +1,21 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// SEEK_DATA and SEEK_HOLE whence values of lseek.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// hasHoles reports whether the file may have holes: it occupies less blocks than its size.
+func hasHoles(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode().IsRegular() && stat.Blocks*512 < info.Size()
+}
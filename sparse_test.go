@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func TestArchive_sparse(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "sparse.img")
+	file, err := os.Create(pth)
+	if err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+	size := int64(16 << 20)
+	if err := file.Truncate(size); err != nil {
+		t.Fatalf("failed to truncate file: %s", err)
+	}
+	data := bytes.Repeat([]byte("data"), 1024)
+	if _, err := file.WriteAt(data, 8<<20); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close file: %s", err)
+	}
+
+	info, err := os.Lstat(pth)
+	if err != nil {
+		t.Fatalf("failed to stat file: %s", err)
+	}
+	if _, sparse, err := sparseRegions(pth, info); err != nil {
+		t.Fatalf("failed to find data regions: %s", err)
+	} else if !sparse {
+		t.Skip("the file system does not support sparse files")
+	}
+
+	var writer bufferWriteCloser
+	archive, err := NewArchive(&writer, TAR, Compression{Method: NONE})
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	if err := archive.Write([]string{pth}, false); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+
+	if int64(writer.Len()) >= size {
+		t.Errorf("archive size = %d, want the holes to be omitted", writer.Len())
+	}
+
+	reader := tar.NewReader(&writer)
+	header, err := reader.Next()
+	if err != nil {
+		t.Fatalf("failed to read header: %s", err)
+	}
+	if header.Name != pth || header.Size != size {
+		t.Errorf("header = %s (%d bytes), want %s (%d bytes)", header.Name, header.Size, pth, size)
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read content: %s", err)
+	}
+	want := make([]byte, size)
+	copy(want[8<<20:], data)
+	if !bytes.Equal(content, want) {
+		t.Errorf("content does not match the written content")
+	}
+
+	sum := sha256.Sum256(want)
+	if got := archive.checksums[pth].SHA256; got != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum = %s, want %s", got, hex.EncodeToString(sum[:]))
+	}
+
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("reader.Next() error = %v, want %v", err, io.EOF)
+	}
+}
+
+func Test_formatPAXRecord(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  string
+	}{
+		{key: "path", value: "foo", want: "12 path=foo\n"},
+		// The size field gets one digit longer including itself.
+		{key: "a", value: "01234", want: "11 a=01234\n"},
+		{key: "GNU.sparse.realsize", value: "16777216", want: "32 GNU.sparse.realsize=16777216\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := formatPAXRecord(tt.key, tt.value); got != tt.want {
+				t.Errorf("formatPAXRecord() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
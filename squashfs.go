@@ -0,0 +1,116 @@
+// SquashFS image related models and functions.
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/bitrise-io/go-utils/command"
+)
+
+// squashfsCommand builds squashfs images from tar streams, the -tar option requires squashfs-tools 4.6 or later.
+const squashfsCommand = "mksquashfs"
+
+// squashfsCompressionArgs returns the mksquashfs arguments compressing the image with the given compression.
+func squashfsCompressionArgs(compression Compression) ([]string, error) {
+	var args []string
+	switch compression.Method {
+	case NONE:
+		// Stores the inodes, the data, the fragments and the extended attributes uncompressed.
+		return []string{"-noI", "-noD", "-noF", "-noX"}, nil
+	case GZIP, ZSTD:
+		args = []string{"-comp", string(compression.Method)}
+		if compression.Level != 0 {
+			args = append(args, "-Xcompression-level", strconv.Itoa(compression.Level))
+		}
+	case XZ, LZ4:
+		args = []string{"-comp", string(compression.Method)}
+	default:
+		return nil, fmt.Errorf("compression method is not supported with archive format %s: %s", SQUASHFS, compression.Method)
+	}
+	return args, nil
+}
+
+// squashfsWriter writes the tar stream into mksquashfs, which writes the image into the archive file.
+type squashfsWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	pth   string
+	// compressed is set to the size of the image when the image is written.
+	compressed *countingWriter
+}
+
+// Write writes b into the tar stream read by mksquashfs.
+func (w *squashfsWriter) Write(b []byte) (int, error) {
+	return w.stdin.Write(b)
+}
+
+// Close ends the tar stream and waits for mksquashfs to write the image.
+func (w *squashfsWriter) Close() error {
+	if err := w.stdin.Close(); err != nil {
+		return err
+	}
+	if err := w.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %s", squashfsCommand, err)
+	}
+
+	info, err := os.Stat(w.pth)
+	if err != nil {
+		return err
+	}
+	w.compressed.n = info.Size()
+	return nil
+}
+
+// newSquashfsArchive creates an Archive writing a squashfs image, the entries are written as a tar stream into mksquashfs,
+// which compresses the image with the given compression.
+// mksquashfs can not write into a stream, the archive's writer must be a file.
+func newSquashfsArchive(archiveWriter io.WriteCloser, compressed *countingWriter, compression Compression) (*Archive, error) {
+	if compression.Seekable {
+		return nil, fmt.Errorf("seekable archive is not supported with archive format: %s", SQUASHFS)
+	}
+	file, ok := archiveWriter.(*os.File)
+	if !ok {
+		return nil, fmt.Errorf("archive format %s requires an archive file", SQUASHFS)
+	}
+
+	pth, err := exec.LookPath(squashfsCommand)
+	if err != nil {
+		return nil, fmt.Errorf("archive format %s requires %s: %s", SQUASHFS, squashfsCommand, err)
+	}
+
+	args, err := squashfsCompressionArgs(compression)
+	if err != nil {
+		return nil, err
+	}
+	// Reads the tar stream from stdin, overwriting the archive file.
+	args = append([]string{"-", file.Name(), "-tar", "-noappend", "-quiet"}, args...)
+
+	cmd := command.New(pth, args...).SetStdout(os.Stdout).SetStderr(os.Stderr).GetCmd()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %s", pth, err)
+	}
+
+	writer := &squashfsWriter{
+		cmd:        cmd,
+		stdin:      stdin,
+		pth:        file.Name(),
+		compressed: compressed,
+	}
+	uncompressed := &countingWriter{writer: writer}
+	return &Archive{
+		io:           archiveWriter,
+		tar:          tar.NewWriter(uncompressed),
+		compressor:   writer,
+		uncompressed: uncompressed,
+		compressed:   compressed,
+	}, nil
+}
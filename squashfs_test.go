@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_squashfsCompressionArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression Compression
+		want        []string
+		wantErr     bool
+	}{
+		{name: "none", compression: Compression{Method: NONE}, want: []string{"-noI", "-noD", "-noF", "-noX"}},
+		{name: "gzip", compression: Compression{Method: GZIP, Level: 6}, want: []string{"-comp", "gzip", "-Xcompression-level", "6"}},
+		{name: "zstd default level", compression: Compression{Method: ZSTD}, want: []string{"-comp", "zstd"}},
+		{name: "xz", compression: Compression{Method: XZ, Level: 6}, want: []string{"-comp", "xz"}},
+		{name: "brotli", compression: Compression{Method: BROTLI}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := squashfsCompressionArgs(tt.compression)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("squashfsCompressionArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("squashfsCompressionArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,17 +3,94 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/pathutil"
 )
 
-func stackVersionData(stackID string) ([]byte, error) {
+// stackVersionData returns the archive info written as the first entry of the cache archive:
+// the stack the cache was created on, the format and the compression method of the archive
+// and the path of the entry index if the archive is seekable.
+// The format is omitted for tar archives, the compression method is omitted for zip archives and squashfs images,
+// since their entries are compressed individually.
+func stackVersionData(stackID string, format ArchiveFormat, compression Compression) ([]byte, error) {
 	type archiveInfo struct {
-		StackID string `json:"stack_id,omitempty"`
+		StackID     string            `json:"stack_id,omitempty"`
+		Format      ArchiveFormat     `json:"format,omitempty"`
+		Compression CompressionMethod `json:"compression,omitempty"`
+		Index       string            `json:"index,omitempty"`
+	}
+	info := archiveInfo{
+		StackID:     stackID,
+		Compression: compression.Method,
+	}
+	if format != TAR {
+		info.Format = format
+		info.Compression = ""
 	}
-	stackData, err := json.Marshal(archiveInfo{
-		StackID: stackID,
-	})
+	if compression.Seekable {
+		info.Index = cacheIndexFilePath
+	}
+	stackData, err := json.Marshal(info)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal data, error: %s", err)
 	}
 	return stackData, nil
 }
+
+// readStackID reads the stack the previous cache was created on from the archive info at pth,
+// empty if the archive info does not exist or records no stack.
+func readStackID(pth string) (string, error) {
+	if exists, err := pathutil.IsPathExists(pth); err != nil {
+		return "", err
+	} else if !exists {
+		return "", nil
+	}
+
+	b, err := fileutil.ReadBytesFromFile(pth)
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		StackID string `json:"stack_id"`
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return "", err
+	}
+	return info.StackID, nil
+}
+
+// stackChanged reports whether the previous cache was created on another stack than stackID,
+// the stacks are not compared if either of them is unknown.
+func stackChanged(previousStackID, stackID string) bool {
+	return previousStackID != "" && stackID != "" && previousStackID != stackID
+}
+
+// stepVersion is the version of the step, recorded in the build info of the cache archive.
+// It is set by the release build with -ldflags "-X main.stepVersion=<version>", dev otherwise.
+var stepVersion = "dev"
+
+// buildInfo describes the build which created the cache archive, to audit and debug cache archives.
+type buildInfo struct {
+	Branch      string `json:"branch,omitempty"`
+	Commit      string `json:"commit,omitempty"`
+	Workflow    string `json:"workflow,omitempty"`
+	AppSlug     string `json:"app_slug,omitempty"`
+	StepVersion string `json:"step_version"`
+}
+
+// buildInfoData returns the build info written as the second entry of the cache archive, after the archive info.
+func buildInfoData(configs Config) ([]byte, error) {
+	info := buildInfo{
+		Branch:      configs.GitBranch,
+		Commit:      configs.GitCommit,
+		Workflow:    configs.WorkflowID,
+		AppSlug:     configs.AppSlug,
+		StepVersion: stepVersion,
+	}
+	buildData, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal data, error: %s", err)
+	}
+	return buildData, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_readStackID(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	stackData, err := stackVersionData("osx-xcode-15.0.x", TAR, Compression{Method: GZIP})
+	if err != nil {
+		t.Fatalf("stackVersionData() error = %v", err)
+	}
+	pth := filepath.Join(tmpDir, "archive_info.json")
+	noStackPth := filepath.Join(tmpDir, "no_stack.json")
+	createDirStruct(t, map[string]string{pth: string(stackData), noStackPth: `{"compression": "gzip"}`})
+
+	for pth, want := range map[string]string{
+		pth:                                 "osx-xcode-15.0.x",
+		noStackPth:                          "",
+		filepath.Join(tmpDir, "not/exists"): "",
+	} {
+		if got, err := readStackID(pth); err != nil || got != want {
+			t.Errorf("readStackID(%s) = %v, %v, want %v", pth, got, err, want)
+		}
+	}
+}
+
+func Test_stackChanged(t *testing.T) {
+	tests := []struct {
+		previous, current string
+		want              bool
+	}{
+		{"osx-xcode-15.0.x", "osx-xcode-15.0.x", false},
+		{"osx-xcode-14.3.x", "osx-xcode-15.0.x", true},
+		{"", "osx-xcode-15.0.x", false},
+		{"osx-xcode-15.0.x", "", false},
+	}
+	for _, tt := range tests {
+		if got := stackChanged(tt.previous, tt.current); got != tt.want {
+			t.Errorf("stackChanged(%q, %q) = %v, want %v", tt.previous, tt.current, got, tt.want)
+		}
+	}
+}
+
+func Test_buildInfoData(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs Config
+		want    string
+	}{
+		{
+			name:    "records the build",
+			configs: Config{GitBranch: "feature/login", GitCommit: "0123abc", WorkflowID: "primary", AppSlug: "app"},
+			want:    `{"branch":"feature/login","commit":"0123abc","workflow":"primary","app_slug":"app","step_version":"dev"}`,
+		},
+		{
+			name:    "omits the unknown fields",
+			configs: Config{WorkflowID: "primary"},
+			want:    `{"workflow":"primary","step_version":"dev"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildInfoData(tt.configs)
+			if err != nil {
+				t.Fatalf("buildInfoData() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("buildInfoData() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+// Step output related functions.
+package main
+
+import (
+	"fmt"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	archiveSizeOutputKey             = "BITRISE_CACHE_ARCHIVE_SIZE"
+	archiveUncompressedSizeOutputKey = "BITRISE_CACHE_ARCHIVE_UNCOMPRESSED_SIZE"
+	archiveCompressionRatioOutputKey = "BITRISE_CACHE_ARCHIVE_COMPRESSION_RATIO"
+	archiveThroughputOutputKey       = "BITRISE_CACHE_ARCHIVE_THROUGHPUT"
+	filesChangedOutputKey            = "BITRISE_CACHE_FILES_CHANGED"
+	filesAddedOutputKey              = "BITRISE_CACHE_FILES_ADDED"
+	filesRemovedOutputKey            = "BITRISE_CACHE_FILES_REMOVED"
+	pushSkippedOutputKey             = "BITRISE_CACHE_PUSH_SKIPPED"
+)
+
+// exportOutput exports the given key-value pair as a step output with envman.
+func exportOutput(key, value string) error {
+	return command.New("envman", "add", "--key", key, "--value", value).Run()
+}
+
+// exportOutputs exports the given step outputs, failures are logged as warnings,
+// since the outputs are informational.
+func exportOutputs(valueByKey map[string]string) {
+	for key, value := range valueByKey {
+		if err := exportOutput(key, value); err != nil {
+			log.Warnf("Failed to export %s: %s", key, err)
+		}
+	}
+}
+
+// exportArchiveReport exports the archive size, compression ratio and throughput as step outputs.
+func exportArchiveReport(report archiveReport) {
+	exportOutputs(map[string]string{
+		archiveSizeOutputKey:             fmt.Sprintf("%d", report.compressed),
+		archiveUncompressedSizeOutputKey: fmt.Sprintf("%d", report.uncompressed),
+		archiveCompressionRatioOutputKey: fmt.Sprintf("%.4f", report.ratio()),
+		archiveThroughputOutputKey:       fmt.Sprintf("%.2f", report.throughput()),
+	})
+}
+
+// exportChangeSummary exports the numbers of the changed, added and removed files of the comparison as step outputs.
+func exportChangeSummary(r result) {
+	exportOutputs(map[string]string{
+		filesChangedOutputKey: fmt.Sprintf("%d", len(r.changed)),
+		filesAddedOutputKey:   fmt.Sprintf("%d", len(r.added)),
+		filesRemovedOutputKey: fmt.Sprintf("%d", len(r.removed)),
+	})
+}
+
+// exportPushSkipped exports whether the step skipped pushing the cache as a step output.
+func exportPushSkipped(skipped bool) {
+	exportOutputs(map[string]string{pushSkippedOutputKey: fmt.Sprintf("%t", skipped)})
+}
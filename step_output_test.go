@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+// fakeEnvman puts an envman on the PATH which records the exported outputs,
+// outputs returns and clears the recorded outputs, restore restores the PATH.
+func fakeEnvman(t *testing.T) (outputs func() map[string]string, restore func()) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("envman")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	outputsPth := filepath.Join(tmpDir, "outputs")
+	// envman add --key KEY --value VALUE
+	script := "#!/bin/sh\necho \"$3=$5\" >> '" + outputsPth + "'\n"
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "envman"), []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write envman: %s", err)
+	}
+
+	path := os.Getenv("PATH")
+	if err := os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+path); err != nil {
+		t.Fatalf("failed to set PATH: %s", err)
+	}
+	restore = func() {
+		if err := os.Setenv("PATH", path); err != nil {
+			t.Fatalf("failed to restore PATH: %s", err)
+		}
+	}
+
+	outputs = func() map[string]string {
+		b, err := ioutil.ReadFile(outputsPth)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("failed to read outputs: %s", err)
+		}
+		outputs := map[string]string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+				outputs[parts[0]] = parts[1]
+			}
+		}
+		if err := os.Remove(outputsPth); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("failed to remove outputs: %s", err)
+		}
+		return outputs
+	}
+	return outputs, restore
+}
+
+func Test_exportChangeSummary(t *testing.T) {
+	outputs, restore := fakeEnvman(t)
+	defer restore()
+
+	exportChangeSummary(result{
+		removed: []string{"/cache/a"},
+		changed: []string{"/cache/b", "/cache/c"},
+		added:   []string{"/cache/d", "/cache/e", "/cache/f"},
+		// The ignored files are not counted.
+		removedIgnored: []string{"/cache/g"},
+		addedIgnored:   []string{"/cache/h"},
+	})
+	want := map[string]string{
+		filesChangedOutputKey: "2",
+		filesAddedOutputKey:   "3",
+		filesRemovedOutputKey: "1",
+	}
+	if got := outputs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("exportChangeSummary() exported %v, want %v", got, want)
+	}
+
+	exportChangeSummary(result{})
+	want = map[string]string{
+		filesChangedOutputKey: "0",
+		filesAddedOutputKey:   "0",
+		filesRemovedOutputKey: "0",
+	}
+	if got := outputs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("exportChangeSummary() of no changes exported %v, want %v", got, want)
+	}
+}
+
+func Test_exportPushSkipped(t *testing.T) {
+	outputs, restore := fakeEnvman(t)
+	defer restore()
+
+	for skipped, value := range map[bool]string{true: "true", false: "false"} {
+		exportPushSkipped(skipped)
+		if got, want := outputs(), map[string]string{pushSkippedOutputKey: value}; !reflect.DeepEqual(got, want) {
+			t.Errorf("exportPushSkipped(%t) exported %v, want %v", skipped, got, want)
+		}
+	}
+}
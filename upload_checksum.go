@@ -0,0 +1,61 @@
+// Upload checksum related models and functions.
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// uploadChecksums reports whether the checksums of the uploaded files are sent, configured by the step inputs.
+var uploadChecksums bool
+
+// contentChecksums are the checksums of an uploaded file, the servers reject the uploads not matching them.
+type contentChecksums struct {
+	md5    []byte
+	sha256 []byte
+}
+
+// loadContentChecksums returns the checksums of the file at pth, or nil if the checksums are not sent.
+// The file is read once before the upload, since the headers are sent before the content;
+// it was just written, so it is usually read from the page cache.
+func loadContentChecksums(pth string) (*contentChecksums, error) {
+	if !uploadChecksums {
+		return nil, nil
+	}
+	return computeContentChecksums(pth)
+}
+
+// computeContentChecksums returns the checksums of the file at pth.
+func computeContentChecksums(pth string) (*contentChecksums, error) {
+	file, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warnf("Failed to close file (%s): %s", pth, err)
+		}
+	}()
+
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), file); err != nil {
+		return nil, fmt.Errorf("failed to read file (%s): %s", pth, err)
+	}
+	return &contentChecksums{md5: md5Hash.Sum(nil), sha256: sha256Hash.Sum(nil)}, nil
+}
+
+// setContentMD5 sets the Content-MD5 header, which is verified by S3, Google Cloud Storage and Azure Blob Storage.
+// The receiver may be nil, in this case no header is set.
+func (c *contentChecksums) setContentMD5(header http.Header) {
+	if c != nil {
+		header.Set("Content-MD5", base64.StdEncoding.EncodeToString(c.md5))
+	}
+}
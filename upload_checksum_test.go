@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_uploadHTTPFile_checksums(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	pth := filepath.Join(tmpDir, "cache-archive.tar")
+	createDirStruct(t, map[string]string{pth: "archive"})
+
+	defer func(checksums bool) {
+		uploadChecksums = checksums
+	}(uploadChecksums)
+
+	tests := []struct {
+		name       string
+		checksums  bool
+		wantMD5    string
+		wantSHA256 string
+	}{
+		{name: "without checksums"},
+		{
+			name:       "with checksums",
+			checksums:  true,
+			wantMD5:    "iI0O42GvNgNzbzITHnsgog==",
+			wantSHA256: "0eb3e36bfb24dcd9bb1d1bece1531216b59539a8fde17ee80224af0653c92aa3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploadChecksums = tt.checksums
+
+			var md5, sha256 string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				md5, sha256 = r.Header.Get("Content-MD5"), r.Header.Get("X-Checksum-Sha256")
+			}))
+			defer server.Close()
+
+			if err := uploadHTTPFile(pth, httpDestinationURL(server.URL)); err != nil {
+				t.Fatalf("uploadHTTPFile() error = %v", err)
+			}
+			if md5 != tt.wantMD5 || sha256 != tt.wantSHA256 {
+				t.Errorf("uploadHTTPFile() sent Content-MD5 %q and X-Checksum-Sha256 %q, want %q and %q", md5, sha256, tt.wantMD5, tt.wantSHA256)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+// Upload HTTP client related models and functions.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// uploadTimeouts describes how long the upload connections may stall, 0 disables a timeout.
+type uploadTimeouts struct {
+	// connect limits establishing the connection, including the TLS handshake.
+	connect time.Duration
+	// read limits the wait for the response after the request is written.
+	read time.Duration
+	// write limits each write to the connection, so a stalled upload fails while a slow but progressing one continues.
+	write time.Duration
+}
+
+// uploadTransportOptions describes the transport of the upload requests.
+type uploadTransportOptions struct {
+	timeouts uploadTimeouts
+	// proxy is the proxy of the requests, if it is nil the proxy is configured by the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	// environment variables, otherwise the requests are sent through proxy, except the ones to the hosts of NO_PROXY.
+	proxy *neturl.URL
+	// http2 enables HTTP/2 with the servers supporting it, the parallel uploads share a single connection per host.
+	http2 bool
+	// keepAlive reuses the connections across the requests, for example the parts of a multipart upload.
+	keepAlive bool
+	// writeBufferSize is the size of the write buffer of the HTTP/1 connections in bytes, 0 is the default of 4KB.
+	writeBufferSize int
+	// maxIdleConnsPerHost is how many idle connections are kept for reuse per host, 0 is the default of 2.
+	maxIdleConnsPerHost int
+}
+
+// uploadTransport is the transport of the upload requests, configured by the step inputs.
+var uploadTransport = newUploadTransport(uploadTransportOptions{http2: true, keepAlive: true})
+
+// newUploadTransport returns a transport with the given options.
+func newUploadTransport(options uploadTransportOptions) *http.Transport {
+	timeouts, proxy := options.timeouts, options.proxy
+	dialer := &net.Dialer{Timeout: timeouts.connect, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if timeouts.write == 0 {
+			return conn, nil
+		}
+		return &deadlineConn{Conn: conn, write: timeouts.write}, nil
+	}
+	transport.TLSHandshakeTimeout = timeouts.connect
+	transport.ResponseHeaderTimeout = timeouts.read
+	transport.DisableKeepAlives = !options.keepAlive
+	transport.WriteBufferSize = options.writeBufferSize
+	transport.MaxIdleConnsPerHost = options.maxIdleConnsPerHost
+	if !options.http2 {
+		// A non-nil empty map disables HTTP/2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if proxy != nil {
+		noProxy := getenvAnyCase("NO_PROXY")
+		transport.Proxy = func(req *http.Request) (*neturl.URL, error) {
+			if matchNoProxy(noProxy, req.URL) {
+				return nil, nil
+			}
+			return proxy, nil
+		}
+	}
+	return transport
+}
+
+// parseProxyURL returns the url of the proxy of the upload requests, authenticated with user and password if user is not empty.
+// The transport sends the credentials in the Proxy-Authorization header, also when tunneling HTTPS requests.
+func parseProxyURL(rawURL, user, password string) (*neturl.URL, error) {
+	proxy, err := neturl.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proxy url: %s", err)
+	}
+	if proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5" {
+		return nil, fmt.Errorf("proxy url should have http, https or socks5 scheme, got: %s", proxy.Scheme)
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("proxy url requires a host")
+	}
+	if user != "" {
+		proxy.User = neturl.UserPassword(user, password)
+	}
+	return proxy, nil
+}
+
+// getenvAnyCase returns the environment variable of the given upper case name, or of its lower case name if it is not set.
+func getenvAnyCase(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// matchNoProxy reports whether the host of u matches the comma separated NO_PROXY list:
+// "*" matches every host, the IP addresses and the CIDR ranges match the IP hosts,
+// the domains (optionally with a leading ".") match the domain and its subdomains, and the entries with a port match only that port.
+func matchNoProxy(noProxy string, u *neturl.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && ipNet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		domain := strings.TrimPrefix(entryHost, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadHTTPClient returns the client of the upload requests.
+func uploadHTTPClient() *http.Client {
+	return &http.Client{Transport: uploadTransport}
+}
+
+// deadlineConn extends the write deadline of the connection before each write, failing the writes which do not make progress in time.
+// The reads have no deadline: the transport reads the connection while the request is written,
+// the wait for the response is limited by the ResponseHeaderTimeout of the transport instead.
+type deadlineConn struct {
+	net.Conn
+	write time.Duration
+}
+
+// Write writes to the connection within the write timeout.
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.write)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,117 @@
+// Upload progress related models and functions.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// progressBarWidth is the number of the characters of the progress bar.
+const progressBarWidth = 30
+
+// progressOptions describes how the progress of the uploads is reported, configured by the step inputs.
+type progressOptions struct {
+	// interval is the time between the progress reports, 0 disables the reports.
+	interval time.Duration
+	// bar renders the progress as a bar rewritten in place instead of log lines.
+	bar bool
+}
+
+// uploadProgress is the progress reporting of the uploads.
+var uploadProgress progressOptions
+
+// progressOutput is where the progress is reported.
+var progressOutput io.Writer = os.Stdout
+
+// progressMu serializes the progress reports of the parallel uploads.
+var progressMu sync.Mutex
+
+// isTerminal reports whether the file is a terminal, the progress bar is only rendered on terminals.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressReader reports the progress of the upload reading reader, total is the size of the upload or 0 if it is unknown.
+type progressReader struct {
+	reader     io.Reader
+	name       string
+	total      int64
+	n          int64
+	start      time.Time
+	lastReport time.Time
+	done       bool
+}
+
+// newProgressReader returns a reader reporting the progress of the upload of the file at pth read from reader,
+// or reader itself if the progress is not reported.
+func newProgressReader(reader io.Reader, pth string, total int64) io.Reader {
+	if uploadProgress.interval <= 0 {
+		return reader
+	}
+	now := time.Now()
+	return &progressReader{reader: reader, name: filepath.Base(pth), total: total, start: now, lastReport: now}
+}
+
+// Read reads from the underlying reader, reporting the progress once per interval and at the end of the upload.
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.n += int64(n)
+
+	end := err == io.EOF || (r.total > 0 && r.n >= r.total)
+	if end && !r.done {
+		r.done = true
+		r.report(true)
+	} else if !end && time.Since(r.lastReport) >= uploadProgress.interval {
+		r.lastReport = time.Now()
+		r.report(false)
+	}
+	return n, err
+}
+
+// report writes a progress report: the uploaded size, the percentage, the throughput and the estimated remaining time.
+func (r *progressReader) report(end bool) {
+	elapsed := time.Since(r.start)
+	mb := float64(r.n) / 1024.0 / 1024.0
+	var throughput float64
+	if elapsed > 0 {
+		throughput = mb / elapsed.Seconds()
+	}
+
+	var line string
+	if r.total > 0 {
+		ratio := float64(r.n) / float64(r.total)
+		var eta time.Duration
+		if r.n > 0 && !end {
+			eta = time.Duration(float64(elapsed) / ratio * (1 - ratio)).Round(time.Second)
+		}
+		line = fmt.Sprintf("%s: %.1f / %.1f MB (%.0f%%), %.2f MB/s, ETA %s", r.name, mb, float64(r.total)/1024.0/1024.0, ratio*100, throughput, eta)
+		if uploadProgress.bar {
+			filled := int(ratio * progressBarWidth)
+			if filled > progressBarWidth {
+				filled = progressBarWidth
+			}
+			line = "[" + strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled) + "] " + line
+		}
+	} else {
+		line = fmt.Sprintf("%s: %.1f MB, %.2f MB/s", r.name, mb, throughput)
+	}
+
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	if !uploadProgress.bar {
+		log.Printf("Uploading %s", line)
+	} else if end {
+		// Clears the rest of the previous line, and keeps the final state of the bar.
+		fmt.Fprintf(progressOutput, "\r%s\033[K\n", line)
+	} else {
+		fmt.Fprintf(progressOutput, "\r%s\033[K", line)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_progressReader(t *testing.T) {
+	defer func(options progressOptions, output io.Writer) {
+		uploadProgress, progressOutput = options, output
+	}(uploadProgress, progressOutput)
+
+	tests := []struct {
+		name  string
+		total int64
+		want  string
+	}{
+		{name: "known size", total: 1024 * 1024, want: "\r[==============================] cache-archive.tar: 1.0 / 1.0 MB (100%)"},
+		{name: "unknown size", want: "\rcache-archive.tar: 1.0 MB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			uploadProgress, progressOutput = progressOptions{interval: time.Hour, bar: true}, &output
+
+			reader := newProgressReader(strings.NewReader(strings.Repeat("a", 1024*1024)), "/tmp/cache-archive.tar", tt.total)
+			if _, err := ioutil.ReadAll(reader); err != nil {
+				t.Fatalf("failed to read: %s", err)
+			}
+
+			// Only the final report is written, the interval is not reached.
+			if got := output.String(); !strings.HasPrefix(got, tt.want) || strings.Count(got, "\r") != 1 || !strings.HasSuffix(got, "\n") {
+				t.Errorf("progress = %q, want a single report starting with %q", got, tt.want)
+			}
+		})
+	}
+
+	uploadProgress = progressOptions{}
+	if reader := strings.NewReader(""); newProgressReader(reader, "/tmp/cache-archive.tar", 0) != reader {
+		t.Errorf("newProgressReader() wrapped the reader with disabled progress")
+	}
+}
@@ -0,0 +1,95 @@
+// Upload retry related models and functions.
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// uploadMaxRetryWait caps the exponential backoff between the upload attempts.
+const uploadMaxRetryWait = time.Minute
+
+// retryPolicy describes how many times and how long apart the failed uploads are retried.
+type retryPolicy struct {
+	retries int
+	// wait is the backoff before the first retry, doubled before each subsequent retry.
+	wait time.Duration
+}
+
+// uploadRetryPolicy is the retry policy of the uploads, configured by the step inputs.
+var uploadRetryPolicy = retryPolicy{retries: 3, wait: 3 * time.Second}
+
+// uploadError describes a failed upload request:
+// retryable reports whether retrying the request may succeed, for example after a connection reset or a 5xx response,
+// expired reports whether the upload url was rejected, the retry requests a fresh upload url,
+// statusCode is the status code of the rejected request, or 0 if no response was received.
+type uploadError struct {
+	err        error
+	retryable  bool
+	expired    bool
+	statusCode int
+}
+
+func (e *uploadError) Error() string {
+	return e.err.Error()
+}
+
+// newRequestError returns the uploadError of a request which failed to be sent or to receive the response,
+// the transient network errors are retried.
+func newRequestError(format string, err error) error {
+	return &uploadError{err: fmt.Errorf(format, err), retryable: true}
+}
+
+// newStatusError returns the uploadError of a request rejected with the given status code,
+// the 5xx and 429 (too many requests) status codes are retried, 403 is returned by expired presigned urls.
+func newStatusError(format string, statusCode int) error {
+	return &uploadError{
+		err:        fmt.Errorf(format, statusCode),
+		retryable:  statusCode >= 500 || statusCode == http.StatusTooManyRequests || statusCode == http.StatusForbidden,
+		expired:    statusCode == http.StatusForbidden,
+		statusCode: statusCode,
+	}
+}
+
+// isNotFoundError reports whether err is the uploadError of a request rejected with 404.
+func isNotFoundError(err error) bool {
+	uploadErr, ok := err.(*uploadError)
+	return ok && uploadErr.statusCode == http.StatusNotFound
+}
+
+// backoff returns the wait before the given retry (starting from 1): the exponential backoff with jitter,
+// randomly between the half and the whole of the backoff, so that concurrent uploads do not retry at once.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	wait := p.wait
+	for i := 1; i < retry && wait < uploadMaxRetryWait; i++ {
+		wait *= 2
+	}
+	if wait > uploadMaxRetryWait {
+		wait = uploadMaxRetryWait
+	}
+	if wait/2 == 0 {
+		return wait
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)))
+}
+
+// do calls fn until it succeeds, it returns an error which is not retryable, or the retries run out.
+func (p retryPolicy) do(fn func() error) error {
+	for retry := 1; ; retry++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if uploadErr, ok := err.(*uploadError); !ok || !uploadErr.retryable || retry > p.retries {
+			return err
+		}
+
+		wait := p.backoff(retry)
+		log.Warnf("Upload attempt failed, retrying (%d/%d) in %s: %s", retry, p.retries, wait, err)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_retryPolicy_backoff(t *testing.T) {
+	policy := retryPolicy{retries: 10, wait: time.Second}
+
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{retry: 1, want: time.Second},
+		{retry: 3, want: 4 * time.Second},
+		{retry: 10, want: uploadMaxRetryWait},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("retry %d", tt.retry), func(t *testing.T) {
+			if got := policy.backoff(tt.retry); got < tt.want/2 || got > tt.want {
+				t.Errorf("backoff() = %s, want between %s and %s", got, tt.want/2, tt.want)
+			}
+		})
+	}
+}
+
+func Test_uploadArchiveFile_retry(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	pth := filepath.Join(tmpDir, "cache-archive.tar")
+	createDirStruct(t, map[string]string{pth: "archive"})
+
+	policy := uploadRetryPolicy
+	uploadRetryPolicy = retryPolicy{retries: 2, wait: time.Millisecond}
+	defer func() {
+		uploadRetryPolicy = policy
+	}()
+
+	tests := []struct {
+		name         string
+		statusCodes  []int
+		wantErr      bool
+		wantUploads  int
+		wantURLCalls int
+	}{
+		{name: "success", statusCodes: []int{http.StatusOK}, wantUploads: 1, wantURLCalls: 1},
+		{name: "server error", statusCodes: []int{http.StatusBadGateway, http.StatusOK}, wantUploads: 2, wantURLCalls: 1},
+		{name: "expired url", statusCodes: []int{http.StatusForbidden, http.StatusOK}, wantUploads: 2, wantURLCalls: 2},
+		{name: "bad request", statusCodes: []int{http.StatusBadRequest}, wantErr: true, wantUploads: 1, wantURLCalls: 1},
+		{name: "retries run out", statusCodes: []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK}, wantErr: true, wantUploads: 3, wantURLCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var uploads, urlCalls int
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPost {
+					urlCalls++
+					fmt.Fprintf(w, `{"upload_url": "%s/upload"}`, server.URL)
+					return
+				}
+				w.WriteHeader(tt.statusCodes[uploads])
+				uploads++
+			}))
+			defer server.Close()
+
+			if err := uploadArchiveFile(pth, server.URL); (err != nil) != tt.wantErr {
+				t.Errorf("uploadArchiveFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if uploads != tt.wantUploads || urlCalls != tt.wantURLCalls {
+				t.Errorf("uploadArchiveFile() uploaded %d times with %d upload urls, want %d times with %d upload urls", uploads, urlCalls, tt.wantUploads, tt.wantURLCalls)
+			}
+		})
+	}
+}
+
+func Test_getCacheUploadURL_sizeRejected(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprint(w, `{"error_msg": "cache size limit of the plan is 2GB"}`)
+	}))
+	defer server.Close()
+
+	policy := uploadRetryPolicy
+	uploadRetryPolicy = retryPolicy{retries: 2, wait: time.Millisecond}
+	defer func() {
+		uploadRetryPolicy = policy
+	}()
+
+	err := uploadRetryPolicy.do(func() error {
+		_, err := getCacheUploadURL(server.URL, 4*1024*1024*1024)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "cache size limit of the plan is 2GB") || !strings.Contains(err.Error(), "4096.00 MB") {
+		t.Errorf("getCacheUploadURL() error = %v, want the size and the message of the cache API", err)
+	}
+	if requests != 1 {
+		t.Errorf("getCacheUploadURL() sent %d requests, want the rejected size not retried", requests)
+	}
+}
+
+func Test_getCacheUploadURL_ttl(t *testing.T) {
+	defer func(ttl int) {
+		uploadTTLDays = ttl
+	}(uploadTTLDays)
+
+	tests := []struct {
+		ttl  int
+		want string
+	}{
+		{ttl: 0, want: `{"file_size_in_bytes":1024}`},
+		{ttl: 7, want: `{"file_size_in_bytes":1024,"ttl_in_days":7}`},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("ttl %d", tt.ttl), func(t *testing.T) {
+			uploadTTLDays = tt.ttl
+
+			var body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				body = string(b)
+				fmt.Fprint(w, `{"upload_url": "https://storage.example.com/upload"}`)
+			}))
+			defer server.Close()
+
+			if _, err := getCacheUploadURL(server.URL, 1024); err != nil {
+				t.Fatalf("getCacheUploadURL() error = %v", err)
+			}
+			if body != tt.want {
+				t.Errorf("getCacheUploadURL() sent %s, want %s", body, tt.want)
+			}
+		})
+	}
+}
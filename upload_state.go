@@ -0,0 +1,107 @@
+// Resumable upload related models and functions.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+// uploadState records the files uploaded to the cache, so that an interrupted upload skips them when the step is run again.
+// The files are identified by their checksum, the files written again with a different content are uploaded again.
+type uploadState struct {
+	// URL is the cache API URL the files were uploaded to, the state is discarded if it changes.
+	URL string `json:"url"`
+	// Uploaded lists the hex encoded SHA256 checksums of the uploaded files.
+	Uploaded map[string]bool `json:"uploaded"`
+
+	pth string
+	mu  sync.Mutex
+}
+
+// loadUploadState reads the upload state at pth of the uploads to url,
+// returns an empty state if it does not exist or belongs to another url.
+func loadUploadState(pth, url string) *uploadState {
+	state := &uploadState{URL: url, Uploaded: map[string]bool{}, pth: pth}
+
+	if exists, err := pathutil.IsPathExists(pth); err != nil || !exists {
+		return state
+	}
+	b, err := fileutil.ReadBytesFromFile(pth)
+	if err != nil {
+		log.Warnf("Failed to read upload state, uploading every file: %s", err)
+		return state
+	}
+
+	var previous uploadState
+	if err := json.Unmarshal(b, &previous); err != nil {
+		log.Warnf("Failed to parse upload state, uploading every file: %s", err)
+		return state
+	}
+	if previous.URL == url && previous.Uploaded != nil {
+		state.Uploaded = previous.Uploaded
+		log.Printf("Resuming upload, %d files are already uploaded", len(state.Uploaded))
+	}
+	return state
+}
+
+// isUploaded reports whether the file with the given checksum is already uploaded, always false if the state is nil.
+func (s *uploadState) isUploaded(sum string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Uploaded[sum]
+}
+
+// markUploaded records the file with the given checksum as uploaded and writes the state, no-op if the state is nil.
+func (s *uploadState) markUploaded(sum string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Uploaded[sum] = true
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteBytesToFile(s.pth, b)
+}
+
+// clear removes the state after every file is uploaded, no-op if the state is nil.
+func (s *uploadState) clear() error {
+	if s == nil {
+		return nil
+	}
+	return os.RemoveAll(s.pth)
+}
+
+// uploadFileChecksum returns the hex encoded SHA256 checksum of the file at pth, identifying it in the upload state.
+func uploadFileChecksum(pth string) (string, error) {
+	file, err := os.Open(pth)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warnf("Failed to close file (%s): %s", pth, err)
+		}
+	}()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read file (%s): %s", pth, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,145 @@
+// Archive volume related models and functions.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// volumeManifestSuffix is appended to the archive path to get the path of the volume manifest.
+const volumeManifestSuffix = ".manifest.json"
+
+// volume describes a volume of a split archive.
+type volume struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// volumeManifest lists the volumes of a split archive, concatenating the volumes in order restores the archive.
+type volumeManifest struct {
+	Volumes []volume `json:"volumes"`
+	Size    int64    `json:"size"`
+}
+
+// volumePath returns the path of the volume with the given index: the archive path suffixed with .000, .001, ...
+func volumePath(pth string, index int) string {
+	return fmt.Sprintf("%s.%03d", pth, index)
+}
+
+// volumeWriter splits the written archive into volumes of at most size bytes,
+// and writes the volume manifest on Close.
+type volumeWriter struct {
+	pth     string
+	size    int64
+	file    *os.File
+	written int64
+	volumes []volume
+}
+
+func newVolumeWriter(pth string, size int64) *volumeWriter {
+	return &volumeWriter{
+		pth:  pth,
+		size: size,
+	}
+}
+
+// Write writes b into the current volume, starting a new volume if the current one is full.
+func (w *volumeWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if w.file == nil || w.written == w.size {
+			if err := w.nextVolume(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := b
+		if free := w.size - w.written; int64(len(chunk)) > free {
+			chunk = chunk[:free]
+		}
+
+		n, err := w.file.Write(chunk)
+		written += n
+		w.written += int64(n)
+		w.volumes[len(w.volumes)-1].Size += int64(n)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// nextVolume closes the current volume and creates the next one.
+func (w *volumeWriter) nextVolume() error {
+	if err := w.closeVolume(); err != nil {
+		return err
+	}
+
+	pth := volumePath(w.pth, len(w.volumes))
+	file, err := os.Create(pth)
+	if err != nil {
+		return fmt.Errorf("failed to create volume (%s): %s", pth, err)
+	}
+
+	w.file = file
+	w.written = 0
+	w.volumes = append(w.volumes, volume{Path: pth})
+	return nil
+}
+
+// closeVolume closes the current volume if any.
+func (w *volumeWriter) closeVolume() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// manifestPath returns the path of the volume manifest.
+func (w *volumeWriter) manifestPath() string {
+	return w.pth + volumeManifestSuffix
+}
+
+// Close closes the last volume and writes the volume manifest.
+func (w *volumeWriter) Close() error {
+	if err := w.closeVolume(); err != nil {
+		return err
+	}
+
+	manifest := volumeManifest{Volumes: w.volumes}
+	for _, volume := range w.volumes {
+		manifest.Size += volume.Size
+	}
+
+	b, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteBytesToFile(w.manifestPath(), b)
+}
+
+// uploadVolumes uploads the volumes written by the given writer with at most parallel concurrent uploads, then the volume manifest,
+// so that the manifest is only uploaded if all of the volumes are.
+func uploadVolumes(writer *volumeWriter, url string, parallel int, state *uploadState) error {
+	var pths []string
+	for _, volume := range writer.volumes {
+		pths = append(pths, volume.Path)
+	}
+	if err := uploadFiles("volume", pths, url, parallel, state, log.Printf); err != nil {
+		return err
+	}
+
+	log.Printf("Uploading volume manifest: %s", writer.manifestPath())
+	if err := uploadArchiveFile(writer.manifestPath(), url); err != nil {
+		return fmt.Errorf("failed to upload volume manifest: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+func Test_volumeWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int64
+		contentSize int
+		wantVolumes int
+	}{
+		{name: "single volume", size: 100, contentSize: 10, wantVolumes: 1},
+		{name: "exactly full volumes", size: 10, contentSize: 30, wantVolumes: 3},
+		{name: "partial last volume", size: 10, contentSize: 35, wantVolumes: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+			if err != nil {
+				t.Fatalf("failed to create tmp dir: %s", err)
+			}
+
+			content := bytes.Repeat([]byte("0123456789"), tt.contentSize/10+1)[:tt.contentSize]
+			writer := newVolumeWriter(filepath.Join(tmpDir, "cache-archive.tar"), tt.size)
+			// Write in chunks crossing the volume boundaries.
+			for _, chunk := range [][]byte{content[:tt.contentSize/3], content[tt.contentSize/3:]} {
+				if _, err := writer.Write(chunk); err != nil {
+					t.Fatalf("failed to write: %s", err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("failed to close: %s", err)
+			}
+
+			b, err := fileutil.ReadBytesFromFile(writer.manifestPath())
+			if err != nil {
+				t.Fatalf("failed to read manifest: %s", err)
+			}
+			var manifest volumeManifest
+			if err := json.Unmarshal(b, &manifest); err != nil {
+				t.Fatalf("failed to unmarshal manifest: %s", err)
+			}
+
+			if len(manifest.Volumes) != tt.wantVolumes {
+				t.Fatalf("number of volumes = %d, want %d", len(manifest.Volumes), tt.wantVolumes)
+			}
+			if manifest.Size != int64(tt.contentSize) {
+				t.Errorf("manifest size = %d, want %d", manifest.Size, tt.contentSize)
+			}
+
+			var joined []byte
+			for i, volume := range manifest.Volumes {
+				if volume.Path != volumePath(writer.pth, i) {
+					t.Errorf("volume path = %s, want %s", volume.Path, volumePath(writer.pth, i))
+				}
+				b, err := ioutil.ReadFile(volume.Path)
+				if err != nil {
+					t.Fatalf("failed to read volume: %s", err)
+				}
+				if int64(len(b)) != volume.Size || volume.Size > tt.size {
+					t.Errorf("volume size = %d, recorded %d, max %d", len(b), volume.Size, tt.size)
+				}
+				joined = append(joined, b...)
+			}
+			if !bytes.Equal(joined, content) {
+				t.Errorf("joined volumes do not match the written content")
+			}
+		})
+	}
+}
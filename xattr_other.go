@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+// readXattrs returns the extended attributes of the file at pth, extended attributes are not supported on this platform.
+func readXattrs(pth string) (map[string]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of the file at pth, without following symlinks.
+// Returns nil if the file system does not support extended attributes.
+func readXattrs(pth string) (map[string]string, error) {
+	size, err := unix.Llistxattr(pth, nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(pth, names)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		size, err := unix.Lgetxattr(pth, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(pth, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = string(value[:size])
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,55 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestArchive_xattrs(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pth := filepath.Join(tmpDir, "Framework.framework", "Framework")
+	createDirStruct(t, map[string]string{pth: "binary"})
+	if err := unix.Setxattr(pth, "user.test", []byte("value\x00binary"), 0); err != nil {
+		t.Skipf("the file system does not support extended attributes: %s", err)
+	}
+
+	for _, preserve := range []bool{true, false} {
+		var writer bufferWriteCloser
+		archive, err := NewArchive(&writer, TAR, Compression{Method: NONE})
+		if err != nil {
+			t.Fatalf("failed to create archive: %s", err)
+		}
+		archive.xattrs = preserve
+
+		if err := archive.Write([]string{pth}, false); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		if err := archive.Close(); err != nil {
+			t.Fatalf("failed to close archive: %s", err)
+		}
+
+		header, err := tar.NewReader(&writer).Next()
+		if err != nil {
+			t.Fatalf("failed to read header: %s", err)
+		}
+
+		value, ok := header.PAXRecords[paxXattrPrefix+"user.test"]
+		if preserve && value != "value\x00binary" {
+			t.Errorf("xattr record = %q, want %q", value, "value\x00binary")
+		}
+		if !preserve && ok {
+			t.Errorf("xattr record stored without preserving extended attributes")
+		}
+	}
+}
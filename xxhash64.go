@@ -0,0 +1,144 @@
+// xxHash64 related models and functions.
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// The primes of xxHash64.
+const (
+	xxh64Prime1 uint64 = 11400714785074694791
+	xxh64Prime2 uint64 = 14029467366897019727
+	xxh64Prime3 uint64 = 1609587929392839161
+	xxh64Prime4 uint64 = 9650029242287828579
+	xxh64Prime5 uint64 = 2870177450012600261
+)
+
+// xxh64 computes the xxHash64 (seed 0) of the written data, which is not cryptographic,
+// but several times faster than MD5 and distributed well enough to detect the changes of the files.
+type xxh64 struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	// buf holds the written data not processed yet, n is its length.
+	buf [32]byte
+	n   int
+}
+
+// newXXH64 returns a hash.Hash computing the xxHash64 of the written data.
+func newXXH64() hash.Hash {
+	h := &xxh64{}
+	h.Reset()
+	return h
+}
+
+// xxh64Round mixes 8 bytes of input into the accumulator.
+func xxh64Round(acc, input uint64) uint64 {
+	acc += input * xxh64Prime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxh64Prime1
+}
+
+// xxh64MergeRound merges an accumulator into the hash of an input of at least 32 bytes.
+func xxh64MergeRound(h, acc uint64) uint64 {
+	h ^= xxh64Round(0, acc)
+	return h*xxh64Prime1 + xxh64Prime4
+}
+
+// Reset resets the hash to its initial state.
+func (h *xxh64) Reset() {
+	// The initial accumulators wrap around, which the constant expressions can not.
+	prime1, prime2 := xxh64Prime1, xxh64Prime2
+	h.v1 = prime1 + prime2
+	h.v2 = prime2
+	h.v3 = 0
+	h.v4 = -prime1
+	h.total = 0
+	h.n = 0
+}
+
+// Size returns the number of bytes of the sum.
+func (h *xxh64) Size() int {
+	return 8
+}
+
+// BlockSize returns the size of the stripes the input is processed in.
+func (h *xxh64) BlockSize() int {
+	return 32
+}
+
+// Write processes every complete stripe of 32 bytes, buffering the rest.
+func (h *xxh64) Write(b []byte) (int, error) {
+	n := len(b)
+	h.total += uint64(n)
+
+	if h.n+len(b) < 32 {
+		h.n += copy(h.buf[h.n:], b)
+		return n, nil
+	}
+
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], b)
+		h.stripe(h.buf[:])
+		b = b[c:]
+		h.n = 0
+	}
+	for ; len(b) >= 32; b = b[32:] {
+		h.stripe(b)
+	}
+	h.n = copy(h.buf[:], b)
+	return n, nil
+}
+
+// stripe processes the first 32 bytes of b.
+func (h *xxh64) stripe(b []byte) {
+	h.v1 = xxh64Round(h.v1, binary.LittleEndian.Uint64(b[0:8]))
+	h.v2 = xxh64Round(h.v2, binary.LittleEndian.Uint64(b[8:16]))
+	h.v3 = xxh64Round(h.v3, binary.LittleEndian.Uint64(b[16:24]))
+	h.v4 = xxh64Round(h.v4, binary.LittleEndian.Uint64(b[24:32]))
+}
+
+// Sum64 returns the hash of the written data.
+func (h *xxh64) Sum64() uint64 {
+	var sum uint64
+	if h.total >= 32 {
+		sum = bits.RotateLeft64(h.v1, 1) + bits.RotateLeft64(h.v2, 7) + bits.RotateLeft64(h.v3, 12) + bits.RotateLeft64(h.v4, 18)
+		sum = xxh64MergeRound(sum, h.v1)
+		sum = xxh64MergeRound(sum, h.v2)
+		sum = xxh64MergeRound(sum, h.v3)
+		sum = xxh64MergeRound(sum, h.v4)
+	} else {
+		sum = h.v3 + xxh64Prime5
+	}
+	sum += h.total
+
+	b := h.buf[:h.n]
+	for ; len(b) >= 8; b = b[8:] {
+		sum ^= xxh64Round(0, binary.LittleEndian.Uint64(b))
+		sum = bits.RotateLeft64(sum, 27)*xxh64Prime1 + xxh64Prime4
+	}
+	if len(b) >= 4 {
+		sum ^= uint64(binary.LittleEndian.Uint32(b)) * xxh64Prime1
+		sum = bits.RotateLeft64(sum, 23)*xxh64Prime2 + xxh64Prime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		sum ^= uint64(c) * xxh64Prime5
+		sum = bits.RotateLeft64(sum, 11) * xxh64Prime1
+	}
+
+	sum ^= sum >> 33
+	sum *= xxh64Prime2
+	sum ^= sum >> 29
+	sum *= xxh64Prime3
+	sum ^= sum >> 32
+	return sum
+}
+
+// Sum appends the big-endian hash of the written data to b, as the canonical representation of xxHash64.
+func (h *xxh64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.Sum64())
+	return append(b, sum[:]...)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func Test_xxh64(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "empty", input: "", want: "ef46db3751d8e999"},
+		{name: "shorter than a stripe", input: "abc", want: "44bc2cf5ad770999"},
+		{name: "stripes", input: "Nobody inspects the spammish repetition", want: "fbcea83c8a378bf1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newXXH64()
+			// Written in pieces crossing the stripes, the sum does not depend on the writes.
+			for _, piece := range strings.SplitAfter(tt.input, " ") {
+				if _, err := h.Write([]byte(piece)); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+				t.Errorf("Sum() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// Zstd frame writer related models and functions.
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// seekableMaxFrameSize is the maximum uncompressed size of a frame in seekable archives,
+	// larger entries are split into multiple frames.
+	seekableMaxFrameSize = 64 << 20
+
+	skippableFrameMagic  = 0x184D2A5E
+	seekableMagic        = 0x8F92EAB1
+	seekTableEntrySize   = 8
+	seekTableFooterSize  = 9
+	skippableHeaderSize  = 8
+	seekTableDescriptor  = 0 // no frame checksums
+	maxFrameSizeInUint32 = 1<<32 - 1
+
+	zstdFrameMagic = 0xFD2FB528
+	// zstdRawFrameDescriptor describes a frame without content size, checksum and dictionary.
+	zstdRawFrameDescriptor = 0x00
+	// zstdRawWindowDescriptor describes a 128KB window, the maximum block size.
+	zstdRawWindowDescriptor = 0x38
+	zstdMaxBlockSize        = 128 * 1024
+	zstdRawBlockType        = 0
+)
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.writer.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// frameWriter is a compressing writer which can end the current frame (or member) of its stream,
+// so that the subsequent writes are compressed independently, or stored without compression.
+type frameWriter interface {
+	io.WriteCloser
+	// nextFrame ends the current frame, the next write starts a new one, stored without compression if store is set.
+	nextFrame(store bool) error
+	// setLevel sets the compression level of the frames started by the subsequent nextFrame calls.
+	setLevel(level int)
+}
+
+// seekableFrame stores the compressed and decompressed size of a zstd frame.
+type seekableFrame struct {
+	compressed   int64
+	decompressed int64
+}
+
+// zstdFrameWriter writes a zstd stream as a sequence of frames,
+// each frame is either compressed or stored in raw blocks.
+//
+// In seekable mode the writer appends a seek table in the zstd seekable format to the end of the stream on Close:
+// https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+// The output remains a valid zstd stream, since decoders skip the seek table's skippable frame.
+type zstdFrameWriter struct {
+	writer   *countingWriter
+	encoder  *zstd.Encoder
+	options  []zstd.EOption
+	seekable bool
+	store    bool
+	// level is the zstd.EncoderLevel of the frames started by the next nextFrame call, 0 if unchanged.
+	level zstd.EncoderLevel
+	// block buffers the current raw block of a stored frame.
+	block      []byte
+	frames     []seekableFrame
+	frameStart int64
+	frameSize  int64
+}
+
+func newZstdFrameWriter(writer io.Writer, seekable bool, options ...zstd.EOption) (*zstdFrameWriter, error) {
+	counter := &countingWriter{writer: writer}
+	encoder, err := zstd.NewWriter(counter, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdFrameWriter{
+		writer:   counter,
+		encoder:  encoder,
+		options:  options,
+		seekable: seekable,
+	}, nil
+}
+
+// Write writes b into the current frame, in seekable mode starting a new frame if the current one is full.
+func (w *zstdFrameWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if w.seekable && w.frameSize == seekableMaxFrameSize {
+			if err := w.endFrame(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := b
+		if free := seekableMaxFrameSize - w.frameSize; w.seekable && int64(len(chunk)) > free {
+			chunk = chunk[:free]
+		}
+
+		var n int
+		var err error
+		if w.store {
+			n, err = w.writeRaw(chunk)
+		} else {
+			n, err = w.encoder.Write(chunk)
+		}
+		written += n
+		w.frameSize += int64(n)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// writeRaw buffers b into raw blocks of the current stored frame.
+func (w *zstdFrameWriter) writeRaw(b []byte) (int, error) {
+	if w.frameSize == 0 {
+		header := make([]byte, 6)
+		binary.LittleEndian.PutUint32(header, zstdFrameMagic)
+		header[4] = zstdRawFrameDescriptor
+		header[5] = zstdRawWindowDescriptor
+		if _, err := w.writer.Write(header); err != nil {
+			return 0, err
+		}
+	}
+
+	w.block = append(w.block, b...)
+	for len(w.block) > zstdMaxBlockSize {
+		if err := w.writeRawBlock(w.block[:zstdMaxBlockSize], false); err != nil {
+			return 0, err
+		}
+		w.block = w.block[zstdMaxBlockSize:]
+	}
+	return len(b), nil
+}
+
+// writeRawBlock writes a raw block with its block header.
+func (w *zstdFrameWriter) writeRawBlock(block []byte, last bool) error {
+	header := uint32(len(block))<<3 | zstdRawBlockType<<1
+	if last {
+		header |= 1
+	}
+
+	if _, err := w.writer.Write([]byte{byte(header), byte(header >> 8), byte(header >> 16)}); err != nil {
+		return err
+	}
+	_, err := w.writer.Write(block)
+	return err
+}
+
+// nextFrame ends the current frame, the next write starts a new one, stored in raw blocks if store is set.
+func (w *zstdFrameWriter) nextFrame(store bool) error {
+	if err := w.endFrame(); err != nil {
+		return err
+	}
+	w.store = store
+
+	if w.level != 0 {
+		options := append([]zstd.EOption{}, w.options...)
+		encoder, err := zstd.NewWriter(w.writer, append(options, zstd.WithEncoderLevel(w.level))...)
+		if err != nil {
+			return err
+		}
+		w.encoder = encoder
+		w.level = 0
+	}
+	return nil
+}
+
+// setLevel sets the zstd.EncoderLevel of the frames started by the subsequent nextFrame calls.
+func (w *zstdFrameWriter) setLevel(level int) {
+	w.level = zstd.EncoderLevel(level)
+}
+
+// endFrame finishes the current frame, the next write starts a new one.
+func (w *zstdFrameWriter) endFrame() error {
+	if w.frameSize == 0 {
+		return nil
+	}
+
+	if w.store {
+		if err := w.writeRawBlock(w.block, true); err != nil {
+			return err
+		}
+		w.block = w.block[:0]
+	} else {
+		if err := w.encoder.Close(); err != nil {
+			return err
+		}
+		w.encoder.Reset(w.writer)
+	}
+
+	frame := seekableFrame{
+		compressed:   w.writer.n - w.frameStart,
+		decompressed: w.frameSize,
+	}
+	if w.seekable && frame.compressed > maxFrameSizeInUint32 {
+		return fmt.Errorf("compressed frame size (%d) exceeds the seekable format limit", frame.compressed)
+	}
+	w.frames = append(w.frames, frame)
+
+	w.frameStart = w.writer.n
+	w.frameSize = 0
+	return nil
+}
+
+// Close finishes the last frame and in seekable mode writes the seek table.
+func (w *zstdFrameWriter) Close() error {
+	if err := w.endFrame(); err != nil {
+		return err
+	}
+
+	if !w.seekable {
+		return nil
+	}
+
+	table := make([]byte, len(w.frames)*seekTableEntrySize+seekTableFooterSize)
+
+	offset := 0
+	for _, frame := range w.frames {
+		binary.LittleEndian.PutUint32(table[offset:], uint32(frame.compressed))
+		binary.LittleEndian.PutUint32(table[offset+4:], uint32(frame.decompressed))
+		offset += seekTableEntrySize
+	}
+
+	binary.LittleEndian.PutUint32(table[offset:], uint32(len(w.frames)))
+	table[offset+4] = seekTableDescriptor
+	binary.LittleEndian.PutUint32(table[offset+5:], seekableMagic)
+
+	return writeSkippableFrame(w.writer, skippableFrameMagic, table)
+}
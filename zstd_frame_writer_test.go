@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/pathutil"
+	"github.com/klauspost/compress/zstd"
+)
+
+type bufferWriteCloser struct {
+	bytes.Buffer
+}
+
+func (writer *bufferWriteCloser) Close() error {
+	return nil
+}
+
+func Test_zstdFrameWriter_seekable(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := newZstdFrameWriter(&buf, true)
+	if err != nil {
+		t.Fatalf("failed to create seekable writer: %s", err)
+	}
+
+	for _, frame := range []string{"first frame", "second frame"} {
+		if _, err := writer.Write([]byte(frame)); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+		if err := writer.nextFrame(false); err != nil {
+			t.Fatalf("failed to end frame: %s", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	data := buf.Bytes()
+	footer := data[len(data)-seekTableFooterSize:]
+	if got := binary.LittleEndian.Uint32(footer[5:]); got != seekableMagic {
+		t.Fatalf("seekable magic = %x, want %x", got, seekableMagic)
+	}
+	if got := binary.LittleEndian.Uint32(footer); got != 2 {
+		t.Fatalf("number of frames = %d, want 2", got)
+	}
+
+	decoder, err := zstd.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to create decoder: %s", err)
+	}
+	defer decoder.Close()
+
+	decompressed, err := ioutil.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+	if string(decompressed) != "first framesecond frame" {
+		t.Errorf("decompressed = %s, want %s", decompressed, "first framesecond frame")
+	}
+}
+
+func Test_zstdFrameWriter_store(t *testing.T) {
+	stored := bytes.Repeat([]byte("stored"), zstdMaxBlockSize/3)
+
+	var buf bytes.Buffer
+	writer, err := newZstdFrameWriter(&buf, false)
+	if err != nil {
+		t.Fatalf("failed to create frame writer: %s", err)
+	}
+
+	if _, err := writer.Write([]byte("compressed")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := writer.nextFrame(true); err != nil {
+		t.Fatalf("failed to start stored frame: %s", err)
+	}
+	if _, err := writer.Write(stored); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	if len(writer.frames) != 2 {
+		t.Fatalf("number of frames = %d, want 2", len(writer.frames))
+	}
+	// raw frame: frame header, 2 block headers and the content
+	if got, want := writer.frames[1].compressed, int64(6+2*3+len(stored)); got != want {
+		t.Errorf("stored frame size = %d, want %d", got, want)
+	}
+
+	decoder, err := zstd.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to create decoder: %s", err)
+	}
+	defer decoder.Close()
+
+	decompressed, err := ioutil.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+	if want := append([]byte("compressed"), stored...); !bytes.Equal(decompressed, want) {
+		t.Errorf("decompressed content does not match the written content")
+	}
+}
+
+func Test_zstdFrameWriter_setLevel(t *testing.T) {
+	content := bytes.Repeat([]byte("content"), 1024)
+
+	var buf bytes.Buffer
+	writer, err := newZstdFrameWriter(&buf, false)
+	if err != nil {
+		t.Fatalf("failed to create frame writer: %s", err)
+	}
+
+	for _, level := range []zstd.EncoderLevel{zstd.SpeedFastest, zstd.SpeedBestCompression} {
+		if _, err := writer.Write(content); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+		writer.setLevel(int(level))
+		if err := writer.nextFrame(false); err != nil {
+			t.Fatalf("failed to start frame: %s", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	if len(writer.frames) != 2 {
+		t.Fatalf("number of frames = %d, want 2", len(writer.frames))
+	}
+
+	decoder, err := zstd.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to create decoder: %s", err)
+	}
+	defer decoder.Close()
+
+	decompressed, err := ioutil.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+	if want := append(append([]byte{}, content...), content...); !bytes.Equal(decompressed, want) {
+		t.Errorf("decompressed content does not match the written content")
+	}
+}
+
+func TestArchive_seekable(t *testing.T) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+
+	pths := []string{filepath.Join(tmpDir, "file1"), filepath.Join(tmpDir, "file2")}
+	createDirStruct(t, map[string]string{pths[0]: "content 1", pths[1]: "content 2"})
+
+	var writer bufferWriteCloser
+	archive, err := NewArchive(&writer, TAR, Compression{Method: ZSTD, Seekable: true})
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	if err := archive.Write(pths, false); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+
+	decoder, err := zstd.NewReader(bytes.NewReader(writer.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to create decoder: %s", err)
+	}
+	defer decoder.Close()
+
+	data, err := ioutil.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+
+	var index map[string]int64
+	reader := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			t.Fatalf("failed to find index entry: %s", err)
+		}
+		if header.Name == cacheIndexFilePath {
+			if err := json.NewDecoder(reader).Decode(&index); err != nil {
+				t.Fatalf("failed to decode index: %s", err)
+			}
+			break
+		}
+	}
+
+	for _, pth := range pths {
+		offset, ok := index[pth]
+		if !ok {
+			t.Fatalf("index does not contain: %s", pth)
+		}
+		header, err := tar.NewReader(bytes.NewReader(data[offset:])).Next()
+		if err != nil {
+			t.Fatalf("failed to read entry at offset %d: %s", offset, err)
+		}
+		if header.Name != pth {
+			t.Errorf("entry at offset %d = %s, want %s", offset, header.Name, pth)
+		}
+	}
+}